@@ -0,0 +1,570 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// aggregate runs an aggregation pipeline over the documents without a database
+// supported are the $match, $sort, $skip, $limit, $project, $addFields, $set, $unwind, $group and $count stages
+// $group supports the $sum, $avg, $min, $max, $first, $last, $push and $count accumulators, see evaluate for the supported expressions
+func aggregate(documents []bson.D, pipeline []bson.D) ([]bson.D, error) {
+	for _, stage := range pipeline {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage must have exactly one field, got %d", len(stage))
+		}
+
+		var err error
+		documents, err = aggregateStage(documents, stage[0].Key, stage[0].Value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return documents, nil
+}
+
+// aggregateStage runs a single stage of an aggregation pipeline
+func aggregateStage(documents []bson.D, name string, argument any) ([]bson.D, error) {
+	switch name {
+	case "$match":
+		filter, ok := argument.(bson.D)
+
+		if !ok {
+			return nil, fmt.Errorf("$match expects a filter document")
+		}
+
+		results := []bson.D{}
+
+		for _, document := range documents {
+			ok, err := matches(document, filter)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				results = append(results, document)
+			}
+		}
+
+		return results, nil
+
+	case "$sort":
+		sort, ok := argument.(bson.D)
+
+		if !ok {
+			return nil, fmt.Errorf("$sort expects a document")
+		}
+
+		sortDocuments(documents, documentMap(sort))
+		return documents, nil
+
+	case "$skip", "$limit":
+		number, ok := toNumber(argument)
+
+		if !ok || number < 0 {
+			return nil, fmt.Errorf("%s expects a non-negative number", name)
+		}
+
+		if name == "$skip" {
+			return documents[min(len(documents), int(number)):], nil
+		}
+
+		return documents[:min(len(documents), int(number))], nil
+
+	case "$project":
+		projection, ok := argument.(bson.D)
+
+		if !ok {
+			return nil, fmt.Errorf("$project expects a document")
+		}
+
+		return mapDocuments(documents, func(document bson.D) (bson.D, error) { return projectStage(document, projection) })
+
+	case "$addFields", "$set":
+		fields, ok := argument.(bson.D)
+
+		if !ok {
+			return nil, fmt.Errorf("%s expects a document", name)
+		}
+
+		return mapDocuments(documents, func(document bson.D) (bson.D, error) {
+			for _, element := range fields {
+				value, err := evaluate(document, element.Value)
+
+				if err != nil {
+					return nil, err
+				}
+
+				document = setPath(document, element.Key, value)
+			}
+
+			return document, nil
+		})
+
+	case "$unwind":
+		path, ok := argument.(string)
+
+		if !ok || !strings.HasPrefix(path, "$") {
+			return nil, fmt.Errorf("$unwind expects a field path")
+		}
+
+		results := []bson.D{}
+
+		for _, document := range documents {
+			values, _ := first(lookup(document, path[1:])).(bson.A)
+
+			for _, value := range values {
+				results = append(results, setPath(document, path[1:], value))
+			}
+		}
+
+		return results, nil
+
+	case "$group":
+		group, ok := argument.(bson.D)
+
+		if !ok {
+			return nil, fmt.Errorf("$group expects a document")
+		}
+
+		return groupDocuments(documents, group)
+
+	case "$count":
+		name, ok := argument.(string)
+
+		if !ok || name == "" || strings.HasPrefix(name, "$") {
+			return nil, fmt.Errorf("$count expects a field name")
+		}
+
+		if len(documents) == 0 {
+			return []bson.D{}, nil
+		}
+
+		return []bson.D{{{Key: name, Value: int64(len(documents))}}}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported pipeline stage '%s'", name)
+	}
+}
+
+// mapDocuments replaces every document by the result of the mapping
+func mapDocuments(documents []bson.D, mapping func(document bson.D) (bson.D, error)) ([]bson.D, error) {
+	results := make([]bson.D, 0, len(documents))
+
+	for _, document := range documents {
+		result, err := mapping(document)
+
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// documentMap returns the fields of the document by name
+func documentMap(document bson.D) map[string]any {
+	result := map[string]any{}
+
+	for _, element := range document {
+		result[element.Key] = element.Value
+	}
+
+	return result
+}
+
+// projectStage projects a document like the $project stage, fields are included, excluded or computed from an expression
+func projectStage(document bson.D, projection bson.D) (bson.D, error) {
+	computed := false
+
+	for _, element := range projection {
+		if _, isFlag := element.Value.(bool); !isFlag {
+			if _, isNumber := toNumber(element.Value); !isNumber {
+				computed = true
+			}
+		}
+	}
+
+	if !computed {
+		return project(document, documentMap(projection)), nil
+	}
+
+	result := bson.D{}
+
+	if id, ok := field(document, "_id"); ok {
+		if flag, excluded := field(projection, "_id"); !excluded || projectionFlag(flag) {
+			result = append(result, bson.E{Key: "_id", Value: id})
+		}
+	}
+
+	for _, element := range projection {
+		if element.Key == "_id" {
+			continue
+		}
+
+		_, isFlag := element.Value.(bool)
+		_, isNumber := toNumber(element.Value)
+
+		if isFlag || isNumber {
+			if projectionFlag(element.Value) {
+				if value, ok := field(document, element.Key); ok {
+					result = append(result, bson.E{Key: element.Key, Value: value})
+				}
+			}
+
+			continue
+		}
+
+		value, err := evaluate(document, element.Value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, bson.E{Key: element.Key, Value: value})
+	}
+
+	return result, nil
+}
+
+// accumulator keeps the state of an accumulator of a $group stage for one group
+type accumulator struct {
+	operator string
+	values   bson.A
+}
+
+// groupDocuments groups the documents by the _id expression of a $group stage and computes the accumulators of every group, in the order the groups first appear
+func groupDocuments(documents []bson.D, group bson.D) ([]bson.D, error) {
+	idExpression, ok := field(group, "_id")
+
+	if !ok {
+		return nil, fmt.Errorf("$group expects an _id expression")
+	}
+
+	keys := []string{}
+	ids := map[string]any{}
+	accumulators := map[string][]*accumulator{}
+
+	for _, document := range documents {
+		id, err := evaluate(document, idExpression)
+
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := groupKey(id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := ids[key]; !ok {
+			keys = append(keys, key)
+			ids[key] = id
+
+			for _, element := range group {
+				if element.Key == "_id" {
+					continue
+				}
+
+				operators, ok := element.Value.(bson.D)
+
+				if !ok || len(operators) != 1 {
+					return nil, fmt.Errorf("the accumulator of '%s' must be a document with a single operator", element.Key)
+				}
+
+				accumulators[key] = append(accumulators[key], &accumulator{operator: operators[0].Key})
+			}
+		}
+
+		i := 0
+
+		for _, element := range group {
+			if element.Key == "_id" {
+				continue
+			}
+
+			accumulator := accumulators[key][i]
+			i++
+			value := any(int64(1))
+
+			if accumulator.operator != "$count" {
+				value, err = evaluate(document, element.Value.(bson.D)[0].Value)
+
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			accumulator.values = append(accumulator.values, value)
+		}
+	}
+
+	results := []bson.D{}
+
+	for _, key := range keys {
+		result := bson.D{{Key: "_id", Value: ids[key]}}
+		i := 0
+
+		for _, element := range group {
+			if element.Key == "_id" {
+				continue
+			}
+
+			value, err := accumulators[key][i].result()
+
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, bson.E{Key: element.Key, Value: value})
+			i++
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// result computes the value of the accumulator from the values of the documents of its group
+// like in mongodb, $sum, $avg, $min and $max ignore missing and non-numeric values, $min and $max also compare values of other types
+func (a *accumulator) result() (any, error) {
+	switch a.operator {
+	case "$sum", "$count":
+		return sumNumbers(a.values), nil
+
+	case "$avg":
+		sum, count := 0.0, 0
+
+		for _, value := range a.values {
+			if number, ok := toNumber(value); ok {
+				sum += number
+				count++
+			}
+		}
+
+		if count == 0 {
+			return nil, nil
+		}
+
+		return sum / float64(count), nil
+
+	case "$min", "$max":
+		var result any
+
+		for _, value := range a.values {
+			if value == nil {
+				continue
+			}
+
+			order := compareForSort(value, result)
+
+			if result == nil || (a.operator == "$min" && order < 0) || (a.operator == "$max" && order > 0) {
+				result = value
+			}
+		}
+
+		return result, nil
+
+	case "$first":
+		return first(a.values), nil
+
+	case "$last":
+		if len(a.values) == 0 {
+			return nil, nil
+		}
+
+		return a.values[len(a.values)-1], nil
+
+	case "$push":
+		return a.values, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported accumulator '%s'", a.operator)
+	}
+}
+
+// groupKey returns a key identifying the _id of a group, numbers of different types with the same value are the same group
+func groupKey(id any) (string, error) {
+	if number, ok := toNumber(id); ok {
+		id = number
+	}
+
+	valueType, data, err := bson.MarshalValue(id)
+
+	if err != nil {
+		return "", fmt.Errorf("error converting group _id '%v': %v", id, err)
+	}
+
+	return string(append([]byte{byte(valueType)}, data...)), nil
+}
+
+// evaluate evaluates an aggregation expression against a document
+// supported are field paths such as "$location.type", literals, documents and arrays of expressions and the $add, $subtract, $multiply, $divide, $mod and $floor operators
+func evaluate(document bson.D, expression any) (any, error) {
+	switch typed := expression.(type) {
+	case string:
+		if strings.HasPrefix(typed, "$$") {
+			return nil, fmt.Errorf("unsupported variable '%s'", typed)
+		}
+
+		if strings.HasPrefix(typed, "$") {
+			return first(lookup(document, typed[1:])), nil
+		}
+
+		return typed, nil
+
+	case bson.A:
+		values := bson.A{}
+
+		for _, element := range typed {
+			value, err := evaluate(document, element)
+
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, value)
+		}
+
+		return values, nil
+
+	case bson.D:
+		if len(typed) == 1 && strings.HasPrefix(typed[0].Key, "$") {
+			return evaluateOperator(document, typed[0].Key, typed[0].Value)
+		}
+
+		result := bson.D{}
+
+		for _, element := range typed {
+			value, err := evaluate(document, element.Value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, bson.E{Key: element.Key, Value: value})
+		}
+
+		return result, nil
+
+	default:
+		return expression, nil
+	}
+}
+
+// evaluateOperator evaluates an arithmetic expression operator, a missing or null argument makes the result null like in mongodb
+func evaluateOperator(document bson.D, operator string, argument any) (any, error) {
+	arguments, ok := argument.(bson.A)
+
+	if !ok {
+		arguments = bson.A{argument}
+	}
+
+	values, err := evaluate(document, arguments)
+
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := values.(bson.A)
+
+	for _, value := range numbers {
+		if value == nil {
+			return nil, nil
+		}
+
+		if _, ok := toNumber(value); !ok {
+			return nil, fmt.Errorf("%s only supports numeric arguments, got '%v'", operator, value)
+		}
+	}
+
+	number := func(i int) float64 {
+		value, _ := toNumber(numbers[i])
+		return value
+	}
+
+	switch operator {
+	case "$add":
+		return sumNumbers(numbers), nil
+
+	case "$multiply":
+		product := bson.A{}
+		result := 1.0
+
+		for i := range numbers {
+			result *= number(i)
+		}
+
+		return numberOfType(result, append(product, numbers...)), nil
+
+	case "$subtract", "$divide", "$mod":
+		if len(numbers) != 2 {
+			return nil, fmt.Errorf("%s expects 2 arguments, got %d", operator, len(numbers))
+		}
+
+		switch operator {
+		case "$subtract":
+			return numberOfType(number(0)-number(1), numbers), nil
+
+		case "$divide":
+			if number(1) == 0 {
+				return nil, fmt.Errorf("$divide by zero")
+			}
+
+			return number(0) / number(1), nil
+
+		default:
+			if number(1) == 0 {
+				return nil, fmt.Errorf("$mod by zero")
+			}
+
+			return numberOfType(math.Mod(number(0), number(1)), numbers), nil
+		}
+
+	case "$floor":
+		if len(numbers) != 1 {
+			return nil, fmt.Errorf("$floor expects 1 argument, got %d", len(numbers))
+		}
+
+		return numberOfType(math.Floor(number(0)), numbers), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported expression operator '%s'", operator)
+	}
+}
+
+// sumNumbers adds the numeric values, the sum is an integer unless one of them is a floating point number
+func sumNumbers(values bson.A) any {
+	numbers := bson.A{}
+	sum := 0.0
+
+	for _, value := range values {
+		if number, ok := toNumber(value); ok {
+			sum += number
+			numbers = append(numbers, value)
+		}
+	}
+
+	return numberOfType(sum, numbers)
+}
+
+// numberOfType returns the result of an arithmetic operation as an int64 if all its operands are integers, otherwise as a float64
+func numberOfType(result float64, operands bson.A) any {
+	for _, operand := range operands {
+		if _, isFloat := operand.(float64); isFloat {
+			return result
+		}
+	}
+
+	return int64(result)
+}
@@ -0,0 +1,597 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type conformanceLocation struct {
+	Username  string         `bson:"username"`
+	Timestamp int64          `bson:"timestamp"`
+	Tags      []string       `bson:"tags"`
+	Location  map[string]any `bson:"location"`
+}
+
+// point returns a geojson point for the [longitude, latitude] coordinates
+func point(longitude, latitude float64) map[string]any {
+	return map[string]any{"type": "Point", "coordinates": []float64{longitude, latitude}}
+}
+
+func TestMemoryClientConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) DBClient {
+		return CreateMemoryClient()
+	})
+}
+
+func TestEmbeddedClientConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) DBClient {
+		client, err := CreateEmbeddedClient(filepath.Join(t.TempDir(), "conformance.db"))
+
+		if err != nil {
+			t.Fatalf("failed to create embedded client: %v", err)
+		}
+
+		t.Cleanup(func() { client.Disconnect(context.Background()) })
+		return client
+	})
+}
+
+// TestMongoClientConformance runs the suite against a real mongodb, so the other backends can be compared to it, if MONGODB_TEST_URI is set
+func TestMongoClientConformance(t *testing.T) {
+	uri := os.Getenv("MONGODB_TEST_URI")
+
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	testConformance(t, func(t *testing.T) DBClient {
+		client, err := CreateClient(ClientInfo{Uri: uri, DefaultDatabase: "conformance_" + bson.NewObjectID().Hex()})
+
+		if err != nil {
+			t.Fatalf("failed to create mongodb client: %v", err)
+		}
+
+		t.Cleanup(func() {
+			client.defaultDb.Drop(context.Background())
+			client.Disconnect(context.Background())
+		})
+
+		return client
+	})
+}
+
+func TestEmbeddedClientPersistence(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "persistence.db")
+	client := MustCreateEmbeddedClient(path)
+	client.MustCreateIndex(ctx, "locations", "username", 1)
+
+	if err := client.SaveOrReplaceDocument(ctx, "locations", conformanceLocation{Username: "user1", Timestamp: 1}, map[string]any{"username": "user1"}); err != nil {
+		t.Fatalf("failed to save document: %v", err)
+	}
+
+	if err := client.Disconnect(ctx); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	client = MustCreateEmbeddedClient(path)
+	defer client.Disconnect(ctx)
+
+	if results := findAll(t, client, "locations", map[string]any{"username": "user1"}, nil, nil, 0, 0); len(results) != 1 {
+		t.Errorf("expected the document to be kept after reopening, got %v", results)
+	}
+}
+
+// testConformance checks that a backend behaves like mongodb for the queries used by the services
+func testConformance(t *testing.T, newClient func(t *testing.T) DBClient) {
+	ctx := context.Background()
+
+	t.Run("upsert", func(t *testing.T) {
+		client := newClient(t)
+		client.MustCreateIndex(ctx, "locations", "username", 1)
+
+		for _, timestamp := range []int64{1, 2} {
+			err := client.SaveOrReplaceDocument(ctx, "locations", conformanceLocation{Username: "user1", Timestamp: timestamp}, map[string]any{"username": "user1"})
+
+			if err != nil {
+				t.Fatalf("failed to save document: %v", err)
+			}
+		}
+
+		results := findAll(t, client, "locations", nil, nil, nil, 0, 0)
+
+		if len(results) != 1 || results[0]["timestamp"] != int64(2) {
+			t.Fatalf("expected the document to be replaced, got %v", results)
+		}
+
+		if _, ok := results[0]["_id"].(bson.ObjectID); !ok {
+			t.Errorf("expected an object id, got %v", results[0]["_id"])
+		}
+
+		err := client.SaveOrReplaceDocument(ctx, "locations", bson.M{"_id": "other", "username": "user1"}, map[string]any{"username": "user1"})
+
+		if err == nil {
+			t.Errorf("expected an error when changing the _id")
+		}
+
+		err = client.SaveOrReplaceDocument(ctx, "locations", bson.M{"username": "user2"}, map[string]any{"_id": "user2"})
+
+		if err != nil {
+			t.Fatalf("failed to save document: %v", err)
+		}
+
+		if results := findAll(t, client, "locations", map[string]any{"_id": "user2"}, nil, nil, 0, 0); len(results) != 1 || results[0]["username"] != "user2" {
+			t.Errorf("expected the _id to be taken from the filter, got %v", results)
+		}
+	})
+
+	t.Run("find", func(t *testing.T) {
+		client := newClient(t)
+		saveLocations(t, client)
+		client.MustCreateIndex(ctx, "locations", "timestamp", -1)
+		client.MustCreateIndex(ctx, "locations", "tags", 1)
+
+		tests := []struct {
+			name       string
+			filter     map[string]any
+			sort       map[string]any
+			pageNumber int
+			pageSize   int
+			expected   []int64
+		}{
+			{"equality", map[string]any{"username": "user2"}, map[string]any{"timestamp": 1}, 0, 0, []int64{2, 5, 8}},
+			{"in", map[string]any{"username": map[string]any{"$in": []string{"user1", "user3"}}}, map[string]any{"timestamp": -1}, 0, 0, []int64{9, 7, 6, 4, 3, 1}},
+			{"range", map[string]any{"username": "user1", "timestamp": map[string]any{"$gt": 1, "$lte": 7}}, map[string]any{"timestamp": 1}, 0, 0, []int64{4, 7}},
+			{"array element", map[string]any{"tags": "even"}, map[string]any{"timestamp": 1}, 0, 0, []int64{2, 4, 6, 8}},
+			{"or", map[string]any{"$or": []any{map[string]any{"timestamp": 1}, map[string]any{"timestamp": map[string]any{"$gte": 9}}}}, map[string]any{"timestamp": 1}, 0, 0, []int64{1, 9}},
+			{"page", map[string]any{}, map[string]any{"timestamp": -1}, 2, 4, []int64{5, 4, 3, 2}},
+			{"last page", map[string]any{}, map[string]any{"timestamp": -1}, 3, 4, []int64{1}},
+			{"no match", map[string]any{"username": "user4"}, nil, 0, 0, []int64{}},
+		}
+
+		for _, test := range tests {
+			results := findAll(t, client, "locations", test.filter, nil, test.sort, test.pageNumber, test.pageSize)
+
+			if timestamps := timestamps(results); !slices.Equal(timestamps, test.expected) {
+				t.Errorf("%s: expected timestamps %v, got %v", test.name, test.expected, timestamps)
+			}
+		}
+
+		results := findAll(t, client, "locations", map[string]any{"timestamp": 1}, map[string]any{"username": 1, "_id": 0}, nil, 0, 0)
+
+		if len(results) != 1 || len(results[0]) != 1 || results[0]["username"] != "user1" {
+			t.Errorf("expected only the projected field, got %v", results)
+		}
+	})
+
+	t.Run("geospatial", func(t *testing.T) {
+		client := newClient(t)
+		client.MustCreate2dSphereIndex(ctx, "locations", "location")
+		saveLocations(t, client)
+
+		near := map[string]any{"location": map[string]any{
+			"$near": map[string]any{"$geometry": point(20.46, 44.81), "$maxDistance": 2000},
+		}}
+
+		if results := timestamps(findAll(t, client, "locations", near, nil, nil, 0, 0)); !slices.Equal(results, []int64{1, 2, 3}) {
+			t.Errorf("expected the locations within 2km ordered by distance, got %v", results)
+		}
+
+		within := map[string]any{"location": map[string]any{
+			"$geoWithin": map[string]any{"$geometry": map[string]any{
+				"type":        "Polygon",
+				"coordinates": [][][]float64{{{20.45, 44.80}, {20.50, 44.80}, {20.50, 44.90}, {20.45, 44.90}, {20.45, 44.80}}},
+			}},
+		}}
+
+		if results := timestamps(findAll(t, client, "locations", within, nil, map[string]any{"timestamp": 1}, 0, 0)); !slices.Equal(results, []int64{1, 2, 3, 4}) {
+			t.Errorf("expected the locations within the polygon, got %v", results)
+		}
+
+		err := client.SaveOrReplaceDocument(ctx, "fences", bson.M{"name": "belgrade", "location": map[string]any{
+			"type":        "Polygon",
+			"coordinates": [][][]float64{{{20.3, 44.7}, {20.6, 44.7}, {20.6, 44.9}, {20.3, 44.9}, {20.3, 44.7}}},
+		}}, map[string]any{"name": "belgrade"})
+
+		if err != nil {
+			t.Fatalf("failed to save fence: %v", err)
+		}
+
+		client.MustCreate2dSphereIndex(ctx, "fences", "location")
+		intersects := map[string]any{"location": map[string]any{"$geoIntersects": map[string]any{"$geometry": point(20.46, 44.81)}}}
+
+		if results := findAll(t, client, "fences", intersects, nil, nil, 0, 0); len(results) != 1 || results[0]["name"] != "belgrade" {
+			t.Errorf("expected the fence containing the point, got %v", results)
+		}
+
+		outside := map[string]any{"location": map[string]any{"$geoIntersects": map[string]any{"$geometry": point(19.84, 45.25)}}}
+
+		if results := findAll(t, client, "fences", outside, nil, nil, 0, 0); len(results) != 0 {
+			t.Errorf("expected no fence containing the point, got %v", results)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		client := newClient(t)
+		saveLocations(t, client)
+
+		deleted, err := client.DeleteDocument(ctx, "locations", map[string]any{"timestamp": 5})
+
+		if err != nil || !deleted {
+			t.Fatalf("expected the document to be deleted, got %v, %v", deleted, err)
+		}
+
+		deleted, err = client.DeleteDocument(ctx, "locations", map[string]any{"timestamp": 5})
+
+		if err != nil || deleted {
+			t.Errorf("expected no document to be deleted, got %v, %v", deleted, err)
+		}
+
+		if results := timestamps(findAll(t, client, "locations", map[string]any{"username": "user2"}, nil, map[string]any{"timestamp": 1}, 0, 0)); !slices.Equal(results, []int64{2, 8}) {
+			t.Errorf("expected the deleted document to be gone from the index, got %v", results)
+		}
+	})
+
+	t.Run("bulk write", func(t *testing.T) {
+		client := newClient(t)
+		saveLocations(t, client)
+
+		models := []ReplaceModel{
+			{Filter: map[string]any{"timestamp": 1}, Document: conformanceLocation{Username: "user4", Timestamp: 1}},
+			{Filter: map[string]any{"timestamp": 10}, Document: conformanceLocation{Username: "user4", Timestamp: 10}},
+			{Filter: map[string]any{"timestamp": 2}, Document: bson.D{{Key: "_id", Value: "changed"}, {Key: "timestamp", Value: 2}}},
+			{Filter: map[string]any{"timestamp": 11}, Document: conformanceLocation{Username: "user4", Timestamp: 11}},
+		}
+
+		for _, ordered := range []bool{true, false} {
+			result, err := client.BulkSaveOrReplace(ctx, "locations", models, ordered)
+			expected := int64(len(models) - 1)
+
+			if ordered {
+				expected = 2
+			}
+
+			if err != nil || len(result.Errors) != 1 || result.Errors[0].Index != 2 || result.Matched+result.Upserted != expected {
+				t.Errorf("expected %d written items and the third one to fail, got %+v, %v", expected, result, err)
+			}
+		}
+
+		if results := timestamps(findAll(t, client, "locations", map[string]any{"username": "user4"}, nil, map[string]any{"timestamp": 1}, 0, 0)); !slices.Equal(results, []int64{1, 10, 11}) {
+			t.Errorf("expected the replaced and upserted documents, got %v", results)
+		}
+	})
+
+	t.Run("insert many", func(t *testing.T) {
+		client := newClient(t)
+
+		documents := []any{
+			bson.D{{Key: "_id", Value: "a"}, {Key: "timestamp", Value: int64(1)}},
+			bson.D{{Key: "_id", Value: "a"}, {Key: "timestamp", Value: int64(2)}},
+			bson.D{{Key: "_id", Value: "b"}, {Key: "timestamp", Value: int64(3)}},
+		}
+
+		result, err := client.InsertMany(ctx, "inserted", documents, true)
+
+		if err != nil || result.Inserted != 1 || len(result.Errors) != 1 || result.Errors[0].Index != 1 || result.Err() == nil {
+			t.Errorf("expected the ordered insert to stop at the duplicate, got %+v, %v", result, err)
+		}
+
+		result, err = client.InsertMany(ctx, "inserted", documents, false)
+
+		if err != nil || result.Inserted != 1 || len(result.Errors) != 2 {
+			t.Errorf("expected the unordered insert to skip the duplicates, got %+v, %v", result, err)
+		}
+
+		if results := timestamps(findAll(t, client, "inserted", nil, nil, map[string]any{"timestamp": 1}, 0, 0)); !slices.Equal(results, []int64{1, 3}) {
+			t.Errorf("expected the first document of every _id, got %v", results)
+		}
+	})
+
+	t.Run("unique index", func(t *testing.T) {
+		client := newClient(t)
+
+		indexes := []IndexSpec{
+			{Keys: []IndexKey{{Field: "username", Type: 1}, {Field: "timestamp", Type: -1}}, Unique: true},
+			{Name: "recent", Keys: []IndexKey{{Field: "username", Type: 1}}, Unique: true, PartialFilter: map[string]any{"timestamp": map[string]any{"$gt": 5}}},
+		}
+
+		if err := client.CreateIndexes(ctx, "unique", indexes); err != nil {
+			t.Fatalf("failed to create the unique indexes: %v", err)
+		}
+
+		documents := []any{
+			bson.D{{Key: "_id", Value: "a"}, {Key: "username", Value: "user1"}, {Key: "timestamp", Value: int64(1)}},
+			bson.D{{Key: "_id", Value: "b"}, {Key: "username", Value: "user1"}, {Key: "timestamp", Value: int64(1)}},
+			bson.D{{Key: "_id", Value: "c"}, {Key: "username", Value: "user1"}, {Key: "timestamp", Value: int64(2)}},
+			bson.D{{Key: "_id", Value: "d"}, {Key: "username", Value: "user1"}, {Key: "timestamp", Value: int64(6)}},
+			bson.D{{Key: "_id", Value: "e"}, {Key: "username", Value: "user1"}, {Key: "timestamp", Value: int64(7)}},
+		}
+
+		result, err := client.InsertMany(ctx, "unique", documents, false)
+
+		if err != nil || result.Inserted != 3 || len(result.Errors) != 2 || !result.Errors[0].IsDuplicateKey() || result.Errors[0].Index != 1 || !result.Errors[1].IsDuplicateKey() || result.Errors[1].Index != 4 {
+			t.Errorf("expected the duplicate keys of both unique indexes to fail, got %+v, %v", result, err)
+		}
+
+		if err := client.SaveOrReplaceDocument(ctx, "unique", bson.D{{Key: "username", Value: "user1"}, {Key: "timestamp", Value: int64(1)}, {Key: "replaced", Value: true}}, map[string]any{"_id": "a"}); err != nil {
+			t.Errorf("expected replacing a document with its own key to succeed, got %v", err)
+		}
+
+		if err := client.SaveOrReplaceDocument(ctx, "unique", bson.D{{Key: "username", Value: "user1"}, {Key: "timestamp", Value: int64(1)}}, map[string]any{"_id": "c"}); err == nil {
+			t.Errorf("expected replacing a document with the key of another one to fail")
+		}
+
+		if _, err := client.UpdateMany(ctx, "unique", map[string]any{"_id": "c"}, map[string]any{"$set": map[string]any{"timestamp": 8}}); err == nil {
+			t.Errorf("expected updating a document to the key of another one to fail")
+		}
+
+		if results := timestamps(findAll(t, client, "unique", nil, nil, map[string]any{"timestamp": 1}, 0, 0)); !slices.Equal(results, []int64{1, 2, 6}) {
+			t.Errorf("expected the failed writes to change nothing, got %v", results)
+		}
+	})
+
+	t.Run("aggregate", func(t *testing.T) {
+		client := newClient(t)
+		saveLocations(t, client)
+
+		pipeline := []map[string]any{
+			{"$match": map[string]any{"timestamp": map[string]any{"$gte": 2}}},
+			{"$group": map[string]any{
+				"_id":   "$username",
+				"total": map[string]any{"$sum": "$timestamp"},
+				"count": map[string]any{"$sum": 1},
+				"last":  map[string]any{"$max": "$timestamp"},
+			}},
+			{"$sort": map[string]any{"_id": -1}},
+			{"$project": map[string]any{"total": 1, "count": 1, "last": 1, "average": map[string]any{"$divide": bson.A{"$total", "$count"}}}},
+		}
+
+		cursor, err := client.Aggregate(ctx, "locations", pipeline)
+
+		if err != nil {
+			t.Fatalf("failed to aggregate: %v", err)
+		}
+
+		results := []struct {
+			ID      string  `bson:"_id"`
+			Total   int64   `bson:"total"`
+			Count   int64   `bson:"count"`
+			Last    int64   `bson:"last"`
+			Average float64 `bson:"average"`
+		}{}
+
+		if err := cursor.All(ctx, &results); err != nil {
+			t.Fatalf("failed to decode aggregation: %v", err)
+		}
+
+		if len(results) != 3 || results[0].ID != "user3" || results[0].Total != 18 || results[0].Count != 3 || results[0].Last != 9 || results[0].Average != 6 || results[2].ID != "user1" || results[2].Total != 11 || results[2].Count != 2 {
+			t.Errorf("expected the totals of every user ordered by username descending, got %+v", results)
+		}
+
+		cursor, err = client.Aggregate(ctx, "locations", []map[string]any{{"$match": map[string]any{"tags": "even"}}, {"$count": "even"}})
+
+		if err != nil {
+			t.Fatalf("failed to aggregate: %v", err)
+		}
+
+		counts := []struct {
+			Even int64 `bson:"even"`
+		}{}
+
+		if err := cursor.All(ctx, &counts); err != nil || len(counts) != 1 || counts[0].Even != 4 {
+			t.Errorf("expected 4 even timestamps, got %v, %v", counts, err)
+		}
+	})
+
+	t.Run("count, update and delete many", func(t *testing.T) {
+		client := newClient(t)
+		saveLocations(t, client)
+
+		if count, err := client.Count(ctx, "locations", map[string]any{"username": "user1"}); err != nil || count != 3 {
+			t.Errorf("expected 3 locations of user1, got %d, %v", count, err)
+		}
+
+		update := map[string]any{"$set": map[string]any{"username": "user4", "moved.by": "update"}, "$inc": map[string]any{"timestamp": 100}}
+		modified, err := client.UpdateMany(ctx, "locations", map[string]any{"username": "user1"}, update)
+
+		if err != nil || modified != 3 {
+			t.Errorf("expected 3 modified locations, got %d, %v", modified, err)
+		}
+
+		if results := timestamps(findAll(t, client, "locations", map[string]any{"username": "user4", "moved.by": "update"}, nil, map[string]any{"timestamp": 1}, 0, 0)); !slices.Equal(results, []int64{101, 104, 107}) {
+			t.Errorf("expected the updated locations to be found through the index, got %v", results)
+		}
+
+		if count, err := client.Count(ctx, "locations", map[string]any{"username": "user1"}); err != nil || count != 0 {
+			t.Errorf("expected no location of user1 after the update, got %d, %v", count, err)
+		}
+
+		if _, err := client.UpdateMany(ctx, "locations", nil, map[string]any{"$set": map[string]any{"_id": "changed"}}); err == nil {
+			t.Errorf("expected an error changing the immutable _id")
+		}
+
+		deleted, err := client.DeleteMany(ctx, "locations", map[string]any{"timestamp": map[string]any{"$gt": 100}})
+
+		if err != nil || deleted != 3 {
+			t.Errorf("expected 3 deleted locations, got %d, %v", deleted, err)
+		}
+
+		if count, err := client.Count(ctx, "locations", nil); err != nil || count != 6 {
+			t.Errorf("expected 6 remaining locations, got %d, %v", count, err)
+		}
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		client := newClient(t)
+		saveLocations(t, client)
+
+		schema := Schema{Collections: []CollectionSpec{
+			{
+				Name:      "locations",
+				Validator: map[string]any{"$jsonSchema": map[string]any{"bsonType": "object", "required": []string{"username", "timestamp"}}},
+				Indexes: []IndexSpec{
+					{Keys: []IndexKey{{Field: "username", Type: 1}}},
+					{Keys: []IndexKey{{Field: "username", Type: 1}, {Field: "timestamp", Type: -1}}, Unique: true},
+					{Keys: []IndexKey{{Field: "location", Type: "2dsphere"}}},
+					{Name: "recent", Keys: []IndexKey{{Field: "timestamp", Type: 1}}, PartialFilter: map[string]any{"timestamp": map[string]any{"$gt": 5}}},
+				},
+			},
+			{
+				Name:    "created",
+				Indexes: []IndexSpec{{Keys: []IndexKey{{Field: "createdAt", Type: 1}}, ExpireAfter: time.Hour}},
+			},
+		}}
+
+		drift, err := ApplySchema(ctx, client, schema)
+		expected := []Drift{
+			{Collection: "locations", Kind: DriftValidator, Resolved: true},
+			{Collection: "locations", Kind: DriftMissingIndex, Index: "username_1_timestamp_-1", Resolved: true},
+			{Collection: "locations", Kind: DriftMissingIndex, Index: "location_2dsphere", Resolved: true},
+			{Collection: "locations", Kind: DriftMissingIndex, Index: "recent", Resolved: true},
+		}
+
+		if err != nil || !slices.Equal(drift, expected) {
+			t.Errorf("expected the drift of the existing collection, got %v, %v", drift, err)
+		}
+
+		if drift, err := ApplySchema(ctx, client, schema); err != nil || len(drift) != 0 {
+			t.Errorf("expected applying the schema again to change nothing, got %v, %v", drift, err)
+		}
+
+		if results := timestamps(findAll(t, client, "locations", map[string]any{"username": "user1"}, nil, map[string]any{"timestamp": -1}, 0, 0)); !slices.Equal(results, []int64{7, 4, 1}) {
+			t.Errorf("expected the documents to be found after applying the schema, got %v", results)
+		}
+
+		client.MustCreateIndex(ctx, "created", "updatedAt", 1)
+		schema.Collections[1].Indexes[0].ExpireAfter = 2 * time.Hour
+		drift, err = ApplySchema(ctx, client, schema)
+
+		expected = []Drift{
+			{Collection: "created", Kind: DriftIndexConflict, Index: "createdAt_1"},
+			{Collection: "created", Kind: DriftUnexpectedIndex, Index: "updatedAt_1"},
+		}
+
+		if err != nil || !slices.Equal(drift, expected) {
+			t.Errorf("expected the conflicting and unexpected indexes, got %v, %v", drift, err)
+		}
+	})
+
+	t.Run("time series", func(t *testing.T) {
+		client := newClient(t)
+		saveLocations(t, client)
+		timeSeries := &TimeSeriesSpec{TimeField: "time", MetaField: "username", Granularity: "seconds"}
+
+		schema := Schema{Collections: []CollectionSpec{
+			{Name: "measurements", TimeSeries: timeSeries},
+			{Name: "locations", Indexes: []IndexSpec{{Keys: []IndexKey{{Field: "username", Type: 1}}}}, TimeSeries: timeSeries},
+		}}
+
+		drift, err := ApplySchema(ctx, client, schema)
+
+		if err != nil || !slices.Equal(drift, []Drift{{Collection: "locations", Kind: DriftTimeSeries}}) {
+			t.Errorf("expected the plain collection to differ from the time-series options, got %v, %v", drift, err)
+		}
+
+		if state, err := client.DescribeCollection(ctx, "measurements"); err != nil || state.TimeSeries == nil || *state.TimeSeries != *timeSeries {
+			t.Errorf("expected the time-series collection to be created, got %+v, %v", state, err)
+		}
+
+		start := time.UnixMilli(1700000000000).UTC()
+		measurements := []any{}
+
+		for i := range 5 {
+			measurements = append(measurements, map[string]any{"username": "user1", "time": start.Add(time.Duration(i) * time.Minute), "value": i})
+		}
+
+		if _, err := client.InsertMany(ctx, "measurements", measurements, true); err != nil {
+			t.Fatalf("error inserting measurements: %v", err)
+		}
+
+		filter := map[string]any{"username": "user1", "time": map[string]any{"$gt": start.Add(time.Minute), "$lte": start.Add(3 * time.Minute)}}
+		cursor, err := client.Find(ctx, "measurements", filter, nil, map[string]any{"time": -1}, 0, 0)
+
+		if err != nil {
+			t.Fatalf("error finding measurements: %v", err)
+		}
+
+		results := []struct {
+			Time  time.Time `bson:"time"`
+			Value int       `bson:"value"`
+		}{}
+
+		if err := cursor.All(ctx, &results); err != nil || len(results) != 2 || results[0].Value != 3 || !results[1].Time.Equal(start.Add(2*time.Minute)) {
+			t.Errorf("expected the measurements between the dates ordered by time, got %+v, %v", results, err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		client := newClient(t)
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if _, err := client.Find(canceled, "locations", nil, nil, nil, 0, 0); err == nil {
+			t.Errorf("expected an error for a canceled context")
+		}
+	})
+}
+
+// saveLocations saves nine locations of three users, with timestamps 1 to 9 and locations moving east from belgrade by about 800m each
+func saveLocations(t *testing.T, client DBClient) {
+	client.MustCreateIndex(context.Background(), "locations", "username", 1)
+
+	for timestamp := int64(1); timestamp <= 9; timestamp++ {
+		tags := []string{"odd"}
+
+		if timestamp%2 == 0 {
+			tags = []string{"even"}
+		}
+
+		location := conformanceLocation{
+			Username:  []string{"user1", "user2", "user3"}[(timestamp-1)%3],
+			Timestamp: timestamp,
+			Tags:      tags,
+			Location:  point(20.46+float64(timestamp-1)*0.01, 44.81),
+		}
+
+		err := client.SaveOrReplaceDocument(context.Background(), "locations", location, map[string]any{"timestamp": timestamp})
+
+		if err != nil {
+			t.Fatalf("failed to save location: %v", err)
+		}
+	}
+}
+
+// findAll finds the documents and decodes all of them
+func findAll(t *testing.T, client DBClient, collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) []bson.M {
+	cursor, err := client.Find(context.Background(), collectionName, filter, projection, sort, pageNumber, pageSize)
+
+	if err != nil {
+		t.Fatalf("failed to find documents: %v", err)
+	}
+
+	results := []bson.M{}
+
+	if err := cursor.All(context.Background(), &results); err != nil {
+		t.Fatalf("failed to decode documents: %v", err)
+	}
+
+	return results
+}
+
+// timestamps returns the timestamps of the documents
+func timestamps(results []bson.M) []int64 {
+	timestamps := []int64{}
+
+	for _, result := range results {
+		timestamp, _ := result["timestamp"].(int64)
+		timestamps = append(timestamps, timestamp)
+	}
+
+	return timestamps
+}
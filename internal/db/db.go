@@ -2,107 +2,284 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"slices"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
+// Operation names a kind of database operation which can be given its own timeout
+type Operation string
+
+const (
+	OperationDisconnect       Operation = "disconnect"
+	OperationCreateCollection Operation = "createCollection"
+	OperationCreateIndex      Operation = "createIndex"
+	OperationSave             Operation = "save"
+	OperationDelete           Operation = "delete"
+	OperationFind             Operation = "find"
+	OperationBulkWrite        Operation = "bulkWrite"
+	OperationAggregate        Operation = "aggregate"
+	OperationCount            Operation = "count"
+	OperationUpdate           Operation = "update"
+
+	// DefaultTimeout bounds every operation without a timeout of its own
+	DefaultTimeout = 10 * time.Second
+)
+
+var operations = []Operation{OperationDisconnect, OperationCreateCollection, OperationCreateIndex, OperationSave, OperationDelete, OperationFind, OperationBulkWrite, OperationAggregate, OperationCount, OperationUpdate}
+
+// Timeouts are the default and per-operation timeouts of database operations, applied on top of the deadline of the caller's context
+type Timeouts struct {
+	Default    time.Duration
+	Operations map[Operation]time.Duration
+}
+
 type ClientInfo struct {
 	AuthSource      string
 	Username        string
 	Password        string
 	Uri             string
 	DefaultDatabase string
+	Timeouts        Timeouts
+}
+
+// ReplaceModel replaces the first document matching the filter in a bulk write, or inserts the document if none matches
+type ReplaceModel struct {
+	Filter   map[string]any
+	Document any
+}
+
+// BulkResult counts the documents written by a bulk write and lists the items which failed
+type BulkResult struct {
+	Inserted int64
+	Matched  int64
+	Upserted int64
+	Errors   []BulkError
+}
+
+// BulkError is the error of a single item of a bulk write, with the index of the item in the written slice
+type BulkError struct {
+	Index   int
+	Message string
+}
+
+// Error describes the failed item
+func (e BulkError) Error() string {
+	return fmt.Sprintf("item %d: %s", e.Index, e.Message)
+}
+
+// IsDuplicateKey checks if the item failed because a document with the same _id or unique index key already exists
+// mongodb and the other backends both start the message of a duplicate key error with its code E11000
+func (e BulkError) IsDuplicateKey() bool {
+	return strings.HasPrefix(e.Message, "E11000")
 }
 
+// Err joins the errors of the failed items, it is nil if every item was written
+func (r BulkResult) Err() error {
+	errs := []error{}
+
+	for _, err := range r.Errors {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// DBClient runs database operations, every operation ends when its context is done or its timeout elapses, whichever comes first
+// operations which failed because their context ended return an error wrapping context.Canceled or context.DeadlineExceeded
 type DBClient interface {
-	Disconnect() error
-	CreateCollection(collectionName string) error
-	MustCreateCollection(collectionName string)
-	SaveOrReplaceDocument(collectionName string, document any, filter map[string]any) error
-	CreateIndex(collectionName, field string, sort int) error
-	MustCreateIndex(collectionName, field string, sort int)
-	Create2dSphereIndex(collectionName, field string) error
-	MustCreate2dSphereIndex(collectionName, field string)
-	Find(collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) (*mongo.Cursor, error)
+	Disconnect(ctx context.Context) error
+	CreateCollection(ctx context.Context, collectionName string) error
+	MustCreateCollection(ctx context.Context, collectionName string)
+	SaveOrReplaceDocument(ctx context.Context, collectionName string, document any, filter map[string]any) error
+	DeleteDocument(ctx context.Context, collectionName string, filter map[string]any) (bool, error)
+	CreateIndex(ctx context.Context, collectionName, field string, sort int) error
+	MustCreateIndex(ctx context.Context, collectionName, field string, sort int)
+	Create2dSphereIndex(ctx context.Context, collectionName, field string) error
+	MustCreate2dSphereIndex(ctx context.Context, collectionName, field string)
+	Find(ctx context.Context, collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) (*mongo.Cursor, error)
+	BulkSaveOrReplace(ctx context.Context, collectionName string, models []ReplaceModel, ordered bool) (BulkResult, error)
+	InsertMany(ctx context.Context, collectionName string, documents []any, ordered bool) (BulkResult, error)
+	Aggregate(ctx context.Context, collectionName string, pipeline []map[string]any) (*mongo.Cursor, error)
+	Count(ctx context.Context, collectionName string, filter map[string]any) (int64, error)
+	UpdateMany(ctx context.Context, collectionName string, filter, update map[string]any) (int64, error)
+	DeleteMany(ctx context.Context, collectionName string, filter map[string]any) (int64, error)
+	DescribeCollection(ctx context.Context, collectionName string) (CollectionState, error)
+	CreateTimeSeriesCollection(ctx context.Context, collectionName string, timeSeries TimeSeriesSpec) error
+	CreateIndexes(ctx context.Context, collectionName string, indexes []IndexSpec) error
+	SetValidator(ctx context.Context, collectionName string, validator map[string]any) error
 }
 
 type MongoClient struct {
 	client    *mongo.Client
 	defaultDb *mongo.Database
+	timeouts  Timeouts
+}
+
+// ParseTimeouts parses the default timeout and a comma separated list of per-operation timeouts such as find=2s,save=500ms
+// an empty default timeout falls back to DefaultTimeout and a timeout of 0 disables the timeout
+func ParseTimeouts(defaultTimeout, operationTimeouts string) (Timeouts, error) {
+	timeouts := Timeouts{
+		Default:    DefaultTimeout,
+		Operations: map[Operation]time.Duration{},
+	}
+
+	if defaultTimeout != "" {
+		timeout, err := parseTimeout(defaultTimeout)
+
+		if err != nil {
+			return Timeouts{}, fmt.Errorf("invalid default timeout '%s': %v", defaultTimeout, err)
+		}
+
+		timeouts.Default = timeout
+	}
+
+	for _, entry := range strings.Split(operationTimeouts, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(entry, "=")
+		operation := Operation(strings.TrimSpace(name))
+
+		if !ok || !slices.Contains(operations, operation) {
+			return Timeouts{}, fmt.Errorf("invalid operation timeout '%s', expected <operation>=<duration> with one of the operations %v", entry, operations)
+		}
+
+		timeout, err := parseTimeout(strings.TrimSpace(value))
+
+		if err != nil {
+			return Timeouts{}, fmt.Errorf("invalid timeout of operation '%s': %v", operation, err)
+		}
+
+		timeouts.Operations[operation] = timeout
+	}
+
+	return timeouts, nil
+}
+
+// WithTimeout returns a copy of the context which ends once the timeout of the operation elapses, unless the context ends earlier
+func (t Timeouts) WithTimeout(ctx context.Context, operation Operation) (context.Context, context.CancelFunc) {
+	timeout, ok := t.Operations[operation]
+
+	if !ok {
+		timeout = t.Default
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
 }
 
 // Disconnect closes the mongodb connection
-func (mc *MongoClient) Disconnect() error {
-	return mc.client.Disconnect(context.Background())
+func (mc *MongoClient) Disconnect(ctx context.Context) error {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationDisconnect)
+	defer cancel()
+	return contextError(ctx, mc.client.Disconnect(ctx))
 }
 
-// CreateCollection creates a new collection in the mongodb database
-func (mc *MongoClient) CreateCollection(collectionName string) error {
-	return mc.defaultDb.CreateCollection(context.Background(), collectionName)
+// CreateCollection creates a new collection in the mongodb database unless it already exists
+func (mc *MongoClient) CreateCollection(ctx context.Context, collectionName string) error {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationCreateCollection)
+	defer cancel()
+	err := mc.defaultDb.CreateCollection(ctx, collectionName)
+
+	if isNamespaceExists(err) {
+		return nil
+	}
+
+	return contextError(ctx, err)
 }
 
-// MustCreateCollection creates a new collection in the mongodb database and panics if it fails
-func (mc *MongoClient) MustCreateCollection(collectionName string) {
-	if err := mc.CreateCollection(collectionName); err != nil {
+// MustCreateCollection creates a new collection in the mongodb database unless it already exists and panics if it fails
+func (mc *MongoClient) MustCreateCollection(ctx context.Context, collectionName string) {
+	if err := mc.CreateCollection(ctx, collectionName); err != nil {
 		log.Fatalf("failed to create collection '%s': %v\n", collectionName, err)
 	}
 }
 
 // SaveOrReplaceDocument saves or replaces a document in the mongodb collection
-func (mc *MongoClient) SaveOrReplaceDocument(collectionName string, document any, filter map[string]any) error {
+func (mc *MongoClient) SaveOrReplaceDocument(ctx context.Context, collectionName string, document any, filter map[string]any) error {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationSave)
+	defer cancel()
 	options := options.Replace().SetUpsert(true)
-	_, err := mc.defaultDb.Collection(collectionName).ReplaceOne(context.Background(), filter, document, options)
+	_, err := mc.defaultDb.Collection(collectionName).ReplaceOne(ctx, filter, document, options)
+
+	return contextError(ctx, err)
+}
+
+// DeleteDocument deletes the first document matching the filter from the mongodb collection and reports whether a document was deleted
+func (mc *MongoClient) DeleteDocument(ctx context.Context, collectionName string, filter map[string]any) (bool, error) {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationDelete)
+	defer cancel()
+	result, err := mc.defaultDb.Collection(collectionName).DeleteOne(ctx, filter)
+
+	if err != nil {
+		return false, contextError(ctx, err)
+	}
 
-	return err
+	return result.DeletedCount > 0, nil
 }
 
 // CreateIndex creates an index on the specified field in the mongodb collection with the specified sort order
-func (mc *MongoClient) CreateIndex(collectionName, field string, sort int) error {
+func (mc *MongoClient) CreateIndex(ctx context.Context, collectionName, field string, sort int) error {
 	indexModel := mongo.IndexModel{
 		Keys: bson.M{
 			field: sort,
 		},
 	}
 
-	collection := mc.defaultDb.Collection(collectionName)
-	_, err := collection.Indexes().CreateOne(context.Background(), indexModel)
-
-	return err
+	return mc.createIndex(ctx, collectionName, indexModel)
 }
 
 // MustCreateIndex creates an index on the specified field in the mongodb collection with the specified sort order and panics if it fails
-func (mc *MongoClient) MustCreateIndex(collectionName, field string, sort int) {
-	if err := mc.CreateIndex(collectionName, field, sort); err != nil {
+func (mc *MongoClient) MustCreateIndex(ctx context.Context, collectionName, field string, sort int) {
+	if err := mc.CreateIndex(ctx, collectionName, field, sort); err != nil {
 		log.Fatalf("failed to create index on field '%s' in collection '%s': %v\n", field, collectionName, err)
 	}
 }
 
 // Create2dSphereIndex creates a 2dsphere index on the specified field in the mongodb collection
-func (mc *MongoClient) Create2dSphereIndex(collectionName, field string) error {
+func (mc *MongoClient) Create2dSphereIndex(ctx context.Context, collectionName, field string) error {
 	indexModel := mongo.IndexModel{
 		Keys: bson.M{
 			field: "2dsphere",
 		},
 	}
 
-	collection := mc.defaultDb.Collection(collectionName)
-	_, err := collection.Indexes().CreateOne(context.Background(), indexModel)
-
-	return err
+	return mc.createIndex(ctx, collectionName, indexModel)
 }
 
 // MustCreate2dSphereIndex creates a 2dsphere index on the specified field in the mongodb collection and panics if it fails
-func (mc *MongoClient) MustCreate2dSphereIndex(collectionName, field string) {
-	if err := mc.Create2dSphereIndex(collectionName, field); err != nil {
+func (mc *MongoClient) MustCreate2dSphereIndex(ctx context.Context, collectionName, field string) {
+	if err := mc.Create2dSphereIndex(ctx, collectionName, field); err != nil {
 		log.Fatalf("failed to create 2dsphere index on field '%s' in collection '%s': %v\n", field, collectionName, err)
 	}
 }
 
+// createIndex creates the index in the mongodb collection
+func (mc *MongoClient) createIndex(ctx context.Context, collectionName string, indexModel mongo.IndexModel) error {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationCreateIndex)
+	defer cancel()
+	_, err := mc.defaultDb.Collection(collectionName).Indexes().CreateOne(ctx, indexModel)
+
+	return contextError(ctx, err)
+}
+
 // Find retrieves documents from the mongodb collection based on the specified filter, projection, and sort options and paginates the results
-func (mc *MongoClient) Find(collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) (*mongo.Cursor, error) {
+// the timeout bounds the query and its first batch, the returned cursor is read with the caller's context
+func (mc *MongoClient) Find(ctx context.Context, collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) (*mongo.Cursor, error) {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationFind)
+	defer cancel()
 	collection := mc.defaultDb.Collection(collectionName)
 	options := options.Find()
 
@@ -115,7 +292,141 @@ func (mc *MongoClient) Find(collectionName string, filter, projection, sort map[
 	}
 
 	options.SetLimit(int64(pageSize)).SetSkip(int64(pageSize * (pageNumber - 1)))
-	return collection.Find(context.Background(), filter, options)
+	cursor, err := collection.Find(ctx, filter, options)
+
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return cursor, nil
+}
+
+// BulkSaveOrReplace saves or replaces every document of the models in the mongodb collection in a single bulk write
+// an ordered bulk write stops at the first failed item, an unordered one writes every other item, the failed items are listed in the result
+func (mc *MongoClient) BulkSaveOrReplace(ctx context.Context, collectionName string, models []ReplaceModel, ordered bool) (BulkResult, error) {
+	if len(models) == 0 {
+		return BulkResult{}, ctx.Err()
+	}
+
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationBulkWrite)
+	defer cancel()
+	writeModels := []mongo.WriteModel{}
+
+	for _, model := range models {
+		writeModels = append(writeModels, mongo.NewReplaceOneModel().SetFilter(model.Filter).SetReplacement(model.Document).SetUpsert(true))
+	}
+
+	result, err := mc.defaultDb.Collection(collectionName).BulkWrite(ctx, writeModels, options.BulkWrite().SetOrdered(ordered))
+	bulkResult := BulkResult{}
+
+	if result != nil {
+		bulkResult.Matched = result.MatchedCount
+		bulkResult.Upserted = result.UpsertedCount
+	}
+
+	return bulkErrors(ctx, bulkResult, err)
+}
+
+// InsertMany inserts the documents into the mongodb collection in a single bulk write
+// an ordered insert stops at the first failed document, an unordered one inserts every other document, the failed documents are listed in the result
+func (mc *MongoClient) InsertMany(ctx context.Context, collectionName string, documents []any, ordered bool) (BulkResult, error) {
+	if len(documents) == 0 {
+		return BulkResult{}, ctx.Err()
+	}
+
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationBulkWrite)
+	defer cancel()
+	result, err := mc.defaultDb.Collection(collectionName).InsertMany(ctx, documents, options.InsertMany().SetOrdered(ordered))
+	bulkResult := BulkResult{}
+
+	if result != nil {
+		bulkResult.Inserted = int64(len(result.InsertedIDs))
+	}
+
+	return bulkErrors(ctx, bulkResult, err)
+}
+
+// Aggregate runs the aggregation pipeline on the mongodb collection
+// the timeout bounds the aggregation and its first batch, the returned cursor is read with the caller's context
+func (mc *MongoClient) Aggregate(ctx context.Context, collectionName string, pipeline []map[string]any) (*mongo.Cursor, error) {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationAggregate)
+	defer cancel()
+	cursor, err := mc.defaultDb.Collection(collectionName).Aggregate(ctx, pipeline)
+
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return cursor, nil
+}
+
+// Count counts the documents matching the filter in the mongodb collection
+func (mc *MongoClient) Count(ctx context.Context, collectionName string, filter map[string]any) (int64, error) {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationCount)
+	defer cancel()
+
+	if filter == nil {
+		filter = map[string]any{}
+	}
+
+	count, err := mc.defaultDb.Collection(collectionName).CountDocuments(ctx, filter)
+
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+
+	return count, nil
+}
+
+// UpdateMany applies the update operators to every document matching the filter in the mongodb collection and returns the number of modified documents
+func (mc *MongoClient) UpdateMany(ctx context.Context, collectionName string, filter, update map[string]any) (int64, error) {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationUpdate)
+	defer cancel()
+
+	if filter == nil {
+		filter = map[string]any{}
+	}
+
+	result, err := mc.defaultDb.Collection(collectionName).UpdateMany(ctx, filter, update)
+
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+
+	return result.ModifiedCount, nil
+}
+
+// DeleteMany deletes every document matching the filter from the mongodb collection and returns the number of deleted documents
+func (mc *MongoClient) DeleteMany(ctx context.Context, collectionName string, filter map[string]any) (int64, error) {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationDelete)
+	defer cancel()
+
+	if filter == nil {
+		filter = map[string]any{}
+	}
+
+	result, err := mc.defaultDb.Collection(collectionName).DeleteMany(ctx, filter)
+
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+
+	return result.DeletedCount, nil
+}
+
+// bulkErrors lists the failed items of a mongodb bulk write in the result, other errors fail the whole bulk write
+func bulkErrors(ctx context.Context, result BulkResult, err error) (BulkResult, error) {
+	var bulkWriteException mongo.BulkWriteException
+
+	if err == nil || !errors.As(err, &bulkWriteException) || bulkWriteException.WriteConcernError != nil {
+		return result, contextError(ctx, err)
+	}
+
+	for _, writeError := range bulkWriteException.WriteErrors {
+		result.Errors = append(result.Errors, BulkError{Index: writeError.Index, Message: writeError.Message})
+	}
+
+	return result, nil
 }
 
 // CreateClient creates a new mongodb client with the specified client info
@@ -133,9 +444,16 @@ func CreateClient(clientInfo ClientInfo) (*MongoClient, error) {
 		return nil, err
 	}
 
+	timeouts := clientInfo.Timeouts
+
+	if timeouts.Default == 0 {
+		timeouts.Default = DefaultTimeout
+	}
+
 	return &MongoClient{
 		client:    client,
 		defaultDb: client.Database(clientInfo.DefaultDatabase),
+		timeouts:  timeouts,
 	}, nil
 }
 
@@ -149,3 +467,27 @@ func MustCreateClient(clientInfo ClientInfo) *MongoClient {
 
 	return mongoClient
 }
+
+// contextError wraps the error of an operation with the reason its context ended, so callers can tell cancellations and timeouts from failures of the database
+func contextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %v", ctx.Err(), err)
+}
+
+// parseTimeout parses a non-negative duration
+func parseTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if timeout < 0 {
+		return 0, fmt.Errorf("timeout '%s' is negative", value)
+	}
+
+	return timeout, nil
+}
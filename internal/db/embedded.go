@@ -0,0 +1,1366 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	documentsBucket       = "documents"
+	schemaKey             = "schema"
+	indexBucketPrefix     = "index:"
+	spatialBucketPrefix   = "2dsphere:"
+	spatialIndexPrecision = 12
+	maxSpatialCells       = 64
+	openTimeout           = 5 * time.Second
+)
+
+// EmbeddedClient stores every collection in a single bbolt file, so the services run without a mongodb server and keep their data across restarts
+// each collection is a bucket with its documents stored as bson under their _id, and an index bucket per indexed field
+// queries are evaluated like in the memory client, but only on the documents found through the indexes of the filter instead of the whole collection
+type EmbeddedClient struct {
+	db *bolt.DB
+}
+
+// Disconnect closes the database file
+func (ec *EmbeddedClient) Disconnect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ec.db.Close()
+}
+
+// CreateCollection creates a new empty collection unless it already exists
+func (ec *EmbeddedClient) CreateCollection(ctx context.Context, collectionName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ec.db.Update(func(tx *bolt.Tx) error {
+		_, err := createCollection(tx, collectionName)
+		return err
+	})
+}
+
+// MustCreateCollection creates a new empty collection unless it already exists and panics if it fails
+func (ec *EmbeddedClient) MustCreateCollection(ctx context.Context, collectionName string) {
+	if err := ec.CreateCollection(ctx, collectionName); err != nil {
+		log.Fatalf("failed to create collection '%s': %v\n", collectionName, err)
+	}
+}
+
+// SaveOrReplaceDocument replaces the first document matching the filter, or inserts the document if none matches
+// like a mongodb upsert, an inserted document without an _id takes it from an equality on _id in the filter or gets a new object id
+func (ec *EmbeddedClient) SaveOrReplaceDocument(ctx context.Context, collectionName string, document any, filter map[string]any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	replacement, err := toDocument(document)
+
+	if err != nil {
+		return fmt.Errorf("error converting document: %v", err)
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return fmt.Errorf("error converting filter: %v", err)
+	}
+
+	return ec.db.Update(func(tx *bolt.Tx) error {
+		collection, err := createCollection(tx, collectionName)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = replaceDocument(collection, replacement, query)
+		return err
+	})
+}
+
+// DeleteDocument deletes the first document matching the filter and reports whether a document was deleted
+func (ec *EmbeddedClient) DeleteDocument(ctx context.Context, collectionName string, filter map[string]any) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return false, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	deleted := false
+
+	err = ec.db.Update(func(tx *bolt.Tx) error {
+		collection := tx.Bucket([]byte(collectionName))
+
+		if collection == nil {
+			return nil
+		}
+
+		keys, existing, err := findDocuments(collection, query, true)
+
+		if err != nil || len(existing) == 0 {
+			return err
+		}
+
+		if err := updateIndexes(collection, keys[0], existing[0], false); err != nil {
+			return err
+		}
+
+		deleted = true
+		return collection.Bucket([]byte(documentsBucket)).Delete(keys[0])
+	})
+
+	return deleted, err
+}
+
+// CreateIndex creates an index on the field and indexes the existing documents, the sort is ignored since the index is scanned in both directions
+// string and number values are indexed, and every element of an array, so equalities, $in and ranges on numbers are answered from the index
+func (ec *EmbeddedClient) CreateIndex(ctx context.Context, collectionName, field string, sort int) error {
+	return ec.CreateIndexes(ctx, collectionName, []IndexSpec{{Keys: []IndexKey{{Field: field, Type: sort}}}})
+}
+
+// MustCreateIndex creates an index on the field and panics if it fails
+func (ec *EmbeddedClient) MustCreateIndex(ctx context.Context, collectionName, field string, sort int) {
+	if err := ec.CreateIndex(ctx, collectionName, field, sort); err != nil {
+		log.Fatalf("failed to create index on field '%s' in collection '%s': %v\n", field, collectionName, err)
+	}
+}
+
+// Create2dSphereIndex creates a spatial index on the field and indexes the existing documents
+// geojson points are indexed by their geohash, other geometries are kept in the index but are candidates of every geospatial query
+func (ec *EmbeddedClient) Create2dSphereIndex(ctx context.Context, collectionName, field string) error {
+	return ec.CreateIndexes(ctx, collectionName, []IndexSpec{{Keys: []IndexKey{{Field: field, Type: "2dsphere"}}}})
+}
+
+// MustCreate2dSphereIndex creates a spatial index on the field and panics if it fails
+func (ec *EmbeddedClient) MustCreate2dSphereIndex(ctx context.Context, collectionName, field string) {
+	if err := ec.Create2dSphereIndex(ctx, collectionName, field); err != nil {
+		log.Fatalf("failed to create 2dsphere index on field '%s' in collection '%s': %v\n", field, collectionName, err)
+	}
+}
+
+// DescribeCollection finds the collection with the validator and indexes recorded for it
+func (ec *EmbeddedClient) DescribeCollection(ctx context.Context, collectionName string) (CollectionState, error) {
+	if err := ctx.Err(); err != nil {
+		return CollectionState{}, err
+	}
+
+	state := CollectionState{}
+
+	err := ec.db.View(func(tx *bolt.Tx) error {
+		collection := tx.Bucket([]byte(collectionName))
+
+		if collection == nil {
+			return nil
+		}
+
+		schema, err := readSchema(collection)
+		state = CollectionState{Exists: true, Validator: schema.Validator, Indexes: schema.Indexes, TimeSeries: schema.TimeSeries}
+		return err
+	})
+
+	return state, err
+}
+
+// CreateTimeSeriesCollection creates a new empty collection with the time-series options unless a collection with the name already exists
+// the documents are kept like in any other collection, the options are only recorded
+func (ec *EmbeddedClient) CreateTimeSeriesCollection(ctx context.Context, collectionName string, timeSeries TimeSeriesSpec) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ec.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(collectionName)) != nil {
+			return nil
+		}
+
+		collection, err := createCollection(tx, collectionName)
+
+		if err != nil {
+			return err
+		}
+
+		return writeSchema(collection, collectionSchema{TimeSeries: &timeSeries})
+	})
+}
+
+// CreateIndexes creates an index for every field of the indexes, a secondary index or a spatial index for 2dsphere keys, and records the indexes
+// a compound index is answered by intersecting the indexes of its fields, unique indexes fail the writes of duplicate keys and expirations are not enforced
+func (ec *EmbeddedClient) CreateIndexes(ctx context.Context, collectionName string, indexes []IndexSpec) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ec.db.Update(func(tx *bolt.Tx) error {
+		collection, err := createCollection(tx, collectionName)
+
+		if err != nil {
+			return err
+		}
+
+		schema, err := readSchema(collection)
+
+		if err != nil {
+			return err
+		}
+
+		for _, index := range indexes {
+			for _, key := range index.Keys {
+				indexName := indexBucketPrefix + key.Field
+
+				if key.Type == "2dsphere" {
+					indexName = spatialBucketPrefix + key.Field
+				}
+
+				if err := addIndex(collection, indexName); err != nil {
+					return err
+				}
+			}
+
+			schema.Indexes = slices.DeleteFunc(schema.Indexes, func(existing IndexSpec) bool {
+				return existing.IndexName() == index.IndexName()
+			})
+
+			schema.Indexes = append(schema.Indexes, index)
+		}
+
+		return writeSchema(collection, schema)
+	})
+}
+
+// SetValidator records the validator of the collection, documents are not validated
+func (ec *EmbeddedClient) SetValidator(ctx context.Context, collectionName string, validator map[string]any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ec.db.Update(func(tx *bolt.Tx) error {
+		collection, err := createCollection(tx, collectionName)
+
+		if err != nil {
+			return err
+		}
+
+		schema, err := readSchema(collection)
+
+		if err != nil {
+			return err
+		}
+
+		schema.Validator = validator
+		return writeSchema(collection, schema)
+	})
+}
+
+// addIndex creates the index bucket unless it already exists and adds the entries of the documents already in the collection
+func addIndex(collection *bolt.Bucket, indexName string) error {
+	if collection.Bucket([]byte(indexName)) != nil {
+		return nil
+	}
+
+	index, err := collection.CreateBucket([]byte(indexName))
+
+	if err != nil {
+		return err
+	}
+
+	return collection.Bucket([]byte(documentsBucket)).ForEach(func(key, value []byte) error {
+		key = slices.Clone(key)
+		document, err := decodeDocument(value)
+
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range indexEntries(indexName, document) {
+			if err := index.Put(append(entry, key...), key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// collectionSchema is the validator, indexes and time-series options recorded for a collection, stored as bson under the schema key of its bucket
+type collectionSchema struct {
+	Validator  map[string]any  `bson:"validator"`
+	Indexes    []IndexSpec     `bson:"indexes"`
+	TimeSeries *TimeSeriesSpec `bson:"timeSeries,omitempty"`
+}
+
+// readSchema reads the validator and indexes recorded for the collection
+func readSchema(collection *bolt.Bucket) (collectionSchema, error) {
+	schema := collectionSchema{}
+	value := collection.Get([]byte(schemaKey))
+
+	if value == nil {
+		return schema, nil
+	}
+
+	if err := bson.Unmarshal(value, &schema); err != nil {
+		return collectionSchema{}, fmt.Errorf("error decoding the schema of the collection: %v", err)
+	}
+
+	return schema, nil
+}
+
+// writeSchema records the validator and indexes of the collection
+func writeSchema(collection *bolt.Bucket, schema collectionSchema) error {
+	value, err := bson.Marshal(schema)
+
+	if err != nil {
+		return fmt.Errorf("error encoding the schema of the collection: %v", err)
+	}
+
+	return collection.Put([]byte(schemaKey), value)
+}
+
+// Find retrieves the documents matching the filter, sorted and paginated like mongodb, with only the projected fields
+// results of a $near query are ordered by distance unless a sort is given, a page size of 0 returns every document
+func (ec *EmbeddedClient) Find(ctx context.Context, collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return nil, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	results := []bson.D{}
+
+	err = ec.db.View(func(tx *bolt.Tx) error {
+		collection := tx.Bucket([]byte(collectionName))
+
+		if collection == nil {
+			return nil
+		}
+
+		_, results, err = findDocuments(collection, query, false)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := selectDocuments(results, query, projection, sort, pageNumber, pageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mongo.NewCursorFromDocuments(documents, nil, nil)
+}
+
+// BulkSaveOrReplace replaces or inserts the document of every model like SaveOrReplaceDocument, all of them in a single transaction
+// an ordered bulk write stops at the first failed item, an unordered one writes every other item, the failed items are listed in the result
+func (ec *EmbeddedClient) BulkSaveOrReplace(ctx context.Context, collectionName string, models []ReplaceModel, ordered bool) (BulkResult, error) {
+	if err := ctx.Err(); err != nil {
+		return BulkResult{}, err
+	}
+
+	result := BulkResult{}
+
+	err := ec.db.Update(func(tx *bolt.Tx) error {
+		collection, err := createCollection(tx, collectionName)
+
+		if err != nil {
+			return err
+		}
+
+		for i, model := range models {
+			upserted, err := bulkReplace(collection, model)
+
+			if err != nil {
+				result.Errors = append(result.Errors, BulkError{Index: i, Message: err.Error()})
+
+				if ordered {
+					break
+				}
+
+				continue
+			}
+
+			if upserted {
+				result.Upserted++
+
+			} else {
+				result.Matched++
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return BulkResult{}, err
+	}
+
+	return result, nil
+}
+
+// InsertMany inserts the documents in a single transaction, documents without an _id get a new object id
+// a document with the _id of an existing document fails like a duplicate key in mongodb, an ordered insert stops at the first failed document
+func (ec *EmbeddedClient) InsertMany(ctx context.Context, collectionName string, documents []any, ordered bool) (BulkResult, error) {
+	if err := ctx.Err(); err != nil {
+		return BulkResult{}, err
+	}
+
+	result := BulkResult{}
+
+	err := ec.db.Update(func(tx *bolt.Tx) error {
+		collection, err := createCollection(tx, collectionName)
+
+		if err != nil {
+			return err
+		}
+
+		for i, document := range documents {
+			if err := insertDocument(collection, document); err != nil {
+				result.Errors = append(result.Errors, BulkError{Index: i, Message: err.Error()})
+
+				if ordered {
+					break
+				}
+
+				continue
+			}
+
+			result.Inserted++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return BulkResult{}, err
+	}
+
+	return result, nil
+}
+
+// Aggregate runs the aggregation pipeline on the collection, see aggregate for the supported stages
+// a leading $match stage is answered through the indexes like the filter of Find
+func (ec *EmbeddedClient) Aggregate(ctx context.Context, collectionName string, pipeline []map[string]any) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stages, err := toStages(pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	query := bson.D{}
+
+	if len(stages) > 0 && len(stages[0]) == 1 && stages[0][0].Key == "$match" {
+		if filter, ok := stages[0][0].Value.(bson.D); ok {
+			query = filter
+		}
+	}
+
+	documents := []bson.D{}
+
+	err = ec.db.View(func(tx *bolt.Tx) error {
+		collection := tx.Bucket([]byte(collectionName))
+
+		if collection == nil {
+			return nil
+		}
+
+		_, documents, err = findDocuments(collection, query, false)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := aggregate(documents, stages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return toCursor(results)
+}
+
+// Count counts the documents matching the filter
+func (ec *EmbeddedClient) Count(ctx context.Context, collectionName string, filter map[string]any) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return 0, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	count := int64(0)
+
+	err = ec.db.View(func(tx *bolt.Tx) error {
+		collection := tx.Bucket([]byte(collectionName))
+
+		if collection == nil {
+			return nil
+		}
+
+		keys, _, err := findDocuments(collection, query, false)
+		count = int64(len(keys))
+		return err
+	})
+
+	return count, err
+}
+
+// UpdateMany applies the update operators to every document matching the filter in a single transaction and returns the number of modified documents
+// see applyUpdate for the supported operators, the indexes of the modified documents are updated
+func (ec *EmbeddedClient) UpdateMany(ctx context.Context, collectionName string, filter, update map[string]any) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return 0, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	operators, err := toDocument(update)
+
+	if err != nil {
+		return 0, fmt.Errorf("error converting update: %v", err)
+	}
+
+	modified := int64(0)
+
+	err = ec.db.Update(func(tx *bolt.Tx) error {
+		collection := tx.Bucket([]byte(collectionName))
+
+		if collection == nil {
+			return nil
+		}
+
+		keys, documents, err := findDocuments(collection, query, false)
+
+		if err != nil {
+			return err
+		}
+
+		for i, document := range documents {
+			updated, err := applyUpdate(document, operators)
+
+			if err != nil {
+				return err
+			}
+
+			if equal(updated, document) {
+				continue
+			}
+
+			if err := updateIndexes(collection, keys[i], document, false); err != nil {
+				return err
+			}
+
+			if err := putDocument(collection, updated); err != nil {
+				return err
+			}
+
+			modified++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return modified, nil
+}
+
+// DeleteMany deletes every document matching the filter in a single transaction and returns the number of deleted documents
+func (ec *EmbeddedClient) DeleteMany(ctx context.Context, collectionName string, filter map[string]any) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return 0, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	deleted := int64(0)
+
+	err = ec.db.Update(func(tx *bolt.Tx) error {
+		collection := tx.Bucket([]byte(collectionName))
+
+		if collection == nil {
+			return nil
+		}
+
+		keys, documents, err := findDocuments(collection, query, false)
+
+		if err != nil {
+			return err
+		}
+
+		for i, document := range documents {
+			if err := updateIndexes(collection, keys[i], document, false); err != nil {
+				return err
+			}
+
+			if err := collection.Bucket([]byte(documentsBucket)).Delete(keys[i]); err != nil {
+				return err
+			}
+
+			deleted++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted, nil
+}
+
+// bulkReplace converts the model and replaces or inserts its document in the collection
+func bulkReplace(collection *bolt.Bucket, model ReplaceModel) (bool, error) {
+	replacement, err := toDocument(model.Document)
+
+	if err != nil {
+		return false, fmt.Errorf("error converting document: %v", err)
+	}
+
+	query, err := toDocument(model.Filter)
+
+	if err != nil {
+		return false, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	return replaceDocument(collection, replacement, query)
+}
+
+// replaceDocument replaces the first document matching the query or inserts the replacement and reports whether it was inserted
+func replaceDocument(collection *bolt.Bucket, replacement, query bson.D) (bool, error) {
+	keys, existing, err := findDocuments(collection, query, true)
+
+	if err != nil {
+		return false, err
+	}
+
+	if len(existing) == 0 {
+		if _, ok := field(replacement, "_id"); !ok {
+			replacement = withID(replacement, upsertID(query))
+		}
+
+		return true, putDocument(collection, replacement)
+	}
+
+	id, _ := field(existing[0], "_id")
+
+	if replacementID, ok := field(replacement, "_id"); ok && !equal(replacementID, id) {
+		return false, fmt.Errorf("the replacement changes the immutable _id of the document from '%v' to '%v'", id, replacementID)
+	}
+
+	if err := updateIndexes(collection, keys[0], existing[0], false); err != nil {
+		return false, err
+	}
+
+	return false, putDocument(collection, withID(replacement, id))
+}
+
+// insertDocument converts and inserts the document into the collection unless its _id already exists
+func insertDocument(collection *bolt.Bucket, document any) error {
+	inserted, err := toDocument(document)
+
+	if err != nil {
+		return fmt.Errorf("error converting document: %v", err)
+	}
+
+	id, ok := field(inserted, "_id")
+
+	if !ok {
+		id = bson.NewObjectID()
+		inserted = withID(inserted, id)
+	}
+
+	key, err := documentKey(id)
+
+	if err != nil {
+		return err
+	}
+
+	if collection.Bucket([]byte(documentsBucket)).Get(key) != nil {
+		return duplicateKeyError(id)
+	}
+
+	return putDocument(collection, inserted)
+}
+
+// createCollection returns the bucket of the collection, creating it and its documents bucket if needed
+func createCollection(tx *bolt.Tx, collectionName string) (*bolt.Bucket, error) {
+	collection, err := tx.CreateBucketIfNotExists([]byte(collectionName))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := collection.CreateBucketIfNotExists([]byte(documentsBucket)); err != nil {
+		return nil, err
+	}
+
+	return collection, nil
+}
+
+// putDocument stores the document under its _id and adds it to every index of the collection
+// it fails like mongodb if another document has the key of the document under a unique index
+func putDocument(collection *bolt.Bucket, document bson.D) error {
+	id, _ := field(document, "_id")
+	key, err := documentKey(id)
+
+	if err != nil {
+		return err
+	}
+
+	schema, err := readSchema(collection)
+
+	if err != nil {
+		return err
+	}
+
+	if err := checkUniqueIndexes(collection, key, document, schema.Indexes); err != nil {
+		return err
+	}
+
+	value, err := bson.Marshal(document)
+
+	if err != nil {
+		return err
+	}
+
+	if err := collection.Bucket([]byte(documentsBucket)).Put(key, value); err != nil {
+		return err
+	}
+
+	return updateIndexes(collection, key, document, true)
+}
+
+// checkUniqueIndexes fails if another document of the collection has the key of the document under one of the unique indexes
+// the other documents are found through the indexes of the fields of the key, the document itself is recognized by its key
+func checkUniqueIndexes(collection *bolt.Bucket, key []byte, document bson.D, indexes []IndexSpec) error {
+	for _, index := range indexes {
+		if !index.Unique {
+			continue
+		}
+
+		filter := bson.D{}
+
+		for _, element := range uniqueKey(index, document) {
+			filter = append(filter, bson.E{Key: element.Key, Value: bson.D{{Key: "$eq", Value: element.Value}}})
+		}
+
+		keys, candidates, err := findDocuments(collection, filter, false)
+
+		if err != nil {
+			return err
+		}
+
+		others := []bson.D{}
+
+		for i, candidate := range candidates {
+			if !bytes.Equal(keys[i], key) {
+				others = append(others, candidate)
+			}
+		}
+
+		if err := uniqueKeyError([]IndexSpec{index}, document, others); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateIndexes adds the entries of the document to every index of the collection, or removes them
+func updateIndexes(collection *bolt.Bucket, key []byte, document bson.D, add bool) error {
+	indexNames := []string{}
+
+	err := collection.ForEachBucket(func(name []byte) error {
+		if string(name) != documentsBucket {
+			indexNames = append(indexNames, string(name))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, indexName := range indexNames {
+		index := collection.Bucket([]byte(indexName))
+
+		for _, entry := range indexEntries(indexName, document) {
+			var err error
+
+			if add {
+				err = index.Put(append(entry, key...), key)
+
+			} else {
+				err = index.Delete(append(entry, key...))
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// findDocuments returns the keys and documents matching the filter in the order of their _id, only the first one if requested
+// the documents are read from the candidates found through the indexes, or from the whole collection if no index applies to the filter
+func findDocuments(collection *bolt.Bucket, filter bson.D, first bool) ([][]byte, []bson.D, error) {
+	documents := collection.Bucket([]byte(documentsBucket))
+	keys, documentList := [][]byte{}, []bson.D{}
+
+	check := func(key, value []byte) (bool, error) {
+		document, err := decodeDocument(value)
+
+		if err != nil {
+			return false, err
+		}
+
+		ok, err := matches(document, filter)
+
+		if err != nil || !ok {
+			return false, err
+		}
+
+		keys = append(keys, slices.Clone(key))
+		documentList = append(documentList, document)
+		return first, nil
+	}
+
+	if candidates, ok := filterCandidates(collection, filter); ok {
+		ordered := []string{}
+
+		for key := range candidates {
+			ordered = append(ordered, key)
+		}
+
+		slices.Sort(ordered)
+
+		for _, key := range ordered {
+			value := documents.Get([]byte(key))
+
+			if value == nil {
+				continue
+			}
+
+			done, err := check([]byte(key), value)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if done {
+				break
+			}
+		}
+
+		return keys, documentList, nil
+	}
+
+	cursor := documents.Cursor()
+
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		done, err := check(key, value)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if done {
+			break
+		}
+	}
+
+	return keys, documentList, nil
+}
+
+// filterCandidates returns the keys of the documents that can match the filter, the intersection of the candidates of every condition answered by an index
+// it reports false if no index applies and the whole collection has to be scanned
+func filterCandidates(collection *bolt.Bucket, filter bson.D) (map[string]bool, bool) {
+	var candidates map[string]bool
+
+	for _, element := range filter {
+		var keys map[string]bool
+		var ok bool
+
+		if element.Key == "$and" {
+			keys, ok = andCandidates(collection, element.Value)
+
+		} else if !strings.HasPrefix(element.Key, "$") {
+			keys, ok = fieldCandidates(collection, element)
+		}
+
+		if ok {
+			candidates = intersect(candidates, keys)
+		}
+	}
+
+	return candidates, candidates != nil
+}
+
+// andCandidates returns the candidates of the filters of an $and operator
+func andCandidates(collection *bolt.Bucket, value any) (map[string]bool, bool) {
+	filters, ok := value.(bson.A)
+
+	if !ok {
+		return nil, false
+	}
+
+	conditions := bson.D{}
+
+	for _, filter := range filters {
+		if document, ok := filter.(bson.D); ok {
+			conditions = append(conditions, document...)
+		}
+	}
+
+	return filterCandidates(collection, conditions)
+}
+
+// fieldCandidates returns the candidates of the condition on a field, looked up by _id, in its index or in its spatial index
+func fieldCandidates(collection *bolt.Bucket, element bson.E) (map[string]bool, bool) {
+	if element.Key == "_id" && !isOperators(element.Value) {
+		key, err := documentKey(element.Value)
+		return map[string]bool{string(key): true}, err == nil
+	}
+
+	if index := collection.Bucket([]byte(indexBucketPrefix + element.Key)); index != nil {
+		return indexCandidates(index, element.Value)
+	}
+
+	if index := collection.Bucket([]byte(spatialBucketPrefix + element.Key)); index != nil {
+		return spatialCandidates(index, element.Value)
+	}
+
+	return nil, false
+}
+
+// indexCandidates returns the candidates of an equality, $eq, $in or a range on numbers found in the index of a field
+func indexCandidates(index *bolt.Bucket, value any) (map[string]bool, bool) {
+	if !isOperators(value) {
+		return equalityCandidates(index, bson.A{value})
+	}
+
+	var candidates map[string]bool
+	var lower, upper *float64
+
+	for _, operator := range value.(bson.D) {
+		var keys map[string]bool
+		ok := false
+
+		switch operator.Key {
+		case "$eq":
+			keys, ok = equalityCandidates(index, bson.A{operator.Value})
+
+		case "$in":
+			if values, isArray := operator.Value.(bson.A); isArray {
+				keys, ok = equalityCandidates(index, values)
+			}
+
+		case "$gt", "$gte":
+			if number, isNumber := toNumber(operator.Value); isNumber {
+				lower = &number
+			}
+
+		case "$lt", "$lte":
+			if number, isNumber := toNumber(operator.Value); isNumber {
+				upper = &number
+			}
+		}
+
+		if ok {
+			candidates = intersect(candidates, keys)
+		}
+	}
+
+	if lower != nil || upper != nil {
+		candidates = intersect(candidates, rangeCandidates(index, lower, upper))
+	}
+
+	return candidates, candidates != nil
+}
+
+// equalityCandidates returns the candidates equal to any of the values, it reports false if a value is not indexed
+func equalityCandidates(index *bolt.Bucket, values bson.A) (map[string]bool, bool) {
+	candidates := map[string]bool{}
+
+	for _, value := range values {
+		key, ok := indexKey(value)
+
+		if !ok {
+			return nil, false
+		}
+
+		scanPrefix(index, key, candidates)
+	}
+
+	return candidates, true
+}
+
+// rangeCandidates returns the candidates with a number between the bounds, a missing bound leaves the range open
+// the bounds are inclusive, the exact comparison is left to the evaluation of the filter
+func rangeCandidates(index *bolt.Bucket, lower, upper *float64) map[string]bool {
+	candidates := map[string]bool{}
+	start := []byte{'n'}
+
+	if lower != nil {
+		start = append(start, orderedNumber(*lower)...)
+	}
+
+	cursor := index.Cursor()
+
+	for key, value := cursor.Seek(start); key != nil && key[0] == 'n'; key, value = cursor.Next() {
+		if upper != nil && bytes.Compare(key[1:9], orderedNumber(*upper)) > 0 {
+			break
+		}
+
+		candidates[string(value)] = true
+	}
+
+	return candidates
+}
+
+// spatialCandidates returns the candidates of a $near or $nearSphere with a maximum distance, a $geoWithin or a $geoIntersects
+// the candidates are the points in the geohash cells covering the bounding boxes of the query and every geometry that is not a point
+func spatialCandidates(index *bolt.Bucket, value any) (map[string]bool, bool) {
+	operators, ok := value.(bson.D)
+
+	if !ok {
+		return nil, false
+	}
+
+	for _, operator := range operators {
+		boxes, ok := queryBoxes(operator, operators)
+
+		if !ok {
+			continue
+		}
+
+		candidates := map[string]bool{}
+		scanPrefix(index, []byte{'o'}, candidates)
+
+		for _, cell := range coveringCells(boxes) {
+			scanPrefix(index, append([]byte{'p'}, cell...), candidates)
+		}
+
+		return candidates, true
+	}
+
+	return nil, false
+}
+
+// queryBoxes returns the bounding boxes of the area a geospatial operator can match, split at the antimeridian
+// it reports false for unbounded $near queries and for areas around a pole or wider than half of the globe
+func queryBoxes(operator bson.E, operators bson.D) ([]geo.BoundingBox, bool) {
+	switch operator.Key {
+	case "$near", "$nearSphere":
+		center, maxDistance, _, err := nearArguments(operator.Key, operator.Value, operators)
+
+		if err != nil || math.IsInf(maxDistance, 1) {
+			return nil, false
+		}
+
+		north := geo.Destination(center, maxDistance, 0)[1]
+		south := geo.Destination(center, maxDistance, 180)[1]
+
+		if north-center[1] < 0 || center[1]-south < 0 || north >= 90 || south <= -90 {
+			return nil, false
+		}
+
+		angularDistance := (north - center[1]) * math.Pi / 180
+		longitudeDelta := math.Asin(min(1, math.Sin(angularDistance)/math.Cos(center[1]*math.Pi/180))) * 180 / math.Pi
+		return splitBox(center[0]-longitudeDelta, south, center[0]+longitudeDelta, north)
+
+	case "$geoWithin", "$geoIntersects":
+		arguments, ok := operator.Value.(bson.D)
+
+		if !ok {
+			return nil, false
+		}
+
+		geometry, _ := field(arguments, "$geometry")
+
+		if point, ok := toPoint(geometry); ok {
+			return splitBox(point[0], point[1], point[0], point[1])
+		}
+
+		polygons, ok := toPolygons(geometry)
+
+		if !ok {
+			return nil, false
+		}
+
+		west, south, east, north := 180.0, 90.0, -180.0, -90.0
+
+		for _, polygon := range polygons {
+			for _, vertex := range polygon[0] {
+				west, east = min(west, vertex[0]), max(east, vertex[0])
+				south, north = min(south, vertex[1]), max(north, vertex[1])
+			}
+		}
+
+		return splitBox(west, south, east, north)
+
+	default:
+		return nil, false
+	}
+}
+
+// splitBox returns the bounding box between the longitudes and latitudes, split in two if it crosses the antimeridian
+func splitBox(west, south, east, north float64) ([]geo.BoundingBox, bool) {
+	if east-west > 180 {
+		return nil, false
+	}
+
+	box := func(west, east float64) geo.BoundingBox {
+		return geo.BoundingBox{SouthWest: []float64{west, south}, NorthEast: []float64{east, north}}
+	}
+
+	if west < -180 {
+		return []geo.BoundingBox{box(west+360, 180), box(-180, east)}, true
+	}
+
+	if east > 180 {
+		return []geo.BoundingBox{box(west, 180), box(-180, east-360)}, true
+	}
+
+	return []geo.BoundingBox{box(west, east)}, true
+}
+
+// coveringCells returns the geohash cells intersecting the bounding boxes, with the longest geohashes that need at most maxSpatialCells cells
+// the boxes are sampled at the size of a cell, so every cell they intersect contains a sample
+func coveringCells(boxes []geo.BoundingBox) []string {
+	precision := spatialIndexPrecision
+	width, height := cellSize(precision)
+
+	for precision > 1 && sampleCount(boxes, width, height) > maxSpatialCells {
+		precision--
+		width, height = cellSize(precision)
+	}
+
+	cells := []string{}
+
+	for _, box := range boxes {
+		for _, longitude := range samples(box.SouthWest[0], box.NorthEast[0], width) {
+			for _, latitude := range samples(box.SouthWest[1], box.NorthEast[1], height) {
+				if cell := geo.Geohash([]float64{longitude, latitude}, precision); !slices.Contains(cells, cell) {
+					cells = append(cells, cell)
+				}
+			}
+		}
+	}
+
+	return cells
+}
+
+// cellSize returns the width and height in degrees of the geohash cells of the precision
+func cellSize(precision int) (float64, float64) {
+	return 360 / math.Pow(2, float64((5*precision+1)/2)), 180 / math.Pow(2, float64(5*precision/2))
+}
+
+// sampleCount returns the number of samples of the bounding boxes at the cell size
+func sampleCount(boxes []geo.BoundingBox, width, height float64) float64 {
+	count := 0.0
+
+	for _, box := range boxes {
+		count += (math.Ceil((box.NorthEast[0]-box.SouthWest[0])/width) + 1) * (math.Ceil((box.NorthEast[1]-box.SouthWest[1])/height) + 1)
+	}
+
+	return count
+}
+
+// samples returns the values from start to end spaced by the step, always including the end
+func samples(start, end, step float64) []float64 {
+	values := []float64{}
+
+	for value := start; value < end; value += step {
+		values = append(values, value)
+	}
+
+	return append(values, end)
+}
+
+// scanPrefix adds the keys of the documents of every index entry starting with the prefix to the candidates
+func scanPrefix(index *bolt.Bucket, prefix []byte, candidates map[string]bool) {
+	cursor := index.Cursor()
+
+	for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		candidates[string(value)] = true
+	}
+}
+
+// intersect returns the keys in both sets, a nil set contains every key
+func intersect(candidates, keys map[string]bool) map[string]bool {
+	if candidates == nil {
+		return keys
+	}
+
+	for key := range candidates {
+		if !keys[key] {
+			delete(candidates, key)
+		}
+	}
+
+	return candidates
+}
+
+// indexEntries returns the entries of the document in the index, to which the key of the document is appended
+// entries of a spatial index are the geohash of every point, or a single entry for a document with other geometries
+func indexEntries(indexName string, document bson.D) [][]byte {
+	entries := [][]byte{}
+
+	if fieldName, ok := strings.CutPrefix(indexName, spatialBucketPrefix); ok {
+		other := false
+
+		for _, value := range lookup(document, fieldName) {
+			if point, ok := toPoint(value); ok {
+				entries = append(entries, append([]byte{'p'}, geo.Geohash(point, spatialIndexPrecision)...))
+
+			} else if value != nil && !other {
+				entries = append(entries, []byte{'o'})
+				other = true
+			}
+		}
+
+		return entries
+	}
+
+	fieldName := strings.TrimPrefix(indexName, indexBucketPrefix)
+
+	for _, value := range lookup(document, fieldName) {
+		values := bson.A{value}
+
+		if array, ok := value.(bson.A); ok {
+			values = array
+		}
+
+		for _, element := range values {
+			if entry, ok := indexKey(element); ok && !slices.ContainsFunc(entries, func(existing []byte) bool { return bytes.Equal(existing, entry) }) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	return entries
+}
+
+// indexKey encodes a string or a number so the index is ordered by value, it reports false for values that are not indexed
+func indexKey(value any) ([]byte, bool) {
+	if number, ok := toNumber(value); ok {
+		return append([]byte{'n'}, orderedNumber(number)...), true
+	}
+
+	if text, ok := value.(string); ok {
+		return append(append([]byte{'s'}, text...), 0), true
+	}
+
+	return nil, false
+}
+
+// orderedNumber encodes a number as 8 bytes ordered like the number
+func orderedNumber(number float64) []byte {
+	bits := math.Float64bits(number)
+
+	if number >= 0 {
+		bits ^= 1 << 63
+
+	} else {
+		bits = ^bits
+	}
+
+	return binary.BigEndian.AppendUint64(nil, bits)
+}
+
+// documentKey encodes the _id of a document as its key, the bson type followed by the bson value
+func documentKey(id any) ([]byte, error) {
+	valueType, data, err := bson.MarshalValue(id)
+
+	if err != nil {
+		return nil, fmt.Errorf("error converting _id '%v': %v", id, err)
+	}
+
+	return append([]byte{byte(valueType)}, data...), nil
+}
+
+// decodeDocument decodes a stored bson document
+func decodeDocument(value []byte) (bson.D, error) {
+	document := bson.D{}
+
+	if err := bson.Unmarshal(value, &document); err != nil {
+		return nil, fmt.Errorf("error decoding document: %v", err)
+	}
+
+	return document, nil
+}
+
+// isOperators checks if the value of a condition is a document of query operators instead of a value to compare
+func isOperators(value any) bool {
+	document, ok := value.(bson.D)
+	return ok && len(document) > 0 && strings.HasPrefix(document[0].Key, "$")
+}
+
+// CreateEmbeddedClient opens or creates the database file at the path
+func CreateEmbeddedClient(path string) (*EmbeddedClient, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &EmbeddedClient{db: db}, nil
+}
+
+// MustCreateEmbeddedClient opens or creates the database file at the path and panics if it fails
+func MustCreateEmbeddedClient(path string) *EmbeddedClient {
+	embeddedClient, err := CreateEmbeddedClient(path)
+
+	if err != nil {
+		log.Fatalf("failed to open embedded database '%s': %v\n", path, err)
+	}
+
+	return embeddedClient
+}
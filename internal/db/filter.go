@@ -0,0 +1,20 @@
+package db
+
+// GeoWithinPolygon returns a query operator matching the GeoJSON geometries inside the closed counterclockwise ring of [longitude, latitude] vertices
+// the polygon is evaluated with strict winding, so it may cover more than a hemisphere
+func GeoWithinPolygon(ring [][]float64) map[string]any {
+	return map[string]any{
+		"$geoWithin": map[string]any{
+			"$geometry": map[string]any{
+				"type":        "Polygon",
+				"coordinates": [][][]float64{ring},
+				"crs": map[string]any{
+					"type": "name",
+					"properties": map[string]any{
+						"name": "urn:x-mongodb:crs:strictwinding:EPSG:4326",
+					},
+				},
+			},
+		},
+	}
+}
@@ -2,7 +2,15 @@ module github.com/mmilosevicgd/location-tracking/db
 
 go 1.24.2
 
-require go.mongodb.org/mongo-driver/v2 v2.0.0
+replace github.com/mmilosevicgd/location-tracking/geo => ../geo
+
+require (
+	github.com/mmilosevicgd/location-tracking/geo v0.0.0-00010101000000-000000000000
+	go.etcd.io/bbolt v1.4.3
+	go.mongodb.org/mongo-driver/v2 v2.0.0
+)
+
+require golang.org/x/sys v0.29.0 // indirect
 
 require (
 	github.com/golang/snappy v0.0.4 // indirect
@@ -0,0 +1,699 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// MemoryClient keeps every collection in memory and evaluates the queries itself, so the services run and can be tested without mongodb
+// it supports the query operators used by the services, see matches, and every query scans the whole collection, so it is meant for tests and local development
+type MemoryClient struct {
+	mutex       *sync.RWMutex
+	collections map[string][]bson.D
+	indexes     map[string][]IndexSpec
+	validators  map[string]map[string]any
+	timeSeries  map[string]TimeSeriesSpec
+}
+
+// Disconnect drops nothing, the documents are kept until the client is garbage collected
+func (mc *MemoryClient) Disconnect(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// CreateCollection creates a new empty collection unless it already exists
+func (mc *MemoryClient) CreateCollection(ctx context.Context, collectionName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if _, ok := mc.collections[collectionName]; !ok {
+		mc.collections[collectionName] = []bson.D{}
+	}
+
+	return nil
+}
+
+// MustCreateCollection creates a new empty collection unless it already exists and panics if it fails
+func (mc *MemoryClient) MustCreateCollection(ctx context.Context, collectionName string) {
+	if err := mc.CreateCollection(ctx, collectionName); err != nil {
+		log.Fatalf("failed to create collection '%s': %v\n", collectionName, err)
+	}
+}
+
+// SaveOrReplaceDocument replaces the first document matching the filter, or inserts the document if none matches
+// like a mongodb upsert, an inserted document without an _id takes it from an equality on _id in the filter or gets a new object id
+func (mc *MemoryClient) SaveOrReplaceDocument(ctx context.Context, collectionName string, document any, filter map[string]any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	replacement, err := toDocument(document)
+
+	if err != nil {
+		return fmt.Errorf("error converting document: %v", err)
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return fmt.Errorf("error converting filter: %v", err)
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	_, err = mc.replaceDocument(collectionName, replacement, query)
+	return err
+}
+
+// DeleteDocument deletes the first document matching the filter and reports whether a document was deleted
+func (mc *MemoryClient) DeleteDocument(ctx context.Context, collectionName string, filter map[string]any) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return false, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	documents := mc.collections[collectionName]
+
+	for i, existing := range documents {
+		ok, err := matches(existing, query)
+
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			mc.collections[collectionName] = slices.Delete(documents, i, i+1)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// CreateIndex records the index, every query scans the whole collection
+func (mc *MemoryClient) CreateIndex(ctx context.Context, collectionName, field string, sort int) error {
+	return mc.CreateIndexes(ctx, collectionName, []IndexSpec{{Keys: []IndexKey{{Field: field, Type: sort}}}})
+}
+
+// MustCreateIndex records the index and panics if it fails, every query scans the whole collection
+func (mc *MemoryClient) MustCreateIndex(ctx context.Context, collectionName, field string, sort int) {
+	if err := mc.CreateIndex(ctx, collectionName, field, sort); err != nil {
+		log.Fatalf("failed to create index on field '%s' in collection '%s': %v\n", field, collectionName, err)
+	}
+}
+
+// Create2dSphereIndex records the index, geospatial queries are evaluated without an index
+func (mc *MemoryClient) Create2dSphereIndex(ctx context.Context, collectionName, field string) error {
+	return mc.CreateIndexes(ctx, collectionName, []IndexSpec{{Keys: []IndexKey{{Field: field, Type: "2dsphere"}}}})
+}
+
+// MustCreate2dSphereIndex records the index and panics if it fails, geospatial queries are evaluated without an index
+func (mc *MemoryClient) MustCreate2dSphereIndex(ctx context.Context, collectionName, field string) {
+	if err := mc.Create2dSphereIndex(ctx, collectionName, field); err != nil {
+		log.Fatalf("failed to create 2dsphere index on field '%s' in collection '%s': %v\n", field, collectionName, err)
+	}
+}
+
+// Find retrieves the documents matching the filter, sorted and paginated like mongodb, with only the projected fields
+// results of a $near query are ordered by distance unless a sort is given, a page size of 0 returns every document
+func (mc *MemoryClient) Find(ctx context.Context, collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return nil, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	mc.mutex.RLock()
+	results := []bson.D{}
+
+	for _, document := range mc.collections[collectionName] {
+		ok, err := matches(document, query)
+
+		if err != nil {
+			mc.mutex.RUnlock()
+			return nil, err
+		}
+
+		if ok {
+			results = append(results, document)
+		}
+	}
+
+	mc.mutex.RUnlock()
+	documents, err := selectDocuments(results, query, projection, sort, pageNumber, pageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mongo.NewCursorFromDocuments(documents, nil, nil)
+}
+
+// BulkSaveOrReplace replaces or inserts the document of every model like SaveOrReplaceDocument, all of them while holding the lock
+// an ordered bulk write stops at the first failed item, an unordered one writes every other item, the failed items are listed in the result
+func (mc *MemoryClient) BulkSaveOrReplace(ctx context.Context, collectionName string, models []ReplaceModel, ordered bool) (BulkResult, error) {
+	if err := ctx.Err(); err != nil {
+		return BulkResult{}, err
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	result := BulkResult{}
+
+	for i, model := range models {
+		upserted, err := mc.bulkReplace(collectionName, model)
+
+		if err != nil {
+			result.Errors = append(result.Errors, BulkError{Index: i, Message: err.Error()})
+
+			if ordered {
+				break
+			}
+
+			continue
+		}
+
+		if upserted {
+			result.Upserted++
+
+		} else {
+			result.Matched++
+		}
+	}
+
+	return result, nil
+}
+
+// bulkReplace converts the model and replaces or inserts its document, the lock must be held
+func (mc *MemoryClient) bulkReplace(collectionName string, model ReplaceModel) (bool, error) {
+	replacement, err := toDocument(model.Document)
+
+	if err != nil {
+		return false, fmt.Errorf("error converting document: %v", err)
+	}
+
+	query, err := toDocument(model.Filter)
+
+	if err != nil {
+		return false, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	return mc.replaceDocument(collectionName, replacement, query)
+}
+
+// replaceDocument replaces the first document matching the query or inserts the replacement and reports whether it was inserted, the lock must be held
+func (mc *MemoryClient) replaceDocument(collectionName string, replacement, query bson.D) (bool, error) {
+	documents := mc.collections[collectionName]
+
+	for i, existing := range documents {
+		ok, err := matches(existing, query)
+
+		if err != nil {
+			return false, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		id, _ := field(existing, "_id")
+
+		if replacementID, ok := field(replacement, "_id"); ok && !equal(replacementID, id) {
+			return false, fmt.Errorf("the replacement changes the immutable _id of the document from '%v' to '%v'", id, replacementID)
+		}
+
+		replacement = withID(replacement, id)
+
+		if err := uniqueKeyError(mc.indexes[collectionName], replacement, slices.Delete(slices.Clone(documents), i, i+1)); err != nil {
+			return false, err
+		}
+
+		documents[i] = replacement
+		return false, nil
+	}
+
+	if _, ok := field(replacement, "_id"); !ok {
+		replacement = withID(replacement, upsertID(query))
+	}
+
+	if err := uniqueKeyError(mc.indexes[collectionName], replacement, documents); err != nil {
+		return false, err
+	}
+
+	mc.collections[collectionName] = append(documents, replacement)
+	return true, nil
+}
+
+// InsertMany inserts the documents, all of them while holding the lock, documents without an _id get a new object id
+// a document with the _id of an existing document fails like a duplicate key in mongodb, an ordered insert stops at the first failed document
+func (mc *MemoryClient) InsertMany(ctx context.Context, collectionName string, documents []any, ordered bool) (BulkResult, error) {
+	if err := ctx.Err(); err != nil {
+		return BulkResult{}, err
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	result := BulkResult{}
+
+	for i, document := range documents {
+		if err := mc.insertDocument(collectionName, document); err != nil {
+			result.Errors = append(result.Errors, BulkError{Index: i, Message: err.Error()})
+
+			if ordered {
+				break
+			}
+
+			continue
+		}
+
+		result.Inserted++
+	}
+
+	return result, nil
+}
+
+// insertDocument converts and inserts the document unless its _id already exists, the lock must be held
+func (mc *MemoryClient) insertDocument(collectionName string, document any) error {
+	inserted, err := toDocument(document)
+
+	if err != nil {
+		return fmt.Errorf("error converting document: %v", err)
+	}
+
+	id, ok := field(inserted, "_id")
+
+	if !ok {
+		id = bson.NewObjectID()
+		inserted = withID(inserted, id)
+	}
+
+	for _, existing := range mc.collections[collectionName] {
+		if existingID, _ := field(existing, "_id"); equal(existingID, id) {
+			return duplicateKeyError(id)
+		}
+	}
+
+	if err := uniqueKeyError(mc.indexes[collectionName], inserted, mc.collections[collectionName]); err != nil {
+		return err
+	}
+
+	mc.collections[collectionName] = append(mc.collections[collectionName], inserted)
+	return nil
+}
+
+// Aggregate runs the aggregation pipeline on the collection, see aggregate for the supported stages
+func (mc *MemoryClient) Aggregate(ctx context.Context, collectionName string, pipeline []map[string]any) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stages, err := toStages(pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mc.mutex.RLock()
+	documents := slices.Clone(mc.collections[collectionName])
+	mc.mutex.RUnlock()
+	results, err := aggregate(documents, stages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return toCursor(results)
+}
+
+// Count counts the documents matching the filter
+func (mc *MemoryClient) Count(ctx context.Context, collectionName string, filter map[string]any) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return 0, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+	count := int64(0)
+
+	for _, document := range mc.collections[collectionName] {
+		ok, err := matches(document, query)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// UpdateMany applies the update operators to every document matching the filter and returns the number of modified documents, see applyUpdate for the supported operators
+func (mc *MemoryClient) UpdateMany(ctx context.Context, collectionName string, filter, update map[string]any) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return 0, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	operators, err := toDocument(update)
+
+	if err != nil {
+		return 0, fmt.Errorf("error converting update: %v", err)
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	documents := mc.collections[collectionName]
+	updated := slices.Clone(documents)
+	modified := int64(0)
+
+	for i, document := range documents {
+		ok, err := matches(document, query)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		updated[i], err = applyUpdate(document, operators)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if equal(updated[i], document) {
+			continue
+		}
+
+		if err := uniqueKeyError(mc.indexes[collectionName], updated[i], slices.Delete(slices.Clone(updated), i, i+1)); err != nil {
+			return 0, err
+		}
+
+		modified++
+	}
+
+	mc.collections[collectionName] = updated
+	return modified, nil
+}
+
+// DeleteMany deletes every document matching the filter and returns the number of deleted documents
+func (mc *MemoryClient) DeleteMany(ctx context.Context, collectionName string, filter map[string]any) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	query, err := toDocument(filter)
+
+	if err != nil {
+		return 0, fmt.Errorf("error converting filter: %v", err)
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	kept := []bson.D{}
+
+	for _, document := range mc.collections[collectionName] {
+		ok, err := matches(document, query)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if !ok {
+			kept = append(kept, document)
+		}
+	}
+
+	deleted := int64(len(mc.collections[collectionName]) - len(kept))
+
+	if _, ok := mc.collections[collectionName]; ok {
+		mc.collections[collectionName] = kept
+	}
+
+	return deleted, nil
+}
+
+// DescribeCollection finds the collection with the validator and indexes recorded for it
+func (mc *MemoryClient) DescribeCollection(ctx context.Context, collectionName string) (CollectionState, error) {
+	if err := ctx.Err(); err != nil {
+		return CollectionState{}, err
+	}
+
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+	_, exists := mc.collections[collectionName]
+
+	state := CollectionState{
+		Exists:    exists,
+		Validator: mc.validators[collectionName],
+		Indexes:   slices.Clone(mc.indexes[collectionName]),
+	}
+
+	if timeSeries, ok := mc.timeSeries[collectionName]; ok {
+		state.TimeSeries = &timeSeries
+	}
+
+	return state, nil
+}
+
+// CreateTimeSeriesCollection creates a new empty collection with the time-series options unless a collection with the name already exists
+// the documents are kept like in any other collection, the options are only recorded
+func (mc *MemoryClient) CreateTimeSeriesCollection(ctx context.Context, collectionName string, timeSeries TimeSeriesSpec) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if _, ok := mc.collections[collectionName]; !ok {
+		mc.collections[collectionName] = []bson.D{}
+		mc.timeSeries[collectionName] = timeSeries
+	}
+
+	return nil
+}
+
+// CreateIndexes records the indexes and creates the collection if needed, replacing the indexes with the same name
+// the indexes are not used by queries and expirations are not enforced, unique indexes fail the writes of duplicate keys
+func (mc *MemoryClient) CreateIndexes(ctx context.Context, collectionName string, indexes []IndexSpec) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if _, ok := mc.collections[collectionName]; !ok {
+		mc.collections[collectionName] = []bson.D{}
+	}
+
+	for _, index := range indexes {
+		mc.indexes[collectionName] = slices.DeleteFunc(mc.indexes[collectionName], func(existing IndexSpec) bool {
+			return existing.IndexName() == index.IndexName()
+		})
+
+		mc.indexes[collectionName] = append(mc.indexes[collectionName], index)
+	}
+
+	return nil
+}
+
+// SetValidator records the validator of the collection, documents are not validated
+func (mc *MemoryClient) SetValidator(ctx context.Context, collectionName string, validator map[string]any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	mc.validators[collectionName] = validator
+	return nil
+}
+
+// upsertID returns the _id of a document inserted by an upsert, taken from an equality on _id in the filter or a new object id like in mongodb
+func upsertID(query bson.D) any {
+	id, ok := field(query, "_id")
+
+	if _, isOperator := id.(bson.D); !ok || isOperator {
+		return bson.NewObjectID()
+	}
+
+	return id
+}
+
+// withID returns a copy of the document with the _id as its first field
+func withID(document bson.D, id any) bson.D {
+	result := bson.D{{Key: "_id", Value: id}}
+
+	for _, element := range document {
+		if element.Key != "_id" {
+			result = append(result, element)
+		}
+	}
+
+	return result
+}
+
+// toDocument converts a value to a document by round tripping it through bson, so structs are stored with their bson field names
+func toDocument(value any) (bson.D, error) {
+	if value == nil {
+		return bson.D{}, nil
+	}
+
+	raw, err := bson.Marshal(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	document := bson.D{}
+
+	if err := bson.Unmarshal(raw, &document); err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+// toStages converts the stages of an aggregation pipeline to documents
+func toStages(pipeline []map[string]any) ([]bson.D, error) {
+	stages := []bson.D{}
+
+	for _, stage := range pipeline {
+		document, err := toDocument(stage)
+
+		if err != nil {
+			return nil, fmt.Errorf("error converting pipeline stage: %v", err)
+		}
+
+		stages = append(stages, document)
+	}
+
+	return stages, nil
+}
+
+// toCursor returns a cursor over the documents
+func toCursor(documents []bson.D) (*mongo.Cursor, error) {
+	results := make([]any, 0, len(documents))
+
+	for _, document := range documents {
+		results = append(results, document)
+	}
+
+	return mongo.NewCursorFromDocuments(results, nil, nil)
+}
+
+// duplicateKeyError fails the insert of a document with the _id of an existing document, with the message of mongodb
+func duplicateKeyError(id any) error {
+	return fmt.Errorf("E11000 duplicate key error, dup key: { _id: %v }", id)
+}
+
+// uniqueKeyError fails the write of a document with the key of one of the other documents under a unique index, with the message of mongodb
+// only the documents matching the partial filter of an index are indexed, and a missing field is indexed as null like in mongodb
+func uniqueKeyError(indexes []IndexSpec, document bson.D, others []bson.D) error {
+	for _, index := range indexes {
+		if !index.Unique {
+			continue
+		}
+
+		ok, err := indexed(index, document)
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		key := uniqueKey(index, document)
+
+		for _, other := range others {
+			ok, err := indexed(index, other)
+
+			if err != nil {
+				return err
+			}
+
+			if ok && equal(uniqueKey(index, other), key) {
+				return fmt.Errorf("E11000 duplicate key error, index: %s dup key: %v", index.IndexName(), key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// indexed checks if the document matches the partial filter of the index, every document matches an index without one
+func indexed(index IndexSpec, document bson.D) (bool, error) {
+	if len(index.PartialFilter) == 0 {
+		return true, nil
+	}
+
+	filter, err := toDocument(index.PartialFilter)
+
+	if err != nil {
+		return false, fmt.Errorf("error converting the partial filter of index '%s': %v", index.IndexName(), err)
+	}
+
+	return matches(document, filter)
+}
+
+// uniqueKey returns the values of the fields of the index in the document, null for a missing field
+func uniqueKey(index IndexSpec, document bson.D) bson.D {
+	values := bson.D{}
+
+	for _, key := range index.Keys {
+		values = append(values, bson.E{Key: key.Field, Value: first(lookup(document, key.Field))})
+	}
+
+	return values
+}
+
+// CreateMemoryClient creates a new in-memory db client without any collections
+func CreateMemoryClient() *MemoryClient {
+	return &MemoryClient{
+		mutex:       &sync.RWMutex{},
+		collections: map[string][]bson.D{},
+		indexes:     map[string][]IndexSpec{},
+		validators:  map[string]map[string]any{},
+		timeSeries:  map[string]TimeSeriesSpec{},
+	}
+}
@@ -0,0 +1,463 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	migrationLockID      = "lock"
+	migrationLockTTL     = 10 * time.Minute
+	migrationLockRetry   = time.Second
+	migrationLockRenewal = migrationLockTTL / 5
+)
+
+// ErrIrreversibleMigration is returned when rolling back a migration without a down function
+var ErrIrreversibleMigration = errors.New("migration can not be rolled back")
+
+// Migration changes the data of a service from the previous version to its version with up, and back with down
+// migrations should be safe to run again, since a migration which fails is not recorded and runs again the next time
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, client DBClient) error
+	Down        func(ctx context.Context, client DBClient) error
+}
+
+// MigrationStatus is a migration with whether and when it was applied, a migration applied by another version of the service may be unknown to this one
+type MigrationStatus struct {
+	Version     int
+	Description string
+	Applied     bool
+	AppliedAt   int64
+	Unknown     bool
+}
+
+// migrationRecord is an applied migration, stored in the migrations collection under its version
+type migrationRecord struct {
+	Version     int    `bson:"_id"`
+	Description string `bson:"description"`
+	AppliedAt   int64  `bson:"appliedAt"`
+}
+
+// migrationLock is held by the replica running migrations, it expires so a crashed replica does not block the others forever
+type migrationLock struct {
+	ID        string `bson:"_id"`
+	Owner     string `bson:"owner"`
+	ExpiresAt int64  `bson:"expiresAt"`
+}
+
+// Migrator runs the migrations of a service in the order of their versions and records the applied ones in a collection
+// a lock document in the same collection makes sure only one replica runs migrations at a time
+type Migrator struct {
+	client     DBClient
+	collection string
+	migrations []Migration
+	owner      string
+	renewal    time.Duration
+}
+
+// Status lists every known or applied migration ordered by version
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+
+	for _, migration := range m.migrations {
+		record, ok := applied[migration.Version]
+		statuses = append(statuses, MigrationStatus{Version: migration.Version, Description: migration.Description, Applied: ok, AppliedAt: record.AppliedAt})
+		delete(applied, migration.Version)
+	}
+
+	for _, record := range applied {
+		statuses = append(statuses, MigrationStatus{Version: record.Version, Description: record.Description, Applied: true, AppliedAt: record.AppliedAt, Unknown: true})
+	}
+
+	slices.SortFunc(statuses, func(a, b MigrationStatus) int { return a.Version - b.Version })
+	return statuses, nil
+}
+
+// Up applies the pending migrations up to the target version, every pending migration if the target is 0, and returns the applied migrations
+// a dry run returns the migrations which would be applied without applying them or taking the lock
+func (m *Migrator) Up(ctx context.Context, target int, dryRun bool) ([]Migration, error) {
+	return m.run(ctx, dryRun, func(applied map[int]migrationRecord) ([]Migration, error) {
+		pending := []Migration{}
+
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && (target <= 0 || migration.Version <= target) {
+				pending = append(pending, migration)
+			}
+		}
+
+		return pending, nil
+	}, m.up)
+}
+
+// Down rolls back the applied migrations above the target version, newest first, and returns the rolled back migrations
+// it fails before rolling back anything if one of them is unknown or has no down function, a dry run returns the migrations which would be rolled back
+func (m *Migrator) Down(ctx context.Context, target int, dryRun bool) ([]Migration, error) {
+	return m.run(ctx, dryRun, func(applied map[int]migrationRecord) ([]Migration, error) {
+		rollback := []Migration{}
+
+		for version := range applied {
+			if version <= target {
+				continue
+			}
+
+			i := slices.IndexFunc(m.migrations, func(migration Migration) bool { return migration.Version == version })
+
+			if i < 0 {
+				return nil, fmt.Errorf("migration %d was applied by another version of the service and is unknown", version)
+			}
+
+			if m.migrations[i].Down == nil {
+				return nil, fmt.Errorf("%w: migration %d '%s'", ErrIrreversibleMigration, version, m.migrations[i].Description)
+			}
+
+			rollback = append(rollback, m.migrations[i])
+		}
+
+		slices.SortFunc(rollback, func(a, b Migration) int { return b.Version - a.Version })
+		return rollback, nil
+	}, m.down)
+}
+
+// run plans the migrations from the applied ones and runs each of them while holding the lock, the plan is made again once the lock is taken
+// the lock is renewed from a ticker while the migrations run, and they are canceled if it was taken over by another replica
+func (m *Migrator) run(ctx context.Context, dryRun bool, plan func(applied map[int]migrationRecord) ([]Migration, error), apply func(ctx context.Context, migration Migration) error) ([]Migration, error) {
+	if dryRun {
+		applied, err := m.applied(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return plan(applied)
+	}
+
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+
+	defer m.unlock()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go m.keepLock(ctx, cancel)
+	applied, err := m.applied(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := plan(applied)
+
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+
+	for _, migration := range migrations {
+		if err := m.renew(ctx); err != nil {
+			return done, err
+		}
+
+		if err := apply(ctx, migration); err != nil {
+			if ctx.Err() != nil {
+				err = context.Cause(ctx)
+			}
+
+			return done, fmt.Errorf("migration %d '%s' failed: %w", migration.Version, migration.Description, err)
+		}
+
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+// up applies the migration and records it
+func (m *Migrator) up(ctx context.Context, migration Migration) error {
+	log.Printf("applying migration %d '%s'\n", migration.Version, migration.Description)
+
+	if migration.Up != nil {
+		if err := migration.Up(ctx, m.client); err != nil {
+			return err
+		}
+	}
+
+	record := migrationRecord{Version: migration.Version, Description: migration.Description, AppliedAt: time.Now().UnixMilli()}
+	return m.client.SaveOrReplaceDocument(ctx, m.collection, record, map[string]any{"_id": migration.Version})
+}
+
+// down rolls back the migration and removes its record
+func (m *Migrator) down(ctx context.Context, migration Migration) error {
+	log.Printf("rolling back migration %d '%s'\n", migration.Version, migration.Description)
+
+	if err := migration.Down(ctx, m.client); err != nil {
+		return err
+	}
+
+	_, err := m.client.DeleteDocument(ctx, m.collection, map[string]any{"_id": migration.Version})
+	return err
+}
+
+// applied returns the records of the applied migrations by version
+func (m *Migrator) applied(ctx context.Context) (map[int]migrationRecord, error) {
+	cursor, err := m.client.Find(ctx, m.collection, map[string]any{"appliedAt": map[string]any{"$exists": true}}, nil, nil, 0, 0)
+
+	if err != nil {
+		return nil, fmt.Errorf("error finding applied migrations: %w", err)
+	}
+
+	records := []migrationRecord{}
+
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("error decoding applied migrations: %w", err)
+	}
+
+	applied := map[int]migrationRecord{}
+
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+
+	return applied, nil
+}
+
+// lock takes the migration lock, waiting while another replica holds it, an expired lock is taken over
+// inserting the lock document fails with a duplicate key while it exists, so only one replica can take it
+func (m *Migrator) lock(ctx context.Context) error {
+	for {
+		result, err := m.client.InsertMany(ctx, m.collection, []any{m.lockDocument()}, true)
+
+		if err != nil {
+			return fmt.Errorf("error taking the migration lock: %w", err)
+		}
+
+		if result.Inserted == 1 {
+			return nil
+		}
+
+		expired := map[string]any{"_id": migrationLockID, "expiresAt": map[string]any{"$lt": time.Now().UnixMilli()}}
+		deleted, err := m.client.DeleteMany(ctx, m.collection, expired)
+
+		if err != nil {
+			return fmt.Errorf("error taking over the expired migration lock: %w", err)
+		}
+
+		if deleted > 0 {
+			log.Println("took over the expired migration lock of another replica")
+			continue
+		}
+
+		log.Println("waiting for another replica to finish its migrations")
+		timer := time.NewTimer(migrationLockRetry)
+
+		select {
+		case <-timer.C:
+
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// keepLock renews the migration lock every renewal interval until the context is done, so migrations running longer than the lock ttl keep it
+// if renewing fails the migrations are canceled with the error as the cause
+func (m *Migrator) keepLock(ctx context.Context, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(m.renewal)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.renew(ctx); err != nil {
+				cancel(err)
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// renew extends the migration lock before every migration and while it runs, and fails if another replica took it over
+func (m *Migrator) renew(ctx context.Context) error {
+	filter := map[string]any{"_id": migrationLockID, "owner": m.owner}
+	update := map[string]any{"$set": map[string]any{"expiresAt": m.lockDocument().ExpiresAt}}
+
+	if _, err := m.client.UpdateMany(ctx, m.collection, filter, update); err != nil {
+		return fmt.Errorf("error renewing the migration lock: %w", err)
+	}
+
+	count, err := m.client.Count(ctx, m.collection, filter)
+
+	if err != nil {
+		return fmt.Errorf("error checking the migration lock: %w", err)
+	}
+
+	if count == 0 {
+		return errors.New("the migration lock expired and was taken over by another replica")
+	}
+
+	return nil
+}
+
+// unlock releases the migration lock unless another replica took it over, it uses a context of its own so the lock is released even if the migrations were canceled
+func (m *Migrator) unlock() {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	if _, err := m.client.DeleteMany(ctx, m.collection, map[string]any{"_id": migrationLockID, "owner": m.owner}); err != nil {
+		log.Printf("error releasing the migration lock, it expires in %v: %v\n", migrationLockTTL, err)
+	}
+}
+
+// lockDocument returns the lock of this migrator expiring after the lock ttl
+func (m *Migrator) lockDocument() migrationLock {
+	return migrationLock{ID: migrationLockID, Owner: m.owner, ExpiresAt: time.Now().Add(migrationLockTTL).UnixMilli()}
+}
+
+// RunMigrationCommand runs a migration command with its arguments and writes its output
+// the commands are list, up [-target version] [-dry-run] and down [-target version] [-dry-run], down rolls back the latest migration without a target
+func RunMigrationCommand(ctx context.Context, migrator *Migrator, args []string, output io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("expected a migration command: list, up or down")
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(output)
+	target := flags.Int("target", -1, "version to migrate to, every pending migration for up and the previous version for down by default")
+	dryRun := flags.Bool("dry-run", false, "print the migrations without running them")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	statuses, err := migrator.Status(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	var migrations []Migration
+
+	switch args[0] {
+	case "list":
+		writer := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "VERSION\tSTATUS\tAPPLIED AT\tDESCRIPTION")
+
+		for _, status := range statuses {
+			state, appliedAt := "pending", "-"
+
+			if status.Applied {
+				state, appliedAt = "applied", time.UnixMilli(status.AppliedAt).UTC().Format(time.RFC3339)
+			}
+
+			if status.Unknown {
+				state += " (unknown)"
+			}
+
+			fmt.Fprintf(writer, "%d\t%s\t%s\t%s\n", status.Version, state, appliedAt, status.Description)
+		}
+
+		return writer.Flush()
+
+	case "up":
+		migrations, err = migrator.Up(ctx, max(*target, 0), *dryRun)
+
+	case "down":
+		if *target < 0 {
+			*target = previousVersion(statuses)
+		}
+
+		migrations, err = migrator.Down(ctx, *target, *dryRun)
+
+	default:
+		return fmt.Errorf("unknown migration command '%s', expected list, up or down", args[0])
+	}
+
+	action := "ran"
+
+	if *dryRun {
+		action = "would run"
+	}
+
+	for _, migration := range migrations {
+		fmt.Fprintf(output, "%s %s of migration %d '%s'\n", action, args[0], migration.Version, migration.Description)
+	}
+
+	if err == nil && len(migrations) == 0 {
+		fmt.Fprintln(output, "nothing to migrate")
+	}
+
+	return err
+}
+
+// previousVersion returns the version of the latest applied migration but one, 0 if at most one migration was applied
+func previousVersion(statuses []MigrationStatus) int {
+	versions := []int{}
+
+	for _, status := range statuses {
+		if status.Applied {
+			versions = append(versions, status.Version)
+		}
+	}
+
+	if len(versions) < 2 {
+		return 0
+	}
+
+	return versions[len(versions)-2]
+}
+
+// CreateMigrator creates a migrator of the migrations recording them in the collection, the versions must be positive and unique
+func CreateMigrator(client DBClient, collectionName string, migrations []Migration) (*Migrator, error) {
+	sorted := slices.Clone(migrations)
+	slices.SortFunc(sorted, func(a, b Migration) int { return a.Version - b.Version })
+
+	for i, migration := range sorted {
+		if migration.Version <= 0 {
+			return nil, fmt.Errorf("migration '%s' has the non-positive version %d", migration.Description, migration.Version)
+		}
+
+		if i > 0 && sorted[i-1].Version == migration.Version {
+			return nil, fmt.Errorf("migrations '%s' and '%s' have the same version %d", sorted[i-1].Description, migration.Description, migration.Version)
+		}
+	}
+
+	return &Migrator{
+		client:     client,
+		collection: collectionName,
+		migrations: sorted,
+		owner:      bson.NewObjectID().Hex(),
+		renewal:    migrationLockRenewal,
+	}, nil
+}
+
+// MustCreateMigrator creates a migrator of the migrations recording them in the collection and panics if it fails
+func MustCreateMigrator(client DBClient, collectionName string, migrations []Migration) *Migrator {
+	migrator, err := CreateMigrator(client, collectionName, migrations)
+
+	if err != nil {
+		log.Fatalf("failed to create migrator: %v\n", err)
+	}
+
+	return migrator
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMigrations returns three migrations which record their runs, the second one can not be rolled back
+func testMigrations(runs *[]string) []Migration {
+	step := func(name string) func(ctx context.Context, client DBClient) error {
+		return func(ctx context.Context, client DBClient) error {
+			*runs = append(*runs, name)
+			return nil
+		}
+	}
+
+	return []Migration{
+		{Version: 3, Description: "third", Up: step("up 3"), Down: step("down 3")},
+		{Version: 1, Description: "first", Up: step("up 1"), Down: step("down 1")},
+		{Version: 2, Description: "second", Up: step("up 2")},
+	}
+}
+
+// versions returns the versions of the migrations
+func versions(migrations []Migration) []int {
+	versions := []int{}
+
+	for _, migration := range migrations {
+		versions = append(versions, migration.Version)
+	}
+
+	return versions
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	client := CreateMemoryClient()
+	runs := []string{}
+	migrator := MustCreateMigrator(client, "migration", testMigrations(&runs))
+
+	if migrations, err := migrator.Up(ctx, 2, true); err != nil || !slices.Equal(versions(migrations), []int{1, 2}) || len(runs) != 0 {
+		t.Errorf("expected a dry run of the first two migrations, got %v, %v, %v", versions(migrations), runs, err)
+	}
+
+	if migrations, err := migrator.Up(ctx, 2, false); err != nil || !slices.Equal(versions(migrations), []int{1, 2}) {
+		t.Errorf("expected the first two migrations to be applied, got %v, %v", versions(migrations), err)
+	}
+
+	if migrations, err := migrator.Up(ctx, 0, false); err != nil || !slices.Equal(versions(migrations), []int{3}) {
+		t.Errorf("expected the pending migration to be applied, got %v, %v", versions(migrations), err)
+	}
+
+	if !slices.Equal(runs, []string{"up 1", "up 2", "up 3"}) {
+		t.Errorf("expected every migration to run once in order, got %v", runs)
+	}
+
+	if migrations, err := migrator.Down(ctx, 0, false); !errors.Is(err, ErrIrreversibleMigration) || len(migrations) != 0 {
+		t.Errorf("expected rolling back the irreversible migration to fail, got %v, %v", versions(migrations), err)
+	}
+
+	if migrations, err := migrator.Down(ctx, 2, false); err != nil || !slices.Equal(versions(migrations), []int{3}) {
+		t.Errorf("expected the third migration to be rolled back, got %v, %v", versions(migrations), err)
+	}
+
+	statuses, err := migrator.Status(ctx)
+	applied := []bool{}
+
+	for _, status := range statuses {
+		applied = append(applied, status.Applied)
+	}
+
+	if err != nil || !slices.Equal(applied, []bool{true, true, false}) {
+		t.Errorf("expected the first two migrations to be applied, got %+v, %v", statuses, err)
+	}
+
+	newer := MustCreateMigrator(client, "migration", []Migration{{Version: 1, Description: "first"}})
+
+	if statuses, err := newer.Status(ctx); err != nil || len(statuses) != 2 || !statuses[1].Unknown {
+		t.Errorf("expected the migration applied by another version to be unknown, got %+v, %v", statuses, err)
+	}
+
+	if _, err := CreateMigrator(client, "migration", []Migration{{Version: 1}, {Version: 1}}); err == nil {
+		t.Errorf("expected an error for duplicate versions")
+	}
+}
+
+func TestMigratorLock(t *testing.T) {
+	ctx := context.Background()
+	client := CreateMemoryClient()
+	runs := []string{}
+	migrator := MustCreateMigrator(client, "migration", testMigrations(&runs))
+	other := MustCreateMigrator(client, "migration", testMigrations(&runs))
+
+	if err := other.lock(ctx); err != nil {
+		t.Fatalf("failed to take the lock: %v", err)
+	}
+
+	waiting, cancel := context.WithTimeout(ctx, 1500*time.Millisecond)
+	defer cancel()
+
+	if _, err := migrator.Up(waiting, 0, false); !errors.Is(err, context.DeadlineExceeded) || len(runs) != 0 {
+		t.Errorf("expected the migrations to wait for the lock of the other replica, got %v, %v", runs, err)
+	}
+
+	if _, err := client.UpdateMany(ctx, "migration", map[string]any{"_id": migrationLockID}, map[string]any{"$set": map[string]any{"expiresAt": 0}}); err != nil {
+		t.Fatalf("failed to expire the lock: %v", err)
+	}
+
+	if migrations, err := migrator.Up(ctx, 0, false); err != nil || len(migrations) != 3 {
+		t.Errorf("expected the expired lock to be taken over, got %v, %v", versions(migrations), err)
+	}
+
+	if count, err := client.Count(ctx, "migration", map[string]any{"_id": migrationLockID}); err != nil || count != 0 {
+		t.Errorf("expected the lock to be released, got %d, %v", count, err)
+	}
+}
+
+func TestMigratorLockRenewal(t *testing.T) {
+	ctx := context.Background()
+	client := CreateMemoryClient()
+	renewed := false
+
+	migrator := MustCreateMigrator(client, "migration", []Migration{{Version: 1, Description: "slow", Up: func(ctx context.Context, client DBClient) error {
+		lock := map[string]any{"_id": migrationLockID}
+
+		if _, err := client.UpdateMany(ctx, "migration", lock, map[string]any{"$set": map[string]any{"expiresAt": 0}}); err != nil {
+			return err
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		count, err := client.Count(ctx, "migration", map[string]any{"_id": migrationLockID, "expiresAt": map[string]any{"$gt": 0}})
+
+		if err != nil {
+			return err
+		}
+
+		renewed = count == 1
+
+		if _, err := client.UpdateMany(ctx, "migration", lock, map[string]any{"$set": map[string]any{"owner": "other"}}); err != nil {
+			return err
+		}
+
+		<-ctx.Done()
+		return ctx.Err()
+	}}})
+
+	migrator.renewal = 10 * time.Millisecond
+	waiting, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if migrations, err := migrator.Up(waiting, 0, false); err == nil || !strings.Contains(err.Error(), "taken over") || len(migrations) != 0 {
+		t.Errorf("expected the migration to be canceled once the lock was taken over, got %v, %v", versions(migrations), err)
+	}
+
+	if !renewed {
+		t.Errorf("expected the lock to be renewed while the migration runs")
+	}
+}
+
+func TestRunMigrationCommand(t *testing.T) {
+	ctx := context.Background()
+	runs := []string{}
+	migrator := MustCreateMigrator(CreateMemoryClient(), "migration", testMigrations(&runs))
+
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"up", "-dry-run"}, []string{"would run up of migration 1 'first'", "would run up of migration 3 'third'"}},
+		{[]string{"up", "-target", "1"}, []string{"ran up of migration 1 'first'"}},
+		{[]string{"list"}, []string{"VERSION", "1        applied", "2        pending", "third"}},
+		{[]string{"down"}, []string{"ran down of migration 1 'first'"}},
+		{[]string{"down"}, []string{"nothing to migrate"}},
+	}
+
+	for _, test := range tests {
+		output := bytes.Buffer{}
+
+		if err := RunMigrationCommand(ctx, migrator, test.args, &output); err != nil {
+			t.Errorf("%v: unexpected error %v", test.args, err)
+		}
+
+		for _, expected := range test.expected {
+			if !strings.Contains(output.String(), expected) {
+				t.Errorf("%v: expected output containing '%s', got %s", test.args, expected, output.String())
+			}
+		}
+	}
+
+	if err := RunMigrationCommand(ctx, migrator, []string{"sideways"}, &bytes.Buffer{}); err == nil {
+		t.Errorf("expected an error for an unknown command")
+	}
+}
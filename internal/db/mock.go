@@ -1,64 +1,342 @@
 package db
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
+	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
 type MockDBClient struct {
+	mutex     *sync.Mutex
 	responses map[string][]any
+	settings  *mockSettings
 }
 
-func (m MockDBClient) Disconnect() error {
-	return nil
+type mockSettings struct {
+	latency     time.Duration
+	timeouts    Timeouts
+	collections map[string]CollectionState
+}
+
+func (m MockDBClient) Disconnect(ctx context.Context) error {
+	return m.wait(ctx, OperationDisconnect)
 }
 
-func (m MockDBClient) CreateCollection(collectionName string) error {
+func (m MockDBClient) CreateCollection(ctx context.Context, collectionName string) error {
+	if err := m.wait(ctx, OperationCreateCollection); err != nil {
+		return err
+	}
+
+	m.updateCollection(collectionName, func(state *CollectionState) {})
 	return nil
 }
 
-func (m MockDBClient) MustCreateCollection(collectionName string) {
+func (m MockDBClient) MustCreateCollection(ctx context.Context, collectionName string) {
 	// No-op for mock
 }
 
-func (m MockDBClient) SaveOrReplaceDocument(collectionName string, document any, filter map[string]any) error {
+func (m MockDBClient) SaveOrReplaceDocument(ctx context.Context, collectionName string, document any, filter map[string]any) error {
+	if err := m.wait(ctx, OperationSave); err != nil {
+		return err
+	}
+
 	m.SetResponse(collectionName, filter, nil, nil, 0, 0, []any{document})
 	return nil
 }
 
-func (m MockDBClient) CreateIndex(collectionName, field string, sort int) error {
-	return nil
+func (m MockDBClient) DeleteDocument(ctx context.Context, collectionName string, filter map[string]any) (bool, error) {
+	if err := m.wait(ctx, OperationDelete); err != nil {
+		return false, err
+	}
+
+	key := generateKey(collectionName, filter, nil, nil, 0, 0)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.responses[key]
+	delete(m.responses, key)
+
+	return ok, nil
+}
+
+func (m MockDBClient) CreateIndex(ctx context.Context, collectionName, field string, sort int) error {
+	return m.wait(ctx, OperationCreateIndex)
 }
 
-func (m MockDBClient) MustCreateIndex(collectionName, field string, sort int) {
+func (m MockDBClient) MustCreateIndex(ctx context.Context, collectionName, field string, sort int) {
 	// No-op for mock
 }
 
-func (m MockDBClient) Create2dSphereIndex(collectionName, field string) error {
-	return nil
+func (m MockDBClient) Create2dSphereIndex(ctx context.Context, collectionName, field string) error {
+	return m.wait(ctx, OperationCreateIndex)
 }
 
-func (m MockDBClient) MustCreate2dSphereIndex(collectionName, field string) {
+func (m MockDBClient) MustCreate2dSphereIndex(ctx context.Context, collectionName, field string) {
 	// No-op for mock
 }
 
-func (m MockDBClient) Find(collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) (*mongo.Cursor, error) {
+func (m MockDBClient) Find(ctx context.Context, collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) (*mongo.Cursor, error) {
+	if err := m.wait(ctx, OperationFind); err != nil {
+		return nil, err
+	}
+
 	return m.GetResponse(collectionName, filter, projection, sort, pageNumber, pageSize), nil
 }
 
+func (m MockDBClient) BulkSaveOrReplace(ctx context.Context, collectionName string, models []ReplaceModel, ordered bool) (BulkResult, error) {
+	if err := m.wait(ctx, OperationBulkWrite); err != nil {
+		return BulkResult{}, err
+	}
+
+	result := BulkResult{}
+
+	for _, model := range models {
+		key := generateKey(collectionName, model.Filter, nil, nil, 0, 0)
+		m.mutex.Lock()
+		_, ok := m.responses[key]
+		m.responses[key] = []any{model.Document}
+		m.mutex.Unlock()
+
+		if ok {
+			result.Matched++
+
+		} else {
+			result.Upserted++
+		}
+	}
+
+	return result, nil
+}
+
+func (m MockDBClient) InsertMany(ctx context.Context, collectionName string, documents []any, ordered bool) (BulkResult, error) {
+	if err := m.wait(ctx, OperationBulkWrite); err != nil {
+		return BulkResult{}, err
+	}
+
+	result := BulkResult{}
+
+	for i, document := range documents {
+		inserted, err := toDocument(document)
+
+		if err != nil {
+			result.Errors = append(result.Errors, BulkError{Index: i, Message: err.Error()})
+
+			if ordered {
+				break
+			}
+
+			continue
+		}
+
+		id, ok := field(inserted, "_id")
+
+		if !ok {
+			id = bson.NewObjectID()
+		}
+
+		m.SetResponse(collectionName, map[string]any{"_id": id}, nil, nil, 0, 0, []any{document})
+		result.Inserted++
+	}
+
+	return result, nil
+}
+
+func (m MockDBClient) Aggregate(ctx context.Context, collectionName string, pipeline []map[string]any) (*mongo.Cursor, error) {
+	if err := m.wait(ctx, OperationAggregate); err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	documents := m.responses[generateAggregateKey(collectionName, pipeline)]
+	m.mutex.Unlock()
+
+	return mongo.NewCursorFromDocuments(documents, nil, nil)
+}
+
+func (m MockDBClient) Count(ctx context.Context, collectionName string, filter map[string]any) (int64, error) {
+	if err := m.wait(ctx, OperationCount); err != nil {
+		return 0, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return int64(len(m.responses[generateKey(collectionName, filter, nil, nil, 0, 0)])), nil
+}
+
+func (m MockDBClient) UpdateMany(ctx context.Context, collectionName string, filter, update map[string]any) (int64, error) {
+	if err := m.wait(ctx, OperationUpdate); err != nil {
+		return 0, err
+	}
+
+	operators, err := toDocument(update)
+
+	if err != nil {
+		return 0, fmt.Errorf("error converting update: %v", err)
+	}
+
+	key := generateKey(collectionName, filter, nil, nil, 0, 0)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	modified := int64(0)
+
+	for i, document := range m.responses[key] {
+		existing, err := toDocument(document)
+
+		if err != nil {
+			return 0, fmt.Errorf("error converting document: %v", err)
+		}
+
+		updated, err := applyUpdate(existing, operators)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if !equal(updated, existing) {
+			m.responses[key][i] = updated
+			modified++
+		}
+	}
+
+	return modified, nil
+}
+
+func (m MockDBClient) DeleteMany(ctx context.Context, collectionName string, filter map[string]any) (int64, error) {
+	if err := m.wait(ctx, OperationDelete); err != nil {
+		return 0, err
+	}
+
+	key := generateKey(collectionName, filter, nil, nil, 0, 0)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	deleted := int64(len(m.responses[key]))
+	delete(m.responses, key)
+
+	return deleted, nil
+}
+
+func (m MockDBClient) DescribeCollection(ctx context.Context, collectionName string) (CollectionState, error) {
+	if err := m.wait(ctx, OperationCreateCollection); err != nil {
+		return CollectionState{}, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.settings.collections[collectionName], nil
+}
+
+func (m MockDBClient) CreateTimeSeriesCollection(ctx context.Context, collectionName string, timeSeries TimeSeriesSpec) error {
+	if err := m.wait(ctx, OperationCreateCollection); err != nil {
+		return err
+	}
+
+	m.updateCollection(collectionName, func(state *CollectionState) {
+		state.TimeSeries = &timeSeries
+	})
+
+	return nil
+}
+
+func (m MockDBClient) CreateIndexes(ctx context.Context, collectionName string, indexes []IndexSpec) error {
+	if err := m.wait(ctx, OperationCreateIndex); err != nil {
+		return err
+	}
+
+	m.updateCollection(collectionName, func(state *CollectionState) {
+		state.Indexes = append(state.Indexes, indexes...)
+	})
+
+	return nil
+}
+
+func (m MockDBClient) SetValidator(ctx context.Context, collectionName string, validator map[string]any) error {
+	if err := m.wait(ctx, OperationCreateCollection); err != nil {
+		return err
+	}
+
+	m.updateCollection(collectionName, func(state *CollectionState) {
+		state.Validator = validator
+	})
+
+	return nil
+}
+
+// SetCollection sets the state of a collection described by the mock, so tests can exercise schema drift
+func (m MockDBClient) SetCollection(collectionName string, state CollectionState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.settings.collections[collectionName] = state
+}
+
+// updateCollection creates the collection if needed and updates its state
+func (m MockDBClient) updateCollection(collectionName string, update func(state *CollectionState)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	state := m.settings.collections[collectionName]
+	state.Exists = true
+	update(&state)
+	m.settings.collections[collectionName] = state
+}
+
+// SetLatency sets how long every operation takes, so tests can exercise cancellations and timeouts
+func (m MockDBClient) SetLatency(latency time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.settings.latency = latency
+}
+
+// SetTimeouts sets the default and per-operation timeouts applied to every operation, by default operations have no timeout
+func (m MockDBClient) SetTimeouts(timeouts Timeouts) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.settings.timeouts = timeouts
+}
+
+// wait simulates the latency of an operation and fails like the mongodb client if the context ends or the timeout of the operation elapses first
+func (m MockDBClient) wait(ctx context.Context, operation Operation) error {
+	m.mutex.Lock()
+	latency, timeouts := m.settings.latency, m.settings.timeouts
+	m.mutex.Unlock()
+	ctx, cancel := timeouts.WithTimeout(ctx, operation)
+	defer cancel()
+
+	if latency <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(latency)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // SetResponse sets the response for the given collection name, filter, projection, sort, page number, and page size
 func (m MockDBClient) SetResponse(collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int, result []any) {
-	m.responses[generateKey(collectionName, filter, projection, sort, pageNumber, pageSize)] = result
+	key := generateKey(collectionName, filter, projection, sort, pageNumber, pageSize)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.responses[key] = result
 }
 
 // GetResponse retrieves the response for the given collection name, filter, projection, sort, page number, and page size
 func (m MockDBClient) GetResponse(collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) *mongo.Cursor {
 	key := generateKey(collectionName, filter, projection, sort, pageNumber, pageSize)
-	cursor, err := mongo.NewCursorFromDocuments(m.responses[key], nil, nil)
+	m.mutex.Lock()
+	documents := m.responses[key]
+	m.mutex.Unlock()
+	cursor, err := mongo.NewCursorFromDocuments(documents, nil, nil)
 
 	if err != nil {
 		log.Fatalf("failed to create cursor for collection '%s', filter '%v', projection '%v' and sort '%v': %v", collectionName, filter, projection, sort, err)
@@ -67,6 +345,34 @@ func (m MockDBClient) GetResponse(collectionName string, filter, projection, sor
 	return cursor
 }
 
+// SetAggregateResponse sets the response for the given collection name and aggregation pipeline
+func (m MockDBClient) SetAggregateResponse(collectionName string, pipeline []map[string]any, result []any) {
+	key := generateAggregateKey(collectionName, pipeline)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.responses[key] = result
+}
+
+// generateAggregateKey generates a unique key for the given collection name and aggregation pipeline
+func generateAggregateKey(collectionName string, pipeline []map[string]any) string {
+	jsonAsString, err := json.Marshal(map[string]any{
+		"collectionName": collectionName,
+		"pipeline":       pipeline,
+	})
+
+	if err != nil {
+		log.Fatalf("failed to generate key for collection '%s' and pipeline '%v': %v", collectionName, pipeline, err)
+	}
+
+	key, err := hashJSON(jsonAsString)
+
+	if err != nil {
+		log.Fatalf("failed to hash JSON for collection '%s' and pipeline '%v': %v", collectionName, pipeline, err)
+	}
+
+	return key
+}
+
 // generateKey generates a unique key for the given collection name, filter, projection, sort, page number, and page size
 func generateKey(collectionName string, filter, projection, sort map[string]any, pageNumber, pageSize int) string {
 	jsonAsString, err := json.Marshal(map[string]any{
@@ -112,6 +418,8 @@ func hashJSON(input []byte) (string, error) {
 // CreateMockDBClient creates a new mock db client
 func CreateMockDBClient() MockDBClient {
 	return MockDBClient{
+		mutex:     &sync.Mutex{},
 		responses: map[string][]any{},
+		settings:  &mockSettings{collections: map[string]CollectionState{}},
 	}
 }
@@ -0,0 +1,750 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// matches evaluates a mongodb filter against a document without a database
+// supported are equality, $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $and, $or, $nor and on geojson points $near, $nearSphere, $geoWithin and $geoIntersects
+// like in mongodb, a condition on an array field matches if any of its elements matches, and dotted paths reach into embedded documents
+func matches(document bson.D, filter bson.D) (bool, error) {
+	for _, element := range filter {
+		ok, err := matchesElement(document, element)
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchesElement evaluates a single top level element of a filter, either a logical operator or the condition of a field
+func matchesElement(document bson.D, element bson.E) (bool, error) {
+	switch element.Key {
+	case "$and", "$or", "$nor":
+		filters, ok := element.Value.(bson.A)
+
+		if !ok || len(filters) == 0 {
+			return false, fmt.Errorf("%s expects a non-empty array of filters", element.Key)
+		}
+
+		matched := 0
+
+		for _, value := range filters {
+			filter, ok := value.(bson.D)
+
+			if !ok {
+				return false, fmt.Errorf("%s expects a non-empty array of filters", element.Key)
+			}
+
+			ok, err := matches(document, filter)
+
+			if err != nil {
+				return false, err
+			}
+
+			if ok {
+				matched++
+			}
+		}
+
+		switch element.Key {
+		case "$and":
+			return matched == len(filters), nil
+
+		case "$or":
+			return matched > 0, nil
+
+		default:
+			return matched == 0, nil
+		}
+	}
+
+	if strings.HasPrefix(element.Key, "$") {
+		return false, fmt.Errorf("unsupported query operator '%s'", element.Key)
+	}
+
+	values := lookup(document, element.Key)
+	operators, ok := element.Value.(bson.D)
+
+	if !ok || len(operators) == 0 || !strings.HasPrefix(operators[0].Key, "$") {
+		return matchesOperator(values, "$eq", element.Value, operators)
+	}
+
+	for _, operator := range operators {
+		switch operator.Key {
+		case "$maxDistance", "$minDistance":
+			continue
+		}
+
+		ok, err := matchesOperator(values, operator.Key, operator.Value, operators)
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchesOperator evaluates a single operator against the values of a field, the sibling operators are needed for the distance bounds of $near
+func matchesOperator(values []any, operator string, argument any, operators bson.D) (bool, error) {
+	switch operator {
+	case "$eq":
+		return anyElement(values, argument == nil, func(value any) bool { return equal(value, argument) }), nil
+
+	case "$ne":
+		ok, err := matchesOperator(values, "$eq", argument, operators)
+		return !ok, err
+
+	case "$gt", "$gte", "$lt", "$lte":
+		return anyElement(values, false, func(value any) bool {
+			result, ok := compare(value, argument)
+
+			switch operator {
+			case "$gt":
+				return ok && result > 0
+
+			case "$gte":
+				return ok && result >= 0
+
+			case "$lt":
+				return ok && result < 0
+
+			default:
+				return ok && result <= 0
+			}
+		}), nil
+
+	case "$in", "$nin":
+		candidates, ok := argument.(bson.A)
+
+		if !ok {
+			return false, fmt.Errorf("%s expects an array", operator)
+		}
+
+		found := anyElement(values, slices.Contains(candidates, nil), func(value any) bool {
+			return slices.ContainsFunc(candidates, func(candidate any) bool { return equal(value, candidate) })
+		})
+
+		return found == (operator == "$in"), nil
+
+	case "$exists":
+		exists, ok := argument.(bool)
+
+		if !ok {
+			return false, fmt.Errorf("$exists expects a boolean")
+		}
+
+		return (len(values) > 0) == exists, nil
+
+	case "$near", "$nearSphere":
+		center, maxDistance, minDistance, err := nearArguments(operator, argument, operators)
+
+		if err != nil {
+			return false, err
+		}
+
+		return slices.ContainsFunc(values, func(value any) bool {
+			point, ok := toPoint(value)
+
+			if !ok {
+				return false
+			}
+
+			distance := geo.Distance(center, point)
+			return distance <= maxDistance && distance >= minDistance
+		}), nil
+
+	case "$geoWithin":
+		within, err := geoWithin(argument)
+
+		if err != nil {
+			return false, err
+		}
+
+		return slices.ContainsFunc(values, func(value any) bool {
+			point, ok := toPoint(value)
+			return ok && within(point)
+		}), nil
+
+	case "$geoIntersects":
+		arguments, ok := argument.(bson.D)
+		geometry, hasGeometry := field(arguments, "$geometry")
+
+		if !ok || !hasGeometry {
+			return false, fmt.Errorf("$geoIntersects expects a $geometry")
+		}
+
+		for _, value := range values {
+			ok, err := intersects(value, geometry)
+
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+
+		return false, nil
+
+	default:
+		return false, fmt.Errorf("unsupported query operator '%s'", operator)
+	}
+}
+
+// nearArguments extracts the center and the distance bounds in meters of a $near or $nearSphere operator on a geojson point
+func nearArguments(operator string, argument any, operators bson.D) ([]float64, float64, float64, error) {
+	arguments, ok := argument.(bson.D)
+	geometry, hasGeometry := field(arguments, "$geometry")
+	center, isPoint := toPoint(geometry)
+
+	if !ok || !hasGeometry || !isPoint {
+		return nil, 0, 0, fmt.Errorf("%s expects a geojson point as $geometry", operator)
+	}
+
+	maxDistance, minDistance := math.Inf(1), 0.0
+
+	for _, bounds := range []bson.D{arguments, operators} {
+		if value, ok := field(bounds, "$maxDistance"); ok {
+			maxDistance, _ = toNumber(value)
+		}
+
+		if value, ok := field(bounds, "$minDistance"); ok {
+			minDistance, _ = toNumber(value)
+		}
+	}
+
+	return center, maxDistance, minDistance, nil
+}
+
+// geoWithin returns the check of a $geoWithin operator with a geojson polygon or multipolygon as $geometry
+func geoWithin(argument any) (func(point []float64) bool, error) {
+	arguments, ok := argument.(bson.D)
+
+	if !ok {
+		return nil, fmt.Errorf("$geoWithin expects a $geometry")
+	}
+
+	if geometry, ok := field(arguments, "$geometry"); ok {
+		polygons, ok := toPolygons(geometry)
+
+		if !ok {
+			return nil, fmt.Errorf("$geoWithin expects a geojson polygon or multipolygon as $geometry")
+		}
+
+		return func(point []float64) bool { return polygonsContain(polygons, point) }, nil
+	}
+
+	return nil, fmt.Errorf("$geoWithin expects a $geometry")
+}
+
+// intersects checks if a stored geojson point or polygon intersects the geojson point or polygon of a query
+// polygons are only intersected with points, which is all the services need
+func intersects(value, geometry any) (bool, error) {
+	valuePoint, valueIsPoint := toPoint(value)
+	geometryPoint, geometryIsPoint := toPoint(geometry)
+
+	if valueIsPoint && geometryIsPoint {
+		return valuePoint[0] == geometryPoint[0] && valuePoint[1] == geometryPoint[1], nil
+	}
+
+	if valueIsPoint {
+		if polygons, ok := toPolygons(geometry); ok {
+			return polygonsContain(polygons, valuePoint), nil
+		}
+	}
+
+	if geometryIsPoint {
+		if polygons, ok := toPolygons(value); ok {
+			return polygonsContain(polygons, geometryPoint), nil
+		}
+
+		return false, nil
+	}
+
+	return false, fmt.Errorf("$geoIntersects is only supported between points and polygons")
+}
+
+// selectDocuments orders the documents matching a filter like mongodb, by distance for a $near query and then by the sort, and returns the projected documents of the page
+// a page size of 0 returns every document
+func selectDocuments(documents []bson.D, filter bson.D, projection, sort map[string]any, pageNumber, pageSize int) ([]any, error) {
+	if err := sortByNear(documents, filter); err != nil {
+		return nil, err
+	}
+
+	sortDocuments(documents, sort)
+
+	if pageNumber > 1 && pageSize > 0 {
+		documents = documents[min(len(documents), pageSize*(pageNumber-1)):]
+	}
+
+	if pageSize > 0 {
+		documents = documents[:min(len(documents), pageSize)]
+	}
+
+	results := []any{}
+
+	for _, document := range documents {
+		results = append(results, project(document, projection))
+	}
+
+	return results, nil
+}
+
+// sortByNear orders the results of a $near or $nearSphere query by their distance from its center, nearest first
+func sortByNear(documents []bson.D, filter bson.D) error {
+	for _, element := range filter {
+		operators, ok := element.Value.(bson.D)
+
+		if !ok {
+			continue
+		}
+
+		for _, operator := range operators {
+			if operator.Key != "$near" && operator.Key != "$nearSphere" {
+				continue
+			}
+
+			center, _, _, err := nearArguments(operator.Key, operator.Value, operators)
+
+			if err != nil {
+				return err
+			}
+
+			distances := make([]float64, len(documents))
+
+			for i, document := range documents {
+				distances[i] = math.Inf(1)
+
+				for _, value := range lookup(document, element.Key) {
+					if point, ok := toPoint(value); ok {
+						distances[i] = min(distances[i], geo.Distance(center, point))
+					}
+				}
+			}
+
+			order := make([]int, len(documents))
+
+			for i := range order {
+				order[i] = i
+			}
+
+			slices.SortStableFunc(order, func(a, b int) int {
+				return compareNumbers(distances[a], distances[b])
+			})
+
+			sorted := make([]bson.D, len(documents))
+
+			for i, index := range order {
+				sorted[i] = documents[index]
+			}
+
+			copy(documents, sorted)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// sortDocuments sorts the documents stably by the fields of the sort in alphabetical order of their names, 1 ascending and -1 descending
+// values of different types are ordered like in mongodb: missing and null values first, then numbers, strings, documents, arrays and booleans
+func sortDocuments(documents []bson.D, sort map[string]any) {
+	if len(sort) == 0 {
+		return
+	}
+
+	fields := []string{}
+
+	for name := range sort {
+		fields = append(fields, name)
+	}
+
+	slices.Sort(fields)
+
+	slices.SortStableFunc(documents, func(a, b bson.D) int {
+		for _, name := range fields {
+			direction, _ := toNumber(sort[name])
+			result := compareForSort(first(lookup(a, name)), first(lookup(b, name)))
+
+			if direction < 0 {
+				result = -result
+			}
+
+			if result != 0 {
+				return result
+			}
+		}
+
+		return 0
+	})
+}
+
+// project returns the document with only the included fields and the _id, or without the excluded fields, of the top level of the document
+func project(document bson.D, projection map[string]any) bson.D {
+	if len(projection) == 0 {
+		return document
+	}
+
+	include := false
+
+	for name, value := range projection {
+		include = include || (name != "_id" && projectionFlag(value))
+	}
+
+	result := bson.D{}
+
+	for _, element := range document {
+		value, listed := projection[element.Key]
+
+		if listed && !projectionFlag(value) || include && !listed && element.Key != "_id" {
+			continue
+		}
+
+		result = append(result, element)
+	}
+
+	return result
+}
+
+// projectionFlag checks if the value of a projection field includes the field, either as a non-zero number or as true
+func projectionFlag(value any) bool {
+	if flag, ok := value.(bool); ok {
+		return flag
+	}
+
+	number, _ := toNumber(value)
+	return number != 0
+}
+
+// lookup returns the values at a dotted path of a document, arrays on the way are expanded into all of their documents
+func lookup(value any, path string) []any {
+	name, rest, nested := strings.Cut(path, ".")
+
+	switch typed := value.(type) {
+	case bson.D:
+		child, ok := field(typed, name)
+
+		if !ok {
+			return nil
+		}
+
+		if !nested {
+			return []any{child}
+		}
+
+		return lookup(child, rest)
+
+	case bson.A:
+		values := []any{}
+
+		for _, element := range typed {
+			if _, ok := element.(bson.D); ok {
+				values = append(values, lookup(element, path)...)
+			}
+		}
+
+		return values
+
+	default:
+		return nil
+	}
+}
+
+// field returns the value of a field of a document and whether the document has it
+func field(document bson.D, name string) (any, bool) {
+	for _, element := range document {
+		if element.Key == name {
+			return element.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// anyElement checks if any value, or any element of a value which is an array, satisfies the check
+// missing reports the result for a field which does not exist
+func anyElement(values []any, missing bool, check func(value any) bool) bool {
+	if len(values) == 0 {
+		return missing
+	}
+
+	for _, value := range values {
+		if check(value) {
+			return true
+		}
+
+		if array, ok := value.(bson.A); ok && slices.ContainsFunc(array, check) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// equal checks if two bson values are equal, numbers of different types are compared by their value
+func equal(a, b any) bool {
+	aNumber, aIsNumber := toNumber(a)
+	bNumber, bIsNumber := toNumber(b)
+
+	if aIsNumber || bIsNumber {
+		return aIsNumber && bIsNumber && aNumber == bNumber
+	}
+
+	aArray, aIsArray := a.(bson.A)
+	bArray, bIsArray := b.(bson.A)
+
+	if aIsArray && bIsArray {
+		return slices.EqualFunc(aArray, bArray, equal)
+	}
+
+	aDocument, aIsDocument := a.(bson.D)
+	bDocument, bIsDocument := b.(bson.D)
+
+	if aIsDocument && bIsDocument {
+		return slices.EqualFunc(aDocument, bDocument, func(x, y bson.E) bool { return x.Key == y.Key && equal(x.Value, y.Value) })
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// compare compares two numbers, two strings or two dates, it reports false for values which cannot be compared
+func compare(a, b any) (int, bool) {
+	aNumber, aIsNumber := toNumber(a)
+	bNumber, bIsNumber := toNumber(b)
+
+	if aIsNumber && bIsNumber {
+		return compareNumbers(aNumber, bNumber), true
+	}
+
+	aDate, aIsDate := a.(bson.DateTime)
+	bDate, bIsDate := b.(bson.DateTime)
+
+	if aIsDate && bIsDate {
+		return compareNumbers(float64(aDate), float64(bDate)), true
+	}
+
+	aString, aIsString := a.(string)
+	bString, bIsString := b.(string)
+
+	if aIsString && bIsString {
+		return strings.Compare(aString, bString), true
+	}
+
+	aID, aIsID := a.(bson.ObjectID)
+	bID, bIsID := b.(bson.ObjectID)
+
+	if aIsID && bIsID {
+		return bytes.Compare(aID[:], bID[:]), true
+	}
+
+	return 0, false
+}
+
+// compareForSort compares two values of any type in the order mongodb sorts them
+func compareForSort(a, b any) int {
+	if rankA, rankB := sortRank(a), sortRank(b); rankA != rankB {
+		return compareNumbers(float64(rankA), float64(rankB))
+	}
+
+	result, _ := compare(a, b)
+	return result
+}
+
+// sortRank returns the position of the type of a value in the sort order of mongodb
+func sortRank(value any) int {
+	if _, ok := toNumber(value); ok {
+		return 1
+	}
+
+	switch value.(type) {
+	case nil:
+		return 0
+
+	case string:
+		return 2
+
+	case bson.D:
+		return 3
+
+	case bson.A:
+		return 4
+
+	case bson.ObjectID:
+		return 5
+
+	case bool:
+		return 6
+
+	case bson.DateTime:
+		return 7
+
+	default:
+		return 8
+	}
+}
+
+// compareNumbers compares two numbers
+func compareNumbers(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+
+	case a > b:
+		return 1
+
+	default:
+		return 0
+	}
+}
+
+// first returns the first value, or nil if there are none
+func first(values []any) any {
+	if len(values) == 0 {
+		return nil
+	}
+
+	return values[0]
+}
+
+// toNumber converts a bson number to a float64 and reports whether the value is a number
+func toNumber(value any) (float64, bool) {
+	switch typed := value.(type) {
+	case int:
+		return float64(typed), true
+
+	case int32:
+		return float64(typed), true
+
+	case int64:
+		return float64(typed), true
+
+	case float64:
+		return typed, true
+
+	default:
+		return 0, false
+	}
+}
+
+// toPoint converts a geojson point or a legacy [longitude, latitude] pair to [longitude, latitude] coordinates
+func toPoint(value any) ([]float64, bool) {
+	if document, ok := value.(bson.D); ok {
+		if geometryType, _ := field(document, "type"); geometryType != "Point" {
+			return nil, false
+		}
+
+		value, _ = field(document, "coordinates")
+	}
+
+	coordinates, ok := toCoordinates(value)
+	return coordinates, ok && len(coordinates) >= 2
+}
+
+// toPolygons converts a geojson polygon or multipolygon to its polygons, each made of its outer ring followed by its holes
+func toPolygons(value any) ([][][][]float64, bool) {
+	document, ok := value.(bson.D)
+
+	if !ok {
+		return nil, false
+	}
+
+	geometryType, _ := field(document, "type")
+	coordinates, _ := field(document, "coordinates")
+	polygons, ok := coordinates.(bson.A)
+
+	if !ok {
+		return nil, false
+	}
+
+	if geometryType == "Polygon" {
+		polygons = bson.A{polygons}
+
+	} else if geometryType != "MultiPolygon" {
+		return nil, false
+	}
+
+	result := [][][][]float64{}
+
+	for _, polygon := range polygons {
+		rings, ok := polygon.(bson.A)
+
+		if !ok || len(rings) == 0 {
+			return nil, false
+		}
+
+		converted := [][][]float64{}
+
+		for _, ring := range rings {
+			vertices, ok := ring.(bson.A)
+
+			if !ok {
+				return nil, false
+			}
+
+			convertedRing := [][]float64{}
+
+			for _, vertex := range vertices {
+				coordinates, ok := toCoordinates(vertex)
+
+				if !ok || len(coordinates) < 2 {
+					return nil, false
+				}
+
+				convertedRing = append(convertedRing, coordinates)
+			}
+
+			converted = append(converted, convertedRing)
+		}
+
+		result = append(result, converted)
+	}
+
+	return result, true
+}
+
+// polygonsContain checks if the [longitude, latitude] point is inside the outer ring and outside the holes of any of the polygons
+func polygonsContain(polygons [][][][]float64, point []float64) bool {
+	for _, polygon := range polygons {
+		if !geo.PolygonContains(polygon[0], point) {
+			continue
+		}
+
+		if !slices.ContainsFunc(polygon[1:], func(hole [][]float64) bool { return geo.PolygonContains(hole, point) }) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// toCoordinates converts a bson array of numbers to coordinates
+func toCoordinates(value any) ([]float64, bool) {
+	array, ok := value.(bson.A)
+
+	if !ok {
+		return nil, false
+	}
+
+	coordinates := []float64{}
+
+	for _, element := range array {
+		number, ok := toNumber(element)
+
+		if !ok {
+			return nil, false
+		}
+
+		coordinates = append(coordinates, number)
+	}
+
+	return coordinates, true
+}
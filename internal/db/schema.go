@@ -0,0 +1,489 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// namespaceExistsCode is the code of the mongodb error creating a collection which already exists
+const namespaceExistsCode = 48
+
+// DriftKind names a kind of difference between a schema and the database
+type DriftKind string
+
+const (
+	// DriftMissingIndex is an index of the schema missing from an existing collection, it is created
+	DriftMissingIndex DriftKind = "missing_index"
+	// DriftIndexConflict is an index with the name or keys of an index of the schema but other options, it is left as it is
+	DriftIndexConflict DriftKind = "index_conflict"
+	// DriftUnexpectedIndex is an index which is not part of the schema, it is left as it is
+	DriftUnexpectedIndex DriftKind = "unexpected_index"
+	// DriftValidator is a validator which differs from the validator of the schema, it is replaced
+	DriftValidator DriftKind = "validator"
+	// DriftTimeSeries is a collection which is not the time-series collection of the schema or is one with other options, it is left as it is
+	DriftTimeSeries DriftKind = "time_series"
+)
+
+// Schema declares the collections of a service with their validators and indexes
+type Schema struct {
+	Collections []CollectionSpec
+}
+
+// CollectionSpec declares a collection, a nil validator means the collection has no validator and nil time-series options a plain collection
+type CollectionSpec struct {
+	Name       string
+	Validator  map[string]any
+	Indexes    []IndexSpec
+	TimeSeries *TimeSeriesSpec
+}
+
+// TimeSeriesSpec declares the options of a time-series collection, mongodb stores the measurements with the same meta field value in buckets ordered by the time field
+// the time field must hold dates, and the granularity is seconds, minutes or hours, minutes by default if it is empty
+type TimeSeriesSpec struct {
+	TimeField   string `bson:"timeField"`
+	MetaField   string `bson:"metaField,omitempty"`
+	Granularity string `bson:"granularity,omitempty"`
+}
+
+// IndexSpec declares an index on one or more keys, an index without a name gets the default name of mongodb such as username_1_timestamp_-1
+// an index with an expiration is a ttl index, mongodb only expires documents with a date in its field
+type IndexSpec struct {
+	Name          string
+	Keys          []IndexKey
+	Unique        bool
+	ExpireAfter   time.Duration
+	PartialFilter map[string]any
+}
+
+// IndexKey is a field of an index, the type is 1 or -1 for an ascending or descending key and "2dsphere" for a geospatial key
+type IndexKey struct {
+	Field string
+	Type  any
+}
+
+// CollectionState is a collection as found in the database, compared to its spec to find drift
+type CollectionState struct {
+	Exists     bool
+	Validator  map[string]any
+	Indexes    []IndexSpec
+	TimeSeries *TimeSeriesSpec
+}
+
+// Drift is a difference between the schema and the database found while applying the schema, resolved if applying the schema removed it
+type Drift struct {
+	Collection string
+	Kind       DriftKind
+	Index      string
+	Resolved   bool
+}
+
+// String describes the drift
+func (d Drift) String() string {
+	switch d.Kind {
+	case DriftMissingIndex:
+		return fmt.Sprintf("index '%s' of collection '%s' was missing and has been created", d.Index, d.Collection)
+
+	case DriftIndexConflict:
+		return fmt.Sprintf("index '%s' of collection '%s' conflicts with an existing index, drop the existing index to apply the schema", d.Index, d.Collection)
+
+	case DriftUnexpectedIndex:
+		return fmt.Sprintf("index '%s' of collection '%s' is not part of the schema", d.Index, d.Collection)
+
+	case DriftTimeSeries:
+		return fmt.Sprintf("collection '%s' differs from the time-series options of the schema, migrate its documents into a new collection to apply the schema", d.Collection)
+
+	default:
+		return fmt.Sprintf("validator of collection '%s' differed from the schema and has been replaced", d.Collection)
+	}
+}
+
+// IndexName returns the name of the index, the default name of mongodb if it has none
+func (i IndexSpec) IndexName() string {
+	if i.Name != "" {
+		return i.Name
+	}
+
+	parts := []string{}
+
+	for _, key := range i.Keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", key.Field, key.Type))
+	}
+
+	return strings.Join(parts, "_")
+}
+
+// ApplySchema creates the missing collections and indexes of the schema and replaces the validators which differ, so applying it again changes nothing
+// indexes which conflict with the schema or are not part of it are never dropped, they are reported as unresolved drift and logged like the resolved drift
+func ApplySchema(ctx context.Context, client DBClient, schema Schema) ([]Drift, error) {
+	drift := []Drift{}
+
+	for _, collection := range schema.Collections {
+		collectionDrift, err := applyCollection(ctx, client, collection)
+
+		if err != nil {
+			return nil, fmt.Errorf("error applying the schema of collection '%s': %w", collection.Name, err)
+		}
+
+		drift = append(drift, collectionDrift...)
+	}
+
+	for _, found := range drift {
+		if found.Resolved {
+			log.Printf("schema drift resolved: %s\n", found)
+
+		} else {
+			log.Printf("schema drift needs attention: %s\n", found)
+		}
+	}
+
+	return drift, nil
+}
+
+// MustApplySchema applies the schema and panics if it fails
+func MustApplySchema(ctx context.Context, client DBClient, schema Schema) []Drift {
+	drift, err := ApplySchema(ctx, client, schema)
+
+	if err != nil {
+		log.Fatalf("failed to apply schema: %v\n", err)
+	}
+
+	return drift
+}
+
+// applyCollection applies the spec of a single collection and returns its drift, a collection which did not exist has no drift
+func applyCollection(ctx context.Context, client DBClient, spec CollectionSpec) ([]Drift, error) {
+	state, err := client.DescribeCollection(ctx, spec.Name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	drift := []Drift{}
+
+	switch {
+	case !state.Exists && spec.TimeSeries != nil:
+		if err := client.CreateTimeSeriesCollection(ctx, spec.Name, *spec.TimeSeries); err != nil {
+			return nil, err
+		}
+
+	case !state.Exists:
+		if err := client.CreateCollection(ctx, spec.Name); err != nil {
+			return nil, err
+		}
+
+	case !sameTimeSeries(state.TimeSeries, spec.TimeSeries):
+		drift = append(drift, Drift{Collection: spec.Name, Kind: DriftTimeSeries})
+	}
+
+	if !sameValue(state.Validator, spec.Validator) {
+		if state.Exists {
+			drift = append(drift, Drift{Collection: spec.Name, Kind: DriftValidator, Resolved: true})
+		}
+
+		if err := client.SetValidator(ctx, spec.Name, spec.Validator); err != nil {
+			return nil, err
+		}
+	}
+
+	existing := map[string]IndexSpec{}
+
+	for _, index := range state.Indexes {
+		if index.IndexName() != "_id_" {
+			existing[index.IndexName()] = index
+		}
+	}
+
+	missing := []IndexSpec{}
+
+	for _, index := range spec.Indexes {
+		name := index.IndexName()
+
+		if current, ok := existing[name]; ok {
+			delete(existing, name)
+
+			if !sameIndex(current, index) {
+				drift = append(drift, Drift{Collection: spec.Name, Kind: DriftIndexConflict, Index: name})
+			}
+
+			continue
+		}
+
+		if other, ok := indexWithKeys(existing, index.Keys); ok {
+			delete(existing, other)
+			drift = append(drift, Drift{Collection: spec.Name, Kind: DriftIndexConflict, Index: name})
+			continue
+		}
+
+		if state.Exists {
+			drift = append(drift, Drift{Collection: spec.Name, Kind: DriftMissingIndex, Index: name, Resolved: true})
+		}
+
+		missing = append(missing, index)
+	}
+
+	if len(missing) > 0 {
+		if err := client.CreateIndexes(ctx, spec.Name, missing); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(existing)) {
+		drift = append(drift, Drift{Collection: spec.Name, Kind: DriftUnexpectedIndex, Index: name})
+	}
+
+	return drift, nil
+}
+
+// indexWithKeys returns the name of the index with the keys, mongodb does not allow two indexes with the same keys and options
+func indexWithKeys(indexes map[string]IndexSpec, keys []IndexKey) (string, bool) {
+	for name, index := range indexes {
+		if sameValue(index.Keys, keys) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// sameIndex checks if two indexes have the same keys and options
+func sameIndex(a, b IndexSpec) bool {
+	return sameValue(a.Keys, b.Keys) && a.Unique == b.Unique && a.ExpireAfter/time.Second == b.ExpireAfter/time.Second && sameValue(a.PartialFilter, b.PartialFilter)
+}
+
+// sameTimeSeries checks if two collections have the same time-series options, mongodb reports the default granularity of minutes for options without one
+func sameTimeSeries(a, b *TimeSeriesSpec) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	granularity := func(spec *TimeSeriesSpec) string {
+		if spec.Granularity == "" {
+			return "minutes"
+		}
+
+		return spec.Granularity
+	}
+
+	return a.TimeField == b.TimeField && a.MetaField == b.MetaField && granularity(a) == granularity(b)
+}
+
+// sameValue checks if two values are the same once normalized, so documents compare independently of their field order and numbers of their type
+func sameValue(a, b any) bool {
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+// normalize converts documents to maps, arrays to slices and numbers to float64 and treats an empty document like a missing one
+func normalize(value any) any {
+	switch typed := value.(type) {
+	case bson.D:
+		return normalize(documentMap(typed))
+
+	case bson.M:
+		return normalize(map[string]any(typed))
+
+	case map[string]any:
+		if len(typed) == 0 {
+			return nil
+		}
+
+		result := map[string]any{}
+
+		for key, element := range typed {
+			result[key] = normalize(element)
+		}
+
+		return result
+
+	case bson.A:
+		return normalize([]any(typed))
+
+	case []IndexKey:
+		result := []any{}
+
+		for _, key := range typed {
+			result = append(result, []any{key.Field, normalize(key.Type)})
+		}
+
+		return result
+
+	default:
+		if number, ok := toNumber(value); ok {
+			return number
+		}
+
+		reflected := reflect.ValueOf(value)
+
+		if reflected.Kind() == reflect.Slice && reflected.Type().Elem().Kind() != reflect.Uint8 {
+			result := []any{}
+
+			for i := range reflected.Len() {
+				result = append(result, normalize(reflected.Index(i).Interface()))
+			}
+
+			return result
+		}
+
+		return value
+	}
+}
+
+// mongoIndex is an index as listed by mongodb
+type mongoIndex struct {
+	Name                    string `bson:"name"`
+	Key                     bson.D `bson:"key"`
+	Unique                  bool   `bson:"unique"`
+	ExpireAfterSeconds      *int64 `bson:"expireAfterSeconds"`
+	PartialFilterExpression bson.M `bson:"partialFilterExpression"`
+}
+
+// DescribeCollection finds the collection in the mongodb database with its validator and indexes
+func (mc *MongoClient) DescribeCollection(ctx context.Context, collectionName string) (CollectionState, error) {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationCreateCollection)
+	defer cancel()
+	specifications, err := mc.defaultDb.ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collectionName}})
+
+	if err != nil {
+		return CollectionState{}, contextError(ctx, err)
+	}
+
+	if len(specifications) == 0 {
+		return CollectionState{}, nil
+	}
+
+	state := CollectionState{Exists: true}
+
+	if validator, err := specifications[0].Options.LookupErr("validator"); err == nil {
+		document := bson.M{}
+
+		if err := validator.Unmarshal(&document); err != nil {
+			return CollectionState{}, fmt.Errorf("error decoding the validator: %v", err)
+		}
+
+		state.Validator = document
+	}
+
+	if timeSeries, err := specifications[0].Options.LookupErr("timeseries"); err == nil {
+		spec := TimeSeriesSpec{}
+
+		if err := timeSeries.Unmarshal(&spec); err != nil {
+			return CollectionState{}, fmt.Errorf("error decoding the time-series options: %v", err)
+		}
+
+		state.TimeSeries = &spec
+	}
+
+	cursor, err := mc.defaultDb.Collection(collectionName).Indexes().List(ctx)
+
+	if err != nil {
+		return CollectionState{}, contextError(ctx, err)
+	}
+
+	indexes := []mongoIndex{}
+
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return CollectionState{}, contextError(ctx, err)
+	}
+
+	for _, index := range indexes {
+		spec := IndexSpec{Name: index.Name, Unique: index.Unique, PartialFilter: index.PartialFilterExpression}
+
+		for _, key := range index.Key {
+			spec.Keys = append(spec.Keys, IndexKey{Field: key.Key, Type: key.Value})
+		}
+
+		if index.ExpireAfterSeconds != nil {
+			spec.ExpireAfter = time.Duration(*index.ExpireAfterSeconds) * time.Second
+		}
+
+		state.Indexes = append(state.Indexes, spec)
+	}
+
+	return state, nil
+}
+
+// CreateTimeSeriesCollection creates a new time-series collection in the mongodb database unless a collection with the name already exists
+func (mc *MongoClient) CreateTimeSeriesCollection(ctx context.Context, collectionName string, timeSeries TimeSeriesSpec) error {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationCreateCollection)
+	defer cancel()
+	timeSeriesOptions := options.TimeSeries().SetTimeField(timeSeries.TimeField)
+
+	if timeSeries.MetaField != "" {
+		timeSeriesOptions.SetMetaField(timeSeries.MetaField)
+	}
+
+	if timeSeries.Granularity != "" {
+		timeSeriesOptions.SetGranularity(timeSeries.Granularity)
+	}
+
+	err := mc.defaultDb.CreateCollection(ctx, collectionName, options.CreateCollection().SetTimeSeriesOptions(timeSeriesOptions))
+
+	if isNamespaceExists(err) {
+		return nil
+	}
+
+	return contextError(ctx, err)
+}
+
+// CreateIndexes creates the indexes in the mongodb collection
+func (mc *MongoClient) CreateIndexes(ctx context.Context, collectionName string, indexes []IndexSpec) error {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationCreateIndex)
+	defer cancel()
+	models := []mongo.IndexModel{}
+
+	for _, index := range indexes {
+		keys := bson.D{}
+
+		for _, key := range index.Keys {
+			keys = append(keys, bson.E{Key: key.Field, Value: key.Type})
+		}
+
+		options := options.Index().SetName(index.IndexName())
+
+		if index.Unique {
+			options.SetUnique(true)
+		}
+
+		if index.ExpireAfter > 0 {
+			options.SetExpireAfterSeconds(int32(index.ExpireAfter / time.Second))
+		}
+
+		if index.PartialFilter != nil {
+			options.SetPartialFilterExpression(index.PartialFilter)
+		}
+
+		models = append(models, mongo.IndexModel{Keys: keys, Options: options})
+	}
+
+	_, err := mc.defaultDb.Collection(collectionName).Indexes().CreateMany(ctx, models)
+	return contextError(ctx, err)
+}
+
+// SetValidator replaces the validator of the mongodb collection, a nil validator removes it
+func (mc *MongoClient) SetValidator(ctx context.Context, collectionName string, validator map[string]any) error {
+	ctx, cancel := mc.timeouts.WithTimeout(ctx, OperationCreateCollection)
+	defer cancel()
+
+	if validator == nil {
+		validator = map[string]any{}
+	}
+
+	command := bson.D{{Key: "collMod", Value: collectionName}, {Key: "validator", Value: validator}}
+	return contextError(ctx, mc.defaultDb.RunCommand(ctx, command).Err())
+}
+
+// isNamespaceExists checks if the mongodb error is about a collection which already exists
+func isNamespaceExists(err error) bool {
+	var serverError mongo.ServerError
+	return errors.As(err, &serverError) && serverError.HasErrorCode(namespaceExistsCode)
+}
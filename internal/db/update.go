@@ -0,0 +1,150 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// applyUpdate returns a copy of the document with the update operators applied
+// supported are the $set, $unset, $inc, $min, $max and $push operators on dotted field paths, the _id can not be changed like in mongodb
+func applyUpdate(document bson.D, update bson.D) (bson.D, error) {
+	if len(update) == 0 {
+		return nil, fmt.Errorf("the update document must not be empty")
+	}
+
+	for _, operator := range update {
+		fields, ok := operator.Value.(bson.D)
+
+		if !ok || !strings.HasPrefix(operator.Key, "$") {
+			return nil, fmt.Errorf("the update document must only contain update operators, got '%s'", operator.Key)
+		}
+
+		for _, element := range fields {
+			if element.Key == "_id" || strings.HasPrefix(element.Key, "_id.") {
+				return nil, fmt.Errorf("the update changes the immutable _id of the document")
+			}
+
+			current, exists := pathValue(document, element.Key)
+
+			switch operator.Key {
+			case "$set":
+				document = setPath(document, element.Key, element.Value)
+
+			case "$unset":
+				document = unsetPath(document, element.Key)
+
+			case "$inc":
+				increment, ok := toNumber(element.Value)
+
+				if !ok {
+					return nil, fmt.Errorf("$inc of '%s' expects a number, got '%v'", element.Key, element.Value)
+				}
+
+				if !exists {
+					document = setPath(document, element.Key, element.Value)
+					continue
+				}
+
+				value, ok := toNumber(current)
+
+				if !ok {
+					return nil, fmt.Errorf("$inc can not increment the non-numeric field '%s'", element.Key)
+				}
+
+				document = setPath(document, element.Key, numberOfType(value+increment, bson.A{current, element.Value}))
+
+			case "$min", "$max":
+				order := compareForSort(element.Value, current)
+
+				if !exists || (operator.Key == "$min" && order < 0) || (operator.Key == "$max" && order > 0) {
+					document = setPath(document, element.Key, element.Value)
+				}
+
+			case "$push":
+				values, ok := current.(bson.A)
+
+				if exists && !ok {
+					return nil, fmt.Errorf("$push can not append to the non-array field '%s'", element.Key)
+				}
+
+				document = setPath(document, element.Key, append(append(bson.A{}, values...), element.Value))
+
+			default:
+				return nil, fmt.Errorf("unsupported update operator '%s'", operator.Key)
+			}
+		}
+	}
+
+	return document, nil
+}
+
+// pathValue returns the value at the dotted path of embedded documents and reports whether it exists
+func pathValue(document bson.D, path string) (any, bool) {
+	name, rest, nested := strings.Cut(path, ".")
+	value, ok := field(document, name)
+
+	if !ok || !nested {
+		return value, ok
+	}
+
+	embedded, ok := value.(bson.D)
+
+	if !ok {
+		return nil, false
+	}
+
+	return pathValue(embedded, rest)
+}
+
+// setPath returns a copy of the document with the value at the dotted path, creating the missing embedded documents
+func setPath(document bson.D, path string, value any) bson.D {
+	name, rest, nested := strings.Cut(path, ".")
+	result := append(bson.D{}, document...)
+
+	for i, element := range result {
+		if element.Key != name {
+			continue
+		}
+
+		if nested {
+			embedded, _ := element.Value.(bson.D)
+			value = setPath(embedded, rest, value)
+		}
+
+		result[i] = bson.E{Key: name, Value: value}
+		return result
+	}
+
+	if nested {
+		value = setPath(bson.D{}, rest, value)
+	}
+
+	return append(result, bson.E{Key: name, Value: value})
+}
+
+// unsetPath returns a copy of the document without the field at the dotted path
+func unsetPath(document bson.D, path string) bson.D {
+	name, rest, nested := strings.Cut(path, ".")
+	result := bson.D{}
+
+	for _, element := range document {
+		if element.Key != name {
+			result = append(result, element)
+			continue
+		}
+
+		if !nested {
+			continue
+		}
+
+		if embedded, ok := element.Value.(bson.D); ok {
+			element.Value = unsetPath(embedded, rest)
+		}
+
+		result = append(result, element)
+	}
+
+	return result
+}
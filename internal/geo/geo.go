@@ -0,0 +1,220 @@
+package geo
+
+import (
+	"math"
+)
+
+const (
+	earthRadius     = 6371008.8
+	maxRingLatitude = 89.999999
+)
+
+type Circle struct {
+	Center []float64
+	Radius float64
+}
+
+type BoundingBox struct {
+	SouthWest []float64
+	NorthEast []float64
+}
+
+// degreesToRadians converts degrees to radians
+func degreesToRadians(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+// radiansToDegrees converts radians to degrees
+func radiansToDegrees(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+// Distance calculates the distance in meters between two [longitude, latitude] coordinates using the haversine formula
+func Distance(start, end []float64) float64 {
+	startLongitude := degreesToRadians(start[0])
+	startLatitude := degreesToRadians(start[1])
+	endLongitude := degreesToRadians(end[0])
+	endLatitude := degreesToRadians(end[1])
+
+	diffLon := endLongitude - startLongitude
+	diffLat := endLatitude - startLatitude
+
+	a := math.Pow(math.Sin(diffLat/2), 2) + math.Cos(startLatitude)*math.Cos(endLatitude)*math.Pow(math.Sin(diffLon/2), 2)
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Contains checks if the [longitude, latitude] coordinates are inside the circle
+func (c Circle) Contains(coordinates []float64) bool {
+	return Distance(c.Center, coordinates) <= c.Radius
+}
+
+// Contains checks if the [longitude, latitude] coordinates are inside the bounding box
+// bounding boxes crossing the antimeridian have a south west longitude greater than the north east longitude
+func (b BoundingBox) Contains(coordinates []float64) bool {
+	if coordinates[1] < b.SouthWest[1] || coordinates[1] > b.NorthEast[1] {
+		return false
+	}
+
+	if b.SouthWest[0] <= b.NorthEast[0] {
+		return coordinates[0] >= b.SouthWest[0] && coordinates[0] <= b.NorthEast[0]
+	}
+
+	return coordinates[0] >= b.SouthWest[0] || coordinates[0] <= b.NorthEast[0]
+}
+
+// Center returns the [longitude, latitude] coordinates of the center of the bounding box
+func (b BoundingBox) Center() []float64 {
+	west, east := b.SouthWest[0], b.NorthEast[0]
+
+	if east < west {
+		east += 360
+	}
+
+	return []float64{normalizeLongitude((west + east) / 2), (b.SouthWest[1] + b.NorthEast[1]) / 2}
+}
+
+// Destination calculates the [longitude, latitude] coordinates reached by moving the given distance in meters from the start coordinates in the direction of the bearing in degrees
+func Destination(start []float64, distance, bearing float64) []float64 {
+	longitude := degreesToRadians(start[0])
+	latitude := degreesToRadians(start[1])
+	angularDistance := distance / earthRadius
+	bearing = degreesToRadians(bearing)
+
+	endLatitude := math.Asin(math.Sin(latitude)*math.Cos(angularDistance) + math.Cos(latitude)*math.Sin(angularDistance)*math.Cos(bearing))
+	endLongitude := longitude + math.Atan2(math.Sin(bearing)*math.Sin(angularDistance)*math.Cos(latitude), math.Cos(angularDistance)-math.Sin(latitude)*math.Sin(endLatitude))
+
+	return []float64{
+		math.Mod(radiansToDegrees(endLongitude)+540, 360) - 180,
+		radiansToDegrees(endLatitude),
+	}
+}
+
+// Polygon approximates the circle with a closed counterclockwise ring of the given number of [longitude, latitude] vertices
+// the vertices are placed outside of the circle so that the edges touch it, so every point inside the circle is inside the polygon as well
+func (c Circle) Polygon(segments int) [][]float64 {
+	ring := [][]float64{}
+	radius := c.Radius / math.Cos(math.Pi/float64(segments))
+
+	for i := range segments {
+		ring = append(ring, Destination(c.Center, radius, 360-float64(i)*360/float64(segments)))
+	}
+
+	return append(ring, ring[0])
+}
+
+// Polygon converts the bounding box to a closed counterclockwise ring of [longitude, latitude] vertices
+// the edges are split into segments of at most one degree, so the geodesic edges used by spherical geometry stay close to the parallels of the bounding box
+// latitudes are kept just short of the poles, where every vertex of an edge would be the same point
+func (b BoundingBox) Polygon() [][]float64 {
+	west, east := b.SouthWest[0], b.NorthEast[0]
+	south, north := max(b.SouthWest[1], -maxRingLatitude), min(b.NorthEast[1], maxRingLatitude)
+
+	if east < west {
+		east += 360
+	}
+
+	longitudes := steps(west, east)
+	latitudes := steps(south, north)
+	ring := [][]float64{}
+
+	for _, longitude := range longitudes {
+		ring = append(ring, []float64{normalizeLongitude(longitude), south})
+	}
+
+	for _, latitude := range latitudes[1:] {
+		ring = append(ring, []float64{normalizeLongitude(east), latitude})
+	}
+
+	for i := len(longitudes) - 2; i >= 0; i-- {
+		ring = append(ring, []float64{normalizeLongitude(longitudes[i]), north})
+	}
+
+	for i := len(latitudes) - 2; i >= 0; i-- {
+		ring = append(ring, []float64{normalizeLongitude(west), latitudes[i]})
+	}
+
+	return ring
+}
+
+// steps splits the range between start and end into steps of at most one degree and returns their bounds
+func steps(start, end float64) []float64 {
+	count := max(1, int(math.Ceil(end-start)))
+	bounds := []float64{}
+
+	for i := range count {
+		bounds = append(bounds, start+(end-start)*float64(i)/float64(count))
+	}
+
+	return append(bounds, end)
+}
+
+// normalizeLongitude maps a longitude to the range from -180 to 180 degrees
+func normalizeLongitude(longitude float64) float64 {
+	if longitude > 180 {
+		return longitude - 360
+	}
+
+	return longitude
+}
+
+// PolygonContains checks if the [longitude, latitude] coordinates are inside the closed counterclockwise ring of [longitude, latitude] vertices
+// edges are treated as straight lines between their longitudes and latitudes, rings may cross the antimeridian and rings going around the globe enclose the pole on their left
+func PolygonContains(ring [][]float64, coordinates []float64) bool {
+	if len(ring) < 3 {
+		return false
+	}
+
+	unwrapped := [][]float64{{ring[0][0], ring[0][1]}}
+
+	for _, vertex := range append(ring[1:], ring[0]) {
+		unwrapped = append(unwrapped, []float64{unwrapLongitude(vertex[0], unwrapped[len(unwrapped)-1][0]), vertex[1]})
+	}
+
+	last := unwrapped[len(unwrapped)-1]
+
+	if offset := last[0] - unwrapped[0][0]; math.Abs(offset) > 180 {
+		pole := 90.0
+
+		if offset < 0 {
+			pole = -90
+		}
+
+		unwrapped = append(unwrapped, []float64{last[0], pole}, []float64{unwrapped[0][0], pole})
+	}
+
+	for _, shift := range []float64{0, 360, -360} {
+		if ringContains(unwrapped, coordinates[0]+shift, coordinates[1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unwrapLongitude shifts the longitude by whole turns until it is at most 180 degrees away from the previous longitude
+func unwrapLongitude(longitude, previous float64) float64 {
+	for longitude-previous > 180 {
+		longitude -= 360
+	}
+
+	for longitude-previous < -180 {
+		longitude += 360
+	}
+
+	return longitude
+}
+
+// ringContains checks if the point is inside the ring using ray casting on the plane of longitudes and latitudes
+func ringContains(ring [][]float64, x, y float64) bool {
+	inside := false
+
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi, xj, yj := ring[i][0], ring[i][1], ring[j][0], ring[j][1]
+
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
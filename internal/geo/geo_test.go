@@ -0,0 +1,22 @@
+package geo
+
+import (
+	"testing"
+)
+
+func TestCirclePolygon(t *testing.T) {
+	circle := Circle{Center: []float64{20.4651, 44.8040}, Radius: 200}
+	ring := circle.Polygon(64)
+
+	if len(ring) != 65 || ring[0][0] != ring[64][0] || ring[0][1] != ring[64][1] {
+		t.Fatalf("expected a closed ring of 65 vertices, got %d", len(ring))
+	}
+
+	for i := range 64 {
+		middle := []float64{(ring[i][0] + ring[i+1][0]) / 2, (ring[i][1] + ring[i+1][1]) / 2}
+
+		if distance := Distance(circle.Center, middle); distance < circle.Radius-0.01 {
+			t.Errorf("edge %d cuts into the circle, its middle is %f meters from the center", i, distance)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package geo
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Place is a named place of a reverse geocoding dataset with its admin region and country
+type Place struct {
+	Name        string
+	Region      string
+	Country     string
+	Coordinates []float64
+}
+
+// ReverseGeocoder resolves [longitude, latitude] coordinates to the nearest place of a dataset kept in memory
+// places are indexed in a k-d tree over their positions on the unit sphere, so lookups take logarithmic time and work across the antimeridian and the poles
+type ReverseGeocoder struct {
+	places []Place
+	nodes  []placeNode
+}
+
+type placeNode struct {
+	point [3]float64
+	place int
+}
+
+// NewReverseGeocoder creates a reverse geocoder and builds the spatial index of the places
+func NewReverseGeocoder(places []Place) *ReverseGeocoder {
+	g := &ReverseGeocoder{
+		places: places,
+		nodes:  make([]placeNode, len(places)),
+	}
+
+	for i, place := range places {
+		g.nodes[i] = placeNode{point: unitVector(place.Coordinates), place: i}
+	}
+
+	g.build(g.nodes, 0)
+	return g
+}
+
+// LoadGeoNames loads the places of a geonames dump, such as cities15000.txt, into a reverse geocoder
+// the admin regions are resolved by their names from an optional admin1CodesASCII.txt file, otherwise their codes are kept
+func LoadGeoNames(places, regions io.Reader) (*ReverseGeocoder, error) {
+	regionNames := map[string]string{}
+
+	if regions != nil {
+		err := readTabSeparated(regions, 2, func(fields []string) error {
+			regionNames[fields[0]] = fields[1]
+			return nil
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading geonames regions: %v", err)
+		}
+	}
+
+	loaded := []Place{}
+
+	err := readTabSeparated(places, 11, func(fields []string) error {
+		latitude, err := strconv.ParseFloat(fields[4], 64)
+
+		if err != nil {
+			return fmt.Errorf("invalid latitude '%s' of place '%s'", fields[4], fields[1])
+		}
+
+		longitude, err := strconv.ParseFloat(fields[5], 64)
+
+		if err != nil {
+			return fmt.Errorf("invalid longitude '%s' of place '%s'", fields[5], fields[1])
+		}
+
+		region, ok := regionNames[fields[8]+"."+fields[10]]
+
+		if !ok {
+			region = fields[10]
+		}
+
+		loaded = append(loaded, Place{
+			Name:        fields[1],
+			Region:      region,
+			Country:     fields[8],
+			Coordinates: []float64{longitude, latitude},
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading geonames places: %v", err)
+	}
+
+	return NewReverseGeocoder(loaded), nil
+}
+
+// LoadGeoNamesFiles loads the places of a geonames dump and optionally the names of their admin regions from files
+// without a places file, the reverse geocoder is empty and every lookup fails
+func LoadGeoNamesFiles(placesPath, regionsPath string) (*ReverseGeocoder, error) {
+	if placesPath == "" {
+		return NewReverseGeocoder(nil), nil
+	}
+
+	places, err := os.Open(placesPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer places.Close()
+
+	if regionsPath == "" {
+		return LoadGeoNames(places, nil)
+	}
+
+	regions, err := os.Open(regionsPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer regions.Close()
+	return LoadGeoNames(places, regions)
+}
+
+// MustLoadReverseGeocoder loads the places of the geonames files set by REVERSE_GEOCODER_PLACES_FILE and REVERSE_GEOCODER_REGIONS_FILE and exits if they can not be loaded
+// without a places file, the reverse geocoder is empty and locations are resolved to no place
+func MustLoadReverseGeocoder() *ReverseGeocoder {
+	geocoder, err := LoadGeoNamesFiles(os.Getenv("REVERSE_GEOCODER_PLACES_FILE"), os.Getenv("REVERSE_GEOCODER_REGIONS_FILE"))
+
+	if err != nil {
+		log.Fatalf("failed to load reverse geocoder places: %v\n", err)
+	}
+
+	log.Printf("successfully loaded %d reverse geocoder places\n", geocoder.Len())
+	return geocoder
+}
+
+// Len returns the number of places of the reverse geocoder
+func (g *ReverseGeocoder) Len() int {
+	if g == nil {
+		return 0
+	}
+
+	return len(g.places)
+}
+
+// Lookup returns the place nearest to the [longitude, latitude] coordinates and its distance in meters, or false if there are no places
+func (g *ReverseGeocoder) Lookup(coordinates []float64) (Place, float64, bool) {
+	if g.Len() == 0 {
+		return Place{}, 0, false
+	}
+
+	best, bestDistance := -1, math.Inf(1)
+	g.nearest(g.nodes, 0, unitVector(coordinates), &best, &bestDistance)
+	place := g.places[best]
+	return place, Distance(coordinates, place.Coordinates), true
+}
+
+// build sorts the nodes into a balanced k-d tree in place, the median of every range is its root
+func (g *ReverseGeocoder) build(nodes []placeNode, depth int) {
+	if len(nodes) <= 1 {
+		return
+	}
+
+	axis := depth % 3
+
+	slices.SortFunc(nodes, func(a, b placeNode) int {
+		return cmp.Compare(a.point[axis], b.point[axis])
+	})
+
+	median := len(nodes) / 2
+	g.build(nodes[:median], depth+1)
+	g.build(nodes[median+1:], depth+1)
+}
+
+// nearest searches the k-d tree for the node nearest to the point by squared chord distance, which orders places the same way as the distance on the sphere
+func (g *ReverseGeocoder) nearest(nodes []placeNode, depth int, point [3]float64, best *int, bestDistance *float64) {
+	if len(nodes) == 0 {
+		return
+	}
+
+	median := len(nodes) / 2
+	node := nodes[median]
+	distance := 0.0
+
+	for i := range node.point {
+		distance += (node.point[i] - point[i]) * (node.point[i] - point[i])
+	}
+
+	if distance < *bestDistance {
+		*best, *bestDistance = node.place, distance
+	}
+
+	axis := depth % 3
+	diff := point[axis] - node.point[axis]
+	near, far := nodes[:median], nodes[median+1:]
+
+	if diff > 0 {
+		near, far = far, near
+	}
+
+	g.nearest(near, depth+1, point, best, bestDistance)
+
+	if diff*diff < *bestDistance {
+		g.nearest(far, depth+1, point, best, bestDistance)
+	}
+}
+
+// unitVector converts [longitude, latitude] coordinates to their position on the unit sphere
+func unitVector(coordinates []float64) [3]float64 {
+	longitude := degreesToRadians(coordinates[0])
+	latitude := degreesToRadians(coordinates[1])
+	return [3]float64{math.Cos(latitude) * math.Cos(longitude), math.Cos(latitude) * math.Sin(longitude), math.Sin(latitude)}
+}
+
+// readTabSeparated calls the handler with the fields of every line of a tab separated file, skipping empty lines and comments
+func readTabSeparated(r io.Reader, minFields int, handle func(fields []string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, "\t")
+
+		if len(fields) < minFields {
+			return fmt.Errorf("line %d has %d fields, expected at least %d", line, len(fields), minFields)
+		}
+
+		if err := handle(fields); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,48 @@
+package geo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReverseGeocoder(t *testing.T) {
+	places := strings.Join([]string{
+		"792680\tBelgrade\tBelgrade\t\t44.80401\t20.46513\tP\tPPLC\tRS\t\t00\t\t\t\t1273651\t\t117\tEurope/Belgrade\t2019-09-05",
+		"789518\tKragujevac\tKragujevac\t\t44.01667\t20.91667\tP\tPPLA\tRS\t\t07\t\t\t\t150835\t\t185\tEurope/Belgrade\t2019-09-05",
+		"789128\tJagodina\tJagodina\t\t43.97713\t21.26121\tP\tPPLA\tRS\t\t13\t\t\t\t35589\t\t117\tEurope/Belgrade\t2019-09-05",
+		"2208248\tTaveuni\tTaveuni\t\t-16.85\t179.95\tP\tPPL\tFJ\t\tN\t\t\t\t12000\t\t10\tPacific/Fiji\t2019-09-05",
+	}, "\n")
+
+	regions := "RS.00\tBelgrade\tBelgrade\t785603\nRS.13\tPomoravlje\tPomoravlje\t7581800\n"
+	geocoder, err := LoadGeoNames(strings.NewReader(places), strings.NewReader(regions))
+
+	if err != nil {
+		t.Fatalf("error loading geonames places: %v", err)
+	}
+
+	if geocoder.Len() != 4 {
+		t.Errorf("expected 4 places, got %d", geocoder.Len())
+	}
+
+	place, distance, ok := geocoder.Lookup([]float64{21.2185255, 43.9754164})
+
+	if !ok || place.Name != "Jagodina" || place.Region != "Pomoravlje" || place.Country != "RS" || distance > 5000 {
+		t.Errorf("unexpected place %v at %f meters", place, distance)
+	}
+
+	place, distance, ok = geocoder.Lookup([]float64{-179.95, -16.85})
+
+	if !ok || place.Name != "Taveuni" || place.Region != "N" || distance > 11000 {
+		t.Errorf("unexpected place across the antimeridian %v at %f meters", place, distance)
+	}
+
+	if _, err := LoadGeoNames(strings.NewReader("1\tBroken\tBroken\t\tnorth\t20.0\tP\tPPL\tRS\t\t00"), nil); err == nil {
+		t.Errorf("expected error loading place with invalid latitude")
+	}
+
+	var empty *ReverseGeocoder
+
+	if _, _, ok := empty.Lookup([]float64{20.46513, 44.80401}); ok {
+		t.Errorf("expected no place without loaded places")
+	}
+}
@@ -0,0 +1,103 @@
+package geo
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// Geohash encodes the [longitude, latitude] coordinates as a geohash with the given number of characters
+func Geohash(coordinates []float64, precision int) string {
+	west, east := -180.0, 180.0
+	south, north := -90.0, 90.0
+	hash := strings.Builder{}
+	bits, value := 0, 0
+	even := true
+
+	for hash.Len() < precision {
+		if even {
+			middle := (west + east) / 2
+
+			if coordinates[0] >= middle {
+				value = value<<1 | 1
+				west = middle
+
+			} else {
+				value <<= 1
+				east = middle
+			}
+
+		} else {
+			middle := (south + north) / 2
+
+			if coordinates[1] >= middle {
+				value = value<<1 | 1
+				south = middle
+
+			} else {
+				value <<= 1
+				north = middle
+			}
+		}
+
+		even = !even
+		bits++
+
+		if bits == 5 {
+			hash.WriteByte(geohashAlphabet[value])
+			bits, value = 0, 0
+		}
+	}
+
+	return hash.String()
+}
+
+// GeohashBounds decodes a geohash to the bounding box of its cell
+func GeohashBounds(hash string) (BoundingBox, error) {
+	west, east := -180.0, 180.0
+	south, north := -90.0, 90.0
+	even := true
+
+	for _, character := range hash {
+		value := strings.IndexRune(geohashAlphabet, character)
+
+		if value < 0 {
+			return BoundingBox{}, fmt.Errorf("invalid geohash character '%c' in '%s'", character, hash)
+		}
+
+		for bit := 4; bit >= 0; bit-- {
+			set := value>>bit&1 == 1
+
+			if even {
+				middle := (west + east) / 2
+
+				if set {
+					west = middle
+
+				} else {
+					east = middle
+				}
+
+			} else {
+				middle := (south + north) / 2
+
+				if set {
+					south = middle
+
+				} else {
+					north = middle
+				}
+			}
+
+			even = !even
+		}
+	}
+
+	return BoundingBox{
+		SouthWest: []float64{west, south},
+		NorthEast: []float64{east, north},
+	}, nil
+}
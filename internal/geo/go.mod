@@ -0,0 +1,3 @@
+module github.com/mmilosevicgd/location-tracking/geo
+
+go 1.24.2
@@ -0,0 +1,91 @@
+package geo
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	olcAlphabet          = "23456789CFGHJMPQRVWX"
+	olcSeparator         = '+'
+	olcSeparatorPosition = 8
+	olcPadding           = '0'
+	olcPairLength        = 10
+	olcMaxLength         = 15
+	olcGridColumns       = 4
+	olcGridRows          = 5
+)
+
+// OpenLocationCodeBounds decodes a full open location code, such as 8GQ3RQ7H+3W, to the bounding box of its area
+// short codes are rejected, since they can only be recovered relative to a reference location
+func OpenLocationCodeBounds(code string) (BoundingBox, error) {
+	code = strings.ToUpper(code)
+	separator := strings.IndexRune(code, olcSeparator)
+
+	if separator < 0 || strings.Count(code, string(olcSeparator)) > 1 {
+		return BoundingBox{}, fmt.Errorf("open location code '%s' must contain a single '%c' separator", code, olcSeparator)
+	}
+
+	if separator < olcSeparatorPosition {
+		return BoundingBox{}, fmt.Errorf("open location code '%s' is a short code, only full codes are supported", code)
+	}
+
+	if separator > olcSeparatorPosition {
+		return BoundingBox{}, fmt.Errorf("open location code '%s' has its separator at position %d instead of %d", code, separator, olcSeparatorPosition)
+	}
+
+	if len(code)-separator-1 == 1 {
+		return BoundingBox{}, fmt.Errorf("open location code '%s' must have at least two characters after the separator", code)
+	}
+
+	digits := code[:separator] + code[separator+1:]
+	padding := strings.IndexRune(digits, olcPadding)
+
+	if padding >= 0 {
+		if padding == 0 || padding%2 == 1 || strings.Trim(digits[padding:], string(olcPadding)) != "" || separator != len(code)-1 {
+			return BoundingBox{}, fmt.Errorf("open location code '%s' has invalid padding", code)
+		}
+
+		digits = digits[:padding]
+	}
+
+	if len(digits) > olcMaxLength {
+		return BoundingBox{}, fmt.Errorf("open location code '%s' has more than %d digits", code, olcMaxLength)
+	}
+
+	south, west := -90.0, -180.0
+	latitudeResolution, longitudeResolution := 400.0, 400.0
+
+	for i, character := range digits {
+		value := strings.IndexRune(olcAlphabet, character)
+
+		if value < 0 {
+			return BoundingBox{}, fmt.Errorf("invalid open location code character '%c' in '%s'", character, code)
+		}
+
+		switch {
+		case i < olcPairLength && i%2 == 0:
+			latitudeResolution /= 20
+			south += float64(value) * latitudeResolution
+
+		case i < olcPairLength:
+			longitudeResolution /= 20
+			west += float64(value) * longitudeResolution
+
+		default:
+			latitudeResolution /= olcGridRows
+			longitudeResolution /= olcGridColumns
+			south += float64(value/olcGridColumns) * latitudeResolution
+			west += float64(value%olcGridColumns) * longitudeResolution
+		}
+	}
+
+	if south >= 90 || west >= 180 {
+		return BoundingBox{}, fmt.Errorf("open location code '%s' is outside of the valid coordinate range", code)
+	}
+
+	return BoundingBox{
+		SouthWest: []float64{west, south},
+		NorthEast: []float64{west + longitudeResolution, south + latitudeResolution},
+	}, nil
+}
@@ -0,0 +1,44 @@
+package geo
+
+import (
+	"math"
+)
+
+const (
+	maxMercatorLatitude = 85.0511287798066
+)
+
+// TilePosition projects the [longitude, latitude] coordinates to web mercator and returns their fractional x and y tile coordinates at the zoom level
+// latitudes beyond the web mercator limits are clamped to them
+func TilePosition(coordinates []float64, zoom int) (float64, float64) {
+	tiles := math.Exp2(float64(zoom))
+	latitude := degreesToRadians(math.Max(-maxMercatorLatitude, math.Min(maxMercatorLatitude, coordinates[1])))
+	x := (coordinates[0] + 180) / 360 * tiles
+	y := (1 - math.Log(math.Tan(latitude)+1/math.Cos(latitude))/math.Pi) / 2 * tiles
+
+	return math.Max(0, math.Min(x, tiles-1e-9)), math.Max(0, math.Min(y, tiles-1e-9))
+}
+
+// Tile returns the x and y coordinates of the web mercator tile containing the [longitude, latitude] coordinates at the zoom level
+func Tile(coordinates []float64, zoom int) (int, int) {
+	x, y := TilePosition(coordinates, zoom)
+	return int(x), int(y)
+}
+
+// TileBounds returns the bounding box of the web mercator tile at the zoom level
+func TileBounds(zoom, x, y int) BoundingBox {
+	tiles := math.Exp2(float64(zoom))
+
+	longitude := func(x int) float64 {
+		return float64(x)/tiles*360 - 180
+	}
+
+	latitude := func(y int) float64 {
+		return radiansToDegrees(math.Atan(math.Sinh(math.Pi * (1 - 2*float64(y)/tiles))))
+	}
+
+	return BoundingBox{
+		SouthWest: []float64{longitude(x), latitude(y + 1)},
+		NorthEast: []float64{longitude(x + 1), latitude(y)},
+	}
+}
@@ -0,0 +1,262 @@
+package problem
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// error codes are part of the api, they are only ever added and never change their meaning
+const (
+	CodeInvalidBody      = "invalid_body"
+	CodeValidationFailed = "validation_failed"
+	CodeInvalidRequest   = "invalid_request"
+	CodeInvalidLocation  = "invalid_location"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeUnavailable      = "unavailable"
+	CodeTimeout          = "timeout"
+	CodeCanceled         = "canceled"
+	CodeInternal         = "internal_error"
+
+	// StatusClientClosedRequest is the non-standard status of requests whose client went away before the response was written
+	StatusClientClosedRequest = 499
+
+	ContentType      = "application/problem+json"
+	RequestIDHeader  = "X-Request-Id"
+	typePrefix       = "urn:problem:location-tracking:"
+	maxRequestIDSize = 128
+)
+
+// Problem is an error response as described by rfc 7807, extended with a stable error code, the request id and the violated fields
+type Problem struct {
+	Type       string      `json:"type"`
+	Title      string      `json:"title"`
+	Status     int         `json:"status"`
+	Code       string      `json:"code"`
+	Detail     string      `json:"detail,omitempty"`
+	Instance   string      `json:"instance,omitempty"`
+	RequestID  string      `json:"requestId,omitempty"`
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// Violation is a single field of the request which failed validation
+type Violation struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type requestIDKey struct{}
+
+var (
+	titles = map[string]string{
+		CodeInvalidBody:      "Request body is not valid JSON",
+		CodeValidationFailed: "Request validation failed",
+		CodeInvalidRequest:   "Invalid request",
+		CodeInvalidLocation:  "Invalid location",
+		CodeNotFound:         "Resource not found",
+		CodeConflict:         "Conflict with the current state of the resource",
+		CodeUnavailable:      "Service temporarily unavailable",
+		CodeTimeout:          "Request timed out",
+		CodeCanceled:         "Request canceled by the client",
+		CodeInternal:         "Internal server error",
+	}
+
+	// violationMessages describes the failed validation tags, %s is replaced with the tag parameter
+	violationMessages = map[string]string{
+		"required":          "is required",
+		"required_if":       "is required when %s",
+		"required_without":  "is required when %s is not set",
+		"excluded_with":     "must not be set together with %s",
+		"min":               "must be at least %s",
+		"max":               "must be at most %s",
+		"len":               "must have a length of %s",
+		"gt":                "must be greater than %s",
+		"gte":               "must be greater than or equal to %s",
+		"lt":                "must be less than %s",
+		"lte":               "must be less than or equal to %s",
+		"gtfield":           "must be greater than %s",
+		"nefield":           "must differ from %s",
+		"oneof":             "must be one of: %s",
+		"alphanum":          "must contain only letters and digits",
+		"hexadecimal":       "must be hexadecimal",
+		"http_url":          "must be an http or https url",
+		"customcoordinates": "must be decimal \"latitude, longitude\" coordinates",
+		"customdatetime":    "must be an RFC 3339 date time such as 2025-01-01T00:00:00+00:00",
+	}
+
+	// fieldParameterTags are the validation tags whose parameter names another field
+	fieldParameterTags = map[string]bool{
+		"required_if":      true,
+		"required_without": true,
+		"excluded_with":    true,
+		"gtfield":          true,
+		"nefield":          true,
+	}
+)
+
+// WithRequestID assigns every request an id, taken from the X-Request-Id header if the client sent a valid one, and echoes it in the response header
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID returns the id of the request the context belongs to, or an empty string if it has none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Write writes a problem with the status code, error code and detail as the response
+func Write(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	write(w, r, Problem{
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	})
+}
+
+// WriteValidation writes a bad request problem for the error, listing the violated fields if it comes from the validator
+func WriteValidation(w http.ResponseWriter, r *http.Request, err error) {
+	validationErrors := validator.ValidationErrors{}
+
+	if !errors.As(err, &validationErrors) {
+		Write(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	violations := []Violation{}
+
+	for _, fieldError := range validationErrors {
+		violations = append(violations, newViolation(fieldError))
+	}
+
+	write(w, r, Problem{
+		Status:     http.StatusBadRequest,
+		Code:       CodeValidationFailed,
+		Detail:     fmt.Sprintf("%d field(s) failed validation", len(violations)),
+		Violations: violations,
+	})
+}
+
+// WriteInternal writes an internal server error problem, the cause is only logged and never exposed to the client
+func WriteInternal(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, http.StatusInternalServerError, CodeInternal, "the request could not be processed, please retry later and report the request id if the problem persists")
+}
+
+// WriteError writes the problem of a failed operation, a timeout if its deadline was exceeded, canceled if the client went away and an internal server error otherwise
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		Write(w, r, http.StatusGatewayTimeout, CodeTimeout, "the request did not complete in time, please retry later")
+
+	case errors.Is(err, context.Canceled):
+		Write(w, r, StatusClientClosedRequest, CodeCanceled, "the request was canceled before it completed")
+
+	default:
+		WriteInternal(w, r)
+	}
+}
+
+// write completes the problem with its type, title, instance and request id and writes it as the response
+func write(w http.ResponseWriter, r *http.Request, problem Problem) {
+	problem.Type = typePrefix + problem.Code
+	problem.Title = titles[problem.Code]
+	problem.Instance = r.URL.Path
+	problem.RequestID = RequestID(r.Context())
+
+	log.Printf("request '%s' to %s %s failed with %d %s: %s\n", problem.RequestID, r.Method, r.URL.Path, problem.Status, problem.Code, problem.Detail)
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(problem.Status)
+
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		log.Printf("error encoding problem response: %v\n", err)
+	}
+}
+
+// newViolation converts a validator field error to a violation of the field, named as in the request
+func newViolation(fieldError validator.FieldError) Violation {
+	field := fieldError.Namespace()
+
+	if _, name, ok := strings.Cut(field, "."); ok {
+		field = name
+	}
+
+	parameter := fieldError.Param()
+
+	if fieldParameterTags[fieldError.Tag()] {
+		parameter = lowerFirst(parameter)
+	}
+
+	if name, value, ok := strings.Cut(parameter, " "); ok && fieldError.Tag() == "required_if" {
+		parameter = name + " is " + value
+	}
+
+	message, ok := violationMessages[fieldError.Tag()]
+
+	if !ok {
+		message = "failed the '%s' validation"
+		parameter = fieldError.Tag()
+	}
+
+	if strings.Contains(message, "%s") {
+		message = fmt.Sprintf(message, parameter)
+	}
+
+	return Violation{
+		Field:   field,
+		Code:    fieldError.Tag(),
+		Message: message,
+	}
+}
+
+// lowerFirst lowercases the first letter of a field name, so go field names match the names used in requests
+func lowerFirst(name string) string {
+	if name == "" {
+		return name
+	}
+
+	first, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(first)) + name[size:]
+}
+
+// validRequestID checks if a request id sent by a client is short and printable, so it is safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDSize {
+		return false
+	}
+
+	for _, character := range id {
+		if character < '!' || character > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newRequestID generates a random request id
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
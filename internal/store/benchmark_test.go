@@ -0,0 +1,256 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/model"
+)
+
+const (
+	benchmarkUsers             = 100
+	benchmarkLocationsPerUser  = 2000
+	benchmarkBatchSize         = 1000
+	benchmarkLocationsInterval = int64(time.Second / time.Millisecond)
+)
+
+// benchmarkStorage is a storage of the location history compared by the benchmarks
+type benchmarkStorage struct {
+	name   string
+	spec   db.CollectionSpec
+	store  func(client db.DBClient, collection string) LocationHistoryStore
+	insert func(ctx context.Context, client db.DBClient, collection string, locations []model.LocationInfo) error
+}
+
+// benchmarkStorages are the document, time-series and chunk storages, declared with the indexes the location history management service gives them
+var benchmarkStorages = []benchmarkStorage{
+	{
+		name: "documents",
+		spec: db.CollectionSpec{Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}, {Field: "timestamp", Type: -1}}, Unique: true},
+			{Keys: []db.IndexKey{{Field: "timestamp", Type: -1}}},
+			{Keys: []db.IndexKey{{Field: "location", Type: "2dsphere"}}},
+		}},
+		store: func(client db.DBClient, collection string) LocationHistoryStore {
+			return CreateMongoLocationHistoryStore(client, collection)
+		},
+		insert: insertDocuments(func(location model.LocationInfo) any { return location }),
+	},
+	{
+		name: "timeseries",
+		spec: db.CollectionSpec{TimeSeries: LocationHistoryTimeSeries(), Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}, {Field: "timestamp", Type: 1}}},
+			{Keys: []db.IndexKey{{Field: "location", Type: "2dsphere"}}},
+		}},
+		store: func(client db.DBClient, collection string) LocationHistoryStore {
+			return CreateTimeSeriesLocationHistoryStore(client, collection)
+		},
+		insert: insertDocuments(ToTimeSeriesDocument),
+	},
+	{
+		name: "chunks",
+		spec: db.CollectionSpec{Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}, {Field: "start", Type: 1}}, Unique: true},
+			{Keys: []db.IndexKey{{Field: "first", Type: 1}}},
+		}},
+		store: func(client db.DBClient, collection string) LocationHistoryStore {
+			return CreateChunkedLocationHistoryStore(client, collection, time.Hour)
+		},
+		insert: func(ctx context.Context, client db.DBClient, collection string, locations []model.LocationInfo) error {
+			return CreateChunkedLocationHistoryStore(client, collection, time.Hour).UpsertMany(ctx, locations)
+		},
+	},
+}
+
+// insertDocuments returns a function inserting the locations as the documents they are converted to
+func insertDocuments(toDocument func(location model.LocationInfo) any) func(ctx context.Context, client db.DBClient, collection string, locations []model.LocationInfo) error {
+	return func(ctx context.Context, client db.DBClient, collection string, locations []model.LocationInfo) error {
+		documents := []any{}
+
+		for _, location := range locations {
+			documents = append(documents, toDocument(location))
+		}
+
+		_, err := client.InsertMany(ctx, collection, documents, false)
+		return err
+	}
+}
+
+// benchmarkClient connects to the mongodb of MONGODB_TEST_URI, the benchmarks measure mongodb itself so they are skipped if it is not set
+func benchmarkClient(b *testing.B) db.DBClient {
+	uri := os.Getenv("MONGODB_TEST_URI")
+
+	if uri == "" {
+		b.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	client, err := db.CreateClient(db.ClientInfo{Uri: uri, DefaultDatabase: "location_history_benchmark", Timeouts: db.Timeouts{Default: time.Minute}})
+
+	if err != nil {
+		b.Fatalf("failed to create mongodb client: %v", err)
+	}
+
+	b.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client
+}
+
+// createBenchmarkCollection creates a new collection of the storage and removes its documents when the benchmark ends
+func createBenchmarkCollection(b *testing.B, client db.DBClient, storage benchmarkStorage) string {
+	ctx := context.Background()
+	spec := storage.spec
+	spec.Name = fmt.Sprintf("location-history-benchmark-%s-%d", storage.name, time.Now().UnixNano())
+
+	if _, err := db.ApplySchema(ctx, client, db.Schema{Collections: []db.CollectionSpec{spec}}); err != nil {
+		b.Fatalf("error creating the benchmark collection: %v", err)
+	}
+
+	b.Cleanup(func() { client.DeleteMany(ctx, spec.Name, nil) })
+	return spec.Name
+}
+
+// benchmarkLocation returns the location of a user at the index of its track, a walk east from belgrade with a location every second
+func benchmarkLocation(user, index int) model.LocationInfo {
+	return model.LocationInfo{
+		Username:  fmt.Sprintf("user%d", user),
+		Location:  model.Location{Type: "Point", Coordinates: []float64{20.46 + float64(index)*0.0001, 44.81 + float64(user)*0.001}},
+		Distance:  float64(index) * 7.9,
+		Timestamp: 1700000000000 + int64(index)*benchmarkLocationsInterval,
+	}
+}
+
+// seedBenchmarkCollection inserts the tracks of every user in batches of consecutive locations of a user
+func seedBenchmarkCollection(b *testing.B, client db.DBClient, collection string, storage benchmarkStorage) {
+	ctx := context.Background()
+
+	for user := range benchmarkUsers {
+		for start := 0; start < benchmarkLocationsPerUser; start += benchmarkBatchSize {
+			locations := []model.LocationInfo{}
+
+			for index := start; index < min(start+benchmarkBatchSize, benchmarkLocationsPerUser); index++ {
+				locations = append(locations, benchmarkLocation(user, index))
+			}
+
+			if err := storage.insert(ctx, client, collection, locations); err != nil {
+				b.Fatalf("error seeding the benchmark collection: %v", err)
+			}
+		}
+	}
+}
+
+// BenchmarkLocationHistoryUpsert measures saving locations of many users one at a time, like the ingestion of the service
+func BenchmarkLocationHistoryUpsert(b *testing.B) {
+	client := benchmarkClient(b)
+
+	for _, storage := range benchmarkStorages {
+		b.Run(storage.name, func(b *testing.B) {
+			history := storage.store(client, createBenchmarkCollection(b, client, storage))
+			ctx := context.Background()
+			i := 0
+
+			for b.Loop() {
+				if err := history.Upsert(ctx, benchmarkLocation(i%benchmarkUsers, i/benchmarkUsers)); err != nil {
+					b.Fatalf("error upserting location: %v", err)
+				}
+
+				i++
+			}
+		})
+	}
+}
+
+// BenchmarkLocationHistoryReads measures the reads of the distance and track queries on a seeded collection, and the size of the collection per location
+func BenchmarkLocationHistoryReads(b *testing.B) {
+	client := benchmarkClient(b)
+
+	for _, storage := range benchmarkStorages {
+		collection := createBenchmarkCollection(b, client, storage)
+		seedBenchmarkCollection(b, client, collection, storage)
+		history := storage.store(client, collection)
+		ctx := context.Background()
+		random := rand.New(rand.NewPCG(1, 2))
+
+		b.Run(storage.name+"/latest-before", func(b *testing.B) {
+			for b.Loop() {
+				location := benchmarkLocation(random.IntN(benchmarkUsers), random.IntN(benchmarkLocationsPerUser))
+
+				if _, ok, err := history.LatestBefore(ctx, location.Username, location.Timestamp); err != nil || !ok {
+					b.Fatalf("expected a location before %d, got %v, %v", location.Timestamp, ok, err)
+				}
+			}
+		})
+
+		b.Run(storage.name+"/range-500", func(b *testing.B) {
+			for b.Loop() {
+				location := benchmarkLocation(random.IntN(benchmarkUsers), random.IntN(benchmarkLocationsPerUser-500))
+
+				if locations, err := history.Range(ctx, location.Username, location.Timestamp, location.Timestamp+500*benchmarkLocationsInterval, true, 500); err != nil || len(locations) != 500 {
+					b.Fatalf("expected 500 locations, got %d, %v", len(locations), err)
+				}
+			}
+		})
+
+		b.Run(storage.name+"/distance", func(b *testing.B) {
+			for b.Loop() {
+				start := benchmarkLocation(random.IntN(benchmarkUsers), random.IntN(benchmarkLocationsPerUser))
+
+				if _, err := benchmarkDistance(ctx, history, start.Username, start.Timestamp, start.Timestamp+1000*benchmarkLocationsInterval); err != nil {
+					b.Fatalf("error calculating distance: %v", err)
+				}
+			}
+		})
+
+		b.Run(storage.name+"/storage", func(b *testing.B) {
+			size := int64(0)
+
+			for b.Loop() {
+				size = benchmarkCollectionSize(b, client, collection)
+			}
+
+			b.ReportMetric(float64(size)/(benchmarkUsers*benchmarkLocationsPerUser), "B/location")
+		})
+	}
+}
+
+// benchmarkDistance calculates the distance traveled by a user between two timestamps like the location history management service
+func benchmarkDistance(ctx context.Context, history LocationHistoryStore, username string, start, end int64) (float64, error) {
+	if distances, ok := history.(DistanceStore); ok {
+		return distances.Distance(ctx, username, start, end)
+	}
+
+	first, _, err := history.FirstAfter(ctx, username, start)
+
+	if err != nil {
+		return 0, err
+	}
+
+	last, _, err := history.LatestBefore(ctx, username, end)
+	return last.Distance - first.Distance, err
+}
+
+// benchmarkCollectionSize returns the size of the collection on disk with its indexes
+func benchmarkCollectionSize(b *testing.B, client db.DBClient, collection string) int64 {
+	ctx := context.Background()
+	cursor, err := client.Aggregate(ctx, collection, []map[string]any{{"$collStats": map[string]any{"storageStats": map[string]any{}}}})
+
+	if err != nil {
+		b.Fatalf("error reading the collection stats: %v", err)
+	}
+
+	stats := []struct {
+		StorageStats struct {
+			StorageSize    int64 `bson:"storageSize"`
+			TotalIndexSize int64 `bson:"totalIndexSize"`
+		} `bson:"storageStats"`
+	}{}
+
+	if err := cursor.All(ctx, &stats); err != nil || len(stats) == 0 {
+		b.Fatalf("error decoding the collection stats: %v", err)
+	}
+
+	return stats[0].StorageStats.StorageSize + stats[0].StorageStats.TotalIndexSize
+}
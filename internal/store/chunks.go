@@ -0,0 +1,634 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// chunkEncoding is the version of the encoding of the locations of a chunk, written as the first byte of every segment of packed locations
+	chunkEncoding = 1
+	// coordinateScale is the number of fixed-point units of a degree, about a centimeter at the equator
+	coordinateScale = 1e7
+	// distanceScale is the number of fixed-point units of a kilometer, so distances read back match the computed ones far below a millimeter
+	distanceScale = 1e10
+	// chunkWriteAttempts is how many times a chunk is read and written again after another writer changed it in the meantime
+	chunkWriteAttempts = 10
+	// chunkPageSize is the number of chunks read at a time by range and bounding box queries
+	chunkPageSize = 24
+	// chunkMaxSegments is the number of segments a chunk grows to by appends before the next write packs its locations into a single segment again
+	chunkMaxSegments = 64
+)
+
+// ErrChunkConflict is returned when a chunk could not be written because other writers kept changing it
+var ErrChunkConflict = errors.New("chunk was changed concurrently")
+
+// ChunkedLocationHistoryStore keeps the location history in chunk documents of a db client, one per user and period of time such as an hour
+// the locations of a chunk are packed in timestamp order into segments, the timestamps as varint deltas and the coordinates and cumulative distances as varint deltas of fixed-point numbers
+// every chunk keeps a summary of its locations, so queries find the chunks they need and often answer from the summaries without decoding any locations
+// locations after the last one of their chunk are appended to it as a new segment without reading it, other writes rewrite the chunk as a single segment
+// chunks are rewritten with a version check, so concurrent writers of the same chunk retry instead of losing each other's locations
+type ChunkedLocationHistoryStore struct {
+	client     db.DBClient
+	collection string
+	duration   int64
+}
+
+// locationChunk is a chunk of the locations of a user in a period of time starting at the start timestamp, with the summary of its locations
+type locationChunk struct {
+	ID            string   `bson:"_id"`
+	Username      string   `bson:"username"`
+	Start         int64    `bson:"start"`
+	First         int64    `bson:"first"`
+	Last          int64    `bson:"last"`
+	Count         int      `bson:"count"`
+	StartDistance float64  `bson:"startDistance"`
+	EndDistance   float64  `bson:"endDistance"`
+	West          float64  `bson:"west"`
+	South         float64  `bson:"south"`
+	East          float64  `bson:"east"`
+	North         float64  `bson:"north"`
+	Locations     [][]byte `bson:"locations"`
+	Segments      int      `bson:"segments"`
+	Version       int64    `bson:"version"`
+}
+
+// Upsert stores the location in the chunk of its user and period, replacing the location of the same user with the same timestamp
+func (s ChunkedLocationHistoryStore) Upsert(ctx context.Context, location model.LocationInfo) error {
+	return s.UpsertMany(ctx, []model.LocationInfo{location})
+}
+
+// UpsertMany stores the locations, writing every chunk they fall into once, and replaces the locations of the same user with the same timestamp
+func (s ChunkedLocationHistoryStore) UpsertMany(ctx context.Context, locations []model.LocationInfo) error {
+	chunks := map[string][]model.LocationInfo{}
+	ids := []string{}
+
+	for _, location := range locations {
+		id := chunkID(location.Username, s.chunkStart(location.Timestamp))
+
+		if _, ok := chunks[id]; !ok {
+			ids = append(ids, id)
+		}
+
+		chunks[id] = append(chunks[id], location)
+	}
+
+	for _, id := range ids {
+		if err := s.writeChunk(ctx, id, chunks[id]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeChunk appends the locations to their chunk if they come after its last location, otherwise it merges them into the chunk
+// a merge inserts the chunk if it does not exist yet and rewrites it only if no other writer changed it since it was read
+func (s ChunkedLocationHistoryStore) writeChunk(ctx context.Context, id string, locations []model.LocationInfo) error {
+	appended, err := s.appendChunk(ctx, id, locations)
+
+	if err != nil || appended {
+		return err
+	}
+
+	for range chunkWriteAttempts {
+		existing, ok, err := findFirst[locationChunk](ctx, s.client, s.collection, bson.M{"_id": id}, nil, nil)
+
+		if err != nil {
+			return err
+		}
+
+		merged, err := decodeChunk(existing)
+
+		if err != nil {
+			return err
+		}
+
+		for _, location := range locations {
+			merged = slices.DeleteFunc(merged, func(other model.LocationInfo) bool {
+				return other.Timestamp == location.Timestamp
+			})
+
+			merged = append(merged, location)
+		}
+
+		chunk := encodeChunk(id, locations[0].Username, s.chunkStart(locations[0].Timestamp), merged)
+
+		if !ok {
+			chunk.Version = 1
+			result, err := s.client.InsertMany(ctx, s.collection, []any{chunk}, true)
+
+			if err != nil {
+				return err
+			}
+
+			if len(result.Errors) == 0 {
+				return nil
+			}
+
+			if !result.Errors[0].IsDuplicateKey() {
+				return result.Err()
+			}
+
+			continue
+		}
+
+		chunk.Version = existing.Version + 1
+
+		update := bson.M{
+			"$set": bson.M{
+				"first":         chunk.First,
+				"last":          chunk.Last,
+				"count":         chunk.Count,
+				"startDistance": chunk.StartDistance,
+				"endDistance":   chunk.EndDistance,
+				"west":          chunk.West,
+				"south":         chunk.South,
+				"east":          chunk.East,
+				"north":         chunk.North,
+				"locations":     chunk.Locations,
+				"segments":      chunk.Segments,
+				"version":       chunk.Version,
+			},
+		}
+
+		updated, err := s.client.UpdateMany(ctx, s.collection, bson.M{"_id": id, "version": existing.Version}, update)
+
+		if err != nil {
+			return err
+		}
+
+		if updated > 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("error saving chunk '%s': %w", id, ErrChunkConflict)
+}
+
+// appendChunk appends the locations to their chunk as a new segment and adds them to its summary, without reading or rewriting the locations already in it
+// it reports false without writing anything unless the locations are in timestamp order after the last location of an existing chunk with room for another segment
+func (s ChunkedLocationHistoryStore) appendChunk(ctx context.Context, id string, locations []model.LocationInfo) (bool, error) {
+	for i := 1; i < len(locations); i++ {
+		if locations[i].Timestamp <= locations[i-1].Timestamp {
+			return false, nil
+		}
+	}
+
+	chunk := encodeChunk(id, locations[0].Username, s.chunkStart(locations[0].Timestamp), locations)
+
+	filter := bson.M{
+		"_id": id,
+		"last": bson.M{
+			"$lt": chunk.First,
+		},
+		"segments": bson.M{
+			"$lt": chunkMaxSegments,
+		},
+	}
+
+	update := bson.M{
+		"$push": bson.M{
+			"locations": chunk.Locations[0],
+		},
+		"$inc": bson.M{
+			"count":    chunk.Count,
+			"segments": 1,
+			"version":  1,
+		},
+		"$set": bson.M{
+			"endDistance": chunk.EndDistance,
+		},
+		"$min": bson.M{
+			"west":  chunk.West,
+			"south": chunk.South,
+		},
+		"$max": bson.M{
+			"last":  chunk.Last,
+			"east":  chunk.East,
+			"north": chunk.North,
+		},
+	}
+
+	updated, err := s.client.UpdateMany(ctx, s.collection, filter, update)
+	return updated > 0, err
+}
+
+// Latest retrieves the latest location of a user and reports whether the user has one
+func (s ChunkedLocationHistoryStore) Latest(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	filter := bson.M{
+		"username": username,
+	}
+
+	return s.findLocation(ctx, filter, -1, func(location model.LocationInfo) bool { return true })
+}
+
+// LatestBefore retrieves the latest location of a user at or before the unix millisecond timestamp and reports whether there is one
+func (s ChunkedLocationHistoryStore) LatestBefore(ctx context.Context, username string, before int64) (model.LocationInfo, bool, error) {
+	filter := bson.M{
+		"username": username,
+		"first": bson.M{
+			"$lte": before,
+		},
+	}
+
+	return s.findLocation(ctx, filter, -1, func(location model.LocationInfo) bool { return location.Timestamp <= before })
+}
+
+// FirstAfter retrieves the first location of a user at or after the unix millisecond timestamp and reports whether there is one
+func (s ChunkedLocationHistoryStore) FirstAfter(ctx context.Context, username string, after int64) (model.LocationInfo, bool, error) {
+	filter := bson.M{
+		"username": username,
+		"last": bson.M{
+			"$gte": after,
+		},
+	}
+
+	return s.findLocation(ctx, filter, 1, func(location model.LocationInfo) bool { return location.Timestamp >= after })
+}
+
+// LatestPosition retrieves the latest location of a user and reports whether the user has one, its chunk is decoded whole so it reads the whole location
+func (s ChunkedLocationHistoryStore) LatestPosition(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	return s.Latest(ctx, username)
+}
+
+// DistanceBefore retrieves the cumulative distance of the latest location of a user at or before the unix millisecond timestamp and reports whether there is one
+func (s ChunkedLocationHistoryStore) DistanceBefore(ctx context.Context, username string, before int64) (float64, bool, error) {
+	location, ok, err := s.LatestBefore(ctx, username, before)
+	return location.Distance, ok, err
+}
+
+// DistanceAfter retrieves the cumulative distance of the first location of a user at or after the unix millisecond timestamp and reports whether there is one
+func (s ChunkedLocationHistoryStore) DistanceAfter(ctx context.Context, username string, after int64) (float64, bool, error) {
+	location, ok, err := s.FirstAfter(ctx, username, after)
+	return location.Distance, ok, err
+}
+
+// findLocation decodes the first chunk matching the filter in the order of their start and returns its first location matching in the same order
+// the filter only matches chunks with a matching location, so a single chunk is decoded
+func (s ChunkedLocationHistoryStore) findLocation(ctx context.Context, filter map[string]any, order int, matches func(location model.LocationInfo) bool) (model.LocationInfo, bool, error) {
+	chunk, ok, err := findFirst[locationChunk](ctx, s.client, s.collection, filter, nil, bson.M{"start": order})
+
+	if err != nil || !ok {
+		return model.LocationInfo{}, false, err
+	}
+
+	return matchLocation(chunk, order, matches)
+}
+
+// matchLocation decodes the chunk and returns its first location matching in timestamp order, or in reverse order if the order is negative
+func matchLocation(chunk locationChunk, order int, matches func(location model.LocationInfo) bool) (model.LocationInfo, bool, error) {
+	locations, err := decodeChunk(chunk)
+
+	if err != nil {
+		return model.LocationInfo{}, false, err
+	}
+
+	if order < 0 {
+		slices.Reverse(locations)
+	}
+
+	for _, location := range locations {
+		if matches(location) {
+			return location, true, nil
+		}
+	}
+
+	return model.LocationInfo{}, false, nil
+}
+
+// Range retrieves at most the limit of locations of a user after a unix millisecond timestamp, or at it if inclusive, and up to the end timestamp ordered by timestamp
+// chunks are read in pages by their start, and only the chunks overlapping the range are decoded
+func (s ChunkedLocationHistoryStore) Range(ctx context.Context, username string, after, end int64, inclusive bool, limit int) ([]model.LocationInfo, error) {
+	locations := []model.LocationInfo{}
+	from := int64(math.MinInt64)
+
+	for {
+		filter := bson.M{
+			"username": username,
+			"start": bson.M{
+				"$gt": from,
+			},
+			"last": bson.M{
+				"$gte": after,
+			},
+			"first": bson.M{
+				"$lte": end,
+			},
+		}
+
+		chunks, err := findAll[locationChunk](ctx, s.client, s.collection, filter, nil, bson.M{"start": 1}, 1, chunkPageSize)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, chunk := range chunks {
+			decoded, err := decodeChunk(chunk)
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, location := range decoded {
+				if (location.Timestamp > after || inclusive && location.Timestamp == after) && location.Timestamp <= end {
+					locations = append(locations, location)
+				}
+			}
+
+			if limit > 0 && len(locations) >= limit {
+				return locations[:limit], nil
+			}
+		}
+
+		if len(chunks) < chunkPageSize {
+			return locations, nil
+		}
+
+		from = chunks[len(chunks)-1].Start
+	}
+}
+
+// Within retrieves a page of the locations of all users inside the bounding box and between two unix millisecond timestamps
+// the chunks are found by their bounding boxes and read in the order of their _id, and their locations are checked against the bounding box itself
+// the page is keyed by the _id of its last chunk and holds every matching location of its chunks, so it has at least the limit of locations unless it is the last one
+func (s ChunkedLocationHistoryStore) Within(ctx context.Context, box geo.BoundingBox, start, end int64, after string, limit int) ([]model.LocationInfo, string, error) {
+	locations := []model.LocationInfo{}
+
+	for {
+		filter := bson.M{
+			"_id": bson.M{
+				"$gt": after,
+			},
+			"first": bson.M{
+				"$lte": end,
+			},
+			"last": bson.M{
+				"$gte": start,
+			},
+			"south": bson.M{
+				"$lte": box.NorthEast[1],
+			},
+			"north": bson.M{
+				"$gte": box.SouthWest[1],
+			},
+			"$or": chunkLongitudeFilter(box),
+		}
+
+		chunks, err := findAll[locationChunk](ctx, s.client, s.collection, filter, nil, bson.M{"_id": 1}, 1, chunkPageSize)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, chunk := range chunks {
+			decoded, err := decodeChunk(chunk)
+
+			if err != nil {
+				return nil, "", err
+			}
+
+			for _, location := range decoded {
+				if location.Timestamp >= start && location.Timestamp <= end && box.Contains(location.Location.Coordinates) {
+					locations = append(locations, location)
+				}
+			}
+
+			after = chunk.ID
+
+			if limit > 0 && len(locations) >= limit {
+				return locations, after, nil
+			}
+		}
+
+		if len(chunks) < chunkPageSize {
+			return locations, "", nil
+		}
+	}
+}
+
+// chunkLongitudeFilter returns the conditions of which one must hold for the longitudes of a chunk to overlap the bounding box
+// bounding boxes crossing the antimeridian overlap the chunks reaching east of their west edge or west of their east edge
+func chunkLongitudeFilter(box geo.BoundingBox) []bson.M {
+	west := bson.M{"east": bson.M{"$gte": box.SouthWest[0]}}
+	east := bson.M{"west": bson.M{"$lte": box.NorthEast[0]}}
+
+	if box.SouthWest[0] > box.NorthEast[0] {
+		return []bson.M{west, east}
+	}
+
+	return []bson.M{{"$and": []bson.M{west, east}}}
+}
+
+// Distance calculates the distance traveled by a user between two unix millisecond timestamps from the cumulative distances of the locations closest to them
+// the distances are taken from the summaries of the chunks at the boundaries, which are only decoded if a boundary falls between their first and last location
+func (s ChunkedLocationHistoryStore) Distance(ctx context.Context, username string, start, end int64) (float64, error) {
+	initialDistance, finalDistance := 0.0, 0.0
+
+	filter := bson.M{
+		"username": username,
+		"last": bson.M{
+			"$gte": start,
+		},
+	}
+
+	first, ok, err := findFirst[locationChunk](ctx, s.client, s.collection, filter, nil, bson.M{"start": 1})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if ok && start <= first.First {
+		initialDistance = first.StartDistance
+
+	} else if ok {
+		location, _, err := matchLocation(first, 1, func(location model.LocationInfo) bool { return location.Timestamp >= start })
+
+		if err != nil {
+			return 0, err
+		}
+
+		initialDistance = location.Distance
+	}
+
+	filter = bson.M{
+		"username": username,
+		"first": bson.M{
+			"$lte": end,
+		},
+	}
+
+	last, ok, err := findFirst[locationChunk](ctx, s.client, s.collection, filter, nil, bson.M{"start": -1})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if ok && end >= last.Last {
+		finalDistance = last.EndDistance
+
+	} else if ok {
+		location, _, err := matchLocation(last, -1, func(location model.LocationInfo) bool { return location.Timestamp <= end })
+
+		if err != nil {
+			return 0, err
+		}
+
+		finalDistance = location.Distance
+	}
+
+	return finalDistance - initialDistance, nil
+}
+
+// chunkStart returns the start of the period of the chunk of the unix millisecond timestamp
+func (s ChunkedLocationHistoryStore) chunkStart(timestamp int64) int64 {
+	return timestamp - ((timestamp%s.duration)+s.duration)%s.duration
+}
+
+// chunkID returns the _id of the chunk of a user starting at the unix millisecond timestamp
+func chunkID(username string, start int64) string {
+	return fmt.Sprintf("%s/%d", username, start)
+}
+
+// encodeChunk packs the locations of a user into a chunk of a single segment with their summary
+func encodeChunk(id, username string, start int64, locations []model.LocationInfo) locationChunk {
+	slices.SortFunc(locations, func(a, b model.LocationInfo) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+
+	chunk := locationChunk{
+		ID:            id,
+		Username:      username,
+		Start:         start,
+		First:         locations[0].Timestamp,
+		Last:          locations[len(locations)-1].Timestamp,
+		Count:         len(locations),
+		StartDistance: locations[0].Distance,
+		EndDistance:   locations[len(locations)-1].Distance,
+		West:          math.Inf(1),
+		South:         math.Inf(1),
+		East:          math.Inf(-1),
+		North:         math.Inf(-1),
+		Locations:     [][]byte{encodeSegment(start, locations)},
+		Segments:      1,
+	}
+
+	for _, location := range locations {
+		coordinates := location.Location.Coordinates
+		chunk.West, chunk.East = min(chunk.West, coordinates[0]), max(chunk.East, coordinates[0])
+		chunk.South, chunk.North = min(chunk.South, coordinates[1]), max(chunk.North, coordinates[1])
+	}
+
+	return chunk
+}
+
+// encodeSegment packs locations in timestamp order into a segment, starting from the start of their chunk
+// every location is written as the varint delta of its timestamp and the zigzag varint deltas of its fixed-point longitude, latitude and cumulative distance
+func encodeSegment(start int64, locations []model.LocationInfo) []byte {
+	segment := []byte{chunkEncoding}
+	timestamp := start
+	longitude, latitude, distance := int64(0), int64(0), int64(0)
+
+	for _, location := range locations {
+		coordinates := location.Location.Coordinates
+		nextLongitude, nextLatitude := toFixed(coordinates[0], coordinateScale), toFixed(coordinates[1], coordinateScale)
+		nextDistance := toFixed(location.Distance, distanceScale)
+
+		segment = binary.AppendUvarint(segment, uint64(location.Timestamp-timestamp))
+		segment = binary.AppendVarint(segment, nextLongitude-longitude)
+		segment = binary.AppendVarint(segment, nextLatitude-latitude)
+		segment = binary.AppendVarint(segment, nextDistance-distance)
+
+		timestamp, longitude, latitude, distance = location.Timestamp, nextLongitude, nextLatitude, nextDistance
+	}
+
+	return segment
+}
+
+// decodeChunk unpacks the locations of a chunk in timestamp order, a chunk without packed locations has none
+// segments are appended in timestamp order, so the locations of a chunk are the ones of its segments one after the other
+func decodeChunk(chunk locationChunk) ([]model.LocationInfo, error) {
+	locations := make([]model.LocationInfo, 0, chunk.Count)
+
+	for _, segment := range chunk.Locations {
+		decoded, err := decodeSegment(chunk, segment)
+
+		if err != nil {
+			return nil, err
+		}
+
+		locations = append(locations, decoded...)
+	}
+
+	return locations, nil
+}
+
+// decodeSegment unpacks the locations of a segment of the chunk in timestamp order
+func decodeSegment(chunk locationChunk, segment []byte) ([]model.LocationInfo, error) {
+	if len(segment) == 0 || segment[0] != chunkEncoding {
+		return nil, fmt.Errorf("error decoding chunk '%s': unknown encoding", chunk.ID)
+	}
+
+	locations := []model.LocationInfo{}
+	data := segment[1:]
+	timestamp := chunk.Start
+	longitude, latitude, distance := int64(0), int64(0), int64(0)
+
+	for len(data) > 0 {
+		delta, n := binary.Uvarint(data)
+
+		if n <= 0 {
+			return nil, fmt.Errorf("error decoding chunk '%s': invalid timestamp", chunk.ID)
+		}
+
+		data = data[n:]
+		deltas := [3]int64{}
+
+		for i := range deltas {
+			deltas[i], n = binary.Varint(data)
+
+			if n <= 0 {
+				return nil, fmt.Errorf("error decoding chunk '%s': invalid location", chunk.ID)
+			}
+
+			data = data[n:]
+		}
+
+		timestamp += int64(delta)
+		longitude, latitude, distance = longitude+deltas[0], latitude+deltas[1], distance+deltas[2]
+
+		locations = append(locations, model.LocationInfo{
+			Username:  chunk.Username,
+			Location:  model.Location{Type: "Point", Coordinates: []float64{float64(longitude) / coordinateScale, float64(latitude) / coordinateScale}},
+			Distance:  float64(distance) / distanceScale,
+			Timestamp: timestamp,
+		})
+	}
+
+	return locations, nil
+}
+
+// toFixed converts a number to a fixed-point number with the scale
+func toFixed(value, scale float64) int64 {
+	return int64(math.Round(value * scale))
+}
+
+// CreateChunkedLocationHistoryStore creates a store of the location history in chunks of the duration in the collection of the db client
+func CreateChunkedLocationHistoryStore(client db.DBClient, collection string, duration time.Duration) ChunkedLocationHistoryStore {
+	return ChunkedLocationHistoryStore{
+		client:     client,
+		collection: collection,
+		duration:   duration.Milliseconds(),
+	}
+}
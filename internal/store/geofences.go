@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Geofence is a circle or a polygon users are notified of entering, dwelling in and exiting
+// circles are stored with a polygon enclosing them as their geometry, so a single 2dsphere query finds every kind of geofence and circles are then checked by their radius
+type Geofence struct {
+	ID        string           `bson:"_id" json:"id"`
+	Name      string           `bson:"name" json:"name"`
+	Type      string           `bson:"type" json:"type"`
+	Center    []float64        `bson:"center,omitempty" json:"center,omitempty"`
+	Radius    float64          `bson:"radius,omitempty" json:"radius,omitempty"`
+	Geometry  GeofenceGeometry `bson:"geometry" json:"geometry"`
+	DwellTime int64            `bson:"dwellTime" json:"dwellTime"`
+}
+
+// GeofenceGeometry is the geojson polygon of a geofence
+type GeofenceGeometry struct {
+	Type        string        `bson:"type" json:"type"`
+	Coordinates [][][]float64 `bson:"coordinates" json:"coordinates"`
+}
+
+// GeofenceState is a geofence a user is inside of, identified by the username and the geofence id
+type GeofenceState struct {
+	ID        string `bson:"_id"`
+	Username  string `bson:"username"`
+	FenceID   string `bson:"fenceId"`
+	FenceName string `bson:"fenceName"`
+	EnteredAt int64  `bson:"enteredAt"`
+	Dwelled   bool   `bson:"dwelled"`
+}
+
+// GeofenceEvent is a user entering, dwelling in or exiting a geofence
+type GeofenceEvent struct {
+	ID        string         `bson:"_id" json:"id"`
+	Type      string         `bson:"type" json:"type"`
+	FenceID   string         `bson:"fenceId" json:"fenceId"`
+	FenceName string         `bson:"fenceName" json:"fenceName"`
+	Username  string         `bson:"username" json:"username"`
+	Location  model.Location `bson:"location" json:"location"`
+	Timestamp int64          `bson:"timestamp" json:"timestamp"`
+}
+
+// GeofenceStore keeps the geofences, the geofences every user is inside of and the geofence events in collections of a db client
+type GeofenceStore struct {
+	client     db.DBClient
+	collection string
+	states     string
+	events     string
+}
+
+// Save saves or replaces a geofence
+func (s GeofenceStore) Save(ctx context.Context, fence Geofence) error {
+	return s.client.SaveOrReplaceDocument(ctx, s.collection, fence, bson.M{"_id": fence.ID})
+}
+
+// Get retrieves a single geofence by its id and reports whether it exists
+func (s GeofenceStore) Get(ctx context.Context, id string) (Geofence, bool, error) {
+	return findFirst[Geofence](ctx, s.client, s.collection, bson.M{"_id": id}, nil, nil)
+}
+
+// List retrieves a page of geofences ordered by name
+func (s GeofenceStore) List(ctx context.Context, pageNumber, pageSize int) ([]Geofence, error) {
+	sort := bson.M{
+		"name": 1,
+	}
+
+	return findAll[Geofence](ctx, s.client, s.collection, bson.M{}, nil, sort, pageNumber, pageSize)
+}
+
+// Delete deletes a geofence together with the states of the users inside of it and reports whether it existed
+// the states are deleted even if the geofence no longer exists, so deleting it again cleans up after a failed delete
+func (s GeofenceStore) Delete(ctx context.Context, id string) (bool, error) {
+	ok, err := s.client.DeleteDocument(ctx, s.collection, bson.M{"_id": id})
+
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := s.client.DeleteMany(ctx, s.states, bson.M{"fenceId": id}); err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
+// Containing retrieves up to the limit of geofences whose geometry contains the location
+func (s GeofenceStore) Containing(ctx context.Context, location model.Location, limit int) ([]Geofence, error) {
+	filter := bson.M{
+		"geometry": bson.M{
+			"$geoIntersects": bson.M{
+				"$geometry": location,
+			},
+		},
+	}
+
+	return findAll[Geofence](ctx, s.client, s.collection, filter, nil, nil, 1, limit)
+}
+
+// States retrieves up to the limit of geofences the user is inside of
+func (s GeofenceStore) States(ctx context.Context, username string, limit int) ([]GeofenceState, error) {
+	filter := bson.M{
+		"username": username,
+	}
+
+	return findAll[GeofenceState](ctx, s.client, s.states, filter, nil, nil, 1, limit)
+}
+
+// SaveState saves or replaces the state of a user inside of a geofence
+func (s GeofenceStore) SaveState(ctx context.Context, state GeofenceState) error {
+	return s.client.SaveOrReplaceDocument(ctx, s.states, state, bson.M{"_id": state.ID})
+}
+
+// DeleteState deletes the state of a user who exited a geofence
+func (s GeofenceStore) DeleteState(ctx context.Context, id string) error {
+	_, err := s.client.DeleteDocument(ctx, s.states, bson.M{"_id": id})
+	return err
+}
+
+// SaveEvent saves or replaces a geofence event
+func (s GeofenceStore) SaveEvent(ctx context.Context, event GeofenceEvent) error {
+	return s.client.SaveOrReplaceDocument(ctx, s.events, event, bson.M{"_id": event.ID})
+}
+
+// Events retrieves a page of geofence events of a user, a geofence or both, latest first, an empty username or geofence id matches every one
+func (s GeofenceStore) Events(ctx context.Context, username, fenceID string, pageNumber, pageSize int) ([]GeofenceEvent, error) {
+	filter := bson.M{}
+
+	if username != "" {
+		filter["username"] = username
+	}
+
+	if fenceID != "" {
+		filter["fenceId"] = fenceID
+	}
+
+	sort := bson.M{
+		"timestamp": -1,
+	}
+
+	return findAll[GeofenceEvent](ctx, s.client, s.events, filter, nil, sort, pageNumber, pageSize)
+}
+
+// CreateGeofenceStore creates a store of the geofences, the geofence states and the geofence events in the collections of the db client
+func CreateGeofenceStore(client db.DBClient, collection, states, events string) GeofenceStore {
+	return GeofenceStore{
+		client:     client,
+		collection: collection,
+		states:     states,
+		events:     events,
+	}
+}
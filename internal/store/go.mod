@@ -0,0 +1,31 @@
+module github.com/mmilosevicgd/location-tracking/store
+
+go 1.24.2
+
+replace github.com/mmilosevicgd/location-tracking/db => ../db
+
+replace github.com/mmilosevicgd/location-tracking/geo => ../geo
+
+replace github.com/mmilosevicgd/location-tracking/model => ../model
+
+require (
+	github.com/mmilosevicgd/location-tracking/db v0.0.0-00010101000000-000000000000
+	github.com/mmilosevicgd/location-tracking/geo v0.0.0-00010101000000-000000000000
+	github.com/mmilosevicgd/location-tracking/model v0.0.0-00010101000000-000000000000
+	go.mongodb.org/mongo-driver v1.17.2
+	go.mongodb.org/mongo-driver/v2 v2.0.0
+)
+
+require (
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/klauspost/compress v1.16.7 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.2 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
+	go.etcd.io/bbolt v1.4.3 // indirect
+	golang.org/x/crypto v0.32.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
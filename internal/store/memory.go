@@ -0,0 +1,270 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+)
+
+// MemoryCurrentLocationStore keeps the current locations in a map by username, so they are looked up without any query evaluation
+type MemoryCurrentLocationStore struct {
+	mutex     *sync.RWMutex
+	locations map[string]model.LocationInfo
+}
+
+// Upsert stores the location as the current location of its user, replacing the previous one
+func (s *MemoryCurrentLocationStore) Upsert(ctx context.Context, location model.LocationInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.locations[location.Username] = location
+	return nil
+}
+
+// Get retrieves the current location of a user and reports whether the user has one
+func (s *MemoryCurrentLocationStore) Get(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return model.LocationInfo{}, false, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	location, ok := s.locations[username]
+	return location, ok, nil
+}
+
+// Near retrieves the usernames of the users within the distance in meters from the [longitude, latitude] coordinates, ordered by username and paginated
+func (s *MemoryCurrentLocationStore) Near(ctx context.Context, coordinates []float64, distance float64, pageNumber, pageSize int) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	usernames := []string{}
+
+	for username, location := range s.locations {
+		if geo.Distance(coordinates, location.Location.Coordinates) <= distance {
+			usernames = append(usernames, username)
+		}
+	}
+
+	s.mutex.RUnlock()
+	slices.Sort(usernames)
+	return page(usernames, pageNumber, pageSize), nil
+}
+
+// Within retrieves at most the limit of current locations inside the bounding box, ordered by username
+func (s *MemoryCurrentLocationStore) Within(ctx context.Context, box geo.BoundingBox, limit int) ([]model.LocationInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	locations := []model.LocationInfo{}
+
+	for _, location := range s.locations {
+		if box.Contains(location.Location.Coordinates) {
+			locations = append(locations, location)
+		}
+	}
+
+	s.mutex.RUnlock()
+	slices.SortFunc(locations, compareLocations)
+	return page(locations, 1, limit), nil
+}
+
+// MemoryLocationHistoryStore keeps the locations of every user in a slice ordered by timestamp, so ranges are found by binary search
+type MemoryLocationHistoryStore struct {
+	mutex     *sync.RWMutex
+	locations map[string][]model.LocationInfo
+}
+
+// Upsert stores the location, replacing the location of the same user with the same timestamp
+func (s *MemoryLocationHistoryStore) Upsert(ctx context.Context, location model.LocationInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	locations := s.locations[location.Username]
+	i, found := slices.BinarySearchFunc(locations, location.Timestamp, compareTimestamp)
+
+	if found {
+		locations[i] = location
+
+	} else {
+		s.locations[location.Username] = slices.Insert(locations, i, location)
+	}
+
+	return nil
+}
+
+// Latest retrieves the latest location of a user and reports whether the user has one
+func (s *MemoryLocationHistoryStore) Latest(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return model.LocationInfo{}, false, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	locations := s.locations[username]
+
+	if len(locations) == 0 {
+		return model.LocationInfo{}, false, nil
+	}
+
+	return locations[len(locations)-1], true, nil
+}
+
+// LatestBefore retrieves the latest location of a user at or before the unix millisecond timestamp and reports whether there is one
+func (s *MemoryLocationHistoryStore) LatestBefore(ctx context.Context, username string, before int64) (model.LocationInfo, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return model.LocationInfo{}, false, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	locations := s.locations[username]
+	i, found := slices.BinarySearchFunc(locations, before, compareTimestamp)
+
+	if found {
+		return locations[i], true, nil
+	}
+
+	if i == 0 {
+		return model.LocationInfo{}, false, nil
+	}
+
+	return locations[i-1], true, nil
+}
+
+// FirstAfter retrieves the first location of a user at or after the unix millisecond timestamp and reports whether there is one
+func (s *MemoryLocationHistoryStore) FirstAfter(ctx context.Context, username string, after int64) (model.LocationInfo, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return model.LocationInfo{}, false, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	locations := s.locations[username]
+	i, _ := slices.BinarySearchFunc(locations, after, compareTimestamp)
+
+	if i == len(locations) {
+		return model.LocationInfo{}, false, nil
+	}
+
+	return locations[i], true, nil
+}
+
+// LatestPosition retrieves the latest location of a user and reports whether the user has one, the locations are kept in memory so it reads the whole location
+func (s *MemoryLocationHistoryStore) LatestPosition(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	return s.Latest(ctx, username)
+}
+
+// DistanceBefore retrieves the cumulative distance of the latest location of a user at or before the unix millisecond timestamp and reports whether there is one
+func (s *MemoryLocationHistoryStore) DistanceBefore(ctx context.Context, username string, before int64) (float64, bool, error) {
+	location, ok, err := s.LatestBefore(ctx, username, before)
+	return location.Distance, ok, err
+}
+
+// DistanceAfter retrieves the cumulative distance of the first location of a user at or after the unix millisecond timestamp and reports whether there is one
+func (s *MemoryLocationHistoryStore) DistanceAfter(ctx context.Context, username string, after int64) (float64, bool, error) {
+	location, ok, err := s.FirstAfter(ctx, username, after)
+	return location.Distance, ok, err
+}
+
+// Range retrieves at most the limit of locations of a user after a unix millisecond timestamp, or at it if inclusive, and up to the end timestamp ordered by timestamp
+func (s *MemoryLocationHistoryStore) Range(ctx context.Context, username string, after, end int64, inclusive bool, limit int) ([]model.LocationInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	locations := s.locations[username]
+	i, found := slices.BinarySearchFunc(locations, after, compareTimestamp)
+
+	if found && !inclusive {
+		i++
+	}
+
+	result := []model.LocationInfo{}
+
+	for ; i < len(locations) && locations[i].Timestamp <= end && (limit <= 0 || len(result) < limit); i++ {
+		result = append(result, locations[i])
+	}
+
+	return result, nil
+}
+
+// Within retrieves a page of the locations of all users inside the bounding box and between two unix millisecond timestamps in timestamp order
+func (s *MemoryLocationHistoryStore) Within(ctx context.Context, box geo.BoundingBox, start, end int64, after string, limit int) ([]model.LocationInfo, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	return withinPage(start, end, after, limit, func(from, to int64, limit int) ([]model.LocationInfo, error) {
+		s.mutex.RLock()
+		locations := []model.LocationInfo{}
+
+		for _, userLocations := range s.locations {
+			for _, location := range userLocations {
+				if location.Timestamp >= from && location.Timestamp <= to && box.Contains(location.Location.Coordinates) {
+					locations = append(locations, location)
+				}
+			}
+		}
+
+		s.mutex.RUnlock()
+
+		slices.SortFunc(locations, func(a, b model.LocationInfo) int {
+			return cmp.Or(cmp.Compare(a.Timestamp, b.Timestamp), cmp.Compare(a.Username, b.Username))
+		})
+
+		return page(locations, 1, limit), nil
+	})
+}
+
+// compareTimestamp compares the timestamp of a location to a unix millisecond timestamp
+func compareTimestamp(location model.LocationInfo, timestamp int64) int {
+	return cmp.Compare(location.Timestamp, timestamp)
+}
+
+// compareLocations orders locations by username and timestamp
+func compareLocations(a, b model.LocationInfo) int {
+	return cmp.Or(cmp.Compare(a.Username, b.Username), cmp.Compare(a.Timestamp, b.Timestamp))
+}
+
+// page returns the page of the values with the 1-based page number, a page size of 0 returns every value
+func page[T any](values []T, pageNumber, pageSize int) []T {
+	if pageSize <= 0 {
+		return values
+	}
+
+	start := min(len(values), pageSize*(max(pageNumber, 1)-1))
+	return values[start:min(len(values), start+pageSize)]
+}
+
+// CreateMemoryCurrentLocationStore creates an empty in-memory store of the current locations
+func CreateMemoryCurrentLocationStore() *MemoryCurrentLocationStore {
+	return &MemoryCurrentLocationStore{
+		mutex:     &sync.RWMutex{},
+		locations: map[string]model.LocationInfo{},
+	}
+}
+
+// CreateMemoryLocationHistoryStore creates an empty in-memory store of the location history
+func CreateMemoryLocationHistoryStore() *MemoryLocationHistoryStore {
+	return &MemoryLocationHistoryStore{
+		mutex:     &sync.RWMutex{},
+		locations: map[string][]model.LocationInfo{},
+	}
+}
@@ -0,0 +1,313 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MongoCurrentLocationStore keeps the current locations in a collection of a db client, one document per user
+// it works with every db client, since the embedded and in-memory backends evaluate the same queries as mongodb
+type MongoCurrentLocationStore struct {
+	client     db.DBClient
+	collection string
+}
+
+// Upsert stores the location as the current location of its user, replacing the previous one
+func (s MongoCurrentLocationStore) Upsert(ctx context.Context, location model.LocationInfo) error {
+	filter := bson.M{
+		"username": location.Username,
+	}
+
+	return s.client.SaveOrReplaceDocument(ctx, s.collection, location, filter)
+}
+
+// Get retrieves the current location of a user and reports whether the user has one
+func (s MongoCurrentLocationStore) Get(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	filter := bson.M{
+		"username": username,
+	}
+
+	return findFirst[model.LocationInfo](ctx, s.client, s.collection, filter, nil, nil)
+}
+
+// Near retrieves the usernames of the users within the distance in meters from the [longitude, latitude] coordinates, ordered by username and paginated
+func (s MongoCurrentLocationStore) Near(ctx context.Context, coordinates []float64, distance float64, pageNumber, pageSize int) ([]string, error) {
+	filter := bson.M{
+		"location": bson.M{
+			"$near": bson.M{
+				"$geometry": model.Location{
+					Type:        "Point",
+					Coordinates: coordinates,
+				},
+				"$maxDistance": distance,
+			},
+		},
+	}
+
+	projection := bson.M{
+		"username": 1,
+	}
+
+	sort := bson.M{
+		"username": 1,
+	}
+
+	rawUsernames, err := findAll[struct {
+		Username string `bson:"username"`
+	}](ctx, s.client, s.collection, filter, projection, sort, pageNumber, pageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	usernames := []string{}
+
+	for _, rawUsername := range rawUsernames {
+		usernames = append(usernames, rawUsername.Username)
+	}
+
+	return usernames, nil
+}
+
+// Within retrieves at most the limit of current locations inside the polygon of the bounding box using the 2dsphere index
+// the edges of the polygon are geodesics, so locations close to the edges may lie outside the box itself
+func (s MongoCurrentLocationStore) Within(ctx context.Context, box geo.BoundingBox, limit int) ([]model.LocationInfo, error) {
+	filter := bson.M{
+		"location": db.GeoWithinPolygon(box.Polygon()),
+	}
+
+	return findAll[model.LocationInfo](ctx, s.client, s.collection, filter, nil, nil, 1, limit)
+}
+
+// MongoLocationHistoryStore keeps the location history in a collection of a db client, one document per user and timestamp
+// it works with every db client, since the embedded and in-memory backends evaluate the same queries as mongodb
+type MongoLocationHistoryStore struct {
+	client     db.DBClient
+	collection string
+}
+
+// Upsert stores the location, replacing the location of the same user with the same timestamp
+func (s MongoLocationHistoryStore) Upsert(ctx context.Context, location model.LocationInfo) error {
+	filter := bson.M{
+		"username":  location.Username,
+		"timestamp": location.Timestamp,
+	}
+
+	return s.client.SaveOrReplaceDocument(ctx, s.collection, location, filter)
+}
+
+// Latest retrieves the latest location of a user and reports whether the user has one
+func (s MongoLocationHistoryStore) Latest(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	return s.latest(ctx, username, nil)
+}
+
+// LatestPosition retrieves the coordinates, cumulative distance and timestamp of the latest location of a user and reports whether the user has one
+func (s MongoLocationHistoryStore) LatestPosition(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	projection := bson.M{
+		"location":  1,
+		"distance":  1,
+		"timestamp": 1,
+	}
+
+	return s.latest(ctx, username, projection)
+}
+
+// latest retrieves the projected fields of the latest location of a user and reports whether the user has one
+func (s MongoLocationHistoryStore) latest(ctx context.Context, username string, projection map[string]any) (model.LocationInfo, bool, error) {
+	filter := bson.M{
+		"username": username,
+	}
+
+	sort := bson.M{
+		"timestamp": -1,
+	}
+
+	return findFirst[model.LocationInfo](ctx, s.client, s.collection, filter, projection, sort)
+}
+
+// LatestBefore retrieves the latest location of a user at or before the unix millisecond timestamp and reports whether there is one
+func (s MongoLocationHistoryStore) LatestBefore(ctx context.Context, username string, before int64) (model.LocationInfo, bool, error) {
+	return s.latestBefore(ctx, username, before, nil)
+}
+
+// DistanceBefore retrieves the cumulative distance of the latest location of a user at or before the unix millisecond timestamp and reports whether there is one
+func (s MongoLocationHistoryStore) DistanceBefore(ctx context.Context, username string, before int64) (float64, bool, error) {
+	location, ok, err := s.latestBefore(ctx, username, before, bson.M{"distance": 1})
+	return location.Distance, ok, err
+}
+
+// latestBefore retrieves the projected fields of the latest location of a user at or before the unix millisecond timestamp and reports whether there is one
+func (s MongoLocationHistoryStore) latestBefore(ctx context.Context, username string, before int64, projection map[string]any) (model.LocationInfo, bool, error) {
+	filter := bson.M{
+		"username": username,
+		"timestamp": bson.M{
+			"$lte": before,
+		},
+	}
+
+	sort := bson.M{
+		"timestamp": -1,
+	}
+
+	return findFirst[model.LocationInfo](ctx, s.client, s.collection, filter, projection, sort)
+}
+
+// FirstAfter retrieves the first location of a user at or after the unix millisecond timestamp and reports whether there is one
+func (s MongoLocationHistoryStore) FirstAfter(ctx context.Context, username string, after int64) (model.LocationInfo, bool, error) {
+	return s.firstAfter(ctx, username, after, nil)
+}
+
+// DistanceAfter retrieves the cumulative distance of the first location of a user at or after the unix millisecond timestamp and reports whether there is one
+func (s MongoLocationHistoryStore) DistanceAfter(ctx context.Context, username string, after int64) (float64, bool, error) {
+	location, ok, err := s.firstAfter(ctx, username, after, bson.M{"distance": 1})
+	return location.Distance, ok, err
+}
+
+// firstAfter retrieves the projected fields of the first location of a user at or after the unix millisecond timestamp and reports whether there is one
+func (s MongoLocationHistoryStore) firstAfter(ctx context.Context, username string, after int64, projection map[string]any) (model.LocationInfo, bool, error) {
+	filter := bson.M{
+		"username": username,
+		"timestamp": bson.M{
+			"$gte": after,
+		},
+	}
+
+	sort := bson.M{
+		"timestamp": 1,
+	}
+
+	return findFirst[model.LocationInfo](ctx, s.client, s.collection, filter, projection, sort)
+}
+
+// Range retrieves at most the limit of locations of a user after a unix millisecond timestamp, or at it if inclusive, and up to the end timestamp ordered by timestamp
+// ranges are read by the last seen timestamp instead of skipped pages, so reading deep into a large range stays cheap
+func (s MongoLocationHistoryStore) Range(ctx context.Context, username string, after, end int64, inclusive bool, limit int) ([]model.LocationInfo, error) {
+	comparator := "$gt"
+
+	if inclusive {
+		comparator = "$gte"
+	}
+
+	filter := bson.M{
+		"username": username,
+		"timestamp": bson.M{
+			comparator: after,
+			"$lte":     end,
+		},
+	}
+
+	sort := bson.M{
+		"timestamp": 1,
+	}
+
+	return findAll[model.LocationInfo](ctx, s.client, s.collection, filter, nil, sort, 1, limit)
+}
+
+// Within retrieves a page of the locations of all users inside the polygon of the bounding box and between two unix millisecond timestamps in timestamp order
+// the edges of the polygon are geodesics, so locations close to the edges may lie outside the box itself
+func (s MongoLocationHistoryStore) Within(ctx context.Context, box geo.BoundingBox, start, end int64, after string, limit int) ([]model.LocationInfo, string, error) {
+	return withinPage(start, end, after, limit, func(from, to int64, limit int) ([]model.LocationInfo, error) {
+		filter := bson.M{
+			"location": db.GeoWithinPolygon(box.Polygon()),
+			"timestamp": bson.M{
+				"$gte": from,
+				"$lte": to,
+			},
+		}
+
+		sort := bson.M{
+			"timestamp": 1,
+		}
+
+		return findAll[model.LocationInfo](ctx, s.client, s.collection, filter, nil, sort, 1, limit)
+	})
+}
+
+// withinPage reads a page of at least the limit of locations in timestamp order after the timestamp of the cursor, find retrieves at most the limit of locations between two timestamps ordered by timestamp, all of them with a limit of 0
+// the page is keyed by the last timestamp it contains instead of skipping the earlier pages, and all locations of that timestamp are read, so no location is skipped or read twice
+func withinPage(start, end int64, after string, limit int, find func(from, to int64, limit int) ([]model.LocationInfo, error)) ([]model.LocationInfo, string, error) {
+	from := start
+
+	if after != "" {
+		last, err := strconv.ParseInt(after, 10, 64)
+
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor '%s': %w", after, err)
+		}
+
+		from = last + 1
+	}
+
+	locations, err := find(from, end, limit)
+
+	if err != nil || limit <= 0 || len(locations) < limit {
+		return locations, "", err
+	}
+
+	last := locations[len(locations)-1].Timestamp
+
+	locations = slices.DeleteFunc(locations, func(location model.LocationInfo) bool {
+		return location.Timestamp == last
+	})
+
+	tied, err := find(last, last, 0)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return append(locations, tied...), strconv.FormatInt(last, 10), nil
+}
+
+// findAll retrieves a page of the documents matching the filter and decodes all of them
+func findAll[T any](ctx context.Context, client db.DBClient, collection string, filter, projection, sort map[string]any, pageNumber, pageSize int) ([]T, error) {
+	cursor, err := client.Find(ctx, collection, filter, projection, sort, pageNumber, pageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer cursor.Close(ctx)
+	results := []T{}
+
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// findFirst retrieves the first document matching the filter and reports whether there is one
+func findFirst[T any](ctx context.Context, client db.DBClient, collection string, filter, projection, sort map[string]any) (T, bool, error) {
+	results, err := findAll[T](ctx, client, collection, filter, projection, sort, 1, 1)
+
+	if err != nil || len(results) == 0 {
+		var zero T
+		return zero, false, err
+	}
+
+	return results[0], true, nil
+}
+
+// CreateMongoCurrentLocationStore creates a store of the current locations in the collection of the db client
+func CreateMongoCurrentLocationStore(client db.DBClient, collection string) MongoCurrentLocationStore {
+	return MongoCurrentLocationStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// CreateMongoLocationHistoryStore creates a store of the location history in the collection of the db client
+func CreateMongoLocationHistoryStore(client db.DBClient, collection string) MongoLocationHistoryStore {
+	return MongoLocationHistoryStore{
+		client:     client,
+		collection: collection,
+	}
+}
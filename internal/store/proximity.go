@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ProximityRule fires an alert when two users come nearer than the distance in meters or, for a far rule, move farther apart
+type ProximityRule struct {
+	ID            string  `bson:"_id" json:"id"`
+	Username      string  `bson:"username" json:"username"`
+	OtherUsername string  `bson:"otherUsername" json:"otherUsername"`
+	Type          string  `bson:"type" json:"type"`
+	Distance      float64 `bson:"distance" json:"distance"`
+}
+
+// ProximityState is whether the condition of a proximity rule held on the last evaluation, identified by the rule id
+type ProximityState struct {
+	ID        string `bson:"_id"`
+	Triggered bool   `bson:"triggered"`
+}
+
+// ProximityAlert is a proximity rule fired by a location update
+type ProximityAlert struct {
+	ID            string         `bson:"_id" json:"id"`
+	RuleID        string         `bson:"ruleId" json:"ruleId"`
+	Type          string         `bson:"type" json:"type"`
+	Username      string         `bson:"username" json:"username"`
+	OtherUsername string         `bson:"otherUsername" json:"otherUsername"`
+	Distance      float64        `bson:"distance" json:"distance"`
+	Location      model.Location `bson:"location" json:"location"`
+	OtherLocation model.Location `bson:"otherLocation" json:"otherLocation"`
+	Timestamp     int64          `bson:"timestamp" json:"timestamp"`
+}
+
+// ProximityStore keeps the proximity rules, their states and their alerts in collections of a db client
+type ProximityStore struct {
+	client     db.DBClient
+	collection string
+	states     string
+	alerts     string
+}
+
+// Save saves or replaces a proximity rule and rearms it
+func (s ProximityStore) Save(ctx context.Context, rule ProximityRule) error {
+	if err := s.client.SaveOrReplaceDocument(ctx, s.collection, rule, bson.M{"_id": rule.ID}); err != nil {
+		return err
+	}
+
+	return s.Rearm(ctx, rule.ID)
+}
+
+// Get retrieves a single proximity rule by its id and reports whether it exists
+func (s ProximityStore) Get(ctx context.Context, id string) (ProximityRule, bool, error) {
+	return findFirst[ProximityRule](ctx, s.client, s.collection, bson.M{"_id": id}, nil, nil)
+}
+
+// List retrieves a page of proximity rules ordered by id, of a single user unless the username is empty
+func (s ProximityStore) List(ctx context.Context, username string, pageNumber, pageSize int) ([]ProximityRule, error) {
+	filter := bson.M{}
+
+	if username != "" {
+		filter = proximityUserFilter(username)
+	}
+
+	sort := bson.M{
+		"_id": 1,
+	}
+
+	return findAll[ProximityRule](ctx, s.client, s.collection, filter, nil, sort, pageNumber, pageSize)
+}
+
+// Rules retrieves up to the limit of proximity rules the user is either of the two parties of
+func (s ProximityStore) Rules(ctx context.Context, username string, limit int) ([]ProximityRule, error) {
+	return findAll[ProximityRule](ctx, s.client, s.collection, proximityUserFilter(username), nil, nil, 1, limit)
+}
+
+// Delete deletes a proximity rule and reports whether it existed, its state is deleted by rearming it
+func (s ProximityStore) Delete(ctx context.Context, id string) (bool, error) {
+	return s.client.DeleteDocument(ctx, s.collection, bson.M{"_id": id})
+}
+
+// Rearm deletes the state of a proximity rule, so it fires again on the next update matching it
+func (s ProximityStore) Rearm(ctx context.Context, id string) error {
+	_, err := s.client.DeleteDocument(ctx, s.states, bson.M{"_id": id})
+	return err
+}
+
+// State retrieves the state of a proximity rule and reports whether it has one
+func (s ProximityStore) State(ctx context.Context, id string) (ProximityState, bool, error) {
+	return findFirst[ProximityState](ctx, s.client, s.states, bson.M{"_id": id}, nil, nil)
+}
+
+// SaveState saves or replaces the state of a proximity rule
+func (s ProximityStore) SaveState(ctx context.Context, state ProximityState) error {
+	return s.client.SaveOrReplaceDocument(ctx, s.states, state, bson.M{"_id": state.ID})
+}
+
+// SaveAlert saves or replaces a proximity alert
+func (s ProximityStore) SaveAlert(ctx context.Context, alert ProximityAlert) error {
+	return s.client.SaveOrReplaceDocument(ctx, s.alerts, alert, bson.M{"_id": alert.ID})
+}
+
+// Alerts retrieves a page of proximity alerts of a user, a rule or both, latest first, an empty username or rule id matches every one
+func (s ProximityStore) Alerts(ctx context.Context, username, ruleID string, pageNumber, pageSize int) ([]ProximityAlert, error) {
+	filter := bson.M{}
+
+	if username != "" {
+		filter = proximityUserFilter(username)
+	}
+
+	if ruleID != "" {
+		filter["ruleId"] = ruleID
+	}
+
+	sort := bson.M{
+		"timestamp": -1,
+	}
+
+	return findAll[ProximityAlert](ctx, s.client, s.alerts, filter, nil, sort, pageNumber, pageSize)
+}
+
+// proximityUserFilter returns the filter matching the documents in which the user is either of the two parties
+func proximityUserFilter(username string) bson.M {
+	return bson.M{
+		"$or": []bson.M{
+			{"username": username},
+			{"otherUsername": username},
+		},
+	}
+}
+
+// CreateProximityStore creates a store of the proximity rules, their states and their alerts in the collections of the db client
+func CreateProximityStore(client db.DBClient, collection, states, alerts string) ProximityStore {
+	return ProximityStore{
+		client:     client,
+		collection: collection,
+		states:     states,
+		alerts:     alerts,
+	}
+}
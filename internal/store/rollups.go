@@ -0,0 +1,528 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// HourlyRollup is the period of the rollups of an hour
+	HourlyRollup = "hour"
+	// DailyRollup is the period of the rollups of a utc day
+	DailyRollup = "day"
+	// movingMaxGap is the longest time between two locations counted as moving, a longer gap is a device which was off
+	movingMaxGap = int64(10 * time.Minute / time.Millisecond)
+	// movingMinSpeed is the slowest speed in meters per second counted as moving, slower locations are a device standing still
+	movingMinSpeed = 0.5
+	// rollupPageSize is the number of locations read at a time when rollups are built or stats are calculated from the locations
+	rollupPageSize = 1000
+)
+
+// rollupPeriods are the periods rollups are kept for, with their durations in milliseconds
+var rollupPeriods = []struct {
+	name     string
+	duration int64
+}{
+	{name: HourlyRollup, duration: int64(time.Hour / time.Millisecond)},
+	{name: DailyRollup, duration: int64(24 * time.Hour / time.Millisecond)},
+}
+
+// LocationStats summarizes the locations of a user in a span of time, the distance in kilometers and the moving time in milliseconds
+// the distance and moving time are the ones of the segments between consecutive locations ending in the span, the bounding box and the first and last timestamps are the ones of its locations
+type LocationStats struct {
+	Distance   float64 `bson:"distance"`
+	Count      int64   `bson:"count"`
+	MovingTime int64   `bson:"movingTime"`
+	First      int64   `bson:"first"`
+	Last       int64   `bson:"last"`
+	West       float64 `bson:"west"`
+	South      float64 `bson:"south"`
+	East       float64 `bson:"east"`
+	North      float64 `bson:"north"`
+}
+
+// Rollup is the summary of the locations of a user in an hour or a utc day starting at the start timestamp
+type Rollup struct {
+	ID            string `bson:"_id"`
+	Username      string `bson:"username"`
+	Period        string `bson:"period"`
+	Start         int64  `bson:"start"`
+	LocationStats `bson:",inline"`
+	located       bool
+}
+
+// RollupChange is a change of the rollups containing the unix millisecond timestamp, caused by a location saved into the history
+// the distance, moving time and count are added to the rollups, the location, if set, extends their bounding box and first and last timestamps
+type RollupChange struct {
+	Timestamp  int64
+	Distance   float64
+	MovingTime int64
+	Count      int64
+	Location   []float64
+}
+
+// rollupSpan is a span of whole periods between two unix millisecond timestamps, the end excluded, answered from the rollups of the period
+type rollupSpan struct {
+	period     string
+	start, end int64
+}
+
+// RollupStore keeps hourly and daily rollups of the location history of every user in a collection of a db client, identified by the username, period and start
+// a segment between two consecutive locations is counted in the rollups of its later location, so the rollups of a span add up to the distance traveled in it
+// the rollups are changed incrementally when locations are saved and can be rebuilt from the location history at any time
+type RollupStore struct {
+	client     db.DBClient
+	collection string
+}
+
+// RollupChanges returns the changes of the rollups caused by saving the location into the history, it must be called before the location is saved
+// the latest location of the user, or nil if the user has none, is passed by the caller, a location after it is appended to the track without looking up other locations
+// a location saved before the latest one splits the segment between its neighbors, and a location with the timestamp of a saved one replaces its segments
+func RollupChanges(ctx context.Context, history LocationHistoryStore, location model.LocationInfo, latest *model.LocationInfo) ([]RollupChange, error) {
+	if latest == nil || latest.Timestamp < location.Timestamp {
+		changes := []RollupChange{{Timestamp: location.Timestamp, Count: 1, Location: location.Location.Coordinates}}
+
+		if latest != nil {
+			changes = append(changes, segmentChange(*latest, location, 1))
+		}
+
+		return changes, nil
+	}
+
+	previous, hasPrevious, err := history.LatestBefore(ctx, location.Username, location.Timestamp-1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	next, hasNext, err := history.FirstAfter(ctx, location.Username, location.Timestamp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	replaced, hasReplaced := next, hasNext && next.Timestamp == location.Timestamp
+
+	if hasReplaced {
+		next, hasNext, err = history.FirstAfter(ctx, location.Username, location.Timestamp+1)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changes := []RollupChange{{Timestamp: location.Timestamp, Count: 1, Location: location.Location.Coordinates}}
+
+	switch {
+	case hasReplaced:
+		changes[0].Count = 0
+
+		if hasPrevious {
+			changes = append(changes, segmentChange(previous, replaced, -1))
+		}
+
+		if hasNext {
+			changes = append(changes, segmentChange(replaced, next, -1))
+		}
+
+	case hasPrevious && hasNext:
+		changes = append(changes, segmentChange(previous, next, -1))
+	}
+
+	if hasPrevious {
+		changes = append(changes, segmentChange(previous, location, 1))
+	}
+
+	if hasNext {
+		changes = append(changes, segmentChange(location, next, 1))
+	}
+
+	return changes, nil
+}
+
+// segmentChange returns the change of the rollups of adding, or removing with a negative sign, the segment between two consecutive locations
+// the segment is counted as moving if the locations are close enough in time and far enough apart in distance
+func segmentChange(from, to model.LocationInfo, sign int64) RollupChange {
+	meters := geo.Distance(from.Location.Coordinates, to.Location.Coordinates)
+	duration := to.Timestamp - from.Timestamp
+	movingTime := int64(0)
+
+	if duration > 0 && duration <= movingMaxGap && meters/(float64(duration)/1000) >= movingMinSpeed {
+		movingTime = duration
+	}
+
+	return RollupChange{
+		Timestamp:  to.Timestamp,
+		Distance:   float64(sign) * meters / 1000,
+		MovingTime: sign * movingTime,
+	}
+}
+
+// Apply applies the changes to the hourly and daily rollups of the user, writing every rollup they change once
+// a rollup is inserted by the first change adding a location to it, changes of rollups which do not exist and add no location are dropped, since a rebuild restores them
+func (s RollupStore) Apply(ctx context.Context, username string, changes []RollupChange) error {
+	batch := createRollupBatch(username)
+
+	for _, change := range changes {
+		batch.add(change)
+	}
+
+	for _, id := range batch.ids {
+		if err := s.write(ctx, *batch.rollups[id]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write adds the rollup to the saved one, inserting it if it does not exist yet and has a location
+func (s RollupStore) write(ctx context.Context, rollup Rollup) error {
+	update := bson.M{
+		"$inc": bson.M{
+			"distance":   rollup.Distance,
+			"count":      rollup.Count,
+			"movingTime": rollup.MovingTime,
+		},
+	}
+
+	if rollup.located {
+		update["$min"] = bson.M{"first": rollup.First, "west": rollup.West, "south": rollup.South}
+		update["$max"] = bson.M{"last": rollup.Last, "east": rollup.East, "north": rollup.North}
+	}
+
+	updated, err := s.client.UpdateMany(ctx, s.collection, bson.M{"_id": rollup.ID}, update)
+
+	if err != nil || updated > 0 || !rollup.located {
+		return err
+	}
+
+	result, err := s.client.InsertMany(ctx, s.collection, []any{rollup}, true)
+
+	if err != nil {
+		return err
+	}
+
+	if len(result.Errors) == 0 {
+		return nil
+	}
+
+	if !result.Errors[0].IsDuplicateKey() {
+		return result.Err()
+	}
+
+	// the rollup exists, either inserted by another writer in the meantime or left unmodified by the update, so the update applies to it now
+	_, err = s.client.UpdateMany(ctx, s.collection, bson.M{"_id": rollup.ID}, update)
+	return err
+}
+
+// apply adds the change to the rollup
+func (r *Rollup) apply(change RollupChange) {
+	r.Distance += change.Distance
+	r.MovingTime += change.MovingTime
+	r.Count += change.Count
+
+	if change.Location != nil {
+		r.extend(change.Timestamp, change.Location, !r.located)
+		r.located = true
+	}
+}
+
+// rollupBatch collects changes of the hourly and daily rollups of a user, keeping the rollups in the order they were first changed
+type rollupBatch struct {
+	username string
+	rollups  map[string]*Rollup
+	ids      []string
+}
+
+// add adds the change to the hourly and daily rollups containing its timestamp
+func (b *rollupBatch) add(change RollupChange) {
+	for _, period := range rollupPeriods {
+		id, start := rollupID(b.username, period.name, period.duration, change.Timestamp)
+
+		if _, ok := b.rollups[id]; !ok {
+			b.rollups[id] = &Rollup{ID: id, Username: b.username, Period: period.name, Start: start}
+			b.ids = append(b.ids, id)
+		}
+
+		b.rollups[id].apply(change)
+	}
+}
+
+// createRollupBatch creates an empty batch of changes of the rollups of a user
+func createRollupBatch(username string) *rollupBatch {
+	return &rollupBatch{
+		username: username,
+		rollups:  map[string]*Rollup{},
+	}
+}
+
+// Rebuild replaces the rollups of the user with the ones built from the locations of the user in the history
+// every rollup is replaced or inserted on its own instead of deleting them all first, so writers applying changes meanwhile never find a rollup missing or hit a duplicate key
+// the rollups which existed before the rebuild and have no location left are deleted, the ones inserted by writers meanwhile are kept
+// a change applied between reading the history and replacing its rollup is overwritten, so rollups are rebuilt while no locations are being saved for exact results
+func (s RollupStore) Rebuild(ctx context.Context, history LocationHistoryStore, username string) error {
+	existing, err := findAll[Rollup](ctx, s.client, s.collection, bson.M{"username": username}, bson.M{"_id": 1}, nil, 1, 0)
+
+	if err != nil {
+		return err
+	}
+
+	batch := createRollupBatch(username)
+
+	err = scanLocations(ctx, history, username, math.MinInt64, math.MaxInt64, func(location model.LocationInfo, previous *model.LocationInfo) {
+		batch.add(RollupChange{Timestamp: location.Timestamp, Count: 1, Location: location.Location.Coordinates})
+
+		if previous != nil {
+			batch.add(segmentChange(*previous, location, 1))
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(batch.ids); offset += rollupPageSize {
+		models := []db.ReplaceModel{}
+
+		for _, id := range batch.ids[offset:min(offset+rollupPageSize, len(batch.ids))] {
+			models = append(models, db.ReplaceModel{Filter: bson.M{"_id": id}, Document: *batch.rollups[id]})
+		}
+
+		result, err := s.client.BulkSaveOrReplace(ctx, s.collection, models, false)
+
+		if err != nil {
+			return err
+		}
+
+		if err := result.Err(); err != nil {
+			return err
+		}
+	}
+
+	stale := []string{}
+
+	for _, rollup := range existing {
+		if _, ok := batch.rollups[rollup.ID]; !ok {
+			stale = append(stale, rollup.ID)
+		}
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+
+	_, err = s.client.DeleteMany(ctx, s.collection, bson.M{"_id": bson.M{"$in": stale}})
+	return err
+}
+
+// Rollups retrieves the rollups of a user of the period starting between two unix millisecond timestamps, the end excluded, ordered by start
+func (s RollupStore) Rollups(ctx context.Context, username, period string, start, end int64) ([]Rollup, error) {
+	filter := bson.M{
+		"username": username,
+		"period":   period,
+		"start": bson.M{
+			"$gte": start,
+			"$lt":  end,
+		},
+	}
+
+	sort := bson.M{
+		"start": 1,
+	}
+
+	return findAll[Rollup](ctx, s.client, s.collection, filter, nil, sort, 1, 0)
+}
+
+// Stats summarizes the locations of a user between two unix millisecond timestamps from the rollups of the whole hours and days between them
+// only the locations of the partial hours at the edges are read from the history, so the time taken does not grow with the number of locations in the span
+// the segment from the location before the start to the first location after it is not counted, like the distance between the cumulative distances of the two
+func (s RollupStore) Stats(ctx context.Context, history LocationHistoryStore, username string, start, end int64) (LocationStats, error) {
+	if end < start {
+		return LocationStats{}, nil
+	}
+
+	hour, day := rollupPeriods[0].duration, rollupPeriods[1].duration
+	hoursStart, hoursEnd := periodStart(start+hour-1, hour), periodStart(end+1, hour)
+
+	if hoursStart >= hoursEnd {
+		return ScanStats(ctx, history, username, start, end)
+	}
+
+	daysStart, daysEnd := periodStart(hoursStart+day-1, day), periodStart(hoursEnd, day)
+	spans := []rollupSpan{{period: HourlyRollup, start: hoursStart, end: hoursEnd}}
+
+	if daysStart < daysEnd {
+		spans = []rollupSpan{
+			{period: HourlyRollup, start: hoursStart, end: daysStart},
+			{period: DailyRollup, start: daysStart, end: daysEnd},
+			{period: HourlyRollup, start: daysEnd, end: hoursEnd},
+		}
+	}
+
+	stats := LocationStats{}
+
+	for _, span := range spans {
+		if span.start >= span.end {
+			continue
+		}
+
+		rollups, err := s.Rollups(ctx, username, span.period, span.start, span.end)
+
+		if err != nil {
+			return LocationStats{}, err
+		}
+
+		for _, rollup := range rollups {
+			stats.merge(rollup.LocationStats)
+		}
+	}
+
+	for _, edge := range [][2]int64{{start, hoursStart - 1}, {hoursEnd, end}} {
+		if edge[0] > edge[1] {
+			continue
+		}
+
+		previous, hasPrevious, err := history.LatestBefore(ctx, username, edge[0]-1)
+
+		if err != nil {
+			return LocationStats{}, err
+		}
+
+		edgeStats := LocationStats{}
+
+		err = scanLocations(ctx, history, username, edge[0], edge[1], func(location model.LocationInfo, scanned *model.LocationInfo) {
+			if scanned == nil && hasPrevious {
+				scanned = &previous
+			}
+
+			edgeStats.add(location, scanned)
+		})
+
+		if err != nil {
+			return LocationStats{}, err
+		}
+
+		stats.merge(edgeStats)
+	}
+
+	first, ok, err := history.FirstAfter(ctx, username, start)
+
+	if err != nil || !ok || first.Timestamp > end {
+		return stats, err
+	}
+
+	previous, ok, err := history.LatestBefore(ctx, username, start-1)
+
+	if err != nil || !ok {
+		return stats, err
+	}
+
+	entering := segmentChange(previous, first, -1)
+	stats.Distance += entering.Distance
+	stats.MovingTime += entering.MovingTime
+	return stats, nil
+}
+
+// ScanStats summarizes the locations of a user between two unix millisecond timestamps by reading every location between them from the history
+// it needs no rollups, so it answers the spans within an hour and is used until the rollups are built
+func ScanStats(ctx context.Context, history LocationHistoryStore, username string, start, end int64) (LocationStats, error) {
+	stats := LocationStats{}
+
+	err := scanLocations(ctx, history, username, start, end, func(location model.LocationInfo, previous *model.LocationInfo) {
+		stats.add(location, previous)
+	})
+
+	return stats, err
+}
+
+// scanLocations reads the locations of a user between two unix millisecond timestamps in pages in timestamp order and visits every one of them with the one before it in the span
+func scanLocations(ctx context.Context, history LocationHistoryStore, username string, start, end int64, visit func(location model.LocationInfo, previous *model.LocationInfo)) error {
+	after, inclusive := start, true
+	var previous *model.LocationInfo
+
+	for {
+		locations, err := history.Range(ctx, username, after, end, inclusive, rollupPageSize)
+
+		if err != nil {
+			return err
+		}
+
+		for _, location := range locations {
+			visit(location, previous)
+			previous = &location
+		}
+
+		if len(locations) < rollupPageSize {
+			return nil
+		}
+
+		after, inclusive = locations[len(locations)-1].Timestamp, false
+	}
+}
+
+// add adds the location and the segment from the location before it, if there is one, to the stats
+func (s *LocationStats) add(location model.LocationInfo, previous *model.LocationInfo) {
+	if previous != nil {
+		segment := segmentChange(*previous, location, 1)
+		s.Distance += segment.Distance
+		s.MovingTime += segment.MovingTime
+	}
+
+	s.extend(location.Timestamp, location.Location.Coordinates, s.Count == 0)
+	s.Count++
+}
+
+// merge adds the stats of another span to the stats
+func (s *LocationStats) merge(other LocationStats) {
+	s.Distance += other.Distance
+	s.MovingTime += other.MovingTime
+
+	if other.Count > 0 {
+		empty := s.Count == 0
+		s.extend(other.First, []float64{other.West, other.South}, empty)
+		s.extend(other.Last, []float64{other.East, other.North}, false)
+	}
+
+	s.Count += other.Count
+}
+
+// extend extends the bounding box and the first and last timestamps of the stats by a location, or starts them from it if the stats are empty
+func (s *LocationStats) extend(timestamp int64, coordinates []float64, empty bool) {
+	if empty {
+		s.First, s.Last = timestamp, timestamp
+		s.West, s.East = coordinates[0], coordinates[0]
+		s.South, s.North = coordinates[1], coordinates[1]
+		return
+	}
+
+	s.First, s.Last = min(s.First, timestamp), max(s.Last, timestamp)
+	s.West, s.East = min(s.West, coordinates[0]), max(s.East, coordinates[0])
+	s.South, s.North = min(s.South, coordinates[1]), max(s.North, coordinates[1])
+}
+
+// rollupID returns the _id and the start of the rollup of a user and period containing the unix millisecond timestamp
+func rollupID(username, period string, duration, timestamp int64) (string, int64) {
+	start := periodStart(timestamp, duration)
+	return fmt.Sprintf("%s/%s/%d", username, period, start), start
+}
+
+// periodStart returns the start of the period of the duration containing the unix millisecond timestamp
+func periodStart(timestamp, duration int64) int64 {
+	return timestamp - ((timestamp%duration)+duration)%duration
+}
+
+// CreateRollupStore creates a store of the hourly and daily rollups of the location history in the collection of the db client
+func CreateRollupStore(client db.DBClient, collection string) RollupStore {
+	return RollupStore{
+		client:     client,
+		collection: collection,
+	}
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"context"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+)
+
+// CurrentLocationStore keeps the current location of every user
+type CurrentLocationStore interface {
+	Upsert(ctx context.Context, location model.LocationInfo) error
+	Get(ctx context.Context, username string) (model.LocationInfo, bool, error)
+	Near(ctx context.Context, coordinates []float64, distance float64, pageNumber, pageSize int) ([]string, error)
+	Within(ctx context.Context, box geo.BoundingBox, limit int) ([]model.LocationInfo, error)
+}
+
+// LocationHistoryStore keeps every location of every user, identified by the username and the timestamp
+// Within reads the locations inside a bounding box in pages continuing after the cursor returned with the previous page, starting with an empty cursor, the cursor of the last page is empty
+// LatestPosition, DistanceBefore and DistanceAfter read only the fields their callers need, the coordinates, cumulative distance and timestamp or the cumulative distance alone
+type LocationHistoryStore interface {
+	Upsert(ctx context.Context, location model.LocationInfo) error
+	Latest(ctx context.Context, username string) (model.LocationInfo, bool, error)
+	LatestPosition(ctx context.Context, username string) (model.LocationInfo, bool, error)
+	DistanceBefore(ctx context.Context, username string, before int64) (float64, bool, error)
+	DistanceAfter(ctx context.Context, username string, after int64) (float64, bool, error)
+	LatestBefore(ctx context.Context, username string, before int64) (model.LocationInfo, bool, error)
+	FirstAfter(ctx context.Context, username string, after int64) (model.LocationInfo, bool, error)
+	Range(ctx context.Context, username string, after, end int64, inclusive bool, limit int) ([]model.LocationInfo, error)
+	Within(ctx context.Context, box geo.BoundingBox, start, end int64, after string, limit int) ([]model.LocationInfo, string, error)
+}
+
+// DistanceStore is a location history store which calculates the distance traveled by a user between two unix millisecond timestamps itself
+// the distance is the difference of the cumulative distances of the latest location at or before the end and the first location at or after the start
+type DistanceStore interface {
+	Distance(ctx context.Context, username string, start, end int64) (float64, error)
+}
@@ -0,0 +1,534 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"go.mongodb.org/mongo-driver/bson"
+	bsonv2 "go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// userLocation returns the location of a user at the [longitude, latitude] coordinates and the unix millisecond timestamp
+func userLocation(username string, longitude, latitude float64, timestamp int64) model.LocationInfo {
+	return model.LocationInfo{
+		Username:  username,
+		Location:  model.Location{Type: "Point", Coordinates: []float64{longitude, latitude}},
+		Timestamp: timestamp,
+	}
+}
+
+func TestCurrentLocationStores(t *testing.T) {
+	stores := map[string]CurrentLocationStore{
+		"mongo":  CreateMongoCurrentLocationStore(db.CreateMemoryClient(), "location"),
+		"memory": CreateMemoryCurrentLocationStore(),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			for _, location := range []model.LocationInfo{
+				userLocation("user3", 20.46, 44.81, 1),
+				userLocation("user1", 20.47, 44.81, 2),
+				userLocation("user2", 21.90, 43.32, 3),
+				userLocation("user1", 20.46, 44.81, 4),
+			} {
+				if err := store.Upsert(ctx, location); err != nil {
+					t.Fatalf("error upserting location: %v", err)
+				}
+			}
+
+			current, ok, err := store.Get(ctx, "user1")
+
+			if err != nil || !ok || current.Timestamp != 4 {
+				t.Errorf("expected the replaced location of user1, got %v, %v, %v", current, ok, err)
+			}
+
+			if _, ok, err := store.Get(ctx, "user4"); err != nil || ok {
+				t.Errorf("expected no location of user4, got %v, %v", ok, err)
+			}
+
+			usernames, err := store.Near(ctx, []float64{20.46, 44.81}, 1000, 1, 10)
+
+			if err != nil || !slices.Equal(usernames, []string{"user1", "user3"}) {
+				t.Errorf("expected the users near belgrade ordered by username, got %v, %v", usernames, err)
+			}
+
+			usernames, err = store.Near(ctx, []float64{20.46, 44.81}, 300000, 2, 2)
+
+			if err != nil || !slices.Equal(usernames, []string{"user3"}) {
+				t.Errorf("expected the second page of users, got %v, %v", usernames, err)
+			}
+
+			box := geo.BoundingBox{SouthWest: []float64{20, 44}, NorthEast: []float64{21, 45}}
+			locations, err := store.Within(ctx, box, 10)
+
+			if err != nil || len(locations) != 2 {
+				t.Errorf("expected the two locations inside the box, got %v, %v", locations, err)
+			}
+		})
+	}
+}
+
+func TestLocationHistoryStores(t *testing.T) {
+	stores := map[string]LocationHistoryStore{
+		"mongo":      CreateMongoLocationHistoryStore(db.CreateMemoryClient(), "location-history"),
+		"timeseries": CreateTimeSeriesLocationHistoryStore(db.CreateMemoryClient(), "location-history"),
+		"chunks":     CreateChunkedLocationHistoryStore(db.CreateMemoryClient(), "location-history", time.Second),
+		"memory":     CreateMemoryLocationHistoryStore(),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			for _, location := range []model.LocationInfo{
+				userLocation("user1", 20.46, 44.81, 3000),
+				userLocation("user1", 20.47, 44.81, 1000),
+				userLocation("user2", 21.90, 43.32, 2000),
+				userLocation("user1", 21.90, 43.32, 2000),
+				userLocation("user1", 20.48, 44.81, 1000),
+			} {
+				if err := store.Upsert(ctx, location); err != nil {
+					t.Fatalf("error upserting location: %v", err)
+				}
+			}
+
+			tests := []struct {
+				name     string
+				find     func() (model.LocationInfo, bool, error)
+				expected int64
+			}{
+				{"latest", func() (model.LocationInfo, bool, error) { return store.Latest(ctx, "user1") }, 3000},
+				{"latest position", func() (model.LocationInfo, bool, error) { return store.LatestPosition(ctx, "user1") }, 3000},
+				{"latest before", func() (model.LocationInfo, bool, error) { return store.LatestBefore(ctx, "user1", 2500) }, 2000},
+				{"latest at", func() (model.LocationInfo, bool, error) { return store.LatestBefore(ctx, "user1", 2000) }, 2000},
+				{"latest before any", func() (model.LocationInfo, bool, error) { return store.LatestBefore(ctx, "user1", 500) }, 0},
+				{"first after", func() (model.LocationInfo, bool, error) { return store.FirstAfter(ctx, "user1", 1500) }, 2000},
+				{"first after all", func() (model.LocationInfo, bool, error) { return store.FirstAfter(ctx, "user1", 3500) }, 0},
+				{"unknown user", func() (model.LocationInfo, bool, error) { return store.Latest(ctx, "user3") }, 0},
+			}
+
+			for _, test := range tests {
+				location, ok, err := test.find()
+
+				if err != nil || ok != (test.expected != 0) || location.Timestamp != test.expected {
+					t.Errorf("%s: expected timestamp %d, got %v, %v, %v", test.name, test.expected, location, ok, err)
+				}
+			}
+
+			if location, _, _ := store.FirstAfter(ctx, "user1", 1000); location.Location.Coordinates[0] != 20.48 {
+				t.Errorf("expected the location with the same timestamp to be replaced, got %v", location)
+			}
+
+			for _, inclusive := range []bool{true, false} {
+				locations, err := store.Range(ctx, "user1", 1000, 3000, inclusive, 10)
+				expected := []int64{1000, 2000, 3000}
+
+				if !inclusive {
+					expected = expected[1:]
+				}
+
+				if timestamps := timestamps(locations); err != nil || !slices.Equal(timestamps, expected) {
+					t.Errorf("expected range timestamps %v, got %v, %v", expected, timestamps, err)
+				}
+			}
+
+			if locations, err := store.Range(ctx, "user1", 0, 3000, true, 2); err != nil || !slices.Equal(timestamps(locations), []int64{1000, 2000}) {
+				t.Errorf("expected the range to be limited, got %v, %v", locations, err)
+			}
+
+			box := geo.BoundingBox{SouthWest: []float64{21, 43}, NorthEast: []float64{22, 44}}
+			locations, cursor, err := store.Within(ctx, box, 0, 5000, "", 10)
+
+			if err != nil || len(locations) != 2 || cursor != "" {
+				t.Errorf("expected the two locations inside the box, got %v, '%s', %v", locations, cursor, err)
+			}
+
+			if locations, _, err := store.Within(ctx, box, 2500, 5000, "", 10); err != nil || len(locations) != 0 {
+				t.Errorf("expected no location inside the box after the start, got %v, %v", locations, err)
+			}
+
+			for _, location := range []model.LocationInfo{userLocation("user3", 21.5, 43.5, 2000), userLocation("user4", 21.5, 43.5, 2000), userLocation("user1", 21.5, 43.5, 4000)} {
+				if err := store.Upsert(ctx, location); err != nil {
+					t.Fatalf("error upserting location: %v", err)
+				}
+			}
+
+			read := []string{}
+
+			for cursor, pages := "", 0; pages == 0 || cursor != ""; pages++ {
+				locations, cursor, err = store.Within(ctx, box, 0, 5000, cursor, 1)
+
+				if err != nil || pages > 5 {
+					t.Fatalf("error reading the locations inside the box in pages: %v, %d pages", err, pages)
+				}
+
+				for _, location := range locations {
+					read = append(read, fmt.Sprintf("%s/%d", location.Username, location.Timestamp))
+				}
+			}
+
+			slices.Sort(read)
+
+			if expected := []string{"user1/2000", "user1/4000", "user2/2000", "user3/2000", "user4/2000"}; !slices.Equal(read, expected) {
+				t.Errorf("expected every location inside the box to be read once in pages, got %v", read)
+			}
+
+			distanced := userLocation("user1", 21.5, 43.5, 5000)
+			distanced.Distance = 1.5
+
+			if err := store.Upsert(ctx, distanced); err != nil {
+				t.Fatalf("error upserting location: %v", err)
+			}
+
+			if distance, ok, err := store.DistanceBefore(ctx, "user1", 6000); err != nil || !ok || distance != 1.5 {
+				t.Errorf("expected the distance of the latest location before, got %f, %v, %v", distance, ok, err)
+			}
+
+			if distance, ok, err := store.DistanceAfter(ctx, "user1", 4500); err != nil || !ok || distance != 1.5 {
+				t.Errorf("expected the distance of the first location after, got %f, %v, %v", distance, ok, err)
+			}
+
+			if _, ok, err := store.DistanceAfter(ctx, "user1", 5500); err != nil || ok {
+				t.Errorf("expected no location after the latest one, got %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+// timestamps returns the timestamps of the locations
+func timestamps(locations []model.LocationInfo) []int64 {
+	timestamps := []int64{}
+
+	for _, location := range locations {
+		timestamps = append(timestamps, location.Timestamp)
+	}
+
+	return timestamps
+}
+
+func TestTimeSeriesLocationHistoryStoreUpsert(t *testing.T) {
+	ctx := context.Background()
+	client := db.CreateMemoryClient()
+	store := CreateTimeSeriesLocationHistoryStore(client, "location-history")
+
+	if err := store.Upsert(ctx, userLocation("user1", 20.46, 44.81, 1000)); err != nil {
+		t.Fatalf("error upserting location: %v", err)
+	}
+
+	// a concurrent upsert of the same timestamp which got its _id first but inserted last
+	concurrent := ToTimeSeriesDocument(userLocation("user1", 20.47, 44.81, 1000)).(timeSeriesLocation)
+	concurrent.ID = bsonv2.NewObjectIDFromTimestamp(time.Now().Add(-time.Hour))
+
+	if _, err := client.InsertMany(ctx, "location-history", []any{concurrent}, true); err != nil {
+		t.Fatalf("error inserting location: %v", err)
+	}
+
+	if err := store.Upsert(ctx, userLocation("user1", 20.48, 44.81, 1000)); err != nil {
+		t.Fatalf("error upserting location: %v", err)
+	}
+
+	locations, err := store.Range(ctx, "user1", 0, 5000, true, 10)
+
+	if err != nil || len(locations) != 1 || locations[0].Location.Coordinates[0] != 20.48 {
+		t.Errorf("expected the locations with a lower _id to be replaced, got %v, %v", locations, err)
+	}
+}
+
+func TestChunkedLocationHistoryStore(t *testing.T) {
+	ctx := context.Background()
+	client := db.CreateMemoryClient()
+	chunks := CreateChunkedLocationHistoryStore(client, "location-history", 10*time.Second)
+	documents := CreateMongoLocationHistoryStore(db.CreateMemoryClient(), "location-history")
+	locations := []model.LocationInfo{}
+
+	for i := range 50 {
+		location := userLocation("user1", 20.4612345+float64(i)*0.0001, 44.8198765, int64(i)*1000+500)
+		location.Distance = float64(i) * 0.0079123
+
+		if i > 0 {
+			location.Location.Coordinates[0] = locations[i-1].Location.Coordinates[0] + 0.00012345
+		}
+
+		locations = append(locations, location)
+	}
+
+	if err := chunks.UpsertMany(ctx, locations); err != nil {
+		t.Fatalf("error upserting locations: %v", err)
+	}
+
+	for _, location := range locations {
+		if err := documents.Upsert(ctx, location); err != nil {
+			t.Fatalf("error upserting location: %v", err)
+		}
+	}
+
+	if count, err := client.Count(ctx, "location-history", nil); err != nil || count != 5 {
+		t.Errorf("expected a chunk per 10 seconds, got %d, %v", count, err)
+	}
+
+	decoded, err := chunks.Range(ctx, "user1", 0, math.MaxInt64, true, 0)
+
+	if err != nil || len(decoded) != len(locations) {
+		t.Fatalf("expected every location to be decoded, got %d, %v", len(decoded), err)
+	}
+
+	for i, location := range decoded {
+		expected := locations[i]
+
+		if location.Timestamp != expected.Timestamp || math.Abs(location.Distance-expected.Distance) > 1e-9 ||
+			math.Abs(location.Location.Coordinates[0]-expected.Location.Coordinates[0]) > 1e-7 || math.Abs(location.Location.Coordinates[1]-expected.Location.Coordinates[1]) > 1e-7 {
+			t.Errorf("expected location %v, got %v", expected, location)
+		}
+	}
+
+	for _, bounds := range [][2]int64{{0, 60000}, {500, 49500}, {10500, 19500}, {3000, 27000}, {12000, 13000}, {60000, 70000}, {0, 100}} {
+		distance, err := chunks.Distance(ctx, "user1", bounds[0], bounds[1])
+		first, _, _ := documents.FirstAfter(ctx, "user1", bounds[0])
+		last, _, _ := documents.LatestBefore(ctx, "user1", bounds[1])
+
+		if err != nil || math.Abs(distance-(last.Distance-first.Distance)) > 1e-9 {
+			t.Errorf("%v: expected distance %f, got %f, %v", bounds, last.Distance-first.Distance, distance, err)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+
+	for i := range chunkWriteAttempts {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := chunks.Upsert(ctx, userLocation("user2", 20.46, 44.81, int64(i))); err != nil {
+				t.Errorf("error upserting location concurrently: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if locations, err := chunks.Range(ctx, "user2", 0, 10000, true, 0); err != nil || len(locations) != chunkWriteAttempts {
+		t.Errorf("expected no concurrently upserted location to be lost, got %d, %v", len(locations), err)
+	}
+
+	if err := chunks.Upsert(ctx, userLocation("user3", 179.9, 0, 1000)); err != nil {
+		t.Fatalf("error upserting location: %v", err)
+	}
+
+	box := geo.BoundingBox{SouthWest: []float64{179, -1}, NorthEast: []float64{-179, 1}}
+
+	if locations, _, err := chunks.Within(ctx, box, 0, 5000, "", 10); err != nil || len(locations) != 1 || locations[0].Username != "user3" {
+		t.Errorf("expected the location in the box crossing the antimeridian, got %v, %v", locations, err)
+	}
+
+	for i := range chunkMaxSegments + 1 {
+		if err := chunks.Upsert(ctx, userLocation("user4", 20.46+float64(i)*0.001, 44.81, int64(i)*10)); err != nil {
+			t.Fatalf("error upserting location: %v", err)
+		}
+
+		chunk, _, err := findFirst[locationChunk](ctx, client, "location-history", bson.M{"_id": chunkID("user4", 0)}, nil, nil)
+
+		if expected := i%chunkMaxSegments + 1; err != nil || chunk.Segments != expected || len(chunk.Locations) != expected || chunk.Count != i+1 || chunk.Last != int64(i)*10 {
+			t.Fatalf("expected the location to be appended as segment %d, got %d segments, %d locations, %v", expected, chunk.Segments, chunk.Count, err)
+		}
+	}
+
+	if err := chunks.Upsert(ctx, userLocation("user4", 20.45, 44.80, 5)); err != nil {
+		t.Fatalf("error upserting location: %v", err)
+	}
+
+	chunk, _, err := findFirst[locationChunk](ctx, client, "location-history", bson.M{"_id": chunkID("user4", 0)}, nil, nil)
+
+	if err != nil || chunk.Segments != 1 || chunk.Count != chunkMaxSegments+2 || chunk.West != 20.45 || chunk.South != 44.80 {
+		t.Errorf("expected the location out of order to rewrite the chunk, got %d segments, %d locations, %v", chunk.Segments, chunk.Count, err)
+	}
+
+	if locations, err := chunks.Range(ctx, "user4", 0, 10000, true, 0); err != nil || len(locations) != chunkMaxSegments+2 || !slices.IsSortedFunc(locations, compareLocations) {
+		t.Errorf("expected every appended location to be decoded in order, got %d, %v", len(locations), err)
+	}
+}
+
+func TestRollupStore(t *testing.T) {
+	ctx := context.Background()
+	client := db.CreateMemoryClient()
+	history := CreateMongoLocationHistoryStore(client, "location-history")
+	rollups := CreateRollupStore(client, "location-rollup")
+	rebuilt := CreateRollupStore(client, "location-rollup-rebuilt")
+	random := rand.New(rand.NewPCG(1, 2))
+	locations := []model.LocationInfo{}
+
+	for i, timestamp := 0, int64(1700000000000); i < 700; i, timestamp = i+1, timestamp+10000+random.Int64N(900000) {
+		location := userLocation("user1", 20.46, 44.81, timestamp)
+
+		if i > 0 {
+			location = userLocation("user1", locations[i-1].Location.Coordinates[0]+random.Float64()*0.01, locations[i-1].Location.Coordinates[1]+random.Float64()*0.004-0.002, timestamp)
+		}
+
+		locations = append(locations, location)
+	}
+
+	saved := slices.Clone(locations)
+	random.Shuffle(len(saved), func(i, j int) { saved[i], saved[j] = saved[j], saved[i] })
+
+	for i := range 20 {
+		replacement := userLocation("user1", locations[i*30].Location.Coordinates[0]+0.001, locations[i*30].Location.Coordinates[1], locations[i*30].Timestamp)
+		saved = append(saved, replacement)
+		locations[i*30] = replacement
+	}
+
+	for _, location := range saved {
+		latest, ok, err := history.Latest(ctx, location.Username)
+
+		if err != nil {
+			t.Fatalf("error finding latest location: %v", err)
+		}
+
+		var previous *model.LocationInfo
+
+		if ok {
+			previous = &latest
+		}
+
+		changes, err := RollupChanges(ctx, history, location, previous)
+
+		if err != nil {
+			t.Fatalf("error finding rollup changes: %v", err)
+		}
+
+		if err := history.Upsert(ctx, location); err != nil {
+			t.Fatalf("error upserting location: %v", err)
+		}
+
+		if err := rollups.Apply(ctx, location.Username, changes); err != nil {
+			t.Fatalf("error applying rollup changes: %v", err)
+		}
+	}
+
+	if err := rebuilt.Rebuild(ctx, history, "user1"); err != nil {
+		t.Fatalf("error rebuilding rollups: %v", err)
+	}
+
+	for _, period := range []string{HourlyRollup, DailyRollup} {
+		incremental, err := rollups.Rollups(ctx, "user1", period, math.MinInt64, math.MaxInt64)
+
+		if err != nil {
+			t.Fatalf("error reading rollups: %v", err)
+		}
+
+		expected, err := rebuilt.Rollups(ctx, "user1", period, math.MinInt64, math.MaxInt64)
+
+		if err != nil || len(expected) != len(incremental) || len(expected) == 0 {
+			t.Fatalf("expected %d %s rollups, got %d, %v", len(incremental), period, len(expected), err)
+		}
+
+		for i, rollup := range incremental {
+			other := expected[i]
+
+			if rollup.ID != other.ID || math.Abs(rollup.Distance-other.Distance) > 1e-9 || rollup.Count != other.Count || rollup.MovingTime != other.MovingTime || rollup.First != other.First || rollup.Last != other.Last ||
+				rollup.West > other.West || rollup.South > other.South || rollup.East < other.East || rollup.North < other.North {
+				t.Errorf("expected the incremental rollup %v to match the rebuilt rollup %v", rollup, other)
+			}
+		}
+	}
+
+	hourly, err := rebuilt.Rollups(ctx, "user1", HourlyRollup, math.MinInt64, math.MaxInt64)
+
+	if err != nil {
+		t.Fatalf("error reading rollups: %v", err)
+	}
+
+	stale := Rollup{ID: "stale", Username: "user1", Period: HourlyRollup, Start: math.MaxInt64 - 1}
+
+	if _, err := client.InsertMany(ctx, "location-rollup-rebuilt", []any{stale}, true); err != nil {
+		t.Fatalf("error inserting stale rollup: %v", err)
+	}
+
+	if err := rebuilt.Rebuild(ctx, history, "user1"); err != nil {
+		t.Fatalf("error rebuilding existing rollups: %v", err)
+	}
+
+	if again, err := rebuilt.Rollups(ctx, "user1", HourlyRollup, math.MinInt64, math.MaxInt64); err != nil || !slices.EqualFunc(again, hourly, func(a, b Rollup) bool { return a.ID == b.ID && a.Count == b.Count }) {
+		t.Errorf("expected rebuilding to replace the existing rollups and delete the stale one, got %d rollups instead of %d, %v", len(again), len(hourly), err)
+	}
+
+	first, last := locations[0].Timestamp, locations[len(locations)-1].Timestamp
+	hour := int64(time.Hour / time.Millisecond)
+	spans := [][2]int64{{first, last}, {first - hour, last + hour}, {periodStart(first, hour), periodStart(last, hour)}, {first + 1, first + hour/2}, {last + 1, last + hour}}
+
+	for range 50 {
+		start := first + random.Int64N(last-first)
+		spans = append(spans, [2]int64{start, start + random.Int64N(last-start)})
+	}
+
+	for _, span := range spans {
+		stats, err := rebuilt.Stats(ctx, history, "user1", span[0], span[1])
+
+		if err != nil {
+			t.Fatalf("error calculating stats: %v", err)
+		}
+
+		expected, err := ScanStats(ctx, history, "user1", span[0], span[1])
+
+		if err != nil {
+			t.Fatalf("error scanning stats: %v", err)
+		}
+
+		if math.Abs(stats.Distance-expected.Distance) > 1e-9 || stats.Count != expected.Count || stats.MovingTime != expected.MovingTime || stats.First != expected.First || stats.Last != expected.Last ||
+			stats.West != expected.West || stats.South != expected.South || stats.East != expected.East || stats.North != expected.North {
+			t.Errorf("%v: expected the stats from the rollups %v to match the scanned stats %v", span, stats, expected)
+		}
+	}
+
+	if stats, err := rebuilt.Stats(ctx, history, "user1", first, last); err != nil || stats.Count != int64(len(locations)) || stats.MovingTime == 0 || stats.MovingTime == last-first {
+		t.Errorf("expected the stats of every location with moving and standing segments, got %v, %v", stats, err)
+	}
+}
+
+func TestGeofenceStoreDelete(t *testing.T) {
+	ctx := context.Background()
+	fences := CreateGeofenceStore(db.CreateMemoryClient(), "geofence", "geofence-state", "geofence-event")
+	fence := Geofence{ID: "fence1", Name: "office", Type: "polygon", Geometry: GeofenceGeometry{Type: "Polygon", Coordinates: [][][]float64{{{20, 44}, {21, 44}, {21, 45}, {20, 44}}}}}
+
+	if err := fences.Save(ctx, fence); err != nil {
+		t.Fatalf("error saving geofence: %v", err)
+	}
+
+	for _, state := range []GeofenceState{{ID: "user1:fence1", Username: "user1", FenceID: "fence1"}, {ID: "user1:fence2", Username: "user1", FenceID: "fence2"}} {
+		if err := fences.SaveState(ctx, state); err != nil {
+			t.Fatalf("error saving geofence state: %v", err)
+		}
+	}
+
+	for _, expected := range []bool{true, false} {
+		ok, err := fences.Delete(ctx, "fence1")
+
+		if err != nil {
+			t.Fatalf("error deleting geofence: %v", err)
+		}
+
+		if ok != expected {
+			t.Errorf("expected geofence deletion to report %t, got %t", expected, ok)
+		}
+	}
+
+	states, err := fences.States(ctx, "user1", 10)
+
+	if err != nil {
+		t.Fatalf("error finding geofence states: %v", err)
+	}
+
+	if len(states) != 1 || states[0].FenceID != "fence2" {
+		t.Errorf("expected only the state of the remaining geofence, got %v", states)
+	}
+}
@@ -0,0 +1,254 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"go.mongodb.org/mongo-driver/bson"
+	bsonv2 "go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// TimeSeriesLocationHistoryStore keeps the location history in a time-series collection of a db client, with the username as meta field and the timestamp as time field
+// mongodb requires the time field to be a date, so the unix millisecond timestamps are stored as dates and converted back when the locations are read
+// time-series collections have no unique indexes and no upserts, so locations are replaced by inserting them and deleting the older ones, which needs mongodb 7.0 or later
+type TimeSeriesLocationHistoryStore struct {
+	client     db.DBClient
+	collection string
+}
+
+// timeSeriesLocation is a location as stored in a time-series collection
+type timeSeriesLocation struct {
+	ID        bsonv2.ObjectID `bson:"_id,omitempty"`
+	Username  string          `bson:"username"`
+	Location  model.Location  `bson:"location"`
+	Distance  float64         `bson:"distance"`
+	Timestamp time.Time       `bson:"timestamp"`
+}
+
+// LocationHistoryTimeSeries returns the time-series options of the collection of a time-series location history store
+func LocationHistoryTimeSeries() *db.TimeSeriesSpec {
+	return &db.TimeSeriesSpec{
+		TimeField:   "timestamp",
+		MetaField:   "username",
+		Granularity: "seconds",
+	}
+}
+
+// ToTimeSeriesDocument converts a location to the document stored in the time-series collection
+func ToTimeSeriesDocument(location model.LocationInfo) any {
+	return timeSeriesLocation{
+		Username:  location.Username,
+		Location:  location.Location,
+		Distance:  location.Distance,
+		Timestamp: toDate(location.Timestamp),
+	}
+}
+
+// Upsert stores the location, replacing the location of the same user with the same timestamp
+// the two steps are not atomic, the location is inserted first and the locations with the same timestamp and a lower _id are deleted after it
+// readers may see both locations in between but never none, and of concurrent upserts of the same timestamp only the one with the highest _id is kept
+func (s TimeSeriesLocationHistoryStore) Upsert(ctx context.Context, location model.LocationInfo) error {
+	document := ToTimeSeriesDocument(location).(timeSeriesLocation)
+	document.ID = bsonv2.NewObjectID()
+	result, err := s.client.InsertMany(ctx, s.collection, []any{document}, true)
+
+	if err != nil {
+		return err
+	}
+
+	if err := result.Err(); err != nil {
+		return err
+	}
+
+	filter := bson.M{
+		"username":  location.Username,
+		"timestamp": toDate(location.Timestamp),
+		"_id": bson.M{
+			"$lt": document.ID,
+		},
+	}
+
+	_, err = s.client.DeleteMany(ctx, s.collection, filter)
+	return err
+}
+
+// Latest retrieves the latest location of a user and reports whether the user has one
+func (s TimeSeriesLocationHistoryStore) Latest(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	return s.latest(ctx, username, nil)
+}
+
+// LatestPosition retrieves the coordinates, cumulative distance and timestamp of the latest location of a user and reports whether the user has one
+func (s TimeSeriesLocationHistoryStore) LatestPosition(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	projection := bson.M{
+		"location":  1,
+		"distance":  1,
+		"timestamp": 1,
+	}
+
+	return s.latest(ctx, username, projection)
+}
+
+// latest retrieves the projected fields of the latest location of a user and reports whether the user has one
+func (s TimeSeriesLocationHistoryStore) latest(ctx context.Context, username string, projection map[string]any) (model.LocationInfo, bool, error) {
+	filter := bson.M{
+		"username": username,
+	}
+
+	sort := bson.M{
+		"timestamp": -1,
+	}
+
+	return s.findFirst(ctx, filter, projection, sort)
+}
+
+// LatestBefore retrieves the latest location of a user at or before the unix millisecond timestamp and reports whether there is one
+func (s TimeSeriesLocationHistoryStore) LatestBefore(ctx context.Context, username string, before int64) (model.LocationInfo, bool, error) {
+	return s.latestBefore(ctx, username, before, nil)
+}
+
+// DistanceBefore retrieves the cumulative distance of the latest location of a user at or before the unix millisecond timestamp and reports whether there is one
+func (s TimeSeriesLocationHistoryStore) DistanceBefore(ctx context.Context, username string, before int64) (float64, bool, error) {
+	location, ok, err := s.latestBefore(ctx, username, before, bson.M{"distance": 1})
+	return location.Distance, ok, err
+}
+
+// latestBefore retrieves the projected fields of the latest location of a user at or before the unix millisecond timestamp and reports whether there is one
+func (s TimeSeriesLocationHistoryStore) latestBefore(ctx context.Context, username string, before int64, projection map[string]any) (model.LocationInfo, bool, error) {
+	filter := bson.M{
+		"username": username,
+		"timestamp": bson.M{
+			"$lte": toDate(before),
+		},
+	}
+
+	sort := bson.M{
+		"timestamp": -1,
+	}
+
+	return s.findFirst(ctx, filter, projection, sort)
+}
+
+// FirstAfter retrieves the first location of a user at or after the unix millisecond timestamp and reports whether there is one
+func (s TimeSeriesLocationHistoryStore) FirstAfter(ctx context.Context, username string, after int64) (model.LocationInfo, bool, error) {
+	return s.firstAfter(ctx, username, after, nil)
+}
+
+// DistanceAfter retrieves the cumulative distance of the first location of a user at or after the unix millisecond timestamp and reports whether there is one
+func (s TimeSeriesLocationHistoryStore) DistanceAfter(ctx context.Context, username string, after int64) (float64, bool, error) {
+	location, ok, err := s.firstAfter(ctx, username, after, bson.M{"distance": 1})
+	return location.Distance, ok, err
+}
+
+// firstAfter retrieves the projected fields of the first location of a user at or after the unix millisecond timestamp and reports whether there is one
+func (s TimeSeriesLocationHistoryStore) firstAfter(ctx context.Context, username string, after int64, projection map[string]any) (model.LocationInfo, bool, error) {
+	filter := bson.M{
+		"username": username,
+		"timestamp": bson.M{
+			"$gte": toDate(after),
+		},
+	}
+
+	sort := bson.M{
+		"timestamp": 1,
+	}
+
+	return s.findFirst(ctx, filter, projection, sort)
+}
+
+// Range retrieves at most the limit of locations of a user after a unix millisecond timestamp, or at it if inclusive, and up to the end timestamp ordered by timestamp
+// ranges are read by the last seen timestamp instead of skipped pages, so reading deep into a large range stays cheap
+func (s TimeSeriesLocationHistoryStore) Range(ctx context.Context, username string, after, end int64, inclusive bool, limit int) ([]model.LocationInfo, error) {
+	comparator := "$gt"
+
+	if inclusive {
+		comparator = "$gte"
+	}
+
+	filter := bson.M{
+		"username": username,
+		"timestamp": bson.M{
+			comparator: toDate(after),
+			"$lte":     toDate(end),
+		},
+	}
+
+	sort := bson.M{
+		"timestamp": 1,
+	}
+
+	return s.findAll(ctx, filter, sort, 1, limit)
+}
+
+// Within retrieves a page of the locations of all users inside the polygon of the bounding box and between two unix millisecond timestamps in timestamp order
+// the edges of the polygon are geodesics, so locations close to the edges may lie outside the box itself
+func (s TimeSeriesLocationHistoryStore) Within(ctx context.Context, box geo.BoundingBox, start, end int64, after string, limit int) ([]model.LocationInfo, string, error) {
+	return withinPage(start, end, after, limit, func(from, to int64, limit int) ([]model.LocationInfo, error) {
+		filter := bson.M{
+			"location": db.GeoWithinPolygon(box.Polygon()),
+			"timestamp": bson.M{
+				"$gte": toDate(from),
+				"$lte": toDate(to),
+			},
+		}
+
+		sort := bson.M{
+			"timestamp": 1,
+		}
+
+		return s.findAll(ctx, filter, sort, 1, limit)
+	})
+}
+
+// findAll retrieves a page of the locations matching the filter and converts them from their stored documents
+func (s TimeSeriesLocationHistoryStore) findAll(ctx context.Context, filter, sort map[string]any, pageNumber, pageSize int) ([]model.LocationInfo, error) {
+	documents, err := findAll[timeSeriesLocation](ctx, s.client, s.collection, filter, nil, sort, pageNumber, pageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	locations := []model.LocationInfo{}
+
+	for _, document := range documents {
+		locations = append(locations, fromTimeSeriesDocument(document))
+	}
+
+	return locations, nil
+}
+
+// findFirst retrieves the projected fields of the first location matching the filter and reports whether there is one
+func (s TimeSeriesLocationHistoryStore) findFirst(ctx context.Context, filter, projection, sort map[string]any) (model.LocationInfo, bool, error) {
+	document, ok, err := findFirst[timeSeriesLocation](ctx, s.client, s.collection, filter, projection, sort)
+
+	if err != nil || !ok {
+		return model.LocationInfo{}, false, err
+	}
+
+	return fromTimeSeriesDocument(document), true, nil
+}
+
+// fromTimeSeriesDocument converts a document stored in the time-series collection to a location
+func fromTimeSeriesDocument(document timeSeriesLocation) model.LocationInfo {
+	return model.LocationInfo{
+		Username:  document.Username,
+		Location:  document.Location,
+		Distance:  document.Distance,
+		Timestamp: document.Timestamp.UnixMilli(),
+	}
+}
+
+// toDate converts a unix millisecond timestamp to a date
+func toDate(timestamp int64) time.Time {
+	return time.UnixMilli(timestamp).UTC()
+}
+
+// CreateTimeSeriesLocationHistoryStore creates a store of the location history in the time-series collection of the db client
+func CreateTimeSeriesLocationHistoryStore(client db.DBClient, collection string) TimeSeriesLocationHistoryStore {
+	return TimeSeriesLocationHistoryStore{
+		client:     client,
+		collection: collection,
+	}
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Webhook is an url events of the subscribed types are posted to, signed with the secret
+type Webhook struct {
+	ID     string   `bson:"_id" json:"id"`
+	URL    string   `bson:"url" json:"url"`
+	Events []string `bson:"events" json:"events"`
+	Secret string   `bson:"secret" json:"-"`
+}
+
+// WebhookDelivery is an event posted to a webhook, together with every attempt of posting it in every round of attempts
+// the next attempt is the unix millisecond timestamp a pending delivery is retried at, it is not set while an attempt is due right away or no attempt is left
+// the round attempts count the attempts of the current round, so a pending delivery is resumed with the attempts it has left
+type WebhookDelivery struct {
+	ID            string           `bson:"_id" json:"id"`
+	WebhookID     string           `bson:"webhookId" json:"webhookId"`
+	EventType     string           `bson:"eventType" json:"eventType"`
+	Payload       string           `bson:"payload" json:"payload"`
+	Status        string           `bson:"status" json:"status"`
+	Attempts      []WebhookAttempt `bson:"attempts" json:"attempts"`
+	RoundAttempts int              `bson:"roundAttempts" json:"-"`
+	NextAttemptAt int64            `bson:"nextAttemptAt,omitempty" json:"nextAttemptAt,omitempty"`
+	CreatedAt     int64            `bson:"createdAt" json:"createdAt"`
+	UpdatedAt     int64            `bson:"updatedAt" json:"updatedAt"`
+}
+
+// WebhookAttempt is the outcome of a single attempt of a delivery
+type WebhookAttempt struct {
+	Timestamp  int64  `bson:"timestamp" json:"timestamp"`
+	StatusCode int    `bson:"statusCode,omitempty" json:"statusCode,omitempty"`
+	Error      string `bson:"error,omitempty" json:"error,omitempty"`
+	Duration   int64  `bson:"duration" json:"duration"`
+}
+
+// WebhookStore keeps the webhooks and their deliveries in collections of a db client
+type WebhookStore struct {
+	client     db.DBClient
+	collection string
+	deliveries string
+}
+
+// Save saves or replaces a webhook
+func (s WebhookStore) Save(ctx context.Context, hook Webhook) error {
+	return s.client.SaveOrReplaceDocument(ctx, s.collection, hook, bson.M{"_id": hook.ID})
+}
+
+// Get retrieves a single webhook by its id and reports whether it exists
+func (s WebhookStore) Get(ctx context.Context, id string) (Webhook, bool, error) {
+	return findFirst[Webhook](ctx, s.client, s.collection, bson.M{"_id": id}, nil, nil)
+}
+
+// List retrieves a page of webhooks ordered by id
+func (s WebhookStore) List(ctx context.Context, pageNumber, pageSize int) ([]Webhook, error) {
+	sort := bson.M{
+		"_id": 1,
+	}
+
+	return findAll[Webhook](ctx, s.client, s.collection, bson.M{}, nil, sort, pageNumber, pageSize)
+}
+
+// Delete deletes a webhook and reports whether it existed, its deliveries are kept
+func (s WebhookStore) Delete(ctx context.Context, id string) (bool, error) {
+	return s.client.DeleteDocument(ctx, s.collection, bson.M{"_id": id})
+}
+
+// Subscribed retrieves up to the limit of webhooks subscribed to the event type
+func (s WebhookStore) Subscribed(ctx context.Context, eventType string, limit int) ([]Webhook, error) {
+	filter := bson.M{
+		"events": eventType,
+	}
+
+	return findAll[Webhook](ctx, s.client, s.collection, filter, nil, nil, 1, limit)
+}
+
+// SaveDelivery saves or replaces a delivery together with its attempts
+func (s WebhookStore) SaveDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	return s.client.SaveOrReplaceDocument(ctx, s.deliveries, delivery, bson.M{"_id": delivery.ID})
+}
+
+// Delivery retrieves a single delivery of a webhook by its id and reports whether it exists
+func (s WebhookStore) Delivery(ctx context.Context, webhookID, id string) (WebhookDelivery, bool, error) {
+	filter := bson.M{
+		"_id":       id,
+		"webhookId": webhookID,
+	}
+
+	return findFirst[WebhookDelivery](ctx, s.client, s.deliveries, filter, nil, nil)
+}
+
+// Deliveries retrieves a page of deliveries of a webhook, latest first, an empty status matches every one
+func (s WebhookStore) Deliveries(ctx context.Context, webhookID, status string, pageNumber, pageSize int) ([]WebhookDelivery, error) {
+	filter := bson.M{
+		"webhookId": webhookID,
+	}
+
+	if status != "" {
+		filter["status"] = status
+	}
+
+	sort := bson.M{
+		"createdAt": -1,
+	}
+
+	return findAll[WebhookDelivery](ctx, s.client, s.deliveries, filter, nil, sort, pageNumber, pageSize)
+}
+
+// Pending retrieves up to the limit of pending deliveries of every webhook with an id greater than the given one, ordered by id
+func (s WebhookStore) Pending(ctx context.Context, after string, limit int) ([]WebhookDelivery, error) {
+	filter := bson.M{
+		"status": "pending",
+		"_id": bson.M{
+			"$gt": after,
+		},
+	}
+
+	sort := bson.M{
+		"_id": 1,
+	}
+
+	return findAll[WebhookDelivery](ctx, s.client, s.deliveries, filter, nil, sort, 1, limit)
+}
+
+// CreateWebhookStore creates a store of the webhooks and their deliveries in the collections of the db client
+func CreateWebhookStore(client db.DBClient, collection, deliveries string) WebhookStore {
+	return WebhookStore{
+		client:     client,
+		collection: collection,
+		deliveries: deliveries,
+	}
+}
@@ -2,7 +2,11 @@ package validation
 
 import (
 	"log"
+	"reflect"
 	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -16,7 +20,10 @@ var (
 )
 
 // RegisterCustomValidations registers custom validation functions for the validator
+// fields are reported by their json names, or by their names with a lowercase first letter as used in query parameters, so errors match the requests
 func RegisterCustomValidations(validate *validator.Validate) {
+	validate.RegisterTagNameFunc(fieldName)
+
 	for tag, regex := range customRegexValidations {
 		err := validate.RegisterValidation(tag, func(fl validator.FieldLevel) bool {
 			matched, err := regexp.MatchString(regex, fl.Field().String())
@@ -34,3 +41,19 @@ func RegisterCustomValidations(validate *validator.Validate) {
 		}
 	}
 }
+
+// fieldName returns the name of a struct field as used in requests
+func fieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+
+	if name == "-" {
+		return ""
+	}
+
+	if name != "" {
+		return name
+	}
+
+	first, size := utf8.DecodeRuneInString(field.Name)
+	return string(unicode.ToLower(first)) + field.Name[size:]
+}
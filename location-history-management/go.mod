@@ -4,17 +4,26 @@ go 1.24.2
 
 replace github.com/mmilosevicgd/location-tracking/db => ../internal/db
 
+replace github.com/mmilosevicgd/location-tracking/geo => ../internal/geo
+
 replace github.com/mmilosevicgd/location-tracking/location-history-management/proto => ./proto
 
 replace github.com/mmilosevicgd/location-tracking/model => ../internal/model
 
+replace github.com/mmilosevicgd/location-tracking/problem => ../internal/problem
+
+replace github.com/mmilosevicgd/location-tracking/store => ../internal/store
+
 replace github.com/mmilosevicgd/location-tracking/validation => ../internal/validation
 
 require (
 	github.com/go-playground/validator/v10 v10.25.0
 	github.com/mmilosevicgd/location-tracking/db v0.0.0-00010101000000-000000000000
+	github.com/mmilosevicgd/location-tracking/geo v0.0.0-00010101000000-000000000000
 	github.com/mmilosevicgd/location-tracking/location-history-management/proto v0.0.0-00010101000000-000000000000
 	github.com/mmilosevicgd/location-tracking/model v0.0.0-00010101000000-000000000000
+	github.com/mmilosevicgd/location-tracking/problem v0.0.0-00010101000000-000000000000
+	github.com/mmilosevicgd/location-tracking/store v0.0.0-00010101000000-000000000000
 	github.com/mmilosevicgd/location-tracking/validation v0.0.0-00010101000000-000000000000
 	go.mongodb.org/mongo-driver v1.17.2
 	google.golang.org/grpc v1.71.0
@@ -29,6 +38,7 @@ require (
 	github.com/prometheus/client_model v0.6.1 // indirect
 	github.com/prometheus/common v0.62.0 // indirect
 	github.com/prometheus/procfs v0.15.1 // indirect
+	go.etcd.io/bbolt v1.4.3 // indirect
 	go.opentelemetry.io/otel v1.35.0 // indirect
 )
 
@@ -3,15 +3,24 @@ package main
 import (
 	context "context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"maps"
 	"math"
 	"net/http"
-	"strconv"
+	"slices"
 	"time"
 
+	"github.com/mmilosevicgd/location-tracking/geo"
 	pb "github.com/mmilosevicgd/location-tracking/location-history-management/proto"
 	"github.com/mmilosevicgd/location-tracking/model"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/mmilosevicgd/location-tracking/problem"
+	"github.com/mmilosevicgd/location-tracking/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -25,21 +34,21 @@ func calculateUserDistanceHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		log.Printf("error decoding request body: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, err.Error())
 		return
 	}
 
 	if err := validate.Struct(data); err != nil {
 		log.Printf("validation error for request data: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		problem.WriteValidation(w, r, err)
 		return
 	}
 
-	distance, err := calculateUserDistance(data.Username, data.Start, data.End)
+	distance, err := calculateUserDistance(r.Context(), data.Username, data.Start, data.End)
 
 	if err != nil {
 		log.Printf("error calculating user distance for username '%s' and date range '%s' - '%s': %v\n", data.Username, data.Start, data.End, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
 
@@ -53,7 +62,7 @@ func calculateUserDistanceHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		log.Printf("error encoding response: %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteInternal(w, r)
 		return
 	}
 
@@ -61,180 +70,380 @@ func calculateUserDistanceHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // calculateUserDistance calculates the distance traveled by a user between two timestamps and returns the result
-func calculateUserDistance(username, start, end string) (float64, error) {
-	parsedStart, err := time.Parse(time.RFC3339, start)
+func calculateUserDistance(ctx context.Context, username, start, end string) (float64, error) {
+	parsedStart, parsedEnd, err := parseDateRange(username, start, end)
 
 	if err != nil {
-		log.Printf("error parsing start time '%s' for username '%s': %v\n", start, username, err)
 		return 0, err
 	}
 
-	initialDistance, err := getFirstAfter(username, parsedStart.UnixMilli())
+	return calculateUserDistanceBetween(ctx, username, parsedStart, parsedEnd)
+}
+
+// parseDateRange parses the RFC 3339 start and end times of a request of a user to unix millisecond timestamps
+func parseDateRange(username, start, end string) (int64, int64, error) {
+	parsedStart, err := time.Parse(time.RFC3339, start)
 
 	if err != nil {
-		log.Printf("error retrieving first location after start time '%s' for username '%s': %v", start, username, err)
-		return 0, err
+		log.Printf("error parsing start time '%s' for username '%s': %v\n", start, username, err)
+		return 0, 0, err
 	}
 
 	parsedEnd, err := time.Parse(time.RFC3339, end)
 
 	if err != nil {
 		log.Printf("error parsing end time '%s' for username '%s': %v", end, username, err)
-		return 0, err
+		return 0, 0, err
 	}
 
-	if parsedEnd.Before(parsedStart) {
-		log.Printf("end time '%s' is before start time '%s' for username '%s'\n", end, start, username)
+	return parsedStart.UnixMilli(), parsedEnd.UnixMilli(), nil
+}
+
+// calculateUserDistanceBetween calculates the distance traveled by a user between two unix millisecond timestamps and returns the result
+// once the rollups are built the distance is answered from them, before that stores which calculate distances themselves, such as the chunks answering from their summaries, are asked for the distance directly
+func calculateUserDistanceBetween(ctx context.Context, username string, start, end int64) (float64, error) {
+	if end < start {
+		log.Printf("end time '%d' is before start time '%d' for username '%s'\n", end, start, username)
 		return 0, nil
 	}
 
-	finalDistance, err := getLastBefore(username, parsedEnd.UnixMilli())
+	if rollupsBuilt() {
+		stats, err := rollupStore().Stats(ctx, locationHistoryStore(), username, start, end)
+
+		if err != nil {
+			log.Printf("error calculating distance from the rollups between '%d' and '%d' for username '%s': %v\n", start, end, username, err)
+		}
+
+		return stats.Distance, err
+	}
+
+	if distanceStore, ok := locationHistoryStore().(store.DistanceStore); ok {
+		distance, err := distanceStore.Distance(ctx, username, start, end)
+
+		if err != nil {
+			log.Printf("error calculating distance between '%d' and '%d' for username '%s': %v\n", start, end, username, err)
+		}
+
+		return distance, err
+	}
+
+	initialDistance, err := getFirstAfter(ctx, username, start)
 
 	if err != nil {
-		log.Printf("error retrieving last location before end time '%s' for username '%s': %v", end, username, err)
+		log.Printf("error retrieving first location after start time '%d' for username '%s': %v", start, username, err)
 		return 0, err
 	}
 
-	return finalDistance - initialDistance, nil
-}
+	finalDistance, err := getLastBefore(ctx, username, end)
 
-// getFirstAfter retrieves the first location after a given date for a specific user
-func getFirstAfter(username string, date int64) (float64, error) {
-	return getDate(username, date, "after")
-}
+	if err != nil {
+		log.Printf("error retrieving last location before end time '%d' for username '%s': %v", end, username, err)
+		return 0, err
+	}
 
-// getLastBefore retrieves the last location before a given date for a specific user
-func getLastBefore(username string, date int64) (float64, error) {
-	return getDate(username, date, "before")
+	return finalDistance - initialDistance, nil
 }
 
-// getDate retrieves the location total distance based on the specified date and type (after or before)
-func getDate(username string, date int64, dateType string) (float64, error) {
-	comparator := "$gte"
+// calculateUserStatsHandler validates the request data, extracts the username and timestamps, and summarizes the locations of the user between the two timestamps
+func calculateUserStatsHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Username string `json:"username" validate:"required,alphanum,min=4,max=16"`
+		Start    string `json:"start" validate:"required,customdatetime"`
+		End      string `json:"end" validate:"required,customdatetime"`
+	}{}
 
-	if dateType == "before" {
-		comparator = "$lte"
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		log.Printf("error decoding request body: %v\n", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, err.Error())
+		return
 	}
 
-	filter := bson.M{
-		"username":  username,
-		"timestamp": bson.M{comparator: date},
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for request data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
 	}
 
-	projection := bson.M{
-		"distance": 1,
-	}
+	stats, err := calculateUserStats(r.Context(), data.Username, data.Start, data.End)
 
-	sorter := 1
+	if err != nil {
+		log.Printf("error calculating user stats for username '%s' and date range '%s' - '%s': %v\n", data.Username, data.Start, data.End, err)
+		problem.WriteError(w, r, err)
+		return
+	}
 
-	if dateType == "before" {
-		sorter = -1
+	response := struct {
+		Distance    float64       `json:"distance"`
+		Count       int64         `json:"count"`
+		MovingTime  float64       `json:"movingTime"`
+		First       string        `json:"first,omitempty"`
+		Last        string        `json:"last,omitempty"`
+		BoundingBox *[2][]float64 `json:"boundingBox,omitempty"`
+	}{
+		Distance:   stats.Distance,
+		Count:      stats.Count,
+		MovingTime: float64(stats.MovingTime) / 1000,
 	}
 
-	sort := bson.M{
-		"timestamp": sorter,
+	if stats.Count > 0 {
+		response.First = time.UnixMilli(stats.First).UTC().Format(time.RFC3339Nano)
+		response.Last = time.UnixMilli(stats.Last).UTC().Format(time.RFC3339Nano)
+		response.BoundingBox = &[2][]float64{{stats.West, stats.South}, {stats.East, stats.North}}
 	}
 
-	cursor, err := mongoClient.Find(locationHistoryCollection, filter, projection, sort, 1, 1)
+	err = json.NewEncoder(w).Encode(response)
 
 	if err != nil {
-		log.Printf("error executing database query for username '%s', date '%s' and date type '%s': %v\n", username, strconv.FormatInt(date, 10), dateType, err)
-		return 0, err
+		log.Printf("error encoding response: %v\n", err)
+		problem.WriteInternal(w, r)
+		return
 	}
 
-	defer cursor.Close(context.Background())
-	locations := []struct {
-		Distance float64 `bson:"distance" json:"distance"`
-	}{}
+	w.Header().Set("Content-Type", "application/json")
+}
 
-	if err := cursor.All(context.Background(), &locations); err != nil {
-		log.Printf("error decoding cursor results for username '%s', date '%s' and date type '%s': %v\n", username, strconv.FormatInt(date, 10), dateType, err)
-		return 0, err
+// calculateUserStats summarizes the locations of a user between two timestamps, from the rollups once they are built and by reading every location before that
+func calculateUserStats(ctx context.Context, username, start, end string) (store.LocationStats, error) {
+	parsedStart, parsedEnd, err := parseDateRange(username, start, end)
+
+	if err != nil {
+		return store.LocationStats{}, err
 	}
 
-	if len(locations) == 0 {
-		return 0, nil
+	if rollupsBuilt() {
+		return rollupStore().Stats(ctx, locationHistoryStore(), username, parsedStart, parsedEnd)
 	}
 
-	return locations[0].Distance, nil
+	return store.ScanStats(ctx, locationHistoryStore(), username, parsedStart, parsedEnd)
+}
+
+// getFirstAfter retrieves the total distance of the first location at or after a given date for a specific user
+func getFirstAfter(ctx context.Context, username string, date int64) (float64, error) {
+	distance, _, err := locationHistoryStore().DistanceAfter(ctx, username, date)
+	return distance, err
+}
+
+// getLastBefore retrieves the total distance of the last location at or before a given date for a specific user
+func getLastBefore(ctx context.Context, username string, date int64) (float64, error) {
+	distance, _, err := locationHistoryStore().DistanceBefore(ctx, username, date)
+	return distance, err
 }
 
 // UpdateUserLocation updates the location of a user in the database
 func (s *protoServer) UpdateUserLocation(ctx context.Context, in *pb.LocationInfo) (*emptypb.Empty, error) {
-	locationInfo := model.LocationInfo{
-		Username: in.Username,
-		Location: model.Location{
-			Type:        in.Location.Type,
-			Coordinates: in.Location.Coordinates,
-		},
-		Timestamp: in.Timestamp,
+	if err := saveUserLocation(ctx, toModelLocationInfo(in)); err != nil {
+		return nil, errorStatus(err, "error saving location for username '%s'", in.Username)
 	}
 
-	currentLocation, currentDistance, ok, err := findCurrent(locationInfo.Username)
+	return &emptypb.Empty{}, nil
+}
+
+// StreamUserLocations receives a continuous stream of user locations, stores them in the order they arrive and acknowledges every one of them separately
+// a location is only read from the stream after the previous one has been acknowledged, so the grpc flow control window bounds the number of unacknowledged locations
+func (s *protoServer) StreamUserLocations(stream grpc.BidiStreamingServer[pb.LocationUpdate, pb.LocationAck]) error {
+	for {
+		update, err := stream.Recv()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			log.Printf("error receiving location update from stream: %v\n", err)
+			return err
+		}
+
+		ack := &pb.LocationAck{
+			Sequence: update.Sequence,
+		}
+
+		if update.Location == nil || update.Location.Location == nil {
+			ack.Error = "location is missing"
+
+		} else if err := saveUserLocation(stream.Context(), toModelLocationInfo(update.Location)); err != nil {
+			ack.Error = err.Error()
+		}
+
+		if err := stream.Send(ack); err != nil {
+			log.Printf("error sending acknowledgement for location update '%d': %v\n", update.Sequence, err)
+			return err
+		}
+	}
+}
+
+// saveUserLocation calculates the total distance traveled by the user up to the given location, stores it in the database and updates the rollups of the user
+func saveUserLocation(ctx context.Context, locationInfo model.LocationInfo) error {
+	current, ok, err := locationHistoryStore().LatestPosition(ctx, locationInfo.Username)
 
 	if err != nil {
 		log.Printf("error finding current location for username '%s': %v\n", locationInfo.Username, err)
-		return nil, err
+		return err
 	}
 
+	var latest *model.LocationInfo
+
 	if !ok {
 		locationInfo.Distance = 0
 
 	} else {
-		locationInfo.Distance = calculateDistance(currentLocation, locationInfo.Location, currentDistance)
+		locationInfo.Distance = calculateDistance(current.Location, locationInfo.Location, current.Distance)
+		latest = &current
 	}
 
-	filter := bson.M{
-		"username":  locationInfo.Username,
-		"timestamp": locationInfo.Timestamp,
+	changes, err := store.RollupChanges(ctx, locationHistoryStore(), locationInfo, latest)
+
+	if err != nil {
+		log.Printf("error finding rollup changes for username '%s': %v\n", locationInfo.Username, err)
+		return err
 	}
 
-	if err := mongoClient.SaveOrReplaceDocument(locationHistoryCollection, locationInfo, filter); err != nil {
-		log.Printf("error saving or replacing document for username '%s': %v\n", locationInfo.Username, err)
-		return nil, err
+	if err := locationHistoryStore().Upsert(ctx, locationInfo); err != nil {
+		log.Printf("error saving location for username '%s': %v\n", locationInfo.Username, err)
+		return err
 	}
 
-	return &emptypb.Empty{}, nil
+	if err := rollupStore().Apply(ctx, locationInfo.Username, changes); err != nil {
+		log.Printf("error updating rollups for username '%s': %v\n", locationInfo.Username, err)
+		return err
+	}
+
+	return nil
+}
+
+// CalculateUserDistance calculates the distance traveled by a user between two unix millisecond timestamps in kilometers
+func (s *protoServer) CalculateUserDistance(ctx context.Context, in *pb.DistanceRequest) (*pb.DistanceResponse, error) {
+	if err := validate.Var(in.Username, "required,alphanum,min=4,max=16"); err != nil {
+		log.Printf("validation error for username '%s': %v\n", in.Username, err)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid username '%s'", in.Username)
+	}
+
+	distance, err := calculateUserDistanceBetween(ctx, in.Username, in.Start, in.End)
+
+	if err != nil {
+		log.Printf("error calculating user distance for username '%s' and date range '%d' - '%d': %v\n", in.Username, in.Start, in.End, err)
+		return nil, errorStatus(err, "error calculating distance for username '%s'", in.Username)
+	}
+
+	return &pb.DistanceResponse{
+		Distance: distance,
+	}, nil
 }
 
-// findCurrent retrieves the current location and total distance for a specific user
-func findCurrent(username string) (model.Location, float64, bool, error) {
-	filter := bson.M{
-		"username": username,
+// GetUserTrack streams the locations of a user between two unix millisecond timestamps ordered by timestamp
+// the locations are read from the database in pages, so large ranges are never loaded into memory at once
+func (s *protoServer) GetUserTrack(in *pb.TrackRequest, stream grpc.ServerStreamingServer[pb.LocationInfo]) error {
+	if err := validate.Var(in.Username, "required,alphanum,min=4,max=16"); err != nil {
+		log.Printf("validation error for username '%s': %v\n", in.Username, err)
+		return status.Errorf(codes.InvalidArgument, "invalid username '%s'", in.Username)
 	}
 
-	projection := bson.M{
-		"location": 1,
-		"distance": 1,
+	if in.End < in.Start {
+		return status.Errorf(codes.InvalidArgument, "end time '%d' is before start time '%d'", in.End, in.Start)
 	}
 
-	sort := bson.M{
-		"timestamp": -1,
+	after := in.Start
+	inclusive := true
+
+	for {
+		locations, err := findTrackPage(stream.Context(), in.Username, after, in.End, inclusive)
+
+		if err != nil {
+			log.Printf("error retrieving track for username '%s' and date range '%d' - '%d': %v\n", in.Username, after, in.End, err)
+			return errorStatus(err, "error retrieving track for username '%s'", in.Username)
+		}
+
+		for _, location := range locations {
+			if err := stream.Send(toProtoLocationInfo(location)); err != nil {
+				log.Printf("error sending track location for username '%s': %v\n", in.Username, err)
+				return err
+			}
+		}
+
+		if len(locations) < trackPageSize {
+			return nil
+		}
+
+		after = locations[len(locations)-1].Timestamp
+		inclusive = false
 	}
+}
 
-	cursor, err := mongoClient.Find(locationHistoryCollection, filter, projection, sort, 1, 1)
+// findTrackPage retrieves a single page of user locations after a given timestamp and up to the end timestamp ordered by timestamp
+// pages are keyed by the last seen timestamp instead of skipped, so reading deep into a large range stays cheap
+func findTrackPage(ctx context.Context, username string, after, end int64, inclusive bool) ([]model.LocationInfo, error) {
+	return locationHistoryStore().Range(ctx, username, after, end, inclusive, trackPageSize)
+}
+
+// GetLatestUserLocation retrieves the latest location of a user at or before a unix millisecond timestamp
+// if the timestamp is not set, the latest known location is returned
+func (s *protoServer) GetLatestUserLocation(ctx context.Context, in *pb.LatestLocationRequest) (*pb.LocationInfo, error) {
+	if err := validate.Var(in.Username, "required,alphanum,min=4,max=16"); err != nil {
+		log.Printf("validation error for username '%s': %v\n", in.Username, err)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid username '%s'", in.Username)
+	}
+
+	location, ok, err := findLatest(ctx, in.Username, in.Before)
 
 	if err != nil {
-		log.Printf("error executing database query for username '%s': %v\n", username, err)
-		return model.Location{}, 0, false, err
+		log.Printf("error finding latest location for username '%s' before '%d': %v\n", in.Username, in.Before, err)
+		return nil, errorStatus(err, "error finding latest location for username '%s'", in.Username)
 	}
 
-	defer cursor.Close(context.Background())
-	locations := []struct {
-		Location model.Location `bson:"location" json:"location"`
-		Distance float64        `bson:"distance" json:"distance"`
-	}{}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no location found for username '%s'", in.Username)
+	}
+
+	return toProtoLocationInfo(location), nil
+}
+
+// findLatest retrieves the latest location of a user at or before a given date, or the latest known location if the date is not set
+func findLatest(ctx context.Context, username string, before int64) (model.LocationInfo, bool, error) {
+	if before > 0 {
+		return locationHistoryStore().LatestBefore(ctx, username, before)
+	}
+
+	return locationHistoryStore().Latest(ctx, username)
+}
+
+// toModelLocationInfo converts a grpc location info to its model representation
+func toModelLocationInfo(in *pb.LocationInfo) model.LocationInfo {
+	return model.LocationInfo{
+		Username: in.Username,
+		Location: model.Location{
+			Type:        in.Location.Type,
+			Coordinates: in.Location.Coordinates,
+		},
+		Timestamp: in.Timestamp,
+	}
+}
 
-	if err := cursor.All(context.Background(), &locations); err != nil {
-		log.Printf("error decoding cursor results for username '%s': %v\n", username, err)
-		return model.Location{}, 0, false, err
+// toProtoLocationInfo converts a location info model to its grpc representation enriched with the nearest known place
+func toProtoLocationInfo(locationInfo model.LocationInfo) *pb.LocationInfo {
+	return &pb.LocationInfo{
+		Username: locationInfo.Username,
+		Location: &pb.Location{
+			Type:        locationInfo.Location.Type,
+			Coordinates: locationInfo.Location.Coordinates,
+		},
+		Timestamp: locationInfo.Timestamp,
+		Distance:  locationInfo.Distance,
+		Place:     pb.LookupPlace(reverseGeocoder, locationInfo.Location.Coordinates),
 	}
+}
+
+// errorStatus returns the grpc status error of a failed operation, keeping cancellations and exceeded deadlines apart from internal errors
+func errorStatus(err error, format string, args ...any) error {
+	code := codes.Internal
 
-	if len(locations) == 0 {
-		return model.Location{}, 0, false, nil
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
 	}
 
-	return locations[0].Location, locations[0].Distance, true, nil
+	return status.Errorf(code, format, args...)
 }
 
 // degreesToRadians converts degrees to radians
@@ -259,3 +468,105 @@ func calculateDistance(start, end model.Location, currentDistance float64) float
 	a := math.Pow(math.Sin(diffLat/2), 2) + math.Cos(startLatitude)*math.Cos(endLatitude)*math.Pow(math.Sin(diffLon/2), 2)
 	return 6371*2*math.Atan2(math.Sqrt(a), math.Sqrt(1-a)) + currentDistance
 }
+
+// GetLocationDensity counts the locations of all users inside a bounding box and between two unix millisecond timestamps per geohash cell of the requested precision
+// each cell also lists the distinct usernames located in it, so callers can count users instead of locations
+// the locations are read from the database in pages keyed by a cursor, once the maximum number of locations is counted the response is marked as truncated
+// the cells and their usernames are limited to a maximum number of entries, so the response stays well below the grpc message size limit
+func (s *protoServer) GetLocationDensity(ctx context.Context, in *pb.DensityRequest) (*pb.DensityResponse, error) {
+	box, err := extractDensityBoundingBox(in)
+
+	if err != nil {
+		log.Printf("validation error for density bounding box: %v\n", err)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid bounding box: %v", err)
+	}
+
+	if in.Precision < 1 || in.Precision > maxDensityPrecision {
+		return nil, status.Errorf(codes.InvalidArgument, "precision '%d' is not between 1 and %d", in.Precision, maxDensityPrecision)
+	}
+
+	if in.End < in.Start {
+		return nil, status.Errorf(codes.InvalidArgument, "end time '%d' is before start time '%d'", in.End, in.Start)
+	}
+
+	counts := map[string]int64{}
+	usernames := map[string]map[string]struct{}{}
+	response := &pb.DensityResponse{}
+
+	for cursor, counted := "", 0; ; {
+		locations, next, err := locationHistoryStore().Within(ctx, box, in.Start, in.End, cursor, densityPageSize)
+
+		if err != nil {
+			log.Printf("error finding locations for density in date range '%d' - '%d': %v\n", in.Start, in.End, err)
+			return nil, errorStatus(err, "error retrieving locations for density")
+		}
+
+		for _, location := range locations {
+			if !box.Contains(location.Location.Coordinates) {
+				continue
+			}
+
+			geohash := geo.Geohash(location.Location.Coordinates, int(in.Precision))
+			counts[geohash]++
+
+			if usernames[geohash] == nil {
+				usernames[geohash] = map[string]struct{}{}
+			}
+
+			usernames[geohash][location.Username] = struct{}{}
+		}
+
+		counted += len(locations)
+
+		if next == "" {
+			break
+		}
+
+		if counted >= maxDensityPoints {
+			response.Truncated = true
+			break
+		}
+
+		cursor = next
+	}
+
+	cells, truncated := buildDensityCells(counts, usernames, maxDensityEntries)
+	response.Cells = cells
+	response.Truncated = response.Truncated || truncated
+	return response, nil
+}
+
+// buildDensityCells converts the location counts and distinct usernames per geohash to density cells in geohash order
+// every cell and every username is an entry, once the cells would exceed the maximum number of entries the rest is left out and reported as truncated
+func buildDensityCells(counts map[string]int64, usernames map[string]map[string]struct{}, maxEntries int) ([]*pb.DensityCell, bool) {
+	cells := []*pb.DensityCell{}
+	entries := 0
+
+	for _, geohash := range slices.Sorted(maps.Keys(counts)) {
+		cellUsernames := slices.Sorted(maps.Keys(usernames[geohash]))
+
+		if entries+1+len(cellUsernames) > maxEntries {
+			return cells, true
+		}
+
+		entries += 1 + len(cellUsernames)
+		cells = append(cells, &pb.DensityCell{Geohash: geohash, Count: counts[geohash], Usernames: cellUsernames})
+	}
+
+	return cells, false
+}
+
+// extractDensityBoundingBox validates and extracts the [longitude, latitude] bounding box of a density request
+func extractDensityBoundingBox(in *pb.DensityRequest) (geo.BoundingBox, error) {
+	for _, coordinates := range [][]float64{in.SouthWest, in.NorthEast} {
+		if len(coordinates) != 2 || coordinates[0] < -180 || coordinates[0] > 180 || coordinates[1] < -90 || coordinates[1] > 90 {
+			return geo.BoundingBox{}, fmt.Errorf("invalid coordinates '%v'", coordinates)
+		}
+	}
+
+	if in.SouthWest[1] > in.NorthEast[1] {
+		return geo.BoundingBox{}, fmt.Errorf("south west latitude %f is greater than north east latitude %f", in.SouthWest[1], in.NorthEast[1])
+	}
+
+	return geo.BoundingBox{SouthWest: in.SouthWest, NorthEast: in.NorthEast}, nil
+}
@@ -13,7 +13,10 @@ import (
 
 	"github.com/go-playground/validator/v10"
 	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/geo"
 	pb "github.com/mmilosevicgd/location-tracking/location-history-management/proto"
+	"github.com/mmilosevicgd/location-tracking/problem"
+	"github.com/mmilosevicgd/location-tracking/store"
 	"github.com/mmilosevicgd/location-tracking/validation"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
@@ -24,19 +27,45 @@ type protoServer struct {
 }
 
 const (
-	locationHistoryCollection = "location-history"
+	locationHistoryCollection           = "location-history"
+	locationHistoryTimeSeriesCollection = "location-history-timeseries"
+	locationHistoryChunksCollection     = "location-history-chunks"
+	locationHistoryChunkDuration        = time.Hour
+	locationRollupCollection            = "location-rollup"
+	documentsStorage                    = "documents"
+	timeSeriesStorage                   = "timeseries"
+	chunksStorage                       = "chunks"
+	migrationCollection                 = "migration"
+	migrationBatchSize                  = 1000
+	migrationStatusInterval             = time.Minute
+	trackPageSize                       = 500
+	densityPageSize                     = 10000
+	maxDensityPoints                    = 1000000
+	maxDensityEntries                   = 100000
+	maxDensityPrecision                 = 12
 )
 
 var (
-	validate    = validator.New()
-	mongoClient db.DBClient
-	httpServer  *http.Server
-	grpcServer  *grpc.Server
+	validate        = validator.New()
+	mongoClient     db.DBClient
+	locationHistory store.LocationHistoryStore
+	httpServer      *http.Server
+	grpcServer      *grpc.Server
+	reverseGeocoder *geo.ReverseGeocoder
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrationCommand(os.Args[2:]); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+
+		return
+	}
+
 	go initValidations()
-	go initMongoClient()
+	initMongoClient()
+	go initReverseGeocoder()
 	go initHttpServer()
 	go initGrpcServer()
 
@@ -57,26 +86,125 @@ func initValidations() {
 	validation.RegisterCustomValidations(validate)
 }
 
-// initMongoClient initializes the mongodb client and creates the necessary collections and indexes
+// initMongoClient initializes the mongodb client, applies the schema of the collections and indexes and the pending migrations
+// it runs before everything else using the client is started, so the servers only accept requests once the data is migrated
 func initMongoClient() {
 	if mongoClient != nil {
 		log.Println("mongo client already initialized")
 		return
 	}
 
-	mongoClient = db.MustCreateClient(db.ClientInfo{
-		AuthSource:      os.Getenv("MONGODB_AUTH_DB"),
-		Username:        os.Getenv("MONGODB_USERNAME"),
-		Password:        os.Getenv("MONGODB_PASSWORD"),
-		Uri:             os.Getenv("MONGODB_URI"),
-		DefaultDatabase: os.Getenv("MONGODB_DEFAULT_DB"),
-	})
+	mongoClient = createDBClient()
+	storage := historyStorage()
+
+	switch {
+	case os.Getenv("DB_BACKEND") == "memory":
+		locationHistory = store.CreateMemoryLocationHistoryStore()
+
+	case storage == timeSeriesStorage:
+		locationHistory = store.CreateTimeSeriesLocationHistoryStore(mongoClient, locationHistoryTimeSeriesCollection)
+
+	case storage == chunksStorage:
+		locationHistory = store.CreateChunkedLocationHistoryStore(mongoClient, locationHistoryChunksCollection, locationHistoryChunkDuration)
+	}
+
+	drift := db.MustApplySchema(context.Background(), mongoClient, storageSchema(storage))
+	reportSchemaDrift(drift)
+
+	if err := migrateOnStartup(); err != nil {
+		mongoClient.Disconnect(context.Background())
+		log.Fatalf("%v\n", err)
+	}
+
+	if err := refreshRollupsBuilt(context.Background(), mongoClient); err != nil {
+		log.Printf("error checking whether the rollups are built: %v\n", err)
+	}
+
+	go watchRollupsBuilt()
+
+	log.Println("successfully initialized mongo client and applied the schema and migrations")
+}
+
+// createDBClient creates the client of the database backend selected by DB_BACKEND, mongodb by default
+func createDBClient() db.DBClient {
+	switch backend := os.Getenv("DB_BACKEND"); backend {
+	case "memory":
+		log.Println("using the in-memory database backend, the data is lost when the service stops")
+		return db.CreateMemoryClient()
+
+	case "embedded":
+		path := os.Getenv("EMBEDDED_DB_PATH")
+
+		if path == "" {
+			path = "location-history-management.db"
+		}
+
+		log.Printf("using the embedded database backend stored in '%s'\n", path)
+		return db.MustCreateEmbeddedClient(path)
+
+	case "", "mongodb":
+		timeouts, err := db.ParseTimeouts(os.Getenv("MONGODB_TIMEOUT"), os.Getenv("MONGODB_OPERATION_TIMEOUTS"))
+
+		if err != nil {
+			log.Fatalf("error parsing mongodb timeouts: %v\n", err)
+		}
+
+		return db.MustCreateClient(db.ClientInfo{
+			AuthSource:      os.Getenv("MONGODB_AUTH_DB"),
+			Username:        os.Getenv("MONGODB_USERNAME"),
+			Password:        os.Getenv("MONGODB_PASSWORD"),
+			Uri:             os.Getenv("MONGODB_URI"),
+			DefaultDatabase: os.Getenv("MONGODB_DEFAULT_DB"),
+			Timeouts:        timeouts,
+		})
+
+	default:
+		log.Fatalf("unknown database backend '%s', expected 'mongodb', 'embedded' or 'memory'\n", backend)
+		return nil
+	}
+}
+
+// historyStorage returns how the location history is stored, selected by LOCATION_HISTORY_STORAGE
+// documents keeps one document per location in a plain collection, timeseries keeps the locations in a time-series collection of mongodb
+// and chunks packs the locations of every user and hour into a single document
+func historyStorage() string {
+	switch storage := os.Getenv("LOCATION_HISTORY_STORAGE"); storage {
+	case "", documentsStorage:
+		return documentsStorage
+
+	case timeSeriesStorage, chunksStorage:
+		return storage
+
+	default:
+		log.Fatalf("unknown location history storage '%s', expected 'documents', 'timeseries' or 'chunks'\n", storage)
+		return ""
+	}
+}
+
+// locationHistoryStore returns the store of the location history of the users, kept in memory with the memory backend, in the collection of the timeseries or chunks storage and in the location history collection otherwise
+func locationHistoryStore() store.LocationHistoryStore {
+	if locationHistory != nil {
+		return locationHistory
+	}
+
+	return store.CreateMongoLocationHistoryStore(mongoClient, locationHistoryCollection)
+}
+
+// rollupStore returns the store of the hourly and daily rollups of the location history, kept in the rollup collection with every backend and storage
+func rollupStore() store.RollupStore {
+	return store.CreateRollupStore(mongoClient, locationRollupCollection)
+}
+
+// initReverseGeocoder loads the places used to resolve coordinates to place names from the configured geonames files
+// until they are loaded, or without a places file, locations are returned without a place
+func initReverseGeocoder() {
+	if reverseGeocoder != nil {
+		log.Println("reverse geocoder already initialized")
+		return
+	}
 
-	mongoClient.MustCreateCollection(locationHistoryCollection)
-	mongoClient.MustCreateIndex(locationHistoryCollection, "username", 1)
-	mongoClient.MustCreateIndex(locationHistoryCollection, "timestamp", -1)
-	mongoClient.MustCreate2dSphereIndex(locationHistoryCollection, "location")
-	log.Println("successfully initialized mongo client and created collections and indexes")
+	reverseGeocoder = geo.MustLoadReverseGeocoder()
+	log.Println("successfully initialized reverse geocoder")
 }
 
 // initHttpServer initializes the HTTP server and sets up the routes
@@ -90,10 +218,11 @@ func initHttpServer() {
 	mux := http.NewServeMux()
 	mux.Handle("GET /metrics", promhttp.Handler())
 	mux.HandleFunc("POST /user/distance", calculateUserDistanceHandler)
+	mux.HandleFunc("POST /user/stats", calculateUserStatsHandler)
 
 	httpServer = &http.Server{
 		Addr:    ":8080",
-		Handler: mux,
+		Handler: problem.WithRequestID(mux),
 	}
 
 	log.Println("started http server at http://localhost:8080")
@@ -137,7 +266,7 @@ func disconnectMongoClient(wg *sync.WaitGroup) {
 
 	log.Println("disconnecting mongo client...")
 
-	if err := mongoClient.Disconnect(); err != nil {
+	if err := mongoClient.Disconnect(context.Background()); err != nil {
 		log.Printf("error disconnecting mongo client: %v\n", err)
 
 	} else {
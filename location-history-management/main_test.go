@@ -9,14 +9,22 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/geo"
 	lhmp "github.com/mmilosevicgd/location-tracking/location-history-management/proto"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"github.com/mmilosevicgd/location-tracking/problem"
+	"github.com/mmilosevicgd/location-tracking/store"
 	"go.mongodb.org/mongo-driver/bson"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -184,6 +192,191 @@ func TestUserDistance(t *testing.T) {
 	}
 }
 
+func TestStreamUserLocations(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	go main()
+	time.Sleep(2 * time.Second)
+	client := lhmp.MustCreateClient("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	stream, err := client.StreamUserLocations(context.Background())
+
+	if err != nil {
+		t.Fatalf("error opening location stream: %v", err)
+	}
+
+	updates := []*lhmp.LocationUpdate{
+		{Sequence: 1, Location: &lhmp.LocationInfo{Username: "user7", Location: &lhmp.Location{Type: "Point", Coordinates: bgCoordinates}, Timestamp: 1000}},
+		{Sequence: 2, Location: &lhmp.LocationInfo{Username: "user7"}},
+		{Sequence: 3, Location: &lhmp.LocationInfo{Username: "user7", Location: &lhmp.Location{Type: "Point", Coordinates: cuCoordinates}, Timestamp: 2000}},
+	}
+
+	for _, update := range updates {
+		if err := stream.Send(update); err != nil {
+			t.Fatalf("error sending location update: %v", err)
+		}
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("error closing location stream: %v", err)
+	}
+
+	acks := []*lhmp.LocationAck{}
+
+	for {
+		ack, err := stream.Recv()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("error receiving acknowledgement: %v", err)
+		}
+
+		acks = append(acks, ack)
+	}
+
+	if len(acks) != len(updates) {
+		t.Fatalf("expected %d acknowledgements, got %d", len(updates), len(acks))
+	}
+
+	for i, ack := range acks {
+		if ack.Sequence != updates[i].Sequence {
+			t.Errorf("expected acknowledgement for sequence %d, got %d", updates[i].Sequence, ack.Sequence)
+		}
+
+		if (ack.Error == "") != (updates[i].Location.Location != nil) {
+			t.Errorf("unexpected acknowledgement error '%s' for sequence %d", ack.Error, ack.Sequence)
+		}
+	}
+
+	for _, timestamp := range []int64{1000, 2000} {
+		cursor := mongoClient.(db.MockDBClient).GetResponse(locationHistoryCollection, bson.M{
+			"username":  "user7",
+			"timestamp": timestamp,
+		}, nil, nil, 0, 0)
+
+		locations := []model.LocationInfo{}
+
+		if err := cursor.All(context.Background(), &locations); err != nil {
+			t.Fatalf("error getting all documents: %v", err)
+		}
+
+		if len(locations) != 1 {
+			t.Errorf("expected 1 document for timestamp %d, got %d", timestamp, len(locations))
+		}
+	}
+}
+
+func TestUserTrack(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	go main()
+	time.Sleep(2 * time.Second)
+	client := lhmp.MustCreateClient("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	track := []any{
+		model.LocationInfo{Username: "user5", Location: model.Location{Type: "Point", Coordinates: bgCoordinates}, Timestamp: 1000},
+		model.LocationInfo{Username: "user5", Location: model.Location{Type: "Point", Coordinates: cuCoordinates}, Timestamp: 2000, Distance: 129.183169},
+	}
+
+	mongoClient.(db.MockDBClient).SetResponse(locationHistoryCollection, bson.M{
+		"username": "user5",
+		"timestamp": bson.M{
+			"$gte": int64(500),
+			"$lte": int64(2500),
+		},
+	}, nil, bson.M{
+		"timestamp": 1,
+	}, 1, trackPageSize, track)
+
+	stream, err := client.GetUserTrack(context.Background(), &lhmp.TrackRequest{Username: "user5", Start: 500, End: 2500})
+
+	if err != nil {
+		t.Fatalf("error getting user track: %v", err)
+	}
+
+	received := []*lhmp.LocationInfo{}
+
+	for {
+		location, err := stream.Recv()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("error receiving user track: %v", err)
+		}
+
+		received = append(received, location)
+	}
+
+	if len(received) != len(track) {
+		t.Fatalf("expected %d locations, got %d", len(track), len(received))
+	}
+
+	for i := range received {
+		expected := track[i].(model.LocationInfo)
+
+		if received[i].Timestamp != expected.Timestamp || received[i].Distance != expected.Distance {
+			t.Errorf("expected location %v, got %v", expected, received[i])
+		}
+	}
+
+	stream, err = client.GetUserTrack(context.Background(), &lhmp.TrackRequest{Username: "u", Start: 500, End: 2500})
+
+	if err != nil {
+		t.Fatalf("error getting user track: %v", err)
+	}
+
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid argument error, got %v", err)
+	}
+}
+
+func TestLatestUserLocation(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	go main()
+	time.Sleep(2 * time.Second)
+	client := lhmp.MustCreateClient("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	_, err := client.GetLatestUserLocation(context.Background(), &lhmp.LatestLocationRequest{Username: "user6"})
+
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	mongoClient.(db.MockDBClient).SetResponse(locationHistoryCollection, bson.M{
+		"username": "user6",
+		"timestamp": bson.M{
+			"$lte": int64(1500),
+		},
+	}, nil, bson.M{
+		"timestamp": -1,
+	}, 1, 1, []any{
+		model.LocationInfo{Username: "user6", Location: model.Location{Type: "Point", Coordinates: deCoordinates}, Timestamp: 1000, Distance: 12.5},
+	})
+
+	location, err := client.GetLatestUserLocation(context.Background(), &lhmp.LatestLocationRequest{Username: "user6", Before: 1500})
+
+	if err != nil {
+		t.Fatalf("error getting latest user location: %v", err)
+	}
+
+	if location.Timestamp != 1000 || location.Distance != 12.5 || location.Location.Coordinates[0] != deCoordinates[0] {
+		t.Errorf("unexpected latest location %v", location)
+	}
+
+	_, err = client.CalculateUserDistance(context.Background(), &lhmp.DistanceRequest{Username: "u6", Start: 0, End: 1500})
+
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid argument error, got %v", err)
+	}
+}
+
 func setCurrentLocationInfo(username, timestamp string) error {
 	parsedTimestamp, err := time.Parse(time.RFC3339, timestamp)
 
@@ -215,8 +408,9 @@ func setCurrentLocationInfo(username, timestamp string) error {
 	mongoClient.(db.MockDBClient).SetResponse(locationHistoryCollection, bson.M{
 		"username": username,
 	}, bson.M{
-		"distance": 1,
-		"location": 1,
+		"distance":  1,
+		"location":  1,
+		"timestamp": 1,
 	}, bson.M{
 		"timestamp": -1,
 	}, 1, 1, locations)
@@ -387,3 +581,598 @@ func getDistance(username, start, end string) (float64, error) {
 
 	return distance.Distance, nil
 }
+
+func TestLocationDensity(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	go main()
+	time.Sleep(2 * time.Second)
+	client := lhmp.MustCreateClient("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	box := geo.BoundingBox{SouthWest: []float64{20, 43}, NorthEast: []float64{22, 45}}
+
+	mongoClient.(db.MockDBClient).SetResponse(locationHistoryCollection, bson.M{
+		"location": db.GeoWithinPolygon(box.Polygon()),
+		"timestamp": bson.M{
+			"$gte": int64(0),
+			"$lte": int64(5000),
+		},
+	}, nil, bson.M{
+		"timestamp": 1,
+	}, 1, densityPageSize, []any{
+		model.LocationInfo{Username: "user7", Location: model.Location{Type: "Point", Coordinates: cuCoordinates}, Timestamp: 1000},
+		model.LocationInfo{Username: "user7", Location: model.Location{Type: "Point", Coordinates: jaCoordinates}, Timestamp: 2000},
+		model.LocationInfo{Username: "user8", Location: model.Location{Type: "Point", Coordinates: bgCoordinates}, Timestamp: 3000},
+	})
+
+	response, err := client.GetLocationDensity(context.Background(), &lhmp.DensityRequest{SouthWest: box.SouthWest, NorthEast: box.NorthEast, Precision: 3, Start: 0, End: 5000})
+
+	if err != nil {
+		t.Fatalf("error getting location density: %v", err)
+	}
+
+	counts := map[string]int64{}
+	usernames := map[string][]string{}
+
+	for _, cell := range response.Cells {
+		counts[cell.Geohash] = cell.Count
+		usernames[cell.Geohash] = cell.Usernames
+	}
+
+	if len(counts) != 2 || counts[geo.Geohash(cuCoordinates, 3)] != 2 || counts[geo.Geohash(bgCoordinates, 3)] != 1 || response.Truncated {
+		t.Errorf("unexpected location density %v", response)
+	}
+
+	if !slices.Equal(usernames[geo.Geohash(cuCoordinates, 3)], []string{"user7"}) || !slices.Equal(usernames[geo.Geohash(bgCoordinates, 3)], []string{"user8"}) {
+		t.Errorf("unexpected location density usernames %v", usernames)
+	}
+
+	_, err = client.GetLocationDensity(context.Background(), &lhmp.DensityRequest{SouthWest: box.NorthEast, NorthEast: box.SouthWest, Precision: 3, Start: 0, End: 5000})
+
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid argument error, got %v", err)
+	}
+
+	cells, truncated := buildDensityCells(map[string]int64{"srz": 3, "sry": 1, "srx": 2}, map[string]map[string]struct{}{
+		"srz": {"user7": {}, "user8": {}},
+		"sry": {"user7": {}},
+		"srx": {"user9": {}},
+	}, 5)
+
+	if len(cells) != 2 || cells[0].Geohash != "srx" || cells[1].Geohash != "sry" || !truncated {
+		t.Errorf("expected the cells beyond the maximum number of entries to be left out, got %v truncated %t", cells, truncated)
+	}
+}
+
+func TestReverseGeocoding(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	reverseGeocoder = geo.NewReverseGeocoder([]geo.Place{
+		{Name: "Belgrade", Region: "Belgrade", Country: "RS", Coordinates: []float64{20.46513, 44.80401}},
+		{Name: "Cuprija", Region: "Pomoravlje", Country: "RS", Coordinates: []float64{21.37, 43.92722}},
+		{Name: "Kragujevac", Region: "Sumadija", Country: "RS", Coordinates: []float64{20.91667, 44.01667}},
+	})
+
+	go main()
+	time.Sleep(2 * time.Second)
+	client := lhmp.MustCreateClient("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	mongoClient.(db.MockDBClient).SetResponse(locationHistoryCollection, bson.M{
+		"username": "user7",
+		"timestamp": bson.M{
+			"$gte": int64(0),
+			"$lte": int64(3000),
+		},
+	}, nil, bson.M{
+		"timestamp": 1,
+	}, 1, trackPageSize, []any{
+		model.LocationInfo{Username: "user7", Location: model.Location{Type: "Point", Coordinates: bgCoordinates}, Timestamp: 1000},
+		model.LocationInfo{Username: "user7", Location: model.Location{Type: "Point", Coordinates: cuCoordinates}, Timestamp: 2000},
+	})
+
+	stream, err := client.GetUserTrack(context.Background(), &lhmp.TrackRequest{Username: "user7", Start: 0, End: 3000})
+
+	if err != nil {
+		t.Fatalf("error getting user track: %v", err)
+	}
+
+	names := []string{}
+
+	for {
+		location, err := stream.Recv()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("error receiving user track: %v", err)
+		}
+
+		if location.Place.GetDistance() <= 0 || location.Place.GetCountry() != "RS" {
+			t.Errorf("unexpected place %v", location.Place)
+		}
+
+		names = append(names, location.Place.GetName())
+	}
+
+	if len(names) != 2 || names[0] != "Belgrade" || names[1] != "Cuprija" {
+		t.Errorf("unexpected places %v", names)
+	}
+}
+
+func TestProblemResponse(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	response, err := http.Post("http://localhost:8080/user/distance", "application/json", bytes.NewBufferString(`{"username": "user8", "start": "2025-01-01", "end": "2025-02-01T00:00:00+00:00"}`))
+
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+
+	defer response.Body.Close()
+	result := problem.Problem{}
+
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatalf("error decoding problem: %v", err)
+	}
+
+	if response.StatusCode != http.StatusBadRequest || response.Header.Get("Content-Type") != problem.ContentType {
+		t.Errorf("unexpected response %d '%s'", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	expected := problem.Violation{Field: "start", Code: "customdatetime", Message: "must be an RFC 3339 date time such as 2025-01-01T00:00:00+00:00"}
+
+	if result.Code != problem.CodeValidationFailed || result.RequestID == "" || result.RequestID != response.Header.Get(problem.RequestIDHeader) || len(result.Violations) != 1 || result.Violations[0] != expected {
+		t.Errorf("unexpected problem %+v", result)
+	}
+}
+
+func TestDatabaseTimeout(t *testing.T) {
+	mockClient := db.CreateMockDBClient()
+	mockClient.SetTimeouts(db.Timeouts{Default: 100 * time.Millisecond})
+	mockClient.SetLatency(time.Second)
+	mongoClient = mockClient
+	go main()
+	time.Sleep(2 * time.Second)
+	defer mockClient.SetLatency(0)
+
+	response, err := http.Post("http://localhost:8080/user/distance", "application/json", bytes.NewBufferString(`{"username": "user9", "start": "2025-01-01T00:00:00+00:00", "end": "2025-02-01T00:00:00+00:00"}`))
+
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+
+	result := problem.Problem{}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatalf("error decoding problem: %v", err)
+	}
+
+	if response.StatusCode != http.StatusGatewayTimeout || result.Code != problem.CodeTimeout {
+		t.Errorf("expected a timeout problem, got %d %+v", response.StatusCode, result)
+	}
+
+	client := lhmp.MustCreateClient("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	_, err = client.UpdateUserLocation(context.Background(), &lhmp.LocationInfo{
+		Username:  "user9",
+		Location:  &lhmp.Location{Type: "Point", Coordinates: deCoordinates},
+		Timestamp: time.Now().UnixMilli(),
+	})
+
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+
+	mockClient.SetTimeouts(db.Timeouts{})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err = client.CalculateUserDistance(ctx, &lhmp.DistanceRequest{Username: "user9", Start: 0, End: time.Now().UnixMilli()})
+
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+}
+
+func TestSchemaDrift(t *testing.T) {
+	mockClient := db.CreateMockDBClient()
+
+	mockClient.SetCollection(locationHistoryCollection, db.CollectionState{
+		Exists: true,
+		Indexes: []db.IndexSpec{
+			{Name: "_id_", Keys: []db.IndexKey{{Field: "_id", Type: 1}}},
+			{Name: "username_1", Keys: []db.IndexKey{{Field: "username", Type: 1}}},
+			{Name: "timestamp_-1", Keys: []db.IndexKey{{Field: "timestamp", Type: -1}}, Unique: true},
+		},
+	})
+
+	reportSchemaDrift(db.MustApplySchema(context.Background(), mockClient, schema))
+
+	if drift := db.MustApplySchema(context.Background(), mockClient, schema); len(drift) != 2 {
+		t.Errorf("expected only the unresolved drift when applying the schema again, got %v", drift)
+	}
+
+	mongoClient = mockClient
+	go main()
+	time.Sleep(2 * time.Second)
+	response, err := http.Get("http://localhost:8080/metrics")
+
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatalf("error reading metrics: %v", err)
+	}
+
+	expected := []string{
+		`schema_drift{collection="location-history",kind="index_conflict",resolved="false"} 1`,
+		`schema_drift{collection="location-history",kind="missing_index",resolved="true"} 2`,
+		`schema_drift{collection="location-history",kind="unexpected_index",resolved="false"} 1`,
+		`schema_drift{collection="location-history",kind="validator",resolved="true"} 1`,
+	}
+
+	for _, metric := range expected {
+		if !bytes.Contains(body, []byte(metric)) {
+			t.Errorf("expected metric '%s'", metric)
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.CreateMemoryClient()
+	history := store.CreateMongoLocationHistoryStore(dbClient, locationHistoryCollection)
+
+	for _, location := range []model.LocationInfo{
+		{Username: "user11", Location: model.Location{Type: "Point", Coordinates: jaCoordinates}, Timestamp: 2000},
+		{Username: "user11", Location: model.Location{Type: "Point", Coordinates: bgCoordinates}, Timestamp: 3000, Distance: 1},
+		{Username: "user11", Location: model.Location{Type: "Point", Coordinates: deCoordinates}, Timestamp: 1000, Distance: 2},
+		{Username: "user12", Location: model.Location{Type: "Point", Coordinates: deCoordinates}, Timestamp: 1000, Distance: 3},
+	} {
+		if err := history.Upsert(ctx, location); err != nil {
+			t.Fatalf("error saving location: %v", err)
+		}
+	}
+
+	migrator := db.MustCreateMigrator(dbClient, migrationCollection, migrations)
+
+	if applied, err := migrator.Up(ctx, 0, false); err != nil || len(applied) != len(migrations) {
+		t.Fatalf("expected every migration to be applied, got %v, %v", applied, err)
+	}
+
+	locations, err := history.Range(ctx, "user11", 0, 3000, true, 10)
+	first := calculateDistance(model.Location{Coordinates: deCoordinates}, model.Location{Coordinates: jaCoordinates}, 0)
+	second := calculateDistance(model.Location{Coordinates: jaCoordinates}, model.Location{Coordinates: bgCoordinates}, first)
+
+	if err != nil || len(locations) != 3 || locations[0].Distance != 0 || locations[1].Distance != first || locations[2].Distance != second {
+		t.Errorf("expected the distances to be recomputed in timestamp order, got %v, %v", locations, err)
+	}
+
+	if location, _, err := history.Latest(ctx, "user12"); err != nil || location.Distance != 0 {
+		t.Errorf("expected the distance of the first location of a user to be 0, got %v, %v", location, err)
+	}
+
+	if applied, err := migrator.Up(ctx, 0, false); err != nil || len(applied) != 0 {
+		t.Errorf("expected no migration to be applied twice, got %v, %v", applied, err)
+	}
+}
+
+func TestTimeSeriesMigration(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.CreateMemoryClient()
+	db.MustApplySchema(ctx, dbClient, timeSeriesSchema)
+	history := store.CreateMongoLocationHistoryStore(dbClient, locationHistoryCollection)
+	timeSeries := store.CreateTimeSeriesLocationHistoryStore(dbClient, locationHistoryTimeSeriesCollection)
+
+	for timestamp := int64(1); timestamp <= migrationBatchSize+1; timestamp++ {
+		location := model.LocationInfo{Username: "user13", Location: model.Location{Type: "Point", Coordinates: bgCoordinates}, Timestamp: timestamp * 1000}
+
+		if err := history.Upsert(ctx, location); err != nil {
+			t.Fatalf("error saving location: %v", err)
+		}
+	}
+
+	if err := timeSeries.Upsert(ctx, model.LocationInfo{Username: "user13", Location: model.Location{Type: "Point", Coordinates: deCoordinates}, Timestamp: 1000}); err != nil {
+		t.Fatalf("error saving location: %v", err)
+	}
+
+	migrator := db.MustCreateMigrator(dbClient, migrationCollection, storageMigrations(timeSeriesStorage))
+
+	if applied, err := migrator.Up(ctx, 0, false); err != nil || len(applied) != 3 {
+		t.Fatalf("expected every migration to be applied, got %v, %v", applied, err)
+	}
+
+	if count, err := dbClient.Count(ctx, locationHistoryTimeSeriesCollection, nil); err != nil || count != migrationBatchSize+1 {
+		t.Errorf("expected every location to be copied once, got %d, %v", count, err)
+	}
+
+	if location, _, err := timeSeries.FirstAfter(ctx, "user13", 0); err != nil || location.Timestamp != 1000 || location.Location.Coordinates[0] != bgCoordinates[0] {
+		t.Errorf("expected the copied location to replace the one with the same timestamp, got %v, %v", location, err)
+	}
+
+	if err := timeSeries.Upsert(ctx, model.LocationInfo{Username: "user14", Location: model.Location{Type: "Point", Coordinates: jaCoordinates}, Timestamp: 5000}); err != nil {
+		t.Fatalf("error saving location: %v", err)
+	}
+
+	if rolledBack, err := migrator.Down(ctx, 1, false); err != nil || len(rolledBack) != 2 {
+		t.Fatalf("expected the copy and the rollups to be rolled back, got %v, %v", rolledBack, err)
+	}
+
+	if location, ok, err := history.Latest(ctx, "user14"); err != nil || !ok || location.Timestamp != 5000 {
+		t.Errorf("expected the location saved in the time-series collection to be copied back, got %v, %v, %v", location, ok, err)
+	}
+
+	if count, err := dbClient.Count(ctx, locationHistoryCollection, nil); err != nil || count != migrationBatchSize+2 {
+		t.Errorf("expected the locations to be copied back without duplicates, got %d, %v", count, err)
+	}
+}
+
+func TestRollups(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.CreateMemoryClient()
+	db.MustApplySchema(ctx, dbClient, schema)
+	history := store.CreateMongoLocationHistoryStore(dbClient, locationHistoryCollection)
+	hour := int64(time.Hour / time.Millisecond)
+
+	if err := history.Upsert(ctx, model.LocationInfo{Username: "user17", Location: model.Location{Type: "Point", Coordinates: bgCoordinates}, Timestamp: 0}); err != nil {
+		t.Fatalf("error saving location: %v", err)
+	}
+
+	migrator := db.MustCreateMigrator(dbClient, migrationCollection, storageMigrations(documentsStorage))
+
+	if applied, err := migrator.Up(ctx, 0, false); err != nil || len(applied) != 2 {
+		t.Fatalf("expected every migration to be applied, got %v, %v", applied, err)
+	}
+
+	if err := refreshRollupsBuilt(ctx, dbClient); err != nil || !rollupsBuilt() {
+		t.Fatalf("expected the rollups to be built, got %v", err)
+	}
+
+	defer rollupsReady.Store(false)
+	mongoClient = dbClient
+	go main()
+	time.Sleep(2 * time.Second)
+	client := lhmp.MustCreateClient("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+	coordinates := [][]float64{deCoordinates, jaCoordinates, kgCoordinates, cuCoordinates, pnCoordinates}
+	timestamps := []int64{}
+
+	for timestamp := hour / 2; timestamp < 3*24*hour; timestamp += hour / 3 {
+		timestamps = append(timestamps, timestamp)
+	}
+
+	timestamps = append(timestamps, hour/4, 30*hour+1, 30*hour+1)
+
+	for i, timestamp := range timestamps {
+		_, err := client.UpdateUserLocation(ctx, &lhmp.LocationInfo{
+			Username:  "user17",
+			Location:  &lhmp.Location{Type: "Point", Coordinates: coordinates[i%len(coordinates)]},
+			Timestamp: timestamp,
+		})
+
+		if err != nil {
+			t.Fatalf("error updating location: %v", err)
+		}
+	}
+
+	if count, err := dbClient.Count(ctx, locationRollupCollection, bson.M{"period": store.DailyRollup}); err != nil || count != 3 {
+		t.Errorf("expected a daily rollup per day, got %d, %v", count, err)
+	}
+
+	for _, span := range [][2]int64{{0, 3 * 24 * hour}, {hour + 1, 50*hour + 7}, {hour / 3, hour / 2}} {
+		expected, err := store.ScanStats(ctx, history, "user17", span[0], span[1])
+
+		if err != nil {
+			t.Fatalf("error scanning stats: %v", err)
+		}
+
+		distance, err := client.CalculateUserDistance(ctx, &lhmp.DistanceRequest{Username: "user17", Start: span[0], End: span[1]})
+
+		if err != nil || math.Abs(distance.Distance-expected.Distance) > 1e-9 {
+			t.Errorf("%v: expected distance %f from the rollups, got %v, %v", span, expected.Distance, distance, err)
+		}
+	}
+
+	body := `{"username": "user17", "start": "1970-01-01T00:00:00+00:00", "end": "1970-01-02T00:00:00+00:00"}`
+	response, err := http.Post("http://localhost:8080/user/stats", "application/json", bytes.NewBufferString(body))
+
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+
+	stats := struct {
+		Distance    float64      `json:"distance"`
+		Count       int64        `json:"count"`
+		MovingTime  float64      `json:"movingTime"`
+		First       string       `json:"first"`
+		BoundingBox [2][]float64 `json:"boundingBox"`
+	}{}
+
+	err = json.NewDecoder(response.Body).Decode(&stats)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatalf("error decoding stats: %v", err)
+	}
+
+	expected, _ := store.ScanStats(ctx, history, "user17", 0, 24*hour)
+
+	if stats.Count != 73 || math.Abs(stats.Distance-expected.Distance) > 1e-9 || stats.First != "1970-01-01T00:00:00Z" || stats.BoundingBox[0][0] != bgCoordinates[0] || stats.BoundingBox[1][0] != deCoordinates[0] {
+		t.Errorf("expected the stats of the first day, got %+v", stats)
+	}
+
+	if rolledBack, err := migrator.Down(ctx, 1, false); err != nil || len(rolledBack) != 1 {
+		t.Fatalf("expected the rollups to be rolled back, got %v, %v", rolledBack, err)
+	}
+
+	if count, err := dbClient.Count(ctx, locationRollupCollection, nil); err != nil || count != 0 {
+		t.Errorf("expected the rollups to be removed, got %d, %v", count, err)
+	}
+	if err := refreshRollupsBuilt(ctx, dbClient); err != nil || rollupsBuilt() {
+		t.Errorf("expected the rollups to no longer be built, got %v", err)
+	}
+}
+
+func TestTimeSeriesStorage(t *testing.T) {
+	client := db.MustCreateEmbeddedClient(filepath.Join(t.TempDir(), "location-history-management.db"))
+	defer client.Disconnect(context.Background())
+	db.MustApplySchema(context.Background(), client, timeSeriesSchema)
+	locationHistory = store.CreateTimeSeriesLocationHistoryStore(client, locationHistoryTimeSeriesCollection)
+	defer func() { locationHistory = nil }()
+	testDatabaseBackend(t, client)
+}
+
+func TestChunksMigration(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.CreateMemoryClient()
+	db.MustApplySchema(ctx, dbClient, chunksSchema)
+	history := store.CreateMongoLocationHistoryStore(dbClient, locationHistoryCollection)
+	chunks := store.CreateChunkedLocationHistoryStore(dbClient, locationHistoryChunksCollection, locationHistoryChunkDuration)
+	hour := locationHistoryChunkDuration.Milliseconds()
+
+	for timestamp := int64(0); timestamp < 3*hour; timestamp += hour / 4 {
+		location := model.LocationInfo{Username: "user15", Location: model.Location{Type: "Point", Coordinates: bgCoordinates}, Timestamp: timestamp}
+
+		if err := history.Upsert(ctx, location); err != nil {
+			t.Fatalf("error saving location: %v", err)
+		}
+	}
+
+	migrator := db.MustCreateMigrator(dbClient, migrationCollection, storageMigrations(chunksStorage))
+
+	if applied, err := migrator.Up(ctx, 0, false); err != nil || len(applied) != 3 {
+		t.Fatalf("expected every migration to be applied, got %v, %v", applied, err)
+	}
+
+	if count, err := dbClient.Count(ctx, locationHistoryChunksCollection, nil); err != nil || count != 3 {
+		t.Errorf("expected a chunk per hour, got %d, %v", count, err)
+	}
+
+	if locations, err := chunks.Range(ctx, "user15", 0, 3*hour, true, 0); err != nil || len(locations) != 12 {
+		t.Errorf("expected every location to be packed, got %d, %v", len(locations), err)
+	}
+
+	if err := chunks.Upsert(ctx, model.LocationInfo{Username: "user16", Location: model.Location{Type: "Point", Coordinates: jaCoordinates}, Timestamp: 5000}); err != nil {
+		t.Fatalf("error saving location: %v", err)
+	}
+
+	if rolledBack, err := migrator.Down(ctx, 1, false); err != nil || len(rolledBack) != 2 {
+		t.Fatalf("expected the packing and the rollups to be rolled back, got %v, %v", rolledBack, err)
+	}
+
+	if count, err := dbClient.Count(ctx, locationHistoryCollection, nil); err != nil || count != 13 {
+		t.Errorf("expected the locations to be unpacked without duplicates, got %d, %v", count, err)
+	}
+}
+
+func TestChunksStorage(t *testing.T) {
+	client := db.MustCreateEmbeddedClient(filepath.Join(t.TempDir(), "location-history-management.db"))
+	defer client.Disconnect(context.Background())
+	db.MustApplySchema(context.Background(), client, chunksSchema)
+	locationHistory = store.CreateChunkedLocationHistoryStore(client, locationHistoryChunksCollection, locationHistoryChunkDuration)
+	defer func() { locationHistory = nil }()
+	testDatabaseBackend(t, client)
+}
+
+func TestMemoryDatabase(t *testing.T) {
+	testDatabaseBackend(t, db.CreateMemoryClient())
+}
+
+func TestMemoryStores(t *testing.T) {
+	locationHistory = store.CreateMemoryLocationHistoryStore()
+	defer func() { locationHistory = nil }()
+	testDatabaseBackend(t, db.CreateMemoryClient())
+}
+
+func TestEmbeddedDatabase(t *testing.T) {
+	client := db.MustCreateEmbeddedClient(filepath.Join(t.TempDir(), "location-history-management.db"))
+	defer client.Disconnect(context.Background())
+	testDatabaseBackend(t, client)
+}
+
+// testDatabaseBackend runs the service on the database client and checks that it behaves like on mongodb
+func testDatabaseBackend(t *testing.T, dbClient db.DBClient) {
+	mongoClient = dbClient
+	go main()
+	time.Sleep(2 * time.Second)
+	client := lhmp.MustCreateClient("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	track := []model.LocationInfo{
+		{Username: "user10", Location: model.Location{Type: "Point", Coordinates: deCoordinates}, Timestamp: 1000},
+		{Username: "user10", Location: model.Location{Type: "Point", Coordinates: jaCoordinates}, Timestamp: 2000},
+		{Username: "user10", Location: model.Location{Type: "Point", Coordinates: bgCoordinates}, Timestamp: 3000},
+	}
+
+	for _, location := range track {
+		_, err := client.UpdateUserLocation(context.Background(), &lhmp.LocationInfo{
+			Username:  location.Username,
+			Location:  &lhmp.Location{Type: location.Location.Type, Coordinates: location.Location.Coordinates},
+			Timestamp: location.Timestamp,
+		})
+
+		if err != nil {
+			t.Fatalf("error updating location: %v", err)
+		}
+	}
+
+	track[1].Distance = calculateDistance(track[0].Location, track[1].Location, 0)
+	track[2].Distance = calculateDistance(track[1].Location, track[2].Location, track[1].Distance)
+
+	distance, err := client.CalculateUserDistance(context.Background(), &lhmp.DistanceRequest{Username: "user10", Start: 1500, End: 5000})
+
+	if err != nil {
+		t.Fatalf("error calculating distance: %v", err)
+	}
+
+	if math.Abs(distance.Distance-(track[2].Distance-track[1].Distance)) > 1e-9 {
+		t.Errorf("expected distance %f, got %f", track[2].Distance-track[1].Distance, distance.Distance)
+	}
+
+	latest, err := client.GetLatestUserLocation(context.Background(), &lhmp.LatestLocationRequest{Username: "user10", Before: 2500})
+
+	if err != nil {
+		t.Fatalf("error getting latest location: %v", err)
+	}
+
+	if latest.Timestamp != 2000 || math.Abs(latest.Distance-track[1].Distance) > 1e-9 {
+		t.Errorf("expected the location at 2000, got %v", latest)
+	}
+
+	stream, err := client.GetUserTrack(context.Background(), &lhmp.TrackRequest{Username: "user10", Start: 1000, End: 2500})
+
+	if err != nil {
+		t.Fatalf("error getting user track: %v", err)
+	}
+
+	received := []int64{}
+
+	for {
+		location, err := stream.Recv()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("error receiving user track: %v", err)
+		}
+
+		received = append(received, location.Timestamp)
+	}
+
+	if !slices.Equal(received, []int64{1000, 2000}) {
+		t.Errorf("expected the locations at 1000 and 2000, got %v", received)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"github.com/mmilosevicgd/location-tracking/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// migrations are the data migrations of the service, a new migration gets the next version and is never changed once released
+var migrations = []db.Migration{
+	{
+		Version:     1,
+		Description: "recompute the cumulative distance of every location in timestamp order",
+		Up:          recomputeDistances,
+	},
+}
+
+// timeSeriesMigration copies the location history into the time-series collection, it only runs with the timeseries storage so its version is never reused
+// rolling it back copies the locations saved in the time-series collection meanwhile back, before switching back to the documents storage
+var timeSeriesMigration = db.Migration{
+	Version:     2,
+	Description: "copy the location history into the time-series collection",
+	Up:          copyToTimeSeries,
+	Down:        copyFromTimeSeries,
+}
+
+// chunksMigration packs the location history into chunks, it only runs with the chunks storage so its version is never reused
+// rolling it back unpacks the locations saved in chunks meanwhile back, before switching back to the documents storage
+var chunksMigration = db.Migration{
+	Version:     3,
+	Description: "pack the location history into chunks",
+	Up:          copyToChunks,
+	Down:        copyFromChunks,
+}
+
+// rollupsMigrationVersion is the version of the migration building the rollups, which does not depend on the storage
+const rollupsMigrationVersion = 4
+
+// rollupsMigration builds the hourly and daily rollups from the location history of the storage, distances and stats are answered from the rollups once it is applied
+// rolling it back removes the rollups, so distances are calculated from the cumulative distances of the locations again
+func rollupsMigration(storage string) db.Migration {
+	return db.Migration{
+		Version:     rollupsMigrationVersion,
+		Description: "build the hourly and daily rollups of the location history",
+		Up: func(ctx context.Context, client db.DBClient) error {
+			return buildRollups(ctx, client, storage)
+		},
+		Down: func(ctx context.Context, client db.DBClient) error {
+			_, err := client.DeleteMany(ctx, locationRollupCollection, nil)
+			return err
+		},
+	}
+}
+
+// storageMigrations returns the migrations of the storage of the location history
+func storageMigrations(storage string) []db.Migration {
+	switch storage {
+	case timeSeriesStorage:
+		return append(slices.Clone(migrations), timeSeriesMigration, rollupsMigration(storage))
+
+	case chunksStorage:
+		return append(slices.Clone(migrations), chunksMigration, rollupsMigration(storage))
+
+	default:
+		return append(slices.Clone(migrations), rollupsMigration(storage))
+	}
+}
+
+// recomputeDistances recomputes the cumulative distance of the locations of every user in timestamp order and saves the ones which changed
+// a location saved out of order got its distance from the latest location at the time, the previous distances can not be restored so there is no down migration
+func recomputeDistances(ctx context.Context, client db.DBClient) error {
+	users, err := historyUsers(ctx, client, locationHistoryCollection)
+
+	if err != nil {
+		return err
+	}
+
+	history := store.CreateMongoLocationHistoryStore(client, locationHistoryCollection)
+
+	for _, user := range users {
+		after, inclusive := int64(math.MinInt64), true
+		var previous *model.LocationInfo
+
+		for {
+			locations, err := history.Range(ctx, user, after, math.MaxInt64, inclusive, migrationBatchSize)
+
+			if err != nil {
+				return err
+			}
+
+			if len(locations) == 0 {
+				break
+			}
+
+			models := []db.ReplaceModel{}
+
+			for _, location := range locations {
+				distance := 0.0
+
+				if previous != nil {
+					distance = calculateDistance(previous.Location, location.Location, previous.Distance)
+				}
+
+				if distance != location.Distance {
+					location.Distance = distance
+					models = append(models, db.ReplaceModel{Filter: bson.M{"username": location.Username, "timestamp": location.Timestamp}, Document: location})
+				}
+
+				previous = &location
+			}
+
+			if len(models) > 0 {
+				result, err := client.BulkSaveOrReplace(ctx, locationHistoryCollection, models, false)
+
+				if err != nil {
+					return err
+				}
+
+				if err := result.Err(); err != nil {
+					return err
+				}
+			}
+
+			after, inclusive = locations[len(locations)-1].Timestamp, false
+		}
+	}
+
+	return nil
+}
+
+// buildRollups rebuilds the rollups of every user from the locations kept by the storage
+func buildRollups(ctx context.Context, client db.DBClient, storage string) error {
+	history, collection := storageHistory(client, storage)
+	users, err := historyUsers(ctx, client, collection)
+
+	if err != nil {
+		return err
+	}
+
+	rollups := store.CreateRollupStore(client, locationRollupCollection)
+
+	for _, user := range users {
+		if err := rollups.Rebuild(ctx, history, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storageHistory returns the store of the location history kept by the storage in the db client and the collection it is kept in
+func storageHistory(client db.DBClient, storage string) (store.LocationHistoryStore, string) {
+	switch storage {
+	case timeSeriesStorage:
+		return store.CreateTimeSeriesLocationHistoryStore(client, locationHistoryTimeSeriesCollection), locationHistoryTimeSeriesCollection
+
+	case chunksStorage:
+		return store.CreateChunkedLocationHistoryStore(client, locationHistoryChunksCollection, locationHistoryChunkDuration), locationHistoryChunksCollection
+
+	default:
+		return store.CreateMongoLocationHistoryStore(client, locationHistoryCollection), locationHistoryCollection
+	}
+}
+
+// rollupsReady caches whether the migration building the rollups is applied, so distance and stats queries do not read the migration state
+var rollupsReady atomic.Bool
+
+// rollupsBuilt reports whether the migration building the rollups is applied, before it is the rollups lack the locations saved earlier
+func rollupsBuilt() bool {
+	return rollupsReady.Load()
+}
+
+// refreshRollupsBuilt reads whether the migration building the rollups is applied and caches it, logging when it changed
+func refreshRollupsBuilt(ctx context.Context, client db.DBClient) error {
+	migrator := db.MustCreateMigrator(client, migrationCollection, storageMigrations(historyStorage()))
+	statuses, err := migrator.Status(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	built := false
+
+	for _, status := range statuses {
+		if status.Version == rollupsMigrationVersion {
+			built = status.Applied
+		}
+	}
+
+	if rollupsReady.Swap(built) != built {
+		log.Printf("rollups built changed to %t, distances and stats are answered accordingly\n", built)
+	}
+
+	return nil
+}
+
+// watchRollupsBuilt refreshes whether the rollups are built every migration status interval, since the migrate command may apply or roll back their migration while the service runs
+func watchRollupsBuilt() {
+	ticker := time.NewTicker(migrationStatusInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), db.DefaultTimeout)
+
+		if err := refreshRollupsBuilt(ctx, mongoClient); err != nil {
+			log.Printf("error checking whether the rollups are built: %v\n", err)
+		}
+
+		cancel()
+	}
+}
+
+// copyToTimeSeries copies the locations of every user into the time-series collection in batches in timestamp order
+// the locations of the time-series collection within the timestamps of a batch are replaced by the batch, so an interrupted copy can be run again
+// the time-series collection is created first, since the migration may run from the migrate command before the service applied its schema
+func copyToTimeSeries(ctx context.Context, client db.DBClient) error {
+	if err := client.CreateTimeSeriesCollection(ctx, locationHistoryTimeSeriesCollection, *store.LocationHistoryTimeSeries()); err != nil {
+		return err
+	}
+
+	return copyHistory(ctx, client, locationHistoryCollection, store.CreateMongoLocationHistoryStore(client, locationHistoryCollection), func(locations []model.LocationInfo) error {
+		filter := bson.M{
+			"username": locations[0].Username,
+			"timestamp": bson.M{
+				"$gte": time.UnixMilli(locations[0].Timestamp).UTC(),
+				"$lte": time.UnixMilli(locations[len(locations)-1].Timestamp).UTC(),
+			},
+		}
+
+		if _, err := client.DeleteMany(ctx, locationHistoryTimeSeriesCollection, filter); err != nil {
+			return err
+		}
+
+		documents := []any{}
+
+		for _, location := range locations {
+			documents = append(documents, store.ToTimeSeriesDocument(location))
+		}
+
+		result, err := client.InsertMany(ctx, locationHistoryTimeSeriesCollection, documents, false)
+
+		if err != nil {
+			return err
+		}
+
+		return result.Err()
+	})
+}
+
+// copyFromTimeSeries copies the locations of every user in the time-series collection back into the location history collection, replacing the locations with the same timestamp
+func copyFromTimeSeries(ctx context.Context, client db.DBClient) error {
+	history := store.CreateTimeSeriesLocationHistoryStore(client, locationHistoryTimeSeriesCollection)
+
+	return copyHistory(ctx, client, locationHistoryTimeSeriesCollection, history, func(locations []model.LocationInfo) error {
+		return saveDocuments(ctx, client, locations)
+	})
+}
+
+// copyToChunks packs the locations of every user into chunks in batches in timestamp order
+// the locations of a batch replace the locations with the same timestamp in their chunks, so an interrupted copy can be run again
+func copyToChunks(ctx context.Context, client db.DBClient) error {
+	chunks := store.CreateChunkedLocationHistoryStore(client, locationHistoryChunksCollection, locationHistoryChunkDuration)
+
+	return copyHistory(ctx, client, locationHistoryCollection, store.CreateMongoLocationHistoryStore(client, locationHistoryCollection), func(locations []model.LocationInfo) error {
+		return chunks.UpsertMany(ctx, locations)
+	})
+}
+
+// copyFromChunks unpacks the locations of every user in chunks back into the location history collection, replacing the locations with the same timestamp
+func copyFromChunks(ctx context.Context, client db.DBClient) error {
+	chunks := store.CreateChunkedLocationHistoryStore(client, locationHistoryChunksCollection, locationHistoryChunkDuration)
+
+	return copyHistory(ctx, client, locationHistoryChunksCollection, chunks, func(locations []model.LocationInfo) error {
+		return saveDocuments(ctx, client, locations)
+	})
+}
+
+// saveDocuments saves the locations into the location history collection, replacing the locations of the same user with the same timestamp
+func saveDocuments(ctx context.Context, client db.DBClient, locations []model.LocationInfo) error {
+	models := []db.ReplaceModel{}
+
+	for _, location := range locations {
+		models = append(models, db.ReplaceModel{Filter: bson.M{"username": location.Username, "timestamp": location.Timestamp}, Document: location})
+	}
+
+	result, err := client.BulkSaveOrReplace(ctx, locationHistoryCollection, models, false)
+
+	if err != nil {
+		return err
+	}
+
+	return result.Err()
+}
+
+// copyHistory reads the locations of every user in the collection from the store in batches in timestamp order and writes every batch
+func copyHistory(ctx context.Context, client db.DBClient, collection string, history store.LocationHistoryStore, write func(locations []model.LocationInfo) error) error {
+	users, err := historyUsers(ctx, client, collection)
+
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		after, inclusive := int64(math.MinInt64), true
+
+		for {
+			locations, err := history.Range(ctx, user, after, math.MaxInt64, inclusive, migrationBatchSize)
+
+			if err != nil {
+				return err
+			}
+
+			if len(locations) == 0 {
+				break
+			}
+
+			if err := write(locations); err != nil {
+				return err
+			}
+
+			after, inclusive = locations[len(locations)-1].Timestamp, false
+		}
+	}
+
+	return nil
+}
+
+// historyUsers returns the usernames of the users with locations in the collection
+func historyUsers(ctx context.Context, client db.DBClient, collection string) ([]string, error) {
+	cursor, err := client.Aggregate(ctx, collection, []map[string]any{{"$group": bson.M{"_id": "$username"}}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	users := []struct {
+		Username string `bson:"_id"`
+	}{}
+
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	usernames := []string{}
+
+	for _, user := range users {
+		usernames = append(usernames, user.Username)
+	}
+
+	return usernames, nil
+}
+
+// migrateOnStartup applies the pending migrations unless MIGRATE_ON_STARTUP is false, replicas starting at the same time wait for the one running them
+// it runs before the servers start, so no request is served while the data is migrated
+func migrateOnStartup() error {
+	if os.Getenv("MIGRATE_ON_STARTUP") == "false" {
+		log.Println("skipping migrations on startup")
+		return nil
+	}
+
+	migrator := db.MustCreateMigrator(mongoClient, migrationCollection, storageMigrations(historyStorage()))
+
+	if _, err := migrator.Up(context.Background(), 0, false); err != nil {
+		return fmt.Errorf("failed to apply migrations: %w", err)
+	}
+
+	return nil
+}
+
+// runMigrationCommand runs a migration command of the migrate entry point against the database configured like the service
+// it returns the error of the command instead of exiting, so the signal handler is stopped and the client disconnected first
+func runMigrationCommand(args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	client := createDBClient()
+	defer client.Disconnect(context.Background())
+	migrator := db.MustCreateMigrator(client, migrationCollection, storageMigrations(historyStorage()))
+
+	if err := db.RunMigrationCommand(ctx, migrator, args, os.Stdout); err != nil {
+		return fmt.Errorf("migration command failed: %w", err)
+	}
+
+	return nil
+}
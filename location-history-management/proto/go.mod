@@ -2,7 +2,10 @@ module github.com/mmilosevicgd/location-tracking/location-history-management/pro
 
 go 1.24.2
 
+replace github.com/mmilosevicgd/location-tracking/geo => ../../internal/geo
+
 require (
+	github.com/mmilosevicgd/location-tracking/geo v0.0.0-00010101000000-000000000000
 	google.golang.org/grpc v1.71.0
 	google.golang.org/protobuf v1.36.5
 )
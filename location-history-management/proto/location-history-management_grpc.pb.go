@@ -20,7 +20,12 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	LocationHistoryManagement_UpdateUserLocation_FullMethodName = "/main.LocationHistoryManagement/UpdateUserLocation"
+	LocationHistoryManagement_UpdateUserLocation_FullMethodName    = "/main.LocationHistoryManagement/UpdateUserLocation"
+	LocationHistoryManagement_StreamUserLocations_FullMethodName   = "/main.LocationHistoryManagement/StreamUserLocations"
+	LocationHistoryManagement_CalculateUserDistance_FullMethodName = "/main.LocationHistoryManagement/CalculateUserDistance"
+	LocationHistoryManagement_GetUserTrack_FullMethodName          = "/main.LocationHistoryManagement/GetUserTrack"
+	LocationHistoryManagement_GetLatestUserLocation_FullMethodName = "/main.LocationHistoryManagement/GetLatestUserLocation"
+	LocationHistoryManagement_GetLocationDensity_FullMethodName    = "/main.LocationHistoryManagement/GetLocationDensity"
 )
 
 // LocationHistoryManagementClient is the client API for LocationHistoryManagement service.
@@ -28,6 +33,11 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type LocationHistoryManagementClient interface {
 	UpdateUserLocation(ctx context.Context, in *LocationInfo, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	StreamUserLocations(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[LocationUpdate, LocationAck], error)
+	CalculateUserDistance(ctx context.Context, in *DistanceRequest, opts ...grpc.CallOption) (*DistanceResponse, error)
+	GetUserTrack(ctx context.Context, in *TrackRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LocationInfo], error)
+	GetLatestUserLocation(ctx context.Context, in *LatestLocationRequest, opts ...grpc.CallOption) (*LocationInfo, error)
+	GetLocationDensity(ctx context.Context, in *DensityRequest, opts ...grpc.CallOption) (*DensityResponse, error)
 }
 
 type locationHistoryManagementClient struct {
@@ -48,11 +58,78 @@ func (c *locationHistoryManagementClient) UpdateUserLocation(ctx context.Context
 	return out, nil
 }
 
+func (c *locationHistoryManagementClient) StreamUserLocations(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[LocationUpdate, LocationAck], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LocationHistoryManagement_ServiceDesc.Streams[0], LocationHistoryManagement_StreamUserLocations_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[LocationUpdate, LocationAck]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LocationHistoryManagement_StreamUserLocationsClient = grpc.BidiStreamingClient[LocationUpdate, LocationAck]
+
+func (c *locationHistoryManagementClient) CalculateUserDistance(ctx context.Context, in *DistanceRequest, opts ...grpc.CallOption) (*DistanceResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DistanceResponse)
+	err := c.cc.Invoke(ctx, LocationHistoryManagement_CalculateUserDistance_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationHistoryManagementClient) GetUserTrack(ctx context.Context, in *TrackRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LocationInfo], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LocationHistoryManagement_ServiceDesc.Streams[1], LocationHistoryManagement_GetUserTrack_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[TrackRequest, LocationInfo]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LocationHistoryManagement_GetUserTrackClient = grpc.ServerStreamingClient[LocationInfo]
+
+func (c *locationHistoryManagementClient) GetLatestUserLocation(ctx context.Context, in *LatestLocationRequest, opts ...grpc.CallOption) (*LocationInfo, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LocationInfo)
+	err := c.cc.Invoke(ctx, LocationHistoryManagement_GetLatestUserLocation_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationHistoryManagementClient) GetLocationDensity(ctx context.Context, in *DensityRequest, opts ...grpc.CallOption) (*DensityResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DensityResponse)
+	err := c.cc.Invoke(ctx, LocationHistoryManagement_GetLocationDensity_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LocationHistoryManagementServer is the server API for LocationHistoryManagement service.
 // All implementations must embed UnimplementedLocationHistoryManagementServer
 // for forward compatibility.
 type LocationHistoryManagementServer interface {
 	UpdateUserLocation(context.Context, *LocationInfo) (*emptypb.Empty, error)
+	StreamUserLocations(grpc.BidiStreamingServer[LocationUpdate, LocationAck]) error
+	CalculateUserDistance(context.Context, *DistanceRequest) (*DistanceResponse, error)
+	GetUserTrack(*TrackRequest, grpc.ServerStreamingServer[LocationInfo]) error
+	GetLatestUserLocation(context.Context, *LatestLocationRequest) (*LocationInfo, error)
+	GetLocationDensity(context.Context, *DensityRequest) (*DensityResponse, error)
 	mustEmbedUnimplementedLocationHistoryManagementServer()
 }
 
@@ -66,6 +143,21 @@ type UnimplementedLocationHistoryManagementServer struct{}
 func (UnimplementedLocationHistoryManagementServer) UpdateUserLocation(context.Context, *LocationInfo) (*emptypb.Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method UpdateUserLocation not implemented")
 }
+func (UnimplementedLocationHistoryManagementServer) StreamUserLocations(grpc.BidiStreamingServer[LocationUpdate, LocationAck]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamUserLocations not implemented")
+}
+func (UnimplementedLocationHistoryManagementServer) CalculateUserDistance(context.Context, *DistanceRequest) (*DistanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CalculateUserDistance not implemented")
+}
+func (UnimplementedLocationHistoryManagementServer) GetUserTrack(*TrackRequest, grpc.ServerStreamingServer[LocationInfo]) error {
+	return status.Errorf(codes.Unimplemented, "method GetUserTrack not implemented")
+}
+func (UnimplementedLocationHistoryManagementServer) GetLatestUserLocation(context.Context, *LatestLocationRequest) (*LocationInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLatestUserLocation not implemented")
+}
+func (UnimplementedLocationHistoryManagementServer) GetLocationDensity(context.Context, *DensityRequest) (*DensityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLocationDensity not implemented")
+}
 func (UnimplementedLocationHistoryManagementServer) mustEmbedUnimplementedLocationHistoryManagementServer() {
 }
 func (UnimplementedLocationHistoryManagementServer) testEmbeddedByValue() {}
@@ -106,6 +198,78 @@ func _LocationHistoryManagement_UpdateUserLocation_Handler(srv interface{}, ctx
 	return interceptor(ctx, in, info, handler)
 }
 
+func _LocationHistoryManagement_StreamUserLocations_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LocationHistoryManagementServer).StreamUserLocations(&grpc.GenericServerStream[LocationUpdate, LocationAck]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LocationHistoryManagement_StreamUserLocationsServer = grpc.BidiStreamingServer[LocationUpdate, LocationAck]
+
+func _LocationHistoryManagement_CalculateUserDistance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DistanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationHistoryManagementServer).CalculateUserDistance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationHistoryManagement_CalculateUserDistance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationHistoryManagementServer).CalculateUserDistance(ctx, req.(*DistanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationHistoryManagement_GetUserTrack_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TrackRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LocationHistoryManagementServer).GetUserTrack(m, &grpc.GenericServerStream[TrackRequest, LocationInfo]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LocationHistoryManagement_GetUserTrackServer = grpc.ServerStreamingServer[LocationInfo]
+
+func _LocationHistoryManagement_GetLatestUserLocation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LatestLocationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationHistoryManagementServer).GetLatestUserLocation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationHistoryManagement_GetLatestUserLocation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationHistoryManagementServer).GetLatestUserLocation(ctx, req.(*LatestLocationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationHistoryManagement_GetLocationDensity_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DensityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationHistoryManagementServer).GetLocationDensity(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationHistoryManagement_GetLocationDensity_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationHistoryManagementServer).GetLocationDensity(ctx, req.(*DensityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // LocationHistoryManagement_ServiceDesc is the grpc.ServiceDesc for LocationHistoryManagement service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -117,7 +281,31 @@ var LocationHistoryManagement_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "UpdateUserLocation",
 			Handler:    _LocationHistoryManagement_UpdateUserLocation_Handler,
 		},
+		{
+			MethodName: "CalculateUserDistance",
+			Handler:    _LocationHistoryManagement_CalculateUserDistance_Handler,
+		},
+		{
+			MethodName: "GetLatestUserLocation",
+			Handler:    _LocationHistoryManagement_GetLatestUserLocation_Handler,
+		},
+		{
+			MethodName: "GetLocationDensity",
+			Handler:    _LocationHistoryManagement_GetLocationDensity_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamUserLocations",
+			Handler:       _LocationHistoryManagement_StreamUserLocations_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "GetUserTrack",
+			Handler:       _LocationHistoryManagement_GetUserTrack_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "location-history-management.proto",
 }
@@ -2,14 +2,30 @@ package proto
 
 import (
 	context "context"
+	"io"
+	"sync"
 
 	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	metadata "google.golang.org/grpc/metadata"
+	status "google.golang.org/grpc/status"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type MockGRPCClient struct {
 }
 
+type mockTrackStream struct {
+	ctx context.Context
+}
+
+type mockLocationStream struct {
+	ctx    context.Context
+	acks   chan *LocationAck
+	closed chan struct{}
+	once   sync.Once
+}
+
 func (m *MockGRPCClient) Close() error {
 	return nil
 }
@@ -18,6 +34,108 @@ func (m *MockGRPCClient) UpdateUserLocation(ctx context.Context, in *LocationInf
 	return &emptypb.Empty{}, nil
 }
 
+func (m *MockGRPCClient) StreamUserLocations(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[LocationUpdate, LocationAck], error) {
+	return &mockLocationStream{
+		ctx:    ctx,
+		acks:   make(chan *LocationAck, 1024),
+		closed: make(chan struct{}),
+	}, nil
+}
+
+func (m *MockGRPCClient) CalculateUserDistance(ctx context.Context, in *DistanceRequest, opts ...grpc.CallOption) (*DistanceResponse, error) {
+	return &DistanceResponse{}, nil
+}
+
+func (m *MockGRPCClient) GetUserTrack(ctx context.Context, in *TrackRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LocationInfo], error) {
+	return &mockTrackStream{ctx: ctx}, nil
+}
+
+func (m *MockGRPCClient) GetLatestUserLocation(ctx context.Context, in *LatestLocationRequest, opts ...grpc.CallOption) (*LocationInfo, error) {
+	return nil, status.Errorf(codes.NotFound, "no location found for username '%s'", in.Username)
+}
+
+func (m *MockGRPCClient) GetLocationDensity(ctx context.Context, in *DensityRequest, opts ...grpc.CallOption) (*DensityResponse, error) {
+	return &DensityResponse{}, nil
+}
+
+func (s *mockTrackStream) Recv() (*LocationInfo, error) {
+	return nil, io.EOF
+}
+
+func (s *mockTrackStream) Header() (metadata.MD, error) {
+	return metadata.MD{}, nil
+}
+
+func (s *mockTrackStream) Trailer() metadata.MD {
+	return metadata.MD{}
+}
+
+func (s *mockTrackStream) CloseSend() error {
+	return nil
+}
+
+func (s *mockTrackStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *mockTrackStream) SendMsg(m any) error {
+	return nil
+}
+
+func (s *mockTrackStream) RecvMsg(m any) error {
+	return io.EOF
+}
+
+func (s *mockLocationStream) Send(update *LocationUpdate) error {
+	select {
+	case s.acks <- &LocationAck{Sequence: update.Sequence}:
+		return nil
+	case <-s.closed:
+		return io.EOF
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *mockLocationStream) Recv() (*LocationAck, error) {
+	select {
+	case ack := <-s.acks:
+		return ack, nil
+	case <-s.closed:
+		return nil, io.EOF
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *mockLocationStream) Header() (metadata.MD, error) {
+	return metadata.MD{}, nil
+}
+
+func (s *mockLocationStream) Trailer() metadata.MD {
+	return metadata.MD{}
+}
+
+func (s *mockLocationStream) CloseSend() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+
+	return nil
+}
+
+func (s *mockLocationStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *mockLocationStream) SendMsg(m any) error {
+	return nil
+}
+
+func (s *mockLocationStream) RecvMsg(m any) error {
+	return nil
+}
+
 // CreateMockGRPCClient creates a new mock grpc client
 func CreateMockGRPCClient() *MockGRPCClient {
 	return &MockGRPCClient{}
@@ -4,6 +4,7 @@ import (
 	context "context"
 	"log"
 
+	"github.com/mmilosevicgd/location-tracking/geo"
 	grpc "google.golang.org/grpc"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
@@ -11,6 +12,11 @@ import (
 type GRPCClient interface {
 	Close() error
 	UpdateUserLocation(ctx context.Context, in *LocationInfo, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	StreamUserLocations(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[LocationUpdate, LocationAck], error)
+	CalculateUserDistance(ctx context.Context, in *DistanceRequest, opts ...grpc.CallOption) (*DistanceResponse, error)
+	GetUserTrack(ctx context.Context, in *TrackRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LocationInfo], error)
+	GetLatestUserLocation(ctx context.Context, in *LatestLocationRequest, opts ...grpc.CallOption) (*LocationInfo, error)
+	GetLocationDensity(ctx context.Context, in *DensityRequest, opts ...grpc.CallOption) (*DensityResponse, error)
 }
 
 type LHMGRPCClient struct {
@@ -28,6 +34,31 @@ func (c *LHMGRPCClient) UpdateUserLocation(ctx context.Context, in *LocationInfo
 	return c.client.UpdateUserLocation(ctx, in, opts...)
 }
 
+// StreamUserLocations opens a bidirectional stream for sending user locations and receiving their acknowledgements using the grpc client
+func (c *LHMGRPCClient) StreamUserLocations(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[LocationUpdate, LocationAck], error) {
+	return c.client.StreamUserLocations(ctx, opts...)
+}
+
+// CalculateUserDistance calculates the distance traveled by the user in the requested time range using the grpc client
+func (c *LHMGRPCClient) CalculateUserDistance(ctx context.Context, in *DistanceRequest, opts ...grpc.CallOption) (*DistanceResponse, error) {
+	return c.client.CalculateUserDistance(ctx, in, opts...)
+}
+
+// GetUserTrack streams the user locations in the requested time range using the grpc client
+func (c *LHMGRPCClient) GetUserTrack(ctx context.Context, in *TrackRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LocationInfo], error) {
+	return c.client.GetUserTrack(ctx, in, opts...)
+}
+
+// GetLatestUserLocation retrieves the latest user location before the requested time using the grpc client
+func (c *LHMGRPCClient) GetLatestUserLocation(ctx context.Context, in *LatestLocationRequest, opts ...grpc.CallOption) (*LocationInfo, error) {
+	return c.client.GetLatestUserLocation(ctx, in, opts...)
+}
+
+// GetLocationDensity counts the user locations in the requested bounding box and time range per geohash cell using the grpc client
+func (c *LHMGRPCClient) GetLocationDensity(ctx context.Context, in *DensityRequest, opts ...grpc.CallOption) (*DensityResponse, error) {
+	return c.client.GetLocationDensity(ctx, in, opts...)
+}
+
 // CreateClient creates a new grpc client for the location history management service
 func CreateClient(target string, opts ...grpc.DialOption) (*LHMGRPCClient, error) {
 	connection, err := grpc.NewClient(target, opts...)
@@ -52,3 +83,19 @@ func MustCreateClient(uri string, opts ...grpc.DialOption) *LHMGRPCClient {
 
 	return client
 }
+
+// LookupPlace resolves the [longitude, latitude] coordinates to the nearest place of the reverse geocoder, or returns nil if it has no places
+func LookupPlace(geocoder *geo.ReverseGeocoder, coordinates []float64) *Place {
+	place, distance, ok := geocoder.Lookup(coordinates)
+
+	if !ok {
+		return nil
+	}
+
+	return &Place{
+		Name:     place.Name,
+		Region:   place.Region,
+		Country:  place.Country,
+		Distance: distance,
+	}
+}
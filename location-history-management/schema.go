@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// locationHistoryValidator rejects locations without a username, a geojson point, a timestamp or a cumulative distance
+var locationHistoryValidator = map[string]any{
+	"$jsonSchema": map[string]any{
+		"bsonType": "object",
+		"required": []string{"username", "location", "timestamp", "distance"},
+		"properties": map[string]any{
+			"username":  map[string]any{"bsonType": "string"},
+			"timestamp": map[string]any{"bsonType": "long"},
+			"distance":  map[string]any{"bsonType": "double", "minimum": 0},
+			"location": map[string]any{
+				"bsonType": "object",
+				"required": []string{"type", "coordinates"},
+				"properties": map[string]any{
+					"type":        map[string]any{"enum": []string{"Point"}},
+					"coordinates": map[string]any{"bsonType": "array", "minItems": 2, "maxItems": 2},
+				},
+			},
+		},
+	},
+}
+
+// rollupCollection declares the collection of the hourly and daily rollups of the location history, the same with every storage
+var rollupCollection = db.CollectionSpec{
+	Name: locationRollupCollection,
+	Indexes: []db.IndexSpec{
+		{Keys: []db.IndexKey{{Field: "username", Type: 1}, {Field: "period", Type: 1}, {Field: "start", Type: 1}}, Unique: true},
+	},
+}
+
+// schema declares the collections of the service with their validators and indexes, it is applied at startup
+// the unique index on username and timestamp keeps a single location of a user per timestamp, which the upserts of the history rely on
+var schema = db.Schema{Collections: []db.CollectionSpec{
+	{
+		Name:      locationHistoryCollection,
+		Validator: locationHistoryValidator,
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}, {Field: "timestamp", Type: -1}}, Unique: true},
+			{Keys: []db.IndexKey{{Field: "timestamp", Type: -1}}},
+			{Keys: []db.IndexKey{{Field: "location", Type: "2dsphere"}}},
+		},
+	},
+	rollupCollection,
+	{
+		Name: migrationCollection,
+	},
+}}
+
+// timeSeriesSchema declares the collections of the service when the location history is stored in a time-series collection
+// time-series collections have no unique indexes, the index on username and timestamp is the one mongodb creates on the meta and time fields
+// the location history collection is not declared, so it is kept as it is for the migration copying its locations
+var timeSeriesSchema = db.Schema{Collections: []db.CollectionSpec{
+	{
+		Name:       locationHistoryTimeSeriesCollection,
+		TimeSeries: store.LocationHistoryTimeSeries(),
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}, {Field: "timestamp", Type: 1}}},
+			{Keys: []db.IndexKey{{Field: "location", Type: "2dsphere"}}},
+		},
+	},
+	rollupCollection,
+	{
+		Name: migrationCollection,
+	},
+}}
+
+// chunksSchema declares the collections of the service when the location history is packed into chunks, identified by the username and the start of their hour
+// the location history collection is not declared, so it is kept as it is for the migration packing its locations
+var chunksSchema = db.Schema{Collections: []db.CollectionSpec{
+	{
+		Name: locationHistoryChunksCollection,
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}, {Field: "start", Type: 1}}, Unique: true},
+			{Keys: []db.IndexKey{{Field: "first", Type: 1}}},
+		},
+	},
+	rollupCollection,
+	{
+		Name: migrationCollection,
+	},
+}}
+
+// storageSchema returns the schema of the storage of the location history
+func storageSchema(storage string) db.Schema {
+	switch storage {
+	case timeSeriesStorage:
+		return timeSeriesSchema
+
+	case chunksStorage:
+		return chunksSchema
+
+	default:
+		return schema
+	}
+}
+
+// schemaDrift counts the differences between the schema and the database found when the schema was applied at startup
+var schemaDrift = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "schema_drift",
+	Help: "Differences between the schema and the database found at startup, by collection, kind and whether applying the schema resolved them.",
+}, []string{"collection", "kind", "resolved"})
+
+// reportSchemaDrift exposes the drift found when applying the schema as metrics
+func reportSchemaDrift(drift []db.Drift) {
+	schemaDrift.Reset()
+
+	for _, found := range drift {
+		schemaDrift.WithLabelValues(found.Collection, string(found.Kind), strconv.FormatBool(found.Resolved)).Inc()
+	}
+}
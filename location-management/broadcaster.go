@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// locationBroadcaster distributes accepted location events between all replicas of the service
+// implementations assign the event ids, so the ids are the same on every replica and clients can resume on any of them
+type locationBroadcaster interface {
+	Publish(event locationEvent) error
+	Listen(handler func(event locationEvent)) error
+	Close() error
+}
+
+// memoryBroadcaster is a location broadcaster for a single replica which delivers events to its listeners in-process
+type memoryBroadcaster struct {
+	mutex    sync.Mutex
+	sequence int64
+	handlers []func(event locationEvent)
+}
+
+// Publish assigns the next id to the event and delivers it to all listeners in order
+func (b *memoryBroadcaster) Publish(event locationEvent) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.sequence++
+	event.ID = b.sequence
+
+	for _, handler := range b.handlers {
+		handler(event)
+	}
+
+	return nil
+}
+
+// Listen registers a handler which receives every published event
+func (b *memoryBroadcaster) Listen(handler func(event locationEvent)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers = append(b.handlers, handler)
+
+	return nil
+}
+
+// Close removes all listeners
+func (b *memoryBroadcaster) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers = nil
+
+	return nil
+}
+
+// newMemoryBroadcaster creates a new in-memory location broadcaster
+func newMemoryBroadcaster() *memoryBroadcaster {
+	return &memoryBroadcaster{}
+}
+
+// createLocationBroadcaster creates the location broadcaster of the given type
+func createLocationBroadcaster(broadcasterType string) (locationBroadcaster, error) {
+	switch broadcasterType {
+	case "", "memory":
+		return newMemoryBroadcaster(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown location broadcaster type '%s'", broadcasterType)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"github.com/mmilosevicgd/location-tracking/problem"
+)
+
+type clusterRequest struct {
+	Zoom int `validate:"gte=0,lte=22"`
+}
+
+type clusterResponse struct {
+	Clusters  []locationCluster `json:"clusters"`
+	Points    []clusterPoint    `json:"points"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+type locationCluster struct {
+	Coordinates []float64 `json:"coordinates"`
+	Count       int       `json:"count"`
+	BoundingBox []float64 `json:"boundingBox"`
+}
+
+type clusterPoint struct {
+	Username  string         `json:"username"`
+	Location  model.Location `json:"location"`
+	Timestamp int64          `json:"timestamp"`
+}
+
+type mapTile struct {
+	zoom, x, y int
+}
+
+type clusterCacheEntry struct {
+	response clusterResponse
+	expires  time.Time
+}
+
+// clusterCache keeps the clusters of recently requested tiles for a short time, so panning maps and many clients looking at the same area do not query the database for every request
+type clusterCache struct {
+	mutex   sync.Mutex
+	entries map[mapTile]clusterCacheEntry
+	ttl     time.Duration
+	size    int
+}
+
+// clusterLocationsHandler clusters the current locations of users in the tiles covering the viewport at the zoom level
+// every tile is split into a grid of cells and the users in a cell are merged into a cluster, single users and every user at the highest zoom levels are returned as points
+func clusterLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	box, err := extractBoundingBox(liveViewport{
+		SouthWest: query.Get("southWest"),
+		NorthEast: query.Get("northEast"),
+	})
+
+	if err != nil {
+		log.Printf("validation error for cluster viewport: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	data := clusterRequest{}
+
+	if err := parseQueryInt(query, "zoom", 0, &data.Zoom); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	tiles, err := coveringTiles(box, data.Zoom)
+
+	if err != nil {
+		log.Printf("validation error for cluster viewport: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	response := clusterResponse{
+		Clusters: []locationCluster{},
+		Points:   []clusterPoint{},
+	}
+
+	for _, tile := range tiles {
+		tileResponse, err := locationClusters.Get(r.Context(), tile)
+
+		if err != nil {
+			log.Printf("error clustering locations of tile %d/%d/%d: %v\n", tile.zoom, tile.x, tile.y, err)
+			problem.WriteError(w, r, err)
+			return
+		}
+
+		response.Clusters = append(response.Clusters, tileResponse.Clusters...)
+		response.Points = append(response.Points, tileResponse.Points...)
+		response.Truncated = response.Truncated || tileResponse.Truncated
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// coveringTiles returns the tiles covering the bounding box at the zoom level, or an error if there are too many of them
+func coveringTiles(box geo.BoundingBox, zoom int) ([]mapTile, error) {
+	west, north := geo.Tile([]float64{box.SouthWest[0], box.NorthEast[1]}, zoom)
+	east, south := geo.Tile([]float64{box.NorthEast[0], box.SouthWest[1]}, zoom)
+	tilesPerSide := 1 << zoom
+	columns := (east-west+tilesPerSide)%tilesPerSide + 1
+
+	if box.SouthWest[0] <= box.NorthEast[0] {
+		columns = east - west + 1
+	}
+
+	if columns*(south-north+1) > maxClusterTiles {
+		return nil, fmt.Errorf("viewport covers %d tiles at zoom level %d, at most %d are allowed", columns*(south-north+1), zoom, maxClusterTiles)
+	}
+
+	tiles := []mapTile{}
+
+	for column := range columns {
+		for y := north; y <= south; y++ {
+			tiles = append(tiles, mapTile{zoom: zoom, x: (west + column) % tilesPerSide, y: y})
+		}
+	}
+
+	return tiles, nil
+}
+
+// newClusterCache creates a new cluster cache which keeps the clusters of up to the given number of tiles for the given duration
+func newClusterCache(ttl time.Duration, size int) *clusterCache {
+	return &clusterCache{
+		entries: map[mapTile]clusterCacheEntry{},
+		ttl:     ttl,
+		size:    size,
+	}
+}
+
+// Get returns the cached clusters of the tile, or clusters its locations and caches them if they are missing or expired
+func (c *clusterCache) Get(ctx context.Context, tile mapTile) (clusterResponse, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[tile]
+	c.mutex.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.response, nil
+	}
+
+	response, err := clusterTileLocations(ctx, tile)
+
+	if err != nil {
+		return clusterResponse{}, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.entries) >= c.size {
+		now := time.Now()
+
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+
+		if len(c.entries) >= c.size {
+			clear(c.entries)
+		}
+	}
+
+	c.entries[tile] = clusterCacheEntry{response: response, expires: time.Now().Add(c.ttl)}
+	return response, nil
+}
+
+// clusterTileLocations clusters the current locations of users inside the tile on a grid of cells
+// every location is assigned only to the tile containing it, so locations on the edges of tiles are not counted twice
+func clusterTileLocations(ctx context.Context, tile mapTile) (clusterResponse, error) {
+	locations, truncated, err := findLocationsInBoundingBox(ctx, geo.TileBounds(tile.zoom, tile.x, tile.y))
+
+	if err != nil {
+		return clusterResponse{}, err
+	}
+
+	response := clusterResponse{
+		Clusters:  []locationCluster{},
+		Points:    []clusterPoint{},
+		Truncated: truncated,
+	}
+
+	cells := map[int][]model.LocationInfo{}
+
+	for _, location := range locations {
+		x, y := geo.TilePosition(location.Location.Coordinates, tile.zoom)
+
+		if int(x) != tile.x || int(y) != tile.y {
+			continue
+		}
+
+		cell := int((y-float64(tile.y))*clusterGridSize)*clusterGridSize + int((x-float64(tile.x))*clusterGridSize)
+		cells[cell] = append(cells[cell], location)
+	}
+
+	for _, cellLocations := range cells {
+		if tile.zoom >= clusterMaxZoom || len(cellLocations) == 1 {
+			for _, location := range cellLocations {
+				response.Points = append(response.Points, clusterPoint{
+					Username:  location.Username,
+					Location:  location.Location,
+					Timestamp: location.Timestamp,
+				})
+			}
+
+			continue
+		}
+
+		response.Clusters = append(response.Clusters, newLocationCluster(cellLocations))
+	}
+
+	return response, nil
+}
+
+// newLocationCluster merges the locations into a cluster with their centroid, count and bounding box
+func newLocationCluster(locations []model.LocationInfo) locationCluster {
+	longitude, latitude := 0.0, 0.0
+	boundingBox := []float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+
+	for _, location := range locations {
+		coordinates := location.Location.Coordinates
+		longitude += coordinates[0]
+		latitude += coordinates[1]
+		boundingBox[0] = math.Min(boundingBox[0], coordinates[0])
+		boundingBox[1] = math.Min(boundingBox[1], coordinates[1])
+		boundingBox[2] = math.Max(boundingBox[2], coordinates[0])
+		boundingBox[3] = math.Max(boundingBox[3], coordinates[1])
+	}
+
+	return locationCluster{
+		Coordinates: []float64{longitude / float64(len(locations)), latitude / float64(len(locations))},
+		Count:       len(locations),
+		BoundingBox: boundingBox,
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+)
+
+var (
+	decimalCoordinatesPattern = regexp.MustCompile(`^\s*[+-]?\d*\.?\d{1,8}\s*,\s*[+-]?\d*\.?\d{1,8}\s*$`)
+	geohashPattern            = regexp.MustCompile(`^[0-9a-z]{1,12}$`)
+	dmsTokenPattern           = regexp.MustCompile(`[NSEW]|[+-]?\d+(?:\.\d+)?`)
+	dmsDivisors               = []float64{1, 60, 3600}
+	dmsSymbolReplacer         = strings.NewReplacer("°", " ", "º", " ", "'", " ", "′", " ", "\"", " ", "″", " ", "’", " ", "”", " ")
+)
+
+// parseLocation normalizes either a geojson point or a coordinates string in any of the supported formats to a location
+// the format of the coordinates string is detected from its content, so errors name the format that failed to parse
+func parseLocation(coordinates string, location *model.Location) (model.Location, error) {
+	if location != nil {
+		return parseGeoJSONPoint(*location)
+	}
+
+	format, parse := detectCoordinatesFormat(coordinates)
+
+	if parse == nil {
+		return model.Location{}, fmt.Errorf("unrecognized coordinates format '%s', expected decimal \"latitude, longitude\", degrees minutes seconds, a lowercase geohash or a full open location code", coordinates)
+	}
+
+	parsed, err := parse(strings.TrimSpace(coordinates))
+
+	if err != nil {
+		return model.Location{}, fmt.Errorf("invalid %s coordinates '%s': %v", format, coordinates, err)
+	}
+
+	if err := validateCoordinates(parsed); err != nil {
+		return model.Location{}, fmt.Errorf("invalid %s coordinates '%s': %v", format, coordinates, err)
+	}
+
+	return model.Location{Type: "Point", Coordinates: parsed}, nil
+}
+
+// detectCoordinatesFormat returns the name and parser of the format of a coordinates string, or a nil parser if it matches none of them
+// geohashes are only detected in lowercase, so degrees minutes seconds such as 45N20E are not mistaken for them
+// degrees minutes seconds need a symbol or a hemisphere, so decimal coordinates with more than 8 decimals are not mistaken for them
+func detectCoordinatesFormat(coordinates string) (string, func(string) ([]float64, error)) {
+	trimmed := strings.TrimSpace(coordinates)
+
+	switch {
+	case trimmed == "":
+		return "", nil
+
+	case strings.ContainsRune(trimmed, '+') && !strings.ContainsAny(trimmed, ", "):
+		return "open location code", parseOpenLocationCode
+
+	case decimalCoordinatesPattern.MatchString(trimmed):
+		return "decimal", extractCoordinates
+
+	case geohashPattern.MatchString(trimmed):
+		return "geohash", parseGeohash
+
+	case strings.ContainsAny(strings.ToUpper(trimmed), "°º'′\"″NSEW") && strings.ContainsAny(trimmed, "0123456789"):
+		return "degrees minutes seconds", parseDMS
+
+	default:
+		return "", nil
+	}
+}
+
+// parseGeoJSONPoint validates a geojson point and drops its altitude if it has one
+func parseGeoJSONPoint(location model.Location) (model.Location, error) {
+	if location.Type != "Point" {
+		return model.Location{}, fmt.Errorf("invalid geojson location: type '%s' is not supported, expected 'Point'", location.Type)
+	}
+
+	if len(location.Coordinates) < 2 || len(location.Coordinates) > 3 {
+		return model.Location{}, fmt.Errorf("invalid geojson location: expected [longitude, latitude] or [longitude, latitude, altitude] coordinates, got %d values", len(location.Coordinates))
+	}
+
+	coordinates := location.Coordinates[:2]
+
+	if err := validateCoordinates(coordinates); err != nil {
+		return model.Location{}, fmt.Errorf("invalid geojson location: %v", err)
+	}
+
+	return model.Location{Type: "Point", Coordinates: coordinates}, nil
+}
+
+// parseGeohash decodes a geohash to the [longitude, latitude] coordinates of the center of its cell
+func parseGeohash(hash string) ([]float64, error) {
+	bounds, err := geo.GeohashBounds(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bounds.Center(), nil
+}
+
+// parseOpenLocationCode decodes a full open location code to the [longitude, latitude] coordinates of the center of its area
+func parseOpenLocationCode(code string) ([]float64, error) {
+	bounds, err := geo.OpenLocationCodeBounds(code)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bounds.Center(), nil
+}
+
+// parseDMS parses degrees with optional minutes and seconds to [longitude, latitude] coordinates
+// hemispheres are given as N, S, E and W before or after every coordinate, such as 44°48'55.7"N 20°15'27.6"E or N44 48.928 E20 15.46
+// without hemispheres, the coordinates are signed and ordered as latitude and longitude separated by a comma
+func parseDMS(dms string) ([]float64, error) {
+	normalized := strings.ToUpper(dms)
+
+	if leftover := strings.TrimSpace(dmsTokenPattern.ReplaceAllString(dmsSymbolReplacer.Replace(normalized), "")); strings.Trim(leftover, ", ") != "" {
+		return nil, fmt.Errorf("unexpected characters '%s'", leftover)
+	}
+
+	if !strings.ContainsAny(normalized, "NSEW") {
+		parts := strings.Split(normalized, ",")
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected latitude and longitude separated by a comma when no hemispheres are given")
+		}
+
+		latitude, err := parseDMSComponent(dmsTokenPattern.FindAllString(dmsSymbolReplacer.Replace(parts[0]), -1), "")
+
+		if err != nil {
+			return nil, fmt.Errorf("latitude: %v", err)
+		}
+
+		longitude, err := parseDMSComponent(dmsTokenPattern.FindAllString(dmsSymbolReplacer.Replace(parts[1]), -1), "")
+
+		if err != nil {
+			return nil, fmt.Errorf("longitude: %v", err)
+		}
+
+		return []float64{longitude, latitude}, nil
+	}
+
+	tokens := dmsTokenPattern.FindAllString(dmsSymbolReplacer.Replace(normalized), -1)
+	prefixed := isHemisphere(tokens[0])
+	hemispheres := []string{}
+	values := [][]string{}
+	pending := []string{}
+
+	for _, token := range tokens {
+		switch {
+		case isHemisphere(token) && prefixed:
+			hemispheres = append(hemispheres, token)
+			values = append(values, []string{})
+
+		case isHemisphere(token):
+			hemispheres = append(hemispheres, token)
+			values = append(values, pending)
+			pending = []string{}
+
+		case prefixed:
+			values[len(values)-1] = append(values[len(values)-1], token)
+
+		default:
+			pending = append(pending, token)
+		}
+	}
+
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("values '%s' are not followed by a hemisphere", strings.Join(pending, " "))
+	}
+
+	components := map[string]float64{}
+
+	for i, hemisphere := range hemispheres {
+		value, err := parseDMSComponent(values[i], hemisphere)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s coordinate: %v", hemisphere, err)
+		}
+
+		axis := "latitude"
+
+		if hemisphere == "E" || hemisphere == "W" {
+			axis = "longitude"
+		}
+
+		if _, ok := components[axis]; ok {
+			return nil, fmt.Errorf("%s is given more than once", axis)
+		}
+
+		components[axis] = value
+	}
+
+	latitude, hasLatitude := components["latitude"]
+	longitude, hasLongitude := components["longitude"]
+
+	if !hasLatitude || !hasLongitude {
+		return nil, fmt.Errorf("expected a latitude with hemisphere N or S and a longitude with hemisphere E or W")
+	}
+
+	return []float64{longitude, latitude}, nil
+}
+
+// parseDMSComponent converts degrees with optional minutes and seconds to decimal degrees, negated for the southern and western hemispheres
+func parseDMSComponent(values []string, hemisphere string) (float64, error) {
+	if len(values) == 0 || len(values) > 3 {
+		return 0, fmt.Errorf("expected degrees with optional minutes and seconds, got %d values", len(values))
+	}
+
+	result, sign := 0.0, 1.0
+
+	for i, value := range values {
+		number, err := strconv.ParseFloat(value, 64)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if i == 0 && strings.HasPrefix(value, "-") {
+			if hemisphere != "" {
+				return 0, fmt.Errorf("degrees '%s' cannot be negative when the hemisphere is given", value)
+			}
+
+			number, sign = -number, -1
+		}
+
+		if i > 0 && (strings.ContainsAny(value, "+-") || number >= 60) {
+			return 0, fmt.Errorf("minutes and seconds must be between 0 and 60, got '%s'", value)
+		}
+
+		if i < len(values)-1 && strings.Contains(value, ".") {
+			return 0, fmt.Errorf("only the last value may have a fraction, got '%s'", value)
+		}
+
+		result += number / dmsDivisors[i]
+	}
+
+	if hemisphere == "S" || hemisphere == "W" {
+		sign = -1
+	}
+
+	return sign * result, nil
+}
+
+// isHemisphere checks if the token is a hemisphere letter
+func isHemisphere(token string) bool {
+	return token == "N" || token == "S" || token == "E" || token == "W"
+}
+
+// validateCoordinates checks that the [longitude, latitude] coordinates are in range
+func validateCoordinates(coordinates []float64) error {
+	if coordinates[0] < -180 || coordinates[0] > 180 {
+		return fmt.Errorf("longitude out of range: %f", coordinates[0])
+	}
+
+	if coordinates[1] < -90 || coordinates[1] > 90 {
+		return fmt.Errorf("latitude out of range: %f", coordinates[1])
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	lhmp "github.com/mmilosevicgd/location-tracking/location-history-management/proto"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"github.com/mmilosevicgd/location-tracking/problem"
+)
+
+type densityRequest struct {
+	Zoom         int   `validate:"gte=0,lte=22"`
+	MinCount     int64 `validate:"gte=1"`
+	HistoryStart int64 `validate:"gte=0"`
+	HistoryEnd   int64 `validate:"omitempty,gtfield=HistoryStart"`
+}
+
+type featureCollection struct {
+	Type      string    `json:"type"`
+	Features  []feature `json:"features"`
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+type feature struct {
+	Type       string         `json:"type"`
+	Geometry   any            `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type polygonGeometry struct {
+	Type        string        `json:"type"`
+	Coordinates [][][]float64 `json:"coordinates"`
+}
+
+var (
+	// geohashPrecisions maps every zoom level to the geohash precision whose cells are roughly an eighth of a tile wide
+	geohashPrecisions = []int{1, 1, 2, 2, 2, 3, 3, 4, 4, 4, 5, 5, 6, 6, 6, 7, 7, 8, 8, 8, 9, 9, 9}
+)
+
+// locationDensityHandler counts the distinct users with a current location, and optionally a location in their history, inside a bounding box per geohash cell of the zoom level
+// cells with fewer users than the minimum count are left out, so single users cannot be picked out however many locations they have
+func locationDensityHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	box, err := extractBoundingBox(liveViewport{
+		SouthWest: query.Get("southWest"),
+		NorthEast: query.Get("northEast"),
+	})
+
+	if err != nil {
+		log.Printf("validation error for density bounding box: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	data := densityRequest{}
+	err = parseQueryInt(query, "zoom", 0, &data.Zoom)
+
+	if err == nil {
+		err = parseQueryInt(query, "minCount", densityDefaultMinCount, &data.MinCount)
+	}
+
+	if err == nil {
+		err = parseQueryInt(query, "historyStart", 0, &data.HistoryStart)
+	}
+
+	if err == nil {
+		err = parseQueryInt(query, "historyEnd", 0, &data.HistoryEnd)
+	}
+
+	if err == nil {
+		err = validate.Struct(data)
+	}
+
+	if err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	precision := geohashPrecisions[data.Zoom]
+	locations, truncated, err := findLocationsInBoundingBox(r.Context(), box)
+
+	if err != nil {
+		log.Printf("error finding locations in bounding box '%v': %v\n", box, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	usernames := map[string]map[string]struct{}{}
+
+	for _, location := range locations {
+		addDensityUser(usernames, geo.Geohash(location.Location.Coordinates, precision), location.Username)
+	}
+
+	if data.HistoryEnd > 0 {
+		response, err := locationHistoryManagementClient.GetLocationDensity(r.Context(), &lhmp.DensityRequest{
+			SouthWest: box.SouthWest,
+			NorthEast: box.NorthEast,
+			Precision: int32(precision),
+			Start:     data.HistoryStart,
+			End:       data.HistoryEnd,
+		})
+
+		if err != nil {
+			log.Printf("error getting location history density in bounding box '%v': %v\n", box, err)
+			problem.WriteError(w, r, statusError(err))
+			return
+		}
+
+		for _, cell := range response.Cells {
+			for _, username := range cell.Usernames {
+				addDensityUser(usernames, cell.Geohash, username)
+			}
+		}
+
+		truncated = truncated || response.Truncated
+	}
+
+	collection := featureCollection{
+		Type:      "FeatureCollection",
+		Features:  []feature{},
+		Truncated: truncated,
+	}
+
+	for _, geohash := range slices.Sorted(maps.Keys(usernames)) {
+		count := int64(len(usernames[geohash]))
+
+		if count < data.MinCount {
+			continue
+		}
+
+		bounds, err := geo.GeohashBounds(geohash)
+
+		if err != nil {
+			log.Printf("error decoding geohash '%s': %v\n", geohash, err)
+			problem.WriteInternal(w, r)
+			return
+		}
+
+		collection.Features = append(collection.Features, feature{
+			Type: "Feature",
+			Geometry: polygonGeometry{
+				Type:        "Polygon",
+				Coordinates: [][][]float64{bounds.Polygon()},
+			},
+			Properties: map[string]any{
+				"geohash": geohash,
+				"count":   count,
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	writeJSON(w, http.StatusOK, collection)
+}
+
+// addDensityUser adds the username to the set of distinct users of the geohash cell
+func addDensityUser(usernames map[string]map[string]struct{}, geohash, username string) {
+	if usernames[geohash] == nil {
+		usernames[geohash] = map[string]struct{}{}
+	}
+
+	usernames[geohash][username] = struct{}{}
+}
+
+// findLocationsInBoundingBox retrieves the current locations of users inside the bounding box
+// at most the maximum number of map locations are returned, in which case the result is marked as truncated
+func findLocationsInBoundingBox(ctx context.Context, box geo.BoundingBox) ([]model.LocationInfo, bool, error) {
+	locations, err := currentLocationStore().Within(ctx, box, maxMapLocations)
+
+	if err != nil {
+		log.Printf("error finding locations in bounding box '%v': %v\n", box, err)
+		return nil, false, err
+	}
+
+	inside := []model.LocationInfo{}
+
+	for _, location := range locations {
+		if box.Contains(location.Location.Coordinates) {
+			inside = append(inside, location)
+		}
+	}
+
+	return inside, len(locations) == maxMapLocations, nil
+}
+
+// parseQueryInt parses an integer query parameter into the target, or sets the default value if the parameter is missing
+func parseQueryInt[T int | int64](query url.Values, name string, defaultValue T, target *T) error {
+	if !query.Has(name) {
+		*target = defaultValue
+		return nil
+	}
+
+	value, err := strconv.ParseInt(query.Get(name), 10, 64)
+
+	if err != nil {
+		return fmt.Errorf("invalid %s '%s': %v", name, query.Get(name), err)
+	}
+
+	*target = T(value)
+	return nil
+}
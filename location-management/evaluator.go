@@ -0,0 +1,89 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+)
+
+// locationEvaluator evaluates accepted location updates in the background, so the ingest path never waits for it
+// updates are sharded between the workers by username, so the updates of a single user are evaluated in order
+type locationEvaluator struct {
+	name     string
+	evaluate func(event locationEvent) error
+	mutex    sync.RWMutex
+	queues   []chan locationEvent
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// newLocationEvaluator creates a new location evaluator with the given number of workers, each queueing up to the given number of updates
+func newLocationEvaluator(name string, evaluate func(event locationEvent) error, workers, queueSize int) *locationEvaluator {
+	evaluator := &locationEvaluator{
+		name:     name,
+		evaluate: evaluate,
+	}
+
+	for range workers {
+		evaluator.queues = append(evaluator.queues, make(chan locationEvent, queueSize))
+	}
+
+	return evaluator
+}
+
+// Start starts the workers evaluating the queued updates
+func (e *locationEvaluator) Start() {
+	for _, queue := range e.queues {
+		e.wg.Add(1)
+
+		go func() {
+			defer e.wg.Done()
+
+			for event := range queue {
+				if err := e.evaluate(event); err != nil {
+					log.Printf("error evaluating %s for username '%s': %v\n", e.name, event.Username, err)
+				}
+			}
+		}()
+	}
+}
+
+// Enqueue queues a location update for evaluation and returns false if the queue of its worker is full or the evaluator is closed
+func (e *locationEvaluator) Enqueue(event locationEvent) bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if e.closed {
+		return false
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(event.Username))
+
+	select {
+	case e.queues[hash.Sum32()%uint32(len(e.queues))] <- event:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// Close stops accepting updates and waits for the queued ones to be evaluated
+func (e *locationEvaluator) Close() {
+	e.mutex.Lock()
+
+	if e.closed {
+		e.mutex.Unlock()
+		return
+	}
+
+	e.closed = true
+
+	for _, queue := range e.queues {
+		close(queue)
+	}
+
+	e.mutex.Unlock()
+	e.wg.Wait()
+}
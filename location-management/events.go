@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/mmilosevicgd/location-tracking/model"
+)
+
+type locationEvent struct {
+	ID        int64          `json:"id"`
+	Username  string         `json:"username"`
+	Location  model.Location `json:"location"`
+	Timestamp int64          `json:"timestamp"`
+}
+
+// locationHub fans out location events to in-process subscribers and keeps the latest events for subscribers resuming after a reconnect
+// publishing never blocks, a subscriber which does not keep up is dropped and its channel is closed
+type locationHub struct {
+	mutex       sync.Mutex
+	subscribers map[*locationSubscription]struct{}
+	history     []locationEvent
+	next        int
+	count       int
+	closed      bool
+}
+
+type locationSubscription struct {
+	hub    *locationHub
+	events chan locationEvent
+}
+
+// newLocationHub creates a new location hub without subscribers which keeps up to the given number of events for resuming subscribers
+func newLocationHub(historySize int) *locationHub {
+	return &locationHub{
+		subscribers: map[*locationSubscription]struct{}{},
+		history:     make([]locationEvent, historySize),
+	}
+}
+
+// Subscribe registers a new subscriber which can buffer up to the given number of events
+// if the last event id is set, the kept events published after it are delivered to the subscriber first
+func (h *locationHub) Subscribe(bufferSize int, lastID int64) *locationSubscription {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	replay := []locationEvent{}
+
+	if lastID > 0 {
+		for i := range h.count {
+			event := h.history[(h.next-h.count+i+len(h.history))%len(h.history)]
+
+			if event.ID > lastID {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	subscription := &locationSubscription{
+		hub:    h,
+		events: make(chan locationEvent, bufferSize+len(replay)),
+	}
+
+	for _, event := range replay {
+		subscription.events <- event
+	}
+
+	if h.closed {
+		close(subscription.events)
+		return subscription
+	}
+
+	h.subscribers[subscription] = struct{}{}
+	return subscription
+}
+
+// Publish keeps the event and sends it to every subscriber, dropping the subscribers whose buffers are full
+func (h *locationHub) Publish(event locationEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.history) > 0 {
+		h.history[h.next] = event
+		h.next = (h.next + 1) % len(h.history)
+		h.count = min(h.count+1, len(h.history))
+	}
+
+	for subscription := range h.subscribers {
+		select {
+		case subscription.events <- event:
+
+		default:
+			delete(h.subscribers, subscription)
+			close(subscription.events)
+		}
+	}
+}
+
+// Close drops all subscribers and every subscriber registered afterwards
+func (h *locationHub) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.closed = true
+
+	for subscription := range h.subscribers {
+		delete(h.subscribers, subscription)
+		close(subscription.events)
+	}
+}
+
+// Events returns the channel the subscriber receives events on, it is closed when the subscriber is dropped or unsubscribed
+func (s *locationSubscription) Events() <-chan locationEvent {
+	return s.events
+}
+
+// Unsubscribe removes the subscriber from the hub
+func (s *locationSubscription) Unsubscribe() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+
+	if _, ok := s.hub.subscribers[s]; ok {
+		delete(s.hub.subscribers, s)
+		close(s.events)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	lhmp "github.com/mmilosevicgd/location-tracking/location-history-management/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+)
+
+type locationStreamOpener func(ctx context.Context) (grpc.BidiStreamingClient[lhmp.LocationUpdate, lhmp.LocationAck], error)
+
+// locationForwarder forwards location updates to the location history management service over a single bidirectional stream
+// updates are queued, sent in batches and acknowledged one by one, and unacknowledged updates are sent again once the stream is reopened
+// retries are kept in the order the updates were queued, so a rejected or unacknowledged update is sent again ahead of every newer update not sent yet
+// the pending, retries, sequence, queued and current fields are owned by the run goroutine
+// the mutex guards the closed flag, so no update is queued once closing has started and the run goroutine no longer waits for new updates
+type locationForwarder struct {
+	open          locationStreamOpener
+	queue         chan *lhmp.LocationInfo
+	batchSize     int
+	batchInterval time.Duration
+	windowSize    int
+	maxAttempts   int
+	pending       map[int64]*forwardedLocation
+	retries       []*forwardedLocation
+	sequence      int64
+	queued        int64
+	current       *forwarderStream
+	closing       chan struct{}
+	closed        bool
+	mutex         sync.RWMutex
+	ctx           context.Context
+	cancel        context.CancelFunc
+	done          chan struct{}
+}
+
+type forwardedLocation struct {
+	location *lhmp.LocationInfo
+	order    int64
+	attempts int
+}
+
+type forwarderStream struct {
+	stream grpc.BidiStreamingClient[lhmp.LocationUpdate, lhmp.LocationAck]
+	cancel context.CancelFunc
+	acks   chan *lhmp.LocationAck
+	failed chan error
+	broken bool
+}
+
+var (
+	errForwarderQueueFull = errors.New("location forwarder queue is full")
+	errForwarderClosed    = errors.New("location forwarder is closed")
+)
+
+// forwarderDropped counts the location updates the forwarder gave up on, by whether they ran out of attempts, were still unacknowledged when it was stopped or were forwarded after it was closed
+var forwarderDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "location_forwarder_dropped_total",
+	Help: "Location updates dropped by the location history forwarder, by reason.",
+}, []string{"reason"})
+
+// newLocationForwarder creates a new location forwarder which opens streams with the given function
+func newLocationForwarder(open locationStreamOpener, queueSize, batchSize int, batchInterval time.Duration, windowSize, maxAttempts int) *locationForwarder {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &locationForwarder{
+		open:          open,
+		queue:         make(chan *lhmp.LocationInfo, queueSize),
+		batchSize:     batchSize,
+		batchInterval: batchInterval,
+		windowSize:    windowSize,
+		maxAttempts:   maxAttempts,
+		pending:       map[int64]*forwardedLocation{},
+		closing:       make(chan struct{}),
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+}
+
+// Start starts forwarding queued location updates in the background
+func (f *locationForwarder) Start() {
+	go f.run()
+}
+
+// Forward queues a location update for forwarding and returns an error if the queue is full or the forwarder is closing
+func (f *locationForwarder) Forward(location *lhmp.LocationInfo) error {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	if f.closed {
+		forwarderDropped.WithLabelValues("closed").Inc()
+		return errForwarderClosed
+	}
+
+	select {
+	case f.queue <- location:
+		return nil
+
+	default:
+		return errForwarderQueueFull
+	}
+}
+
+// Close stops accepting new work and waits for the queued location updates to be acknowledged
+// if they are not acknowledged before the context is done, forwarding is stopped and the remaining updates are dropped
+func (f *locationForwarder) Close(ctx context.Context) error {
+	f.mutex.Lock()
+	f.closed = true
+	close(f.closing)
+	f.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return nil
+
+	case <-ctx.Done():
+		f.cancel()
+		<-f.done
+		return ctx.Err()
+	}
+}
+
+// run sends queued and retried location updates and processes their acknowledgements until the forwarder is closed
+func (f *locationForwarder) run() {
+	defer close(f.done)
+	defer f.closeStream()
+	closing := f.closing
+	backoff := 100 * time.Millisecond
+
+	for {
+		if closing == nil && len(f.queue) == 0 && len(f.retries) == 0 && len(f.pending) == 0 {
+			return
+		}
+
+		if len(f.retries) > 0 && len(f.pending) < f.windowSize && (f.current == nil || !f.current.broken) {
+			if !f.openStream() {
+				if !f.sleep(backoff) {
+					f.drop()
+					return
+				}
+
+				backoff = min(2*backoff, 5*time.Second)
+				continue
+			}
+
+			backoff = 100 * time.Millisecond
+			batchSize := min(f.batchSize, f.windowSize-len(f.pending), len(f.retries))
+			batch := f.retries[:batchSize]
+			f.retries = f.retries[batchSize:]
+			f.send(batch)
+			continue
+		}
+
+		var queue chan *lhmp.LocationInfo
+		var acks chan *lhmp.LocationAck
+		var failed chan error
+
+		if len(f.pending) < f.windowSize {
+			queue = f.queue
+		}
+
+		if f.current != nil {
+			acks = f.current.acks
+			failed = f.current.failed
+		}
+
+		select {
+		case location := <-queue:
+			f.retries = append(f.retries, f.collect(location, min(f.batchSize, f.windowSize-len(f.pending)))...)
+
+		case ack := <-acks:
+			f.acknowledge(ack)
+
+		case err := <-failed:
+			for len(acks) > 0 {
+				f.acknowledge(<-acks)
+			}
+
+			log.Printf("location history management stream failed, resending %d unacknowledged location updates: %v\n", len(f.pending), err)
+			f.requeuePending()
+			f.closeStream()
+
+		case <-closing:
+			closing = nil
+
+		case <-f.ctx.Done():
+			f.drop()
+			return
+		}
+	}
+}
+
+// collect collects a batch of queued location updates starting with the given one
+// it waits at most the batch interval for the batch to fill up
+func (f *locationForwarder) collect(first *lhmp.LocationInfo, limit int) []*forwardedLocation {
+	f.queued++
+	batch := []*forwardedLocation{{location: first, order: f.queued}}
+	timer := time.NewTimer(f.batchInterval)
+	defer timer.Stop()
+
+	for len(batch) < limit {
+		select {
+		case location := <-f.queue:
+			f.queued++
+			batch = append(batch, &forwardedLocation{location: location, order: f.queued})
+
+		case <-timer.C:
+			return batch
+
+		case <-f.ctx.Done():
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// send sends a batch of location updates on the current stream and registers them as pending
+// if sending fails, the unsent updates are queued for retry and the stream is marked as broken until its receiver reports the failure
+func (f *locationForwarder) send(batch []*forwardedLocation) {
+	for i, location := range batch {
+		f.sequence++
+		err := f.current.stream.Send(&lhmp.LocationUpdate{
+			Sequence: f.sequence,
+			Location: location.location,
+		})
+
+		if err != nil {
+			log.Printf("error sending location update for username '%s': %v\n", location.location.Username, err)
+			f.retries = slices.Concat(batch[i:], f.retries)
+			f.current.broken = true
+			f.current.cancel()
+			return
+		}
+
+		f.pending[f.sequence] = location
+	}
+}
+
+// acknowledge removes an acknowledged location update from the pending updates
+// updates rejected by the location history management service are retried ahead of the newer updates until they run out of attempts, then they are dropped and counted
+func (f *locationForwarder) acknowledge(ack *lhmp.LocationAck) {
+	location, ok := f.pending[ack.Sequence]
+
+	if !ok {
+		return
+	}
+
+	delete(f.pending, ack.Sequence)
+
+	if ack.Error == "" {
+		return
+	}
+
+	location.attempts++
+
+	if location.attempts >= f.maxAttempts {
+		log.Printf("dropping location update for username '%s' after %d attempts: %s\n", location.location.Username, location.attempts, ack.Error)
+		forwarderDropped.WithLabelValues("attempts").Inc()
+		return
+	}
+
+	log.Printf("location update for username '%s' was rejected, retrying: %s\n", location.location.Username, ack.Error)
+	f.retry(location)
+}
+
+// retry inserts location updates into the retries at the position of the order they were queued in
+func (f *locationForwarder) retry(locations ...*forwardedLocation) {
+	for _, location := range locations {
+		i, _ := slices.BinarySearchFunc(f.retries, location.order, func(retry *forwardedLocation, order int64) int {
+			return cmp.Compare(retry.order, order)
+		})
+
+		f.retries = slices.Insert(f.retries, i, location)
+	}
+}
+
+// drop counts the location updates left when the forwarder is stopped before they are acknowledged
+func (f *locationForwarder) drop() {
+	dropped := len(f.queue) + len(f.retries) + len(f.pending)
+
+	if dropped == 0 {
+		return
+	}
+
+	log.Printf("dropping %d location updates which were not acknowledged before the forwarder was stopped\n", dropped)
+	forwarderDropped.WithLabelValues("stopped").Add(float64(dropped))
+}
+
+// requeuePending moves all pending location updates into the retries in the order they were queued
+func (f *locationForwarder) requeuePending() {
+	for sequence, location := range f.pending {
+		f.retry(location)
+		delete(f.pending, sequence)
+	}
+}
+
+// openStream opens a new stream if there is no current one and starts receiving its acknowledgements
+func (f *locationForwarder) openStream() bool {
+	if f.current != nil {
+		return true
+	}
+
+	ctx, cancel := context.WithCancel(f.ctx)
+	stream, err := f.open(ctx)
+
+	if err != nil {
+		log.Printf("error opening location history management stream: %v\n", err)
+		cancel()
+		return false
+	}
+
+	f.current = &forwarderStream{
+		stream: stream,
+		cancel: cancel,
+		acks:   make(chan *lhmp.LocationAck, f.windowSize),
+		failed: make(chan error, 1),
+	}
+
+	go f.current.receive()
+	return true
+}
+
+// closeStream closes the current stream if there is one
+func (f *locationForwarder) closeStream() {
+	if f.current == nil {
+		return
+	}
+
+	if err := f.current.stream.CloseSend(); err != nil {
+		log.Printf("error closing location history management stream: %v\n", err)
+	}
+
+	f.current.cancel()
+	f.current = nil
+}
+
+// sleep waits for the given duration and returns false if the forwarder was stopped in the meantime
+func (f *locationForwarder) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+
+	case <-f.ctx.Done():
+		return false
+	}
+}
+
+// receive receives acknowledgements from the stream until it fails or is closed
+// the acknowledgements channel is buffered with the window size, so receiving never blocks the run goroutine
+func (s *forwarderStream) receive() {
+	for {
+		ack, err := s.stream.Recv()
+
+		if err != nil {
+			s.failed <- err
+			return
+		}
+
+		s.acks <- ack
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/problem"
+	"github.com/mmilosevicgd/location-tracking/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type geofenceRequest struct {
+	Name        string   `json:"name" validate:"required,max=64"`
+	Type        string   `json:"type" validate:"required,oneof=circle polygon"`
+	Coordinates string   `json:"coordinates" validate:"required_if=Type circle,omitempty,customcoordinates"`
+	Radius      float64  `json:"radius" validate:"required_if=Type circle,omitempty,gt=0"`
+	Polygon     []string `json:"polygon" validate:"required_if=Type polygon,omitempty,min=3,max=1000,dive,customcoordinates"`
+	DwellTime   int64    `json:"dwellTime" validate:"gte=0"`
+}
+
+type pageRequest struct {
+	PageNumber int `validate:"required,gt=0"`
+	PageSize   int `validate:"required,gt=0,lte=1000"`
+}
+
+type geofenceEventsRequest struct {
+	Username string `validate:"required_without=FenceID,omitempty,alphanum,min=4,max=16"`
+	FenceID  string `validate:"omitempty,hexadecimal,len=24"`
+}
+
+// createGeofenceHandler validates the request data and creates a new geofence
+func createGeofenceHandler(w http.ResponseWriter, r *http.Request) {
+	data := geofenceRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		log.Printf("error decoding request body: %v\n", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, err.Error())
+		return
+	}
+
+	fence, err := buildGeofence(primitive.NewObjectID().Hex(), data)
+
+	if err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	if err := geofenceStore().Save(r.Context(), fence); err != nil {
+		log.Printf("error saving geofence '%s': %v\n", fence.Name, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, fence)
+}
+
+// updateGeofenceHandler validates the request data and replaces an existing geofence
+func updateGeofenceHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	data := geofenceRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		log.Printf("error decoding request body: %v\n", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, err.Error())
+		return
+	}
+
+	fence, err := buildGeofence(id, data)
+
+	if err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	_, ok, err := geofenceStore().Get(r.Context(), id)
+
+	if err != nil {
+		log.Printf("error finding geofence '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("geofence '%s' not found", id))
+		return
+	}
+
+	if err := geofenceStore().Save(r.Context(), fence); err != nil {
+		log.Printf("error saving geofence '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, fence)
+}
+
+// getGeofenceHandler returns a single geofence
+func getGeofenceHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	fence, ok, err := geofenceStore().Get(r.Context(), id)
+
+	if err != nil {
+		log.Printf("error finding geofence '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("geofence '%s' not found", id))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, fence)
+}
+
+// listGeofencesHandler returns a page of geofences ordered by name
+func listGeofencesHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := extractPage(r.URL.Query())
+
+	if err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	fences, err := geofenceStore().List(r.Context(), page.PageNumber, page.PageSize)
+
+	if err != nil {
+		log.Printf("error listing geofences: %v\n", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Geofences []store.Geofence `json:"geofences"`
+	}{
+		Geofences: fences,
+	})
+}
+
+// deleteGeofenceHandler deletes a geofence
+func deleteGeofenceHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	ok, err := geofenceStore().Delete(r.Context(), id)
+
+	if err != nil {
+		log.Printf("error deleting geofence '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("geofence '%s' not found", id))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listGeofenceEventsHandler returns a page of geofence events of a user, a geofence or both, latest first
+func listGeofenceEventsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	data := geofenceEventsRequest{
+		Username: query.Get("username"),
+		FenceID:  query.Get("fenceId"),
+	}
+
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	page, err := extractPage(query)
+
+	if err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	events, err := geofenceStore().Events(r.Context(), data.Username, data.FenceID, page.PageNumber, page.PageSize)
+
+	if err != nil {
+		log.Printf("error listing geofence events for username '%s' and geofence '%s': %v\n", data.Username, data.FenceID, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Events []store.GeofenceEvent `json:"events"`
+	}{
+		Events: events,
+	})
+}
+
+// buildGeofence validates the request data and converts it to a geofence with the given id
+func buildGeofence(id string, data geofenceRequest) (store.Geofence, error) {
+	if err := validate.Struct(data); err != nil {
+		return store.Geofence{}, err
+	}
+
+	fence := store.Geofence{
+		ID:        id,
+		Name:      data.Name,
+		Type:      data.Type,
+		DwellTime: data.DwellTime,
+		Geometry: store.GeofenceGeometry{
+			Type: "Polygon",
+		},
+	}
+
+	if data.Type == "circle" {
+		center, err := extractCoordinates(data.Coordinates)
+
+		if err != nil {
+			return store.Geofence{}, err
+		}
+
+		fence.Center = center
+		fence.Radius = data.Radius
+		fence.Geometry.Coordinates = [][][]float64{geo.Circle{Center: center, Radius: data.Radius}.Polygon(geofenceCircleSegments)}
+		return fence, nil
+	}
+
+	ring := [][]float64{}
+
+	for _, vertex := range data.Polygon {
+		coordinates, err := extractCoordinates(vertex)
+
+		if err != nil {
+			return store.Geofence{}, err
+		}
+
+		ring = append(ring, coordinates)
+	}
+
+	first, last := ring[0], ring[len(ring)-1]
+
+	if first[0] != last[0] || first[1] != last[1] {
+		ring = append(ring, first)
+	}
+
+	if len(ring) < 4 {
+		return store.Geofence{}, fmt.Errorf("polygon needs at least 3 distinct vertices")
+	}
+
+	fence.Geometry.Coordinates = [][][]float64{ring}
+	return fence, nil
+}
+
+// extractPage extracts and validates the page number and page size query parameters
+func extractPage(query url.Values) (pageRequest, error) {
+	page := pageRequest{}
+	var err error
+
+	if page.PageNumber, err = strconv.Atoi(query.Get("pageNumber")); err != nil {
+		return pageRequest{}, fmt.Errorf("invalid page number '%s': %v", query.Get("pageNumber"), err)
+	}
+
+	if page.PageSize, err = strconv.Atoi(query.Get("pageSize")); err != nil {
+		return pageRequest{}, fmt.Errorf("invalid page size '%s': %v", query.Get("pageSize"), err)
+	}
+
+	if err := validate.Struct(page); err != nil {
+		return pageRequest{}, err
+	}
+
+	return page, nil
+}
+
+// writeJSON writes the response as json with the given status code, unless a more specific content type is already set
+func writeJSON(w http.ResponseWriter, statusCode int, response any) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding response: %v\n", err)
+	}
+}
+
+// evaluateGeofences compares the geofences the user was inside of before the update with the ones containing the new location and stores the enter, exit and dwell events
+// the geofences the user is inside of are kept in the geofence state collection, so the previous location never has to be evaluated again
+func evaluateGeofences(event locationEvent) error {
+	ctx := context.Background()
+	fences, err := geofenceStore().Containing(ctx, event.Location, maxGeofencesPerLocation)
+
+	if err != nil {
+		return err
+	}
+
+	states, err := geofenceStore().States(ctx, event.Username, maxGeofencesPerLocation)
+
+	if err != nil {
+		return err
+	}
+
+	previous := map[string]store.GeofenceState{}
+
+	for _, state := range states {
+		previous[state.FenceID] = state
+	}
+
+	inside := map[string]bool{}
+
+	for _, fence := range fences {
+		if fence.Type == "circle" && !(geo.Circle{Center: fence.Center, Radius: fence.Radius}).Contains(event.Location.Coordinates) {
+			continue
+		}
+
+		inside[fence.ID] = true
+		state, ok := previous[fence.ID]
+
+		if !ok {
+			state = store.GeofenceState{
+				ID:        event.Username + ":" + fence.ID,
+				Username:  event.Username,
+				FenceID:   fence.ID,
+				FenceName: fence.Name,
+				EnteredAt: event.Timestamp,
+			}
+
+			if err := saveGeofenceTransition(ctx, state, "enter", event); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if fence.DwellTime > 0 && !state.Dwelled && event.Timestamp-state.EnteredAt >= fence.DwellTime*1000 {
+			state.Dwelled = true
+
+			if err := saveGeofenceTransition(ctx, state, "dwell", event); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, state := range states {
+		if inside[state.FenceID] {
+			continue
+		}
+
+		if err := geofenceStore().DeleteState(ctx, state.ID); err != nil {
+			return err
+		}
+
+		if err := saveGeofenceEvent(ctx, state, "exit", event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveGeofenceTransition stores the new geofence state of the user and the event which led to it
+func saveGeofenceTransition(ctx context.Context, state store.GeofenceState, eventType string, event locationEvent) error {
+	if err := geofenceStore().SaveState(ctx, state); err != nil {
+		return err
+	}
+
+	return saveGeofenceEvent(ctx, state, eventType, event)
+}
+
+// saveGeofenceEvent stores a geofence event and queues it for the webhooks, its id is derived from its content so evaluating the same update twice stores it only once
+func saveGeofenceEvent(ctx context.Context, state store.GeofenceState, eventType string, event locationEvent) error {
+	fenceEvent := store.GeofenceEvent{
+		ID:        fmt.Sprintf("%s:%s:%d:%s", state.Username, state.FenceID, event.Timestamp, eventType),
+		Type:      eventType,
+		FenceID:   state.FenceID,
+		FenceName: state.FenceName,
+		Username:  state.Username,
+		Location:  event.Location,
+		Timestamp: event.Timestamp,
+	}
+
+	if err := geofenceStore().SaveEvent(ctx, fenceEvent); err != nil {
+		return err
+	}
+
+	if !webhooks.Publish("geofence", fenceEvent) {
+		log.Printf("webhook queue is full, dropping geofence event '%s'\n", fenceEvent.ID)
+	}
+
+	return nil
+}
@@ -4,29 +4,51 @@ go 1.24.2
 
 replace github.com/mmilosevicgd/location-tracking/db => ../internal/db
 
+replace github.com/mmilosevicgd/location-tracking/geo => ../internal/geo
+
 replace github.com/mmilosevicgd/location-tracking/location-history-management/proto => ../location-history-management/proto
 
+replace github.com/mmilosevicgd/location-tracking/location-management/proto => ./proto
+
 replace github.com/mmilosevicgd/location-tracking/model => ../internal/model
 
+replace github.com/mmilosevicgd/location-tracking/problem => ../internal/problem
+
+replace github.com/mmilosevicgd/location-tracking/store => ../internal/store
+
 replace github.com/mmilosevicgd/location-tracking/validation => ../internal/validation
 
 require (
 	github.com/go-playground/validator/v10 v10.25.0
+	github.com/gorilla/websocket v1.5.3
 	github.com/mmilosevicgd/location-tracking/db v0.0.0-00010101000000-000000000000
+	github.com/mmilosevicgd/location-tracking/geo v0.0.0-00010101000000-000000000000
 	github.com/mmilosevicgd/location-tracking/location-history-management/proto v0.0.0-00010101000000-000000000000
+	github.com/mmilosevicgd/location-tracking/location-management/proto v0.0.0-00010101000000-000000000000
 	github.com/mmilosevicgd/location-tracking/model v0.0.0-00010101000000-000000000000
+	github.com/mmilosevicgd/location-tracking/problem v0.0.0-00010101000000-000000000000
+	github.com/mmilosevicgd/location-tracking/store v0.0.0-00010101000000-000000000000
 	github.com/mmilosevicgd/location-tracking/validation v0.0.0-00010101000000-000000000000
+	github.com/nats-io/nats-server/v2 v2.11.4
+	github.com/nats-io/nats.go v1.42.0
+	github.com/prometheus/client_model v0.6.1
 	google.golang.org/grpc v1.71.0
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/google/go-tpm v0.9.5 // indirect
+	github.com/minio/highwayhash v1.0.3 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
-	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/nats-io/jwt/v2 v2.7.4 // indirect
+	github.com/nats-io/nkeys v0.4.11 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/prometheus/common v0.62.0 // indirect
 	github.com/prometheus/procfs v0.15.1 // indirect
+	go.etcd.io/bbolt v1.4.3 // indirect
 	go.mongodb.org/mongo-driver/v2 v2.0.0 // indirect
+	golang.org/x/time v0.11.0 // indirect
 )
 
 require (
@@ -34,7 +56,7 @@ require (
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
-	github.com/klauspost/compress v1.17.11 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/leodido/go-urn v1.4.0 // indirect
 	github.com/prometheus/client_golang v1.21.1
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
@@ -42,11 +64,11 @@ require (
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
 	go.mongodb.org/mongo-driver v1.17.2
-	golang.org/x/crypto v0.32.0 // indirect
+	golang.org/x/crypto v0.38.0 // indirect
 	golang.org/x/net v0.34.0 // indirect
-	golang.org/x/sync v0.10.0 // indirect
-	golang.org/x/sys v0.29.0 // indirect
-	golang.org/x/text v0.21.0 // indirect
+	golang.org/x/sync v0.14.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.25.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250115164207-1a7da9e5054f // indirect
-	google.golang.org/protobuf v1.36.5 // indirect
+	google.golang.org/protobuf v1.36.5
 )
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,46 +13,61 @@ import (
 	"time"
 
 	lhmp "github.com/mmilosevicgd/location-tracking/location-history-management/proto"
+	pb "github.com/mmilosevicgd/location-tracking/location-management/proto"
 	"github.com/mmilosevicgd/location-tracking/model"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/mmilosevicgd/location-tracking/problem"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
-// updateUserLocationHandler validates the request data, extracts coordinates and updates the user's location
+type userLocationRequest struct {
+	Username    string          `json:"username" validate:"required,alphanum,min=4,max=16"`
+	Coordinates string          `json:"coordinates" validate:"required_without=Location,excluded_with=Location,max=64"`
+	Location    *model.Location `json:"location" validate:"required_without=Coordinates"`
+}
+
+type searchUserLocationRequest struct {
+	Coordinates string          `json:"coordinates" validate:"required_without=Location,excluded_with=Location,max=64"`
+	Location    *model.Location `json:"location" validate:"required_without=Coordinates"`
+	Distance    float64         `json:"distance" validate:"required,gte=0"`
+	PageNumber  int             `json:"pageNumber" validate:"required,gt=0"`
+	PageSize    int             `json:"pageSize" validate:"required,gt=0"`
+}
+
+// updateUserLocationHandler validates the request data, parses the location in any of the supported formats and updates the user's location
 func updateUserLocationHandler(w http.ResponseWriter, r *http.Request) {
-	data := struct {
-		Username    string `json:"username" validate:"required,alphanum,min=4,max=16"`
-		Coordinates string `json:"coordinates" validate:"required,customcoordinates"`
-	}{}
+	data := userLocationRequest{}
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		log.Printf("error decoding request body: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, err.Error())
 		return
 	}
 
 	if err := validate.Struct(data); err != nil {
 		log.Printf("validation error for input data: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		problem.WriteValidation(w, r, err)
 		return
 	}
 
-	coordinates, err := extractCoordinates(data.Coordinates)
+	location, err := parseLocation(data.Coordinates, data.Location)
 
 	if err != nil {
-		log.Printf("error extracting coordinates '%s': %v\n", data.Coordinates, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("error parsing location for username '%s': %v\n", data.Username, err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidLocation, err.Error())
 		return
 	}
 
-	if err := updateUserLocation(data.Username, coordinates); err != nil {
-		log.Printf("error updating user location for username '%s' and coordinates '%v': %v\n", data.Username, coordinates, err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := updateUserLocation(r.Context(), data.Username, location.Coordinates); err != nil {
+		log.Printf("error updating user location for username '%s' and coordinates '%v': %v\n", data.Username, location.Coordinates, err)
+		problem.WriteError(w, r, err)
 		return
 	}
 }
 
-// updateUserLocation updates the user's location in the database and sends the update to the location history management service
-func updateUserLocation(username string, coordinates []float64) error {
+// updateUserLocation updates the user's location in the database, queues the update for the location history management service the geofence and proximity evaluation, the webhooks and the event sink and broadcasts it to the live subscribers
+func updateUserLocation(ctx context.Context, username string, coordinates []float64) error {
 	locationInfo := model.LocationInfo{
 		Username: username,
 		Location: model.Location{
@@ -61,16 +77,12 @@ func updateUserLocation(username string, coordinates []float64) error {
 		Timestamp: time.Now().UnixMilli(),
 	}
 
-	filter := map[string]any{
-		"username": locationInfo.Username,
-	}
-
-	if err := mongoClient.SaveOrReplaceDocument(locationCollection, locationInfo, filter); err != nil {
+	if err := currentLocationStore().Upsert(ctx, locationInfo); err != nil {
 		log.Printf("error saving or replacing document in mongodb for username '%s': %v", locationInfo.Username, err)
 		return err
 	}
 
-	_, err := locationHistoryManagementClient.UpdateUserLocation(context.Background(), &lhmp.LocationInfo{
+	err := locationHistoryForwarder.Forward(&lhmp.LocationInfo{
 		Username: locationInfo.Username,
 		Location: &lhmp.Location{
 			Type:        locationInfo.Location.Type,
@@ -80,47 +92,68 @@ func updateUserLocation(username string, coordinates []float64) error {
 	})
 
 	if err != nil {
-		log.Printf("error sending location update to grpc service for username '%s': %v\n", locationInfo.Username, err)
+		log.Printf("error forwarding location update to grpc service for username '%s': %v\n", locationInfo.Username, err)
 		return err
 	}
 
+	event := locationEvent{
+		Username:  locationInfo.Username,
+		Location:  locationInfo.Location,
+		Timestamp: locationInfo.Timestamp,
+	}
+
+	if !geofenceEvaluator.Enqueue(event) {
+		log.Printf("geofence evaluation queue is full, dropping location update for username '%s'\n", locationInfo.Username)
+	}
+
+	if !proximityEvaluator.Enqueue(event) {
+		log.Printf("proximity evaluation queue is full, dropping location update for username '%s'\n", locationInfo.Username)
+	}
+
+	if !locationEventSinkPublisher.Enqueue(event) {
+		log.Printf("event sink queue is full, dropping location event for username '%s'\n", locationInfo.Username)
+	}
+
+	if !webhooks.Publish("location", event) {
+		log.Printf("webhook queue is full, dropping location event for username '%s'\n", locationInfo.Username)
+	}
+
+	if err := locationEventBroadcaster.Publish(event); err != nil {
+		log.Printf("error broadcasting location event for username '%s': %v\n", locationInfo.Username, err)
+	}
+
 	return nil
 }
 
-// searchUserLocationHandler validates the request data, extracts coordinates and searches for users within a specified distance and returns their usernames
+// searchUserLocationHandler validates the request data, parses the location in any of the supported formats and searches for users within a specified distance and returns their usernames
 func searchUserLocationHandler(w http.ResponseWriter, r *http.Request) {
-	data := struct {
-		Coordinates string  `json:"coordinates" validate:"required,customcoordinates"`
-		Distance    float64 `json:"distance" validate:"required,gte=0"`
-		PageNumber  int     `json:"pageNumber" validate:"required,gt=0"`
-		PageSize    int     `json:"pageSize" validate:"required,gt=0"`
-	}{}
+	data := searchUserLocationRequest{}
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		log.Printf("error decoding request body: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, err.Error())
 		return
 	}
 
 	if err := validate.Struct(data); err != nil {
 		log.Printf("validation error for input data: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		problem.WriteValidation(w, r, err)
 		return
 	}
 
-	coordinates, err := extractCoordinates(data.Coordinates)
+	location, err := parseLocation(data.Coordinates, data.Location)
 
 	if err != nil {
-		log.Printf("error extracting coordinates '%s': %v\n", data.Coordinates, err)
-		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("error parsing search location: %v\n", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidLocation, err.Error())
 		return
 	}
 
-	usernames, err := searchUserLocation(coordinates, data.Distance, data.PageNumber, data.PageSize)
+	usernames, err := searchUserLocation(r.Context(), location.Coordinates, data.Distance, data.PageNumber, data.PageSize)
 
 	if err != nil {
-		log.Printf("error searching user locations for coordinates '%v' and distance '%f': %v\n", coordinates, data.Distance, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("error searching user locations for coordinates '%v' and distance '%f': %v\n", location.Coordinates, data.Distance, err)
+		problem.WriteError(w, r, err)
 		return
 	}
 
@@ -134,7 +167,7 @@ func searchUserLocationHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		log.Printf("error encoding response: %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteInternal(w, r)
 		return
 	}
 
@@ -142,15 +175,11 @@ func searchUserLocationHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // searchUserLocation searches for users within a specified distance from the given coordinates and returns their usernames
-func searchUserLocation(coordinates []float64, distance float64, pageNumber, pageSize int) ([]string, error) {
-	target := model.Location{
-		Type:        "Point",
-		Coordinates: coordinates,
-	}
-
-	usernames, err := findNear(target, distance, pageNumber, pageSize)
+func searchUserLocation(ctx context.Context, coordinates []float64, distance float64, pageNumber, pageSize int) ([]string, error) {
+	usernames, err := currentLocationStore().Near(ctx, coordinates, distance, pageNumber, pageSize)
 
 	if err != nil {
+		log.Printf("error finding users near coordinates '%v': %v\n", coordinates, err)
 		return nil, err
 	}
 
@@ -173,58 +202,178 @@ func extractCoordinates(coordinatesString string) ([]float64, error) {
 
 	slices.Reverse(coordinates)
 
-	if coordinates[0] < -180 || coordinates[0] > 180 {
-		return nil, fmt.Errorf("longitude out of range: %f", coordinates[0])
+	if err := validateCoordinates(coordinates); err != nil {
+		return nil, err
+	}
+
+	return coordinates, nil
+}
+
+// findCurrent retrieves the current location of a specific user
+func findCurrent(ctx context.Context, username string) (model.LocationInfo, bool, error) {
+	locationInfo, ok, err := currentLocationStore().Get(ctx, username)
+
+	if err != nil {
+		log.Printf("error finding current location for username '%s': %v\n", username, err)
+		return model.LocationInfo{}, false, err
 	}
 
-	if coordinates[1] < -90 || coordinates[1] > 90 {
-		return nil, fmt.Errorf("latitude out of range: %f", coordinates[1])
+	return locationInfo, ok, nil
+}
+
+// UpdateUserLocation validates the request data, extracts coordinates and updates the user's location
+func (s *protoServer) UpdateUserLocation(ctx context.Context, in *pb.UpdateLocationRequest) (*emptypb.Empty, error) {
+	err := updateUserLocationFromRequest(ctx, userLocationRequest{
+		Username:    in.Username,
+		Coordinates: in.Coordinates,
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	return coordinates, nil
+	return &emptypb.Empty{}, nil
 }
 
-// findNear finds users within a specified distance from the target location and returns their usernames
-func findNear(target model.Location, distance float64, pageNumber, pageSize int) ([]string, error) {
-	filter := bson.M{
-		"location": bson.M{
-			"$near": bson.M{
-				"$geometry":    target,
-				"$maxDistance": distance,
-			},
-		},
+// BatchUpdateUserLocation validates and updates multiple user locations and reports the outcome of every update separately
+func (s *protoServer) BatchUpdateUserLocation(ctx context.Context, in *pb.BatchUpdateLocationRequest) (*pb.BatchUpdateLocationResponse, error) {
+	if len(in.Locations) > maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "batch size %d exceeds the maximum of %d", len(in.Locations), maxBatchSize)
+	}
+
+	results := []*pb.BatchUpdateLocationResult{}
+
+	for i, location := range in.Locations {
+		result := &pb.BatchUpdateLocationResult{
+			Index: int32(i),
+		}
+
+		err := updateUserLocationFromRequest(ctx, userLocationRequest{
+			Username:    location.Username,
+			Coordinates: location.Coordinates,
+		})
+
+		if err != nil {
+			result.Error = status.Convert(err).Message()
+		}
+
+		results = append(results, result)
 	}
 
-	projection := bson.M{
-		"username": 1,
+	return &pb.BatchUpdateLocationResponse{
+		Results: results,
+	}, nil
+}
+
+// updateUserLocationFromRequest validates the request data, extracts coordinates and updates the user's location, returning grpc status errors
+func updateUserLocationFromRequest(ctx context.Context, data userLocationRequest) error {
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		return status.Errorf(codes.InvalidArgument, "invalid location update for username '%s': %v", data.Username, err)
+	}
+
+	location, err := parseLocation(data.Coordinates, data.Location)
+
+	if err != nil {
+		log.Printf("error parsing location: %v\n", err)
+		return status.Errorf(codes.InvalidArgument, "%v", err)
 	}
 
-	sort := bson.M{
-		"username": 1,
+	if err := updateUserLocation(ctx, data.Username, location.Coordinates); err != nil {
+		log.Printf("error updating user location for username '%s' and coordinates '%v': %v\n", data.Username, location.Coordinates, err)
+		return errorStatus(err, "error updating location for username '%s'", data.Username)
 	}
 
-	cursor, err := mongoClient.Find(locationCollection, filter, projection, sort, pageNumber, pageSize)
+	return nil
+}
+
+// GetUserLocation retrieves the current location of a user
+func (s *protoServer) GetUserLocation(ctx context.Context, in *pb.UserLocationRequest) (*pb.LocationInfo, error) {
+	if err := validate.Var(in.Username, "required,alphanum,min=4,max=16"); err != nil {
+		log.Printf("validation error for username '%s': %v\n", in.Username, err)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid username '%s'", in.Username)
+	}
+
+	locationInfo, ok, err := findCurrent(ctx, in.Username)
 
 	if err != nil {
-		log.Printf("error executing mongodb find query: %v", err)
-		return nil, err
+		log.Printf("error finding current location for username '%s': %v\n", in.Username, err)
+		return nil, errorStatus(err, "error finding current location for username '%s'", in.Username)
 	}
 
-	defer cursor.Close(context.Background())
-	rawUsernames := []struct {
-		Username string `bson:"username" json:"username"`
-	}{}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no location found for username '%s'", in.Username)
+	}
 
-	if err := cursor.All(context.Background(), &rawUsernames); err != nil {
-		log.Printf("error decoding mongodb cursor results: %v", err)
-		return nil, err
+	return &pb.LocationInfo{
+		Username: locationInfo.Username,
+		Location: &pb.Location{
+			Type:        locationInfo.Location.Type,
+			Coordinates: locationInfo.Location.Coordinates,
+		},
+		Timestamp: locationInfo.Timestamp,
+		Place:     pb.LookupPlace(reverseGeocoder, locationInfo.Location.Coordinates),
+	}, nil
+}
+
+// errorStatus returns the grpc status error of a failed operation, keeping cancellations and exceeded deadlines apart from internal errors
+func errorStatus(err error, format string, args ...any) error {
+	code := codes.Internal
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
 	}
 
-	usernames := []string{}
+	return status.Errorf(code, format, args...)
+}
+
+// statusError returns the error of a failed grpc call as a cancellation or an exceeded deadline if its status says so, or the error itself otherwise
+func statusError(err error) error {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded:
+		return fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+
+	case codes.Canceled:
+		return fmt.Errorf("%w: %v", context.Canceled, err)
+
+	default:
+		return err
+	}
+}
 
-	for _, rawUsername := range rawUsernames {
-		usernames = append(usernames, rawUsername.Username)
+// SearchUserLocation validates the request data, extracts coordinates and searches for users within a specified distance and returns their usernames
+func (s *protoServer) SearchUserLocation(ctx context.Context, in *pb.SearchRequest) (*pb.SearchResponse, error) {
+	data := searchUserLocationRequest{
+		Coordinates: in.Coordinates,
+		Distance:    in.Distance,
+		PageNumber:  int(in.PageNumber),
+		PageSize:    int(in.PageSize),
 	}
 
-	return usernames, nil
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid search request: %v", err)
+	}
+
+	location, err := parseLocation(data.Coordinates, data.Location)
+
+	if err != nil {
+		log.Printf("error parsing location: %v\n", err)
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	usernames, err := searchUserLocation(ctx, location.Coordinates, data.Distance, data.PageNumber, data.PageSize)
+
+	if err != nil {
+		log.Printf("error searching user locations for coordinates '%v' and distance '%f': %v\n", location.Coordinates, data.Distance, err)
+		return nil, errorStatus(err, "error searching user locations")
+	}
+
+	return &pb.SearchResponse{
+		Usernames: usernames,
+	}, nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,7 +12,11 @@ import (
 	"time"
 
 	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/geo"
 	lhmp "github.com/mmilosevicgd/location-tracking/location-history-management/proto"
+	pb "github.com/mmilosevicgd/location-tracking/location-management/proto"
+	"github.com/mmilosevicgd/location-tracking/problem"
+	"github.com/mmilosevicgd/location-tracking/store"
 	"github.com/mmilosevicgd/location-tracking/validation"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
@@ -20,32 +25,133 @@ import (
 	"github.com/go-playground/validator/v10"
 )
 
+type protoServer struct {
+	pb.UnimplementedLocationManagementServer
+}
+
 const (
-	locationCollection = "location"
+	locationCollection        = "location"
+	migrationCollection       = "migration"
+	maxBatchSize              = 1000
+	forwarderQueueSize        = 10000
+	forwarderBatchSize        = 100
+	forwarderBatchInterval    = 10 * time.Millisecond
+	forwarderWindowSize       = 1000
+	forwarderMaxAttempts      = 3
+	liveBufferSize            = 256
+	liveReadLimit             = 4096
+	liveWriteWait             = 10 * time.Second
+	livePongWait              = 60 * time.Second
+	livePingPeriod            = 30 * time.Second
+	eventHistorySize          = 1000
+	streamBufferSize          = 256
+	streamHeartbeatPeriod     = 15 * time.Second
+	streamRetry               = 3 * time.Second
+	geofenceCollection        = "geofence"
+	geofenceStateCollection   = "geofence-state"
+	geofenceEventCollection   = "geofence-event"
+	geofenceCircleSegments    = 64
+	geofenceWorkers           = 4
+	geofenceQueueSize         = 1000
+	maxGeofencesPerLocation   = 1000
+	proximityRuleCollection   = "proximity-rule"
+	proximityStateCollection  = "proximity-state"
+	proximityAlertCollection  = "proximity-alert"
+	proximityQueueSize        = 1000
+	maxProximityRulesPerUser  = 1000
+	webhookCollection         = "webhook"
+	webhookDeliveryCollection = "webhook-delivery"
+	webhookWorkers            = 4
+	webhookQueueSize          = 1000
+	webhookTimeout            = 10 * time.Second
+	webhookMaxAttempts        = 5
+	webhookMinBackoff         = time.Second
+	webhookMaxBackoff         = time.Minute
+	webhookResumePageSize     = 1000
+	maxWebhooksPerEvent       = 1000
+	sinkEventSchemaVersion    = 1
+	sinkQueueSize             = 10000
+	sinkTimeout               = 10 * time.Second
+	sinkDefaultSubject        = "location.updated"
+	densityDefaultMinCount    = 1
+	maxMapLocations           = 100000
+	maxClusterTiles           = 64
+	clusterGridSize           = 8
+	clusterMaxZoom            = 17
+	clusterCacheTTL           = 5 * time.Second
+	clusterCacheSize          = 10000
+	maxTileZoom               = 22
+	tileExtent                = 4096
+	tileLayerName             = "users"
 )
 
 var (
-	validate                            = validator.New()
-	mongoClient                         db.DBClient
-	httpServer                          *http.Server
-	locationHistoryManagementClient     lhmp.GRPCClient
+	validate                        = validator.New()
+	mongoClient                     db.DBClient
+	currentLocations                store.CurrentLocationStore
+	httpServer                      *http.Server
+	grpcServer                      *grpc.Server
+	locationHistoryManagementClient lhmp.GRPCClient
+	locationHistoryForwarder        *locationForwarder
+	locationEvents                  = newLocationHub(eventHistorySize)
+	locationEventBroadcaster        locationBroadcaster
+	geofenceEvaluator               *locationEvaluator
+	proximityEvaluator              *locationEvaluator
+	webhooks                        *webhookDispatcher
+	locationEventSink               eventSink
+	locationEventSinkPublisher      *locationEvaluator
+	locationClusters                = newClusterCache(clusterCacheTTL, clusterCacheSize)
+	reverseGeocoder                 *geo.ReverseGeocoder
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrationCommand(os.Args[2:]); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+
+		return
+	}
+
 	go initValidations()
-	go initMongoClient()
+	initMongoClient()
 	go initLocationHistoryManagementClient()
+	go initLocationHistoryForwarder()
+	go initLocationEventBroadcaster()
+	go initGeofenceEvaluator()
+	go initProximityEvaluator()
+	go initWebhookDispatcher()
+	go initLocationEventSink()
+	go initReverseGeocoder()
 	go initHttpServer()
+	go initGrpcServer()
 
 	shutdown, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 	<-shutdown.Done()
 
+	// the servers are shut down first, then the workers behind them, the webhook dispatcher the evaluators publish to and the clients last, so nothing uses a closed worker or client
 	wg := sync.WaitGroup{}
-	wg.Add(3)
+	wg.Add(2)
+	go shutdownHttpServer(&wg)
+	go shutdownGrpcServer(&wg)
+	wg.Wait()
+
+	wg.Add(5)
+	go closeLocationHistoryForwarder(&wg)
+	go closeLocationEventBroadcaster(&wg)
+	go closeGeofenceEvaluator(&wg)
+	go closeProximityEvaluator(&wg)
+	go closeLocationEventSink(&wg)
+	wg.Wait()
+
+	wg.Add(1)
+	go closeWebhookDispatcher(&wg)
+	wg.Wait()
+
+	wg.Add(2)
 	go disconnectMongoClient(&wg)
 	go disconnectLocationHistoryManagementClient(&wg)
-	go shutdownHttpServer(&wg)
 	wg.Wait()
 }
 
@@ -54,25 +160,92 @@ func initValidations() {
 	validation.RegisterCustomValidations(validate)
 }
 
-// initMongoClient initializes the mongodb client and creates the necessary collections and indexes
+// initMongoClient initializes the mongodb client, applies the schema of the collections and indexes and the pending migrations
+// it runs before everything else using the client is started, so the servers only accept requests once the data is migrated
 func initMongoClient() {
 	if mongoClient != nil {
 		log.Println("mongo client already initialized")
 		return
 	}
 
-	mongoClient = db.MustCreateClient(db.ClientInfo{
-		AuthSource:      os.Getenv("MONGODB_AUTH_DB"),
-		Username:        os.Getenv("MONGODB_USERNAME"),
-		Password:        os.Getenv("MONGODB_PASSWORD"),
-		Uri:             os.Getenv("MONGODB_URI"),
-		DefaultDatabase: os.Getenv("MONGODB_DEFAULT_DB"),
-	})
+	mongoClient = createDBClient()
+
+	if os.Getenv("DB_BACKEND") == "memory" {
+		currentLocations = store.CreateMemoryCurrentLocationStore()
+	}
+
+	drift := db.MustApplySchema(context.Background(), mongoClient, schema)
+	reportSchemaDrift(drift)
+
+	if err := migrateOnStartup(); err != nil {
+		mongoClient.Disconnect(context.Background())
+		log.Fatalf("%v\n", err)
+	}
+
+	log.Println("successfully initialized mongo client and applied the schema and migrations")
+}
+
+// createDBClient creates the client of the database backend selected by DB_BACKEND, mongodb by default
+func createDBClient() db.DBClient {
+	switch backend := os.Getenv("DB_BACKEND"); backend {
+	case "memory":
+		log.Println("using the in-memory database backend, the data is lost when the service stops")
+		return db.CreateMemoryClient()
+
+	case "embedded":
+		path := os.Getenv("EMBEDDED_DB_PATH")
+
+		if path == "" {
+			path = "location-management.db"
+		}
+
+		log.Printf("using the embedded database backend stored in '%s'\n", path)
+		return db.MustCreateEmbeddedClient(path)
+
+	case "", "mongodb":
+		timeouts, err := db.ParseTimeouts(os.Getenv("MONGODB_TIMEOUT"), os.Getenv("MONGODB_OPERATION_TIMEOUTS"))
+
+		if err != nil {
+			log.Fatalf("error parsing mongodb timeouts: %v\n", err)
+		}
+
+		return db.MustCreateClient(db.ClientInfo{
+			AuthSource:      os.Getenv("MONGODB_AUTH_DB"),
+			Username:        os.Getenv("MONGODB_USERNAME"),
+			Password:        os.Getenv("MONGODB_PASSWORD"),
+			Uri:             os.Getenv("MONGODB_URI"),
+			DefaultDatabase: os.Getenv("MONGODB_DEFAULT_DB"),
+			Timeouts:        timeouts,
+		})
+
+	default:
+		log.Fatalf("unknown database backend '%s', expected 'mongodb', 'embedded' or 'memory'\n", backend)
+		return nil
+	}
+}
+
+// currentLocationStore returns the store of the current locations of the users, kept in memory with the memory backend and in the location collection of the db client otherwise
+func currentLocationStore() store.CurrentLocationStore {
+	if currentLocations != nil {
+		return currentLocations
+	}
 
-	mongoClient.MustCreateCollection(locationCollection)
-	mongoClient.MustCreateIndex(locationCollection, "username", 1)
-	mongoClient.MustCreate2dSphereIndex(locationCollection, "location")
-	log.Println("successfully initialized mongo client and created collections and indexes")
+	return store.CreateMongoCurrentLocationStore(mongoClient, locationCollection)
+}
+
+// geofenceStore returns the store of the geofences, the geofences the users are inside of and the geofence events
+func geofenceStore() store.GeofenceStore {
+	return store.CreateGeofenceStore(mongoClient, geofenceCollection, geofenceStateCollection, geofenceEventCollection)
+}
+
+// proximityStore returns the store of the proximity rules, their states and their alerts
+func proximityStore() store.ProximityStore {
+	return store.CreateProximityStore(mongoClient, proximityRuleCollection, proximityStateCollection, proximityAlertCollection)
+}
+
+// webhookStore returns the store of the webhooks and their deliveries
+func webhookStore() store.WebhookStore {
+	return store.CreateWebhookStore(mongoClient, webhookCollection, webhookDeliveryCollection)
 }
 
 // initLocationHistoryManagementClient initializes the location history management client
@@ -87,6 +260,116 @@ func initLocationHistoryManagementClient() {
 	log.Println("successfully initialized location history management client")
 }
 
+// initLocationHistoryForwarder initializes and starts the forwarder which streams location updates to the location history management service
+func initLocationHistoryForwarder() {
+	if locationHistoryForwarder != nil {
+		log.Println("location history forwarder already initialized")
+		return
+	}
+
+	open := func(ctx context.Context) (grpc.BidiStreamingClient[lhmp.LocationUpdate, lhmp.LocationAck], error) {
+		return locationHistoryManagementClient.StreamUserLocations(ctx)
+	}
+
+	locationHistoryForwarder = newLocationForwarder(open, forwarderQueueSize, forwarderBatchSize, forwarderBatchInterval, forwarderWindowSize, forwarderMaxAttempts)
+	locationHistoryForwarder.Start()
+	log.Println("successfully initialized location history forwarder")
+}
+
+// initLocationEventBroadcaster initializes the location event broadcaster and feeds the events it delivers to the live subscribers
+func initLocationEventBroadcaster() {
+	if locationEventBroadcaster != nil {
+		log.Println("location event broadcaster already initialized")
+		return
+	}
+
+	broadcaster, err := createLocationBroadcaster(os.Getenv("LOCATION_EVENT_BROADCASTER"))
+
+	if err != nil {
+		log.Fatalf("failed to create location event broadcaster: %v\n", err)
+	}
+
+	if err := broadcaster.Listen(locationEvents.Publish); err != nil {
+		log.Fatalf("failed to listen to location event broadcaster: %v\n", err)
+	}
+
+	locationEventBroadcaster = broadcaster
+	log.Println("successfully initialized location event broadcaster")
+}
+
+// initGeofenceEvaluator initializes and starts the evaluator which generates geofence events from the location updates
+func initGeofenceEvaluator() {
+	if geofenceEvaluator != nil {
+		log.Println("geofence evaluator already initialized")
+		return
+	}
+
+	geofenceEvaluator = newLocationEvaluator("geofences", evaluateGeofences, geofenceWorkers, geofenceQueueSize)
+	geofenceEvaluator.Start()
+	log.Println("successfully initialized geofence evaluator")
+}
+
+// initProximityEvaluator initializes and starts the evaluator which generates proximity alerts from the location updates
+// a rule depends on the updates of two users, so they are evaluated by a single worker to keep the transitions of every rule in order
+func initProximityEvaluator() {
+	if proximityEvaluator != nil {
+		log.Println("proximity evaluator already initialized")
+		return
+	}
+
+	proximityEvaluator = newLocationEvaluator("proximity rules", evaluateProximityRules, 1, proximityQueueSize)
+	proximityEvaluator.Start()
+	log.Println("successfully initialized proximity evaluator")
+}
+
+// initWebhookDispatcher initializes and starts the dispatcher which delivers location, geofence and proximity events to the webhooks
+func initWebhookDispatcher() {
+	if webhooks != nil {
+		log.Println("webhook dispatcher already initialized")
+		return
+	}
+
+	webhooks = newWebhookDispatcher(&http.Client{Timeout: webhookTimeout}, webhookWorkers, webhookQueueSize, webhookMaxAttempts, webhookMinBackoff, webhookMaxBackoff)
+	webhooks.Start()
+	log.Println("successfully initialized webhook dispatcher")
+}
+
+// initLocationEventSink initializes the event sink and starts publishing the location updates to it in the background
+// a single worker publishes the updates, so they reach the sink in the order they were accepted
+func initLocationEventSink() {
+	if locationEventSink != nil {
+		log.Println("location event sink already initialized")
+		return
+	}
+
+	sink, err := createEventSink(os.Getenv("LOCATION_EVENT_SINK_URI"))
+
+	if err != nil {
+		log.Fatalf("failed to create location event sink: %v\n", err)
+	}
+
+	publish := func(event locationEvent) error {
+		return sink.Publish(newSinkEvent(event))
+	}
+
+	locationEventSinkPublisher = newLocationEvaluator("event sink", publish, 1, sinkQueueSize)
+	locationEventSinkPublisher.Start()
+	locationEventSink = sink
+	log.Println("successfully initialized location event sink")
+}
+
+// initReverseGeocoder loads the places used to resolve coordinates to place names from the configured geonames files
+// until they are loaded, or without a places file, locations are returned without a place
+func initReverseGeocoder() {
+	if reverseGeocoder != nil {
+		log.Println("reverse geocoder already initialized")
+		return
+	}
+
+	reverseGeocoder = geo.MustLoadReverseGeocoder()
+	log.Println("successfully initialized reverse geocoder")
+}
+
 // initHttpServer initializes the HTTP server and sets up the routes
 func initHttpServer() {
 	if httpServer != nil {
@@ -99,12 +382,38 @@ func initHttpServer() {
 	mux.Handle("GET /metrics", promhttp.Handler())
 	mux.HandleFunc("POST /user/location", updateUserLocationHandler)
 	mux.HandleFunc("POST /user/search", searchUserLocationHandler)
+	mux.HandleFunc("GET /user/live", liveLocationHandler)
+	mux.HandleFunc("GET /user/stream", streamUserLocationHandler)
+	mux.HandleFunc("POST /geofence", createGeofenceHandler)
+	mux.HandleFunc("GET /geofence", listGeofencesHandler)
+	mux.HandleFunc("GET /geofence/events", listGeofenceEventsHandler)
+	mux.HandleFunc("GET /geofence/{id}", getGeofenceHandler)
+	mux.HandleFunc("PUT /geofence/{id}", updateGeofenceHandler)
+	mux.HandleFunc("DELETE /geofence/{id}", deleteGeofenceHandler)
+	mux.HandleFunc("POST /proximity", createProximityRuleHandler)
+	mux.HandleFunc("GET /proximity", listProximityRulesHandler)
+	mux.HandleFunc("GET /proximity/alerts", listProximityAlertsHandler)
+	mux.HandleFunc("GET /proximity/{id}", getProximityRuleHandler)
+	mux.HandleFunc("PUT /proximity/{id}", updateProximityRuleHandler)
+	mux.HandleFunc("DELETE /proximity/{id}", deleteProximityRuleHandler)
+	mux.HandleFunc("GET /map/density", locationDensityHandler)
+	mux.HandleFunc("GET /map/clusters", clusterLocationsHandler)
+	mux.HandleFunc("GET /tiles/{z}/{x}/{tile}", tileHandler)
+	mux.HandleFunc("POST /webhook", createWebhookHandler)
+	mux.HandleFunc("GET /webhook", listWebhooksHandler)
+	mux.HandleFunc("GET /webhook/{id}", getWebhookHandler)
+	mux.HandleFunc("PUT /webhook/{id}", updateWebhookHandler)
+	mux.HandleFunc("DELETE /webhook/{id}", deleteWebhookHandler)
+	mux.HandleFunc("GET /webhook/{id}/deliveries", listWebhookDeliveriesHandler)
+	mux.HandleFunc("POST /webhook/{id}/deliveries/{deliveryId}/redeliver", redeliverWebhookDeliveryHandler)
 
 	httpServer = &http.Server{
 		Addr:    ":8080",
-		Handler: mux,
+		Handler: problem.WithRequestID(mux),
 	}
 
+	httpServer.RegisterOnShutdown(locationEvents.Close)
+
 	log.Println("started http server at http://localhost:8080")
 
 	if err := httpServer.ListenAndServe(); err != nil {
@@ -112,6 +421,29 @@ func initHttpServer() {
 	}
 }
 
+// initGrpcServer initializes the grpc server and registers the service
+func initGrpcServer() {
+	if grpcServer != nil {
+		log.Println("grpc server already initialized")
+		return
+	}
+
+	log.Println("initializing grpc server...")
+	listener, err := net.Listen("tcp", ":50052")
+
+	if err != nil {
+		log.Fatalf("failed to create tcp listener on port 50052: %v\n", err)
+	}
+
+	grpcServer = grpc.NewServer()
+	pb.RegisterLocationManagementServer(grpcServer, &protoServer{})
+	log.Println("started grpc server at http://localhost:50052")
+
+	if err = grpcServer.Serve(listener); err != nil {
+		log.Fatalf("grpc server failed to start: %v\n", err)
+	}
+}
+
 // disconnectMongoClient disconnects the mongo client from the database
 func disconnectMongoClient(wg *sync.WaitGroup) {
 	defer wg.Done()
@@ -123,7 +455,7 @@ func disconnectMongoClient(wg *sync.WaitGroup) {
 
 	log.Println("disconnecting mongo client...")
 
-	if err := mongoClient.Disconnect(); err != nil {
+	if err := mongoClient.Disconnect(context.Background()); err != nil {
 		log.Printf("error disconnecting mongo client: %v\n", err)
 
 	} else {
@@ -150,6 +482,117 @@ func disconnectLocationHistoryManagementClient(wg *sync.WaitGroup) {
 	}
 }
 
+// closeLocationHistoryForwarder closes the location history forwarder
+// if the queued location updates are not delivered in 10 seconds, they are dropped
+func closeLocationHistoryForwarder(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if locationHistoryForwarder == nil {
+		log.Println("location history forwarder is nil, skipping close")
+		return
+	}
+
+	log.Println("closing location history forwarder...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := locationHistoryForwarder.Close(ctx); err != nil {
+		log.Printf("error closing location history forwarder: %v\n", err)
+
+	} else {
+		log.Println("successfully closed location history forwarder")
+	}
+}
+
+// closeLocationEventBroadcaster closes the location event broadcaster
+func closeLocationEventBroadcaster(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if locationEventBroadcaster == nil {
+		log.Println("location event broadcaster is nil, skipping close")
+		return
+	}
+
+	log.Println("closing location event broadcaster...")
+
+	if err := locationEventBroadcaster.Close(); err != nil {
+		log.Printf("error closing location event broadcaster: %v\n", err)
+
+	} else {
+		log.Println("successfully closed location event broadcaster")
+	}
+}
+
+// closeGeofenceEvaluator closes the geofence evaluator after the queued location updates are evaluated
+func closeGeofenceEvaluator(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if geofenceEvaluator == nil {
+		log.Println("geofence evaluator is nil, skipping close")
+		return
+	}
+
+	log.Println("closing geofence evaluator...")
+	geofenceEvaluator.Close()
+	log.Println("successfully closed geofence evaluator")
+}
+
+// closeProximityEvaluator closes the proximity evaluator after the queued location updates are evaluated
+func closeProximityEvaluator(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if proximityEvaluator == nil {
+		log.Println("proximity evaluator is nil, skipping close")
+		return
+	}
+
+	log.Println("closing proximity evaluator...")
+	proximityEvaluator.Close()
+	log.Println("successfully closed proximity evaluator")
+}
+
+// closeWebhookDispatcher closes the webhook dispatcher
+// if the queued events are not dispatched in 10 seconds, they are dropped
+func closeWebhookDispatcher(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if webhooks == nil {
+		log.Println("webhook dispatcher is nil, skipping close")
+		return
+	}
+
+	log.Println("closing webhook dispatcher...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := webhooks.Close(ctx); err != nil {
+		log.Printf("error closing webhook dispatcher: %v\n", err)
+
+	} else {
+		log.Println("successfully closed webhook dispatcher")
+	}
+}
+
+// closeLocationEventSink publishes the queued location updates and closes the event sink
+func closeLocationEventSink(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if locationEventSink == nil {
+		log.Println("location event sink is nil, skipping close")
+		return
+	}
+
+	log.Println("closing location event sink...")
+	locationEventSinkPublisher.Close()
+
+	if err := locationEventSink.Close(); err != nil {
+		log.Printf("error closing location event sink: %v\n", err)
+
+	} else {
+		log.Println("successfully closed location event sink")
+	}
+}
+
 // shutdownHttpServer shuts down the HTTP server gracefully
 // if it does not shutdown in 10 seconds, it will force shutdown
 func shutdownHttpServer(wg *sync.WaitGroup) {
@@ -171,3 +614,26 @@ func shutdownHttpServer(wg *sync.WaitGroup) {
 		log.Println("successfully shut down http server")
 	}
 }
+
+// shutdownGrpcServer shuts down the grpc server gracefully
+// if it does not shutdown in 10 seconds, it will force shutdown
+func shutdownGrpcServer(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if grpcServer == nil {
+		log.Println("grpc server is nil, skipping shutdown")
+		return
+	}
+
+	log.Println("shutting down grpc server...")
+
+	timer := time.AfterFunc(10*time.Second, func() {
+		log.Println("grpc server did not shutdown gracefully in time, forcing shutdown...")
+		grpcServer.Stop()
+	})
+
+	defer timer.Stop()
+
+	grpcServer.GracefulStop()
+	log.Println("successfully shut down grpc server")
+}
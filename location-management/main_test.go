@@ -1,19 +1,41 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/mmilosevicgd/location-tracking/geo"
 	lhmp "github.com/mmilosevicgd/location-tracking/location-history-management/proto"
+	pb "github.com/mmilosevicgd/location-tracking/location-management/proto"
 	"github.com/mmilosevicgd/location-tracking/model"
+	"github.com/mmilosevicgd/location-tracking/problem"
+	"github.com/mmilosevicgd/location-tracking/store"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	dto "github.com/prometheus/client_model/go"
 	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 const (
@@ -179,6 +201,402 @@ func TestSearchUserLocation(t *testing.T) {
 	}
 }
 
+func TestGrpcUserLocation(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+	client := pb.MustCreateClient("localhost:50052", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	_, err := client.UpdateUserLocation(context.Background(), &pb.UpdateLocationRequest{Username: "user13", Coordinates: deCoordinates})
+
+	if err != nil {
+		t.Fatalf("error updating location: %v", err)
+	}
+
+	if err := validateLocation("user13", deCoordinates); err != nil {
+		t.Fatalf("error validating location: %v", err)
+	}
+
+	_, err = client.UpdateUserLocation(context.Background(), &pb.UpdateLocationRequest{Username: "user13", Coordinates: "91.0,20.0"})
+
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid argument error, got %v", err)
+	}
+
+	response, err := client.BatchUpdateUserLocation(context.Background(), &pb.BatchUpdateLocationRequest{
+		Locations: []*pb.UpdateLocationRequest{
+			{Username: "user14", Coordinates: jaCoordinates},
+			{Username: "u", Coordinates: jaCoordinates},
+			{Username: "user15", Coordinates: kgCoordinates},
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("error batch updating locations: %v", err)
+	}
+
+	if len(response.Results) != 3 || response.Results[0].Error != "" || response.Results[1].Error == "" || response.Results[2].Error != "" {
+		t.Errorf("unexpected batch update results %v", response.Results)
+	}
+
+	if err := validateLocation("user15", kgCoordinates); err != nil {
+		t.Fatalf("error validating location: %v", err)
+	}
+
+	_, err = client.GetUserLocation(context.Background(), &pb.UserLocationRequest{Username: "user16"})
+
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	cursor := mongoClient.(db.MockDBClient).GetResponse(locationCollection, bson.M{"username": "user14"}, nil, nil, 0, 0)
+	locations := []any{}
+
+	if err := cursor.All(context.Background(), &locations); err != nil {
+		t.Fatalf("error getting all documents: %v", err)
+	}
+
+	mongoClient.(db.MockDBClient).SetResponse(locationCollection, bson.M{"username": "user14"}, nil, nil, 1, 1, locations)
+	location, err := client.GetUserLocation(context.Background(), &pb.UserLocationRequest{Username: "user14"})
+
+	if err != nil {
+		t.Fatalf("error getting user location: %v", err)
+	}
+
+	extractedCoordinates, err := extractCoordinates(jaCoordinates)
+
+	if err != nil {
+		t.Fatalf("error extracting coordinates: %v", err)
+	}
+
+	if location.Username != "user14" || location.Location.Coordinates[0] != extractedCoordinates[0] || location.Location.Coordinates[1] != extractedCoordinates[1] {
+		t.Errorf("unexpected user location %v", location)
+	}
+
+	_, err = client.SearchUserLocation(context.Background(), &pb.SearchRequest{Coordinates: deCoordinates, Distance: 10})
+
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid argument error, got %v", err)
+	}
+}
+
+func TestLiveLocation(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	subscriber, _, err := websocket.DefaultDialer.Dial("ws://localhost:8080/user/live", nil)
+
+	if err != nil {
+		t.Fatalf("error connecting subscriber: %v", err)
+	}
+
+	defer subscriber.Close()
+	publisher, _, err := websocket.DefaultDialer.Dial("ws://localhost:8080/user/live", nil)
+
+	if err != nil {
+		t.Fatalf("error connecting publisher: %v", err)
+	}
+
+	defer publisher.Close()
+
+	exchange := func(conn *websocket.Conn, message map[string]any, expectedType string) {
+		if err := conn.WriteJSON(message); err != nil {
+			t.Fatalf("error writing frame %v: %v", message, err)
+		}
+
+		expectFrame(t, conn, expectedType, "")
+	}
+
+	exchange(subscriber, map[string]any{"type": "subscribe", "id": "1", "coordinates": deCoordinates, "distance": 10000}, "subscribed")
+	exchange(subscriber, map[string]any{"type": "subscribe", "id": "2", "coordinates": deCoordinates}, "error")
+	exchange(publisher, map[string]any{"type": "location", "id": "3", "username": "user17", "coordinates": deCoordinates}, "ack")
+	expectFrame(t, subscriber, "enter", "user17")
+	exchange(publisher, map[string]any{"type": "location", "id": "4", "username": "user17", "coordinates": "44.09, 21.42"}, "ack")
+	expectFrame(t, subscriber, "move", "user17")
+	exchange(publisher, map[string]any{"type": "location", "id": "5", "username": "user17", "coordinates": bgCoordinates}, "ack")
+	expectFrame(t, subscriber, "leave", "user17")
+	exchange(publisher, map[string]any{"type": "location", "id": "6", "username": "u", "coordinates": deCoordinates}, "error")
+	exchange(subscriber, map[string]any{"type": "subscribe", "id": "7", "viewport": map[string]any{"southWest": "43.9, 21.2", "northEast": "44.0, 21.4"}}, "subscribed")
+	exchange(publisher, map[string]any{"type": "location", "id": "8", "username": "user18", "coordinates": cuCoordinates}, "ack")
+	expectFrame(t, subscriber, "enter", "user18")
+
+	for _, origin := range []string{"http://localhost:8080", "https://tracking.example.com"} {
+		t.Setenv("LIVE_ALLOWED_ORIGINS", "https://tracking.example.com")
+		conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:8080/user/live", http.Header{"Origin": []string{origin}})
+
+		if err != nil {
+			t.Fatalf("error connecting from origin '%s': %v", origin, err)
+		}
+
+		conn.Close()
+	}
+
+	_, response, err := websocket.DefaultDialer.Dial("ws://localhost:8080/user/live", http.Header{"Origin": []string{"https://attacker.example.com"}})
+
+	if err == nil || response == nil || response.StatusCode != http.StatusForbidden {
+		t.Errorf("expected connection from another site to be forbidden, got %v", err)
+	}
+}
+
+func expectFrame(t *testing.T, conn *websocket.Conn, expectedType, expectedUsername string) {
+	frame := struct {
+		Type     string `json:"type"`
+		Username string `json:"username"`
+		Message  string `json:"message"`
+	}{}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatalf("error reading frame: %v", err)
+	}
+
+	if frame.Type != expectedType || frame.Username != expectedUsername {
+		t.Fatalf("expected frame of type '%s' for username '%s', got %v", expectedType, expectedUsername, frame)
+	}
+}
+
+func TestStreamUserLocation(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	resp, err := http.Get("http://localhost:8080/user/stream?coordinates=44.0947626,21.4197348")
+
+	if err != nil {
+		t.Fatalf("error making get request: %v", err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status code 400, got %d", resp.StatusCode)
+	}
+
+	events := readStreamEvents(t, "http://localhost:8080/user/stream?coordinates=44.0947626,21.4197348&distance=10000", "", 2)
+
+	for _, location := range []struct {
+		username    string
+		coordinates string
+	}{
+		{username: "user19", coordinates: deCoordinates},
+		{username: "user20", coordinates: bgCoordinates},
+		{username: "user21", coordinates: deCoordinates},
+	} {
+		if err := updateLocation(location.username, location.coordinates); err != nil {
+			t.Fatalf("error updating location: %v", err)
+		}
+	}
+
+	received := []locationEvent{}
+
+	for range 2 {
+		select {
+		case event := <-events:
+			received = append(received, event)
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for stream events")
+		}
+	}
+
+	if received[0].Username != "user19" || received[1].Username != "user21" || received[1].ID <= received[0].ID {
+		t.Fatalf("unexpected stream events %v", received)
+	}
+
+	resumed := readStreamEvents(t, "http://localhost:8080/user/stream?southWest=44.0,21.3&northEast=44.2,21.5", strconv.FormatInt(received[0].ID, 10), 1)
+
+	select {
+	case event := <-resumed:
+		if event.Username != "user21" || event.ID != received[1].ID {
+			t.Errorf("expected resumed event for username 'user21' with id %d, got %v", received[1].ID, event)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for resumed stream events")
+	}
+}
+
+func readStreamEvents(t *testing.T, url, lastEventID string, count int) <-chan locationEvent {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("error making get request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+
+	events := make(chan locationEvent, count)
+
+	go func() {
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+
+		for scanner.Scan() && count > 0 {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+
+			if !ok {
+				continue
+			}
+
+			event := locationEvent{}
+
+			if err := json.Unmarshal([]byte(data), &event); err == nil {
+				events <- event
+				count--
+			}
+		}
+	}()
+
+	return events
+}
+
+type recordingLocationStream struct {
+	grpc.BidiStreamingClient[lhmp.LocationUpdate, lhmp.LocationAck]
+	sent chan *lhmp.LocationUpdate
+}
+
+func (s *recordingLocationStream) Send(update *lhmp.LocationUpdate) error {
+	s.sent <- update
+	return s.BidiStreamingClient.Send(update)
+}
+
+func TestLocationForwarder(t *testing.T) {
+	client := lhmp.CreateMockGRPCClient()
+	sent := make(chan *lhmp.LocationUpdate, 10)
+	attempts := 0
+
+	open := func(ctx context.Context) (grpc.BidiStreamingClient[lhmp.LocationUpdate, lhmp.LocationAck], error) {
+		attempts++
+
+		if attempts == 1 {
+			return nil, fmt.Errorf("location history management service unavailable")
+		}
+
+		stream, err := client.StreamUserLocations(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &recordingLocationStream{BidiStreamingClient: stream, sent: sent}, nil
+	}
+
+	forwarder := newLocationForwarder(open, 10, 2, time.Millisecond, 3, 3)
+	forwarder.Start()
+
+	for i := range 5 {
+		if err := forwarder.Forward(&lhmp.LocationInfo{Username: "user1", Timestamp: int64(i)}); err != nil {
+			t.Fatalf("error forwarding location update: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := forwarder.Close(ctx); err != nil {
+		t.Fatalf("error closing forwarder: %v", err)
+	}
+
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts to open the stream, got %d", attempts)
+	}
+
+	if len(sent) != 5 {
+		t.Fatalf("expected 5 location updates to be sent, got %d", len(sent))
+	}
+
+	for i := range 5 {
+		update := <-sent
+
+		if update.Location.Timestamp != int64(i) {
+			t.Errorf("expected location update with timestamp %d, got %d", i, update.Location.Timestamp)
+		}
+	}
+
+	rejected := newLocationForwarder(open, 10, 2, time.Millisecond, 3, 3)
+	rejected.retries = []*forwardedLocation{{location: &lhmp.LocationInfo{Timestamp: 3}, order: 3}}
+
+	for sequence := range int64(2) {
+		rejected.pending[sequence+1] = &forwardedLocation{location: &lhmp.LocationInfo{Timestamp: sequence + 1}, order: sequence + 1}
+	}
+
+	rejected.acknowledge(&lhmp.LocationAck{Sequence: 2, Error: "rejected"})
+	rejected.requeuePending()
+	timestamps := []int64{}
+
+	for _, retry := range rejected.retries {
+		timestamps = append(timestamps, retry.location.Timestamp)
+	}
+
+	if !slices.Equal(timestamps, []int64{1, 2, 3}) {
+		t.Errorf("expected the rejected and unacknowledged location updates to be retried ahead of the newer ones, got %v", timestamps)
+	}
+
+	dropped := forwarderDroppedCount(t, "attempts")
+	rejected.retries[1].attempts = 2
+	rejected.pending[3] = rejected.retries[1]
+	rejected.acknowledge(&lhmp.LocationAck{Sequence: 3, Error: "rejected"})
+
+	if count := forwarderDroppedCount(t, "attempts"); count != dropped+1 {
+		t.Errorf("expected the location update out of attempts to be counted as dropped, got %f dropped after %f", count, dropped)
+	}
+
+	full := newLocationForwarder(open, 1, 1, time.Millisecond, 1, 1)
+
+	if err := full.Forward(&lhmp.LocationInfo{Username: "user1"}); err != nil {
+		t.Fatalf("error forwarding location update: %v", err)
+	}
+
+	if err := full.Forward(&lhmp.LocationInfo{Username: "user1"}); err != errForwarderQueueFull {
+		t.Errorf("expected queue full error, got %v", err)
+	}
+
+	closed := newLocationForwarder(open, 1, 1, time.Millisecond, 1, 1)
+	closed.Start()
+
+	if err := closed.Close(ctx); err != nil {
+		t.Fatalf("error closing forwarder: %v", err)
+	}
+
+	dropped = forwarderDroppedCount(t, "closed")
+
+	if err := closed.Forward(&lhmp.LocationInfo{Username: "user1"}); err != errForwarderClosed {
+		t.Errorf("expected forwarder closed error, got %v", err)
+	}
+
+	if count := forwarderDroppedCount(t, "closed"); count != dropped+1 {
+		t.Errorf("expected the location update forwarded after closing to be counted as dropped, got %f dropped after %f", count, dropped)
+	}
+}
+
+func forwarderDroppedCount(t *testing.T, reason string) float64 {
+	metric := &dto.Metric{}
+
+	if err := forwarderDropped.WithLabelValues(reason).Write(metric); err != nil {
+		t.Fatalf("error reading dropped location updates metric: %v", err)
+	}
+
+	return metric.GetCounter().GetValue()
+}
+
 func updateLocation(username, coordinates string) error {
 	payload, err := json.Marshal(struct {
 		Username    string `json:"username"`
@@ -303,3 +721,1249 @@ func validateLocation(username, coordinates string) error {
 
 	return nil
 }
+
+func TestGeofence(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	body := `{"name":"belgrade","type":"circle","coordinates":"` + bgCoordinates + `","radius":1000,"dwellTime":60}`
+	response, err := http.Post("http://localhost:8080/geofence", "application/json", strings.NewReader(body))
+
+	if err != nil {
+		t.Fatalf("error creating geofence: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status code %d, got %d", http.StatusCreated, response.StatusCode)
+	}
+
+	fence := store.Geofence{}
+
+	if err := json.NewDecoder(response.Body).Decode(&fence); err != nil {
+		t.Fatalf("error decoding geofence: %v", err)
+	}
+
+	if fence.ID == "" || len(fence.Geometry.Coordinates[0]) != geofenceCircleSegments+1 {
+		t.Errorf("unexpected geofence %v", fence)
+	}
+
+	body = `{"name":"invalid","type":"polygon","polygon":["` + bgCoordinates + `","` + kgCoordinates + `"]}`
+	response, err = http.Post("http://localhost:8080/geofence", "application/json", strings.NewReader(body))
+
+	if err != nil {
+		t.Fatalf("error creating geofence: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, response.StatusCode)
+	}
+
+	mongoClient.(db.MockDBClient).SetResponse(geofenceCollection, bson.M{"_id": fence.ID}, nil, nil, 1, 1, []any{fence})
+	response, err = http.Get("http://localhost:8080/geofence/" + fence.ID)
+
+	if err != nil {
+		t.Fatalf("error getting geofence: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, response.StatusCode)
+	}
+
+	request, err := http.NewRequest(http.MethodPut, "http://localhost:8080/geofence/000000000000000000000000", strings.NewReader(`{"name":"missing","type":"circle","coordinates":"`+bgCoordinates+`","radius":1000}`))
+
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+
+	response, err = http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatalf("error updating geofence: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status code %d, got %d", http.StatusNotFound, response.StatusCode)
+	}
+
+	center, err := extractCoordinates(bgCoordinates)
+
+	if err != nil {
+		t.Fatalf("error extracting coordinates: %v", err)
+	}
+
+	outside, err := extractCoordinates(kgCoordinates)
+
+	if err != nil {
+		t.Fatalf("error extracting coordinates: %v", err)
+	}
+
+	event := locationEvent{
+		Username:  "user17",
+		Location:  model.Location{Type: "Point", Coordinates: center},
+		Timestamp: 1000,
+	}
+
+	intersects := bson.M{"geometry": bson.M{"$geoIntersects": bson.M{"$geometry": event.Location}}}
+	mongoClient.(db.MockDBClient).SetResponse(geofenceCollection, intersects, nil, nil, 1, maxGeofencesPerLocation, []any{fence})
+
+	if err := evaluateGeofences(event); err != nil {
+		t.Fatalf("error evaluating geofences: %v", err)
+	}
+
+	expectGeofenceEvent(t, "user17:"+fence.ID+":1000:enter")
+	state := store.GeofenceState{ID: "user17:" + fence.ID, Username: "user17", FenceID: fence.ID, FenceName: fence.Name, EnteredAt: 1000}
+	mongoClient.(db.MockDBClient).SetResponse(geofenceStateCollection, bson.M{"username": "user17"}, nil, nil, 1, maxGeofencesPerLocation, []any{state})
+	event.Timestamp = 61000
+
+	if err := evaluateGeofences(event); err != nil {
+		t.Fatalf("error evaluating geofences: %v", err)
+	}
+
+	expectGeofenceEvent(t, "user17:"+fence.ID+":61000:dwell")
+	event.Location.Coordinates = outside
+	event.Timestamp = 62000
+
+	if err := evaluateGeofences(event); err != nil {
+		t.Fatalf("error evaluating geofences: %v", err)
+	}
+
+	expectGeofenceEvent(t, "user17:"+fence.ID+":62000:exit")
+
+	for _, expected := range []int{http.StatusNoContent, http.StatusNotFound} {
+		request, err := http.NewRequest(http.MethodDelete, "http://localhost:8080/geofence/"+fence.ID, nil)
+
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+
+		if err != nil {
+			t.Fatalf("error deleting geofence: %v", err)
+		}
+
+		defer response.Body.Close()
+
+		if response.StatusCode != expected {
+			t.Errorf("expected status code %d, got %d", expected, response.StatusCode)
+		}
+	}
+}
+
+// expectGeofenceEvent checks that the geofence event with the given id was stored
+func expectGeofenceEvent(t *testing.T, id string) {
+	cursor := mongoClient.(db.MockDBClient).GetResponse(geofenceEventCollection, bson.M{"_id": id}, nil, nil, 0, 0)
+	events := []store.GeofenceEvent{}
+
+	if err := cursor.All(context.Background(), &events); err != nil {
+		t.Fatalf("error getting all documents: %v", err)
+	}
+
+	if len(events) != 1 {
+		t.Errorf("expected geofence event '%s' to be stored", id)
+	}
+}
+
+func TestProximityRule(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	response, err := http.Post("http://localhost:8080/proximity", "application/json", strings.NewReader(`{"username":"user18","otherUsername":"user18","type":"near","distance":1000}`))
+
+	if err != nil {
+		t.Fatalf("error creating proximity rule: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, response.StatusCode)
+	}
+
+	response, err = http.Post("http://localhost:8080/proximity", "application/json", strings.NewReader(`{"username":"user18","otherUsername":"user19","type":"near","distance":1000}`))
+
+	if err != nil {
+		t.Fatalf("error creating proximity rule: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status code %d, got %d", http.StatusCreated, response.StatusCode)
+	}
+
+	rule := store.ProximityRule{}
+
+	if err := json.NewDecoder(response.Body).Decode(&rule); err != nil {
+		t.Fatalf("error decoding proximity rule: %v", err)
+	}
+
+	response, err = http.Get("http://localhost:8080/proximity/alerts?pageNumber=1&pageSize=5")
+
+	if err != nil {
+		t.Fatalf("error listing proximity alerts: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, response.StatusCode)
+	}
+
+	near, err := extractCoordinates(bgCoordinates)
+
+	if err != nil {
+		t.Fatalf("error extracting coordinates: %v", err)
+	}
+
+	far, err := extractCoordinates(kgCoordinates)
+
+	if err != nil {
+		t.Fatalf("error extracting coordinates: %v", err)
+	}
+
+	other := model.LocationInfo{Username: "user19", Location: model.Location{Type: "Point", Coordinates: near}, Timestamp: 500}
+	mongoClient.(db.MockDBClient).SetResponse(locationCollection, bson.M{"username": "user19"}, nil, nil, 1, 1, []any{other})
+	mongoClient.(db.MockDBClient).SetResponse(proximityRuleCollection, bson.M{"$or": []bson.M{{"username": "user18"}, {"otherUsername": "user18"}}}, nil, nil, 1, maxProximityRulesPerUser, []any{rule})
+	event := locationEvent{Username: "user18", Location: model.Location{Type: "Point", Coordinates: near}, Timestamp: 1000}
+
+	for _, timestamp := range []int64{1000, 2000} {
+		event.Timestamp = timestamp
+
+		if err := evaluateProximityRules(event); err != nil {
+			t.Fatalf("error evaluating proximity rules: %v", err)
+		}
+
+		mongoClient.(db.MockDBClient).SetResponse(proximityStateCollection, bson.M{"_id": rule.ID}, nil, nil, 1, 1, []any{store.ProximityState{ID: rule.ID, Triggered: true}})
+	}
+
+	expectProximityAlerts(t, rule.ID+":user18:1000", 1)
+	expectProximityAlerts(t, rule.ID+":user18:2000", 0)
+	event.Location.Coordinates = far
+	event.Timestamp = 3000
+
+	if err := evaluateProximityRules(event); err != nil {
+		t.Fatalf("error evaluating proximity rules: %v", err)
+	}
+
+	expectProximityAlerts(t, rule.ID+":user18:3000", 0)
+	cursor := mongoClient.(db.MockDBClient).GetResponse(proximityStateCollection, bson.M{"_id": rule.ID}, nil, nil, 0, 0)
+	states := []store.ProximityState{}
+
+	if err := cursor.All(context.Background(), &states); err != nil {
+		t.Fatalf("error getting all documents: %v", err)
+	}
+
+	if len(states) != 1 || states[0].Triggered {
+		t.Errorf("expected proximity rule to be rearmed, got %v", states)
+	}
+}
+
+// expectProximityAlerts checks that the expected number of proximity alerts with the given id was stored
+func expectProximityAlerts(t *testing.T, id string, expected int) {
+	cursor := mongoClient.(db.MockDBClient).GetResponse(proximityAlertCollection, bson.M{"_id": id}, nil, nil, 0, 0)
+	alerts := []store.ProximityAlert{}
+
+	if err := cursor.All(context.Background(), &alerts); err != nil {
+		t.Fatalf("error getting all documents: %v", err)
+	}
+
+	if len(alerts) != expected {
+		t.Errorf("expected %d proximity alerts with id '%s', got %d", expected, id, len(alerts))
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	response, err := http.Post("http://localhost:8080/webhook", "application/json", strings.NewReader(`{"url":"ftp://example.com","events":["location"],"secret":"0123456789abcdef"}`))
+
+	if err != nil {
+		t.Fatalf("error creating webhook: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, response.StatusCode)
+	}
+
+	response, err = http.Post("http://localhost:8080/webhook", "application/json", strings.NewReader(`{"url":"http://example.com","events":["location"],"secret":"0123456789abcdef"}`))
+
+	if err != nil {
+		t.Fatalf("error creating webhook: %v", err)
+	}
+
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+
+	if err != nil {
+		t.Fatalf("error reading response body: %v", err)
+	}
+
+	if response.StatusCode != http.StatusCreated || strings.Contains(string(body), "0123456789abcdef") {
+		t.Errorf("expected webhook to be created without exposing its secret, got %d %s", response.StatusCode, body)
+	}
+
+	secret := "0123456789abcdef"
+	delivered := make(chan string, 10)
+	attempts := 0
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := io.ReadAll(r.Body)
+
+		if err != nil || r.Header.Get("X-Webhook-Signature") != "sha256="+signWebhookPayload(secret, payload) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		attempts++
+
+		if r.Header.Get("X-Webhook-Event") == "geofence" || attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			delivered <- r.Header.Get("X-Webhook-Delivery")
+			return
+		}
+
+		delivered <- r.Header.Get("X-Webhook-Delivery")
+	}))
+
+	defer receiver.Close()
+
+	hook := store.Webhook{ID: "000000000000000000000001", URL: receiver.URL, Events: []string{"location", "geofence"}, Secret: secret}
+	mongoClient.(db.MockDBClient).SetResponse(webhookCollection, bson.M{"events": "location"}, nil, nil, 1, maxWebhooksPerEvent, []any{hook})
+	mongoClient.(db.MockDBClient).SetResponse(webhookCollection, bson.M{"events": "geofence"}, nil, nil, 1, maxWebhooksPerEvent, []any{hook})
+	dispatcher := newWebhookDispatcher(receiver.Client(), 1, 10, 3, 10*time.Millisecond, 50*time.Millisecond)
+	dispatcher.Start()
+	defer dispatcher.Close(context.Background())
+
+	if !dispatcher.Publish("location", locationEvent{Username: "user20", Timestamp: 1000}) {
+		t.Fatal("expected location event to be queued")
+	}
+
+	expectWebhookDelivery(t, delivered, "delivered", 2, 2)
+
+	if !dispatcher.Publish("geofence", store.GeofenceEvent{ID: "event", Username: "user20", Timestamp: 2000}) {
+		t.Fatal("expected geofence event to be queued")
+	}
+
+	dead := expectWebhookDelivery(t, delivered, "dead", 3, 3)
+
+	if !dispatcher.Redeliver(hook, dead) {
+		t.Fatal("expected dead delivery to be queued again")
+	}
+
+	expectWebhookDelivery(t, delivered, "dead", 3, 6)
+	closing := newWebhookDispatcher(receiver.Client(), 1, 10, 3, time.Hour, time.Hour)
+	closing.Start()
+
+	if !closing.Publish("geofence", store.GeofenceEvent{ID: "event", Username: "user20", Timestamp: 3000}) {
+		t.Fatal("expected geofence event to be queued")
+	}
+
+	pending := expectWebhookDelivery(t, delivered, "pending", 1, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := closing.Close(ctx); err != nil {
+		t.Fatalf("error closing webhook dispatcher with a retry waiting for its backoff: %v", err)
+	}
+
+	if pending.NextAttemptAt <= time.Now().UnixMilli() {
+		t.Errorf("expected the pending delivery to keep its next attempt, got %d", pending.NextAttemptAt)
+	}
+
+	pending.NextAttemptAt = time.Now().UnixMilli()
+	mongoClient.(db.MockDBClient).SetResponse(webhookDeliveryCollection, bson.M{"status": "pending", "_id": bson.M{"$gt": ""}}, nil, bson.M{"_id": 1}, 1, webhookResumePageSize, []any{pending})
+	mongoClient.(db.MockDBClient).SetResponse(webhookCollection, bson.M{"_id": hook.ID}, nil, nil, 1, 1, []any{hook})
+	resumed := newWebhookDispatcher(receiver.Client(), 1, 10, 3, 10*time.Millisecond, 50*time.Millisecond)
+	resumed.Start()
+	defer resumed.Close(context.Background())
+	expectWebhookDelivery(t, delivered, "dead", 2, 3)
+}
+
+// expectWebhookDelivery waits for the given number of sent attempts of a delivery, checks its stored status and total number of attempts and returns it
+func expectWebhookDelivery(t *testing.T, delivered <-chan string, status string, sent, attempts int) store.WebhookDelivery {
+	id := ""
+
+	for range sent {
+		select {
+		case id = <-delivered:
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for webhook delivery")
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		cursor := mongoClient.(db.MockDBClient).GetResponse(webhookDeliveryCollection, bson.M{"_id": id}, nil, nil, 0, 0)
+		deliveries := []store.WebhookDelivery{}
+
+		if err := cursor.All(context.Background(), &deliveries); err != nil {
+			t.Fatalf("error getting all documents: %v", err)
+		}
+
+		if len(deliveries) == 1 && deliveries[0].Status == status && len(deliveries[0].Attempts) == attempts {
+			return deliveries[0]
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("expected delivery '%s' to be %s after %d attempts", id, status, attempts)
+	return store.WebhookDelivery{}
+}
+
+func TestEventSink(t *testing.T) {
+	event := locationEvent{
+		Username:  "user21",
+		Location:  model.Location{Type: "Point", Coordinates: []float64{20.2576593, 44.8154844}},
+		Timestamp: 1000,
+	}
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	received := make(chan []byte, 10)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := io.ReadAll(r.Body)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received <- payload
+	}))
+
+	defer receiver.Close()
+
+	natsServer, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1})
+
+	if err != nil {
+		t.Fatalf("error creating nats server: %v", err)
+	}
+
+	go natsServer.Start()
+	defer natsServer.Shutdown()
+
+	if !natsServer.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server is not ready for connections")
+	}
+
+	conn, err := nats.Connect(natsServer.ClientURL())
+
+	if err != nil {
+		t.Fatalf("error connecting to nats server: %v", err)
+	}
+
+	defer conn.Close()
+	messages := make(chan *nats.Msg, 10)
+
+	if _, err := conn.ChanSubscribe("locations", messages); err != nil {
+		t.Fatalf("error subscribing to nats subject: %v", err)
+	}
+
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("error flushing nats subscription: %v", err)
+	}
+
+	for _, uri := range []string{"file://" + path, receiver.URL, natsServer.ClientURL() + "?subject=locations"} {
+		sink, err := createEventSink(uri)
+
+		if err != nil {
+			t.Fatalf("error creating event sink for uri '%s': %v", uri, err)
+		}
+
+		if err := sink.Publish(newSinkEvent(event)); err != nil {
+			t.Errorf("error publishing to event sink for uri '%s': %v", uri, err)
+		}
+
+		if err := sink.Close(); err != nil {
+			t.Errorf("error closing event sink for uri '%s': %v", uri, err)
+		}
+	}
+
+	file, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatalf("error reading event sink file: %v", err)
+	}
+
+	payloads := [][]byte{bytes.TrimSuffix(file, []byte("\n"))}
+
+	select {
+	case payload := <-received:
+		payloads = append(payloads, payload)
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for http event sink")
+	}
+
+	select {
+	case message := <-messages:
+		payloads = append(payloads, message.Data)
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for nats event sink")
+	}
+
+	for _, payload := range payloads {
+		published := sinkEvent{}
+
+		if err := json.Unmarshal(payload, &published); err != nil {
+			t.Fatalf("error decoding sink event '%s': %v", payload, err)
+		}
+
+		if published.SchemaVersion != sinkEventSchemaVersion || published.ID != "user21:1000" || published.Username != event.Username {
+			t.Errorf("unexpected sink event %v", published)
+		}
+	}
+
+	if _, err := createEventSink("kafka://localhost:9092"); err == nil {
+		t.Error("expected error creating event sink with unknown scheme")
+	}
+}
+
+func TestLocationDensity(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	if !errors.Is(statusError(status.Error(codes.DeadlineExceeded, "deadline exceeded")), context.DeadlineExceeded) || !errors.Is(statusError(status.Error(codes.Canceled, "canceled")), context.Canceled) {
+		t.Errorf("expected grpc deadline and cancellation statuses to be reported as context errors")
+	}
+
+	box := geo.BoundingBox{SouthWest: []float64{20, 43}, NorthEast: []float64{22, 45}}
+	locations := []any{}
+
+	for username, coordinates := range map[string]string{"user22": cuCoordinates, "user23": jaCoordinates, "user24": bgCoordinates} {
+		extractedCoordinates, err := extractCoordinates(coordinates)
+
+		if err != nil {
+			t.Fatalf("error extracting coordinates: %v", err)
+		}
+
+		locations = append(locations, model.LocationInfo{Username: username, Location: model.Location{Type: "Point", Coordinates: extractedCoordinates}, Timestamp: 1000})
+	}
+
+	mongoClient.(db.MockDBClient).SetResponse(locationCollection, bson.M{"location": db.GeoWithinPolygon(box.Polygon())}, nil, nil, 1, maxMapLocations, locations)
+	response, err := http.Get("http://localhost:8080/map/density?southWest=43,20&northEast=45,22&zoom=5&minCount=2&historyStart=0&historyEnd=5000")
+
+	if err != nil {
+		t.Fatalf("error getting location density: %v", err)
+	}
+
+	defer response.Body.Close()
+	collection := featureCollection{}
+
+	if err := json.NewDecoder(response.Body).Decode(&collection); err != nil {
+		t.Fatalf("error decoding location density: %v", err)
+	}
+
+	if len(collection.Features) != 1 || collection.Features[0].Properties["count"] != float64(2) || collection.Features[0].Properties["geohash"] != "srz" {
+		t.Errorf("unexpected location density %v", collection)
+	}
+
+	cuCoordinatesExtracted, err := extractCoordinates(cuCoordinates)
+
+	if err != nil {
+		t.Fatalf("error extracting coordinates: %v", err)
+	}
+
+	mongoClient.(db.MockDBClient).SetResponse(locationCollection, bson.M{"location": db.GeoWithinPolygon(box.Polygon())}, nil, nil, 1, maxMapLocations, []any{
+		model.LocationInfo{Username: "user22", Location: model.Location{Type: "Point", Coordinates: cuCoordinatesExtracted}, Timestamp: 1000},
+		model.LocationInfo{Username: "user22", Location: model.Location{Type: "Point", Coordinates: cuCoordinatesExtracted}, Timestamp: 2000},
+		model.LocationInfo{Username: "user22", Location: model.Location{Type: "Point", Coordinates: cuCoordinatesExtracted}, Timestamp: 3000},
+	})
+
+	response, err = http.Get("http://localhost:8080/map/density?southWest=43,20&northEast=45,22&zoom=5&minCount=2")
+
+	if err != nil {
+		t.Fatalf("error getting location density: %v", err)
+	}
+
+	defer response.Body.Close()
+	collection = featureCollection{}
+
+	if err := json.NewDecoder(response.Body).Decode(&collection); err != nil {
+		t.Fatalf("error decoding location density: %v", err)
+	}
+
+	if len(collection.Features) != 0 {
+		t.Errorf("expected a single user with many locations to be left out, got %v", collection)
+	}
+
+	response, err = http.Get("http://localhost:8080/map/density?southWest=45,20&northEast=43,22")
+
+	if err != nil {
+		t.Fatalf("error getting location density: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, response.StatusCode)
+	}
+}
+
+func TestClusterLocations(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	filter := bson.M{"location": db.GeoWithinPolygon(geo.TileBounds(10, 570, 369).Polygon())}
+
+	mongoClient.(db.MockDBClient).SetResponse(locationCollection, filter, nil, nil, 1, maxMapLocations, []any{
+		model.LocationInfo{Username: "user25", Location: model.Location{Type: "Point", Coordinates: []float64{20.45, 44.8}}, Timestamp: 1000},
+		model.LocationInfo{Username: "user26", Location: model.Location{Type: "Point", Coordinates: []float64{20.4502, 44.8002}}, Timestamp: 1000},
+		model.LocationInfo{Username: "user27", Location: model.Location{Type: "Point", Coordinates: []float64{20.7, 44.6}}, Timestamp: 1000},
+	})
+
+	for range 2 {
+		response, err := http.Get("http://localhost:8080/map/clusters?southWest=44.6,20.4&northEast=44.8,20.7&zoom=10")
+
+		if err != nil {
+			t.Fatalf("error getting clusters: %v", err)
+		}
+
+		defer response.Body.Close()
+		clusters := clusterResponse{}
+
+		if err := json.NewDecoder(response.Body).Decode(&clusters); err != nil {
+			t.Fatalf("error decoding clusters: %v", err)
+		}
+
+		if len(clusters.Clusters) != 1 || clusters.Clusters[0].Count != 2 || clusters.Clusters[0].Coordinates[0] != 20.4501 || len(clusters.Points) != 1 || clusters.Points[0].Username != "user27" {
+			t.Errorf("unexpected clusters %v", clusters)
+		}
+
+		mongoClient.(db.MockDBClient).SetResponse(locationCollection, filter, nil, nil, 1, maxMapLocations, []any{})
+	}
+
+	response, err := http.Get("http://localhost:8080/map/clusters?southWest=-80,-170&northEast=80,170&zoom=10")
+
+	if err != nil {
+		t.Fatalf("error getting clusters: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, response.StatusCode)
+	}
+}
+
+func TestTile(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	mongoClient.(db.MockDBClient).SetResponse(locationCollection, bson.M{"location": db.GeoWithinPolygon(geo.TileBounds(10, 570, 369).Polygon())}, nil, nil, 1, maxMapLocations, []any{
+		model.LocationInfo{Username: "user28", Location: model.Location{Type: "Point", Coordinates: []float64{20.45, 44.8}}, Timestamp: 1000},
+		model.LocationInfo{Username: "user29", Location: model.Location{Type: "Point", Coordinates: []float64{20.7, 44.6}}, Timestamp: 2000},
+	})
+
+	response, err := http.Get("http://localhost:8080/tiles/10/570/369.mvt")
+
+	if err != nil {
+		t.Fatalf("error getting tile: %v", err)
+	}
+
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+
+	if err != nil {
+		t.Fatalf("error reading tile: %v", err)
+	}
+
+	if response.Header.Get("Content-Type") != mvtContentType || response.Header.Get("X-Truncated") != "" {
+		t.Errorf("unexpected content type '%s' or truncated header '%s'", response.Header.Get("Content-Type"), response.Header.Get("X-Truncated"))
+	}
+
+	layers := decodeTileFields(t, body)[mvtTileLayers]
+
+	if len(layers) != 1 {
+		t.Fatalf("expected 1 layer, got %d", len(layers))
+	}
+
+	layer := decodeTileFields(t, layers[0])
+
+	if string(layer[mvtLayerName][0]) != tileLayerName || len(layer[mvtLayerFeatures]) != 2 || len(layer[mvtLayerKeys]) != 2 || len(layer[mvtLayerValues]) != 4 {
+		t.Errorf("unexpected layer %v", layer)
+	}
+
+	if string(decodeTileFields(t, layer[mvtLayerValues][2])[mvtValueString][0]) != "user29" {
+		t.Errorf("unexpected username value %v", layer[mvtLayerValues][2])
+	}
+
+	locations := []any{}
+
+	for i := range maxMapLocations {
+		locations = append(locations, model.LocationInfo{Username: fmt.Sprintf("user%d", i), Location: model.Location{Type: "Point", Coordinates: []float64{20.45, 44.8}}, Timestamp: 1000})
+	}
+
+	mongoClient.(db.MockDBClient).SetResponse(locationCollection, bson.M{"location": db.GeoWithinPolygon(geo.TileBounds(10, 570, 369).Polygon())}, nil, nil, 1, maxMapLocations, locations)
+	response, err = http.Get("http://localhost:8080/tiles/10/570/369.mvt")
+
+	if err != nil {
+		t.Fatalf("error getting tile: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.Header.Get("X-Truncated") != "true" {
+		t.Errorf("expected truncated header on a tile with too many users, got '%s'", response.Header.Get("X-Truncated"))
+	}
+
+	for _, path := range []string{"/tiles/10/570/369.png", "/tiles/10/1024/369.mvt", "/tiles/23/0/0.mvt"} {
+		response, err := http.Get("http://localhost:8080" + path)
+
+		if err != nil {
+			t.Fatalf("error getting tile: %v", err)
+		}
+
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status code %d for '%s', got %d", http.StatusBadRequest, path, response.StatusCode)
+		}
+	}
+}
+
+// decodeTileFields decodes a protobuf message of a vector tile into its length delimited fields by field number
+func decodeTileFields(t *testing.T, message []byte) map[protowire.Number][][]byte {
+	fields := map[protowire.Number][][]byte{}
+
+	for len(message) > 0 {
+		number, fieldType, length := protowire.ConsumeTag(message)
+
+		if length < 0 {
+			t.Fatalf("error decoding tile field tag: %v", protowire.ParseError(length))
+		}
+
+		message = message[length:]
+
+		if fieldType == protowire.BytesType {
+			value, valueLength := protowire.ConsumeBytes(message)
+
+			if valueLength < 0 {
+				t.Fatalf("error decoding tile field %d: %v", number, protowire.ParseError(valueLength))
+			}
+
+			fields[number] = append(fields[number], value)
+			length = valueLength
+
+		} else {
+			length = protowire.ConsumeFieldValue(number, fieldType, message)
+		}
+
+		message = message[length:]
+	}
+
+	return fields
+}
+
+func TestReverseGeocoding(t *testing.T) {
+	places := strings.Join([]string{
+		"792680\tBelgrade\tBelgrade\t\t44.80401\t20.46513\tP\tPPLC\tRS\t\t00\t\t\t\t1273651\t\t117\tEurope/Belgrade\t2019-09-05",
+		"789518\tKragujevac\tKragujevac\t\t44.01667\t20.91667\tP\tPPLA\tRS\t\t07\t\t\t\t150835\t\t185\tEurope/Belgrade\t2019-09-05",
+		"789128\tJagodina\tJagodina\t\t43.97713\t21.26121\tP\tPPLA\tRS\t\t13\t\t\t\t35589\t\t117\tEurope/Belgrade\t2019-09-05",
+	}, "\n")
+
+	regions := "RS.00\tBelgrade\tBelgrade\t785603\nRS.13\tPomoravlje\tPomoravlje\t7581800\n"
+	geocoder, err := geo.LoadGeoNames(strings.NewReader(places), strings.NewReader(regions))
+
+	if err != nil {
+		t.Fatalf("error loading geonames places: %v", err)
+	}
+
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	reverseGeocoder = geocoder
+	go main()
+	time.Sleep(2 * time.Second)
+	client := pb.MustCreateClient("localhost:50052", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	mongoClient.(db.MockDBClient).SetResponse(locationCollection, bson.M{"username": "user30"}, nil, nil, 1, 1, []any{
+		model.LocationInfo{Username: "user30", Location: model.Location{Type: "Point", Coordinates: []float64{21.2185255, 43.9754164}}, Timestamp: 1000},
+	})
+
+	location, err := client.GetUserLocation(context.Background(), &pb.UserLocationRequest{Username: "user30"})
+
+	if err != nil {
+		t.Fatalf("error getting user location: %v", err)
+	}
+
+	if location.Place.GetName() != "Jagodina" || location.Place.GetRegion() != "Pomoravlje" || location.Place.GetCountry() != "RS" || location.Place.GetDistance() > 5000 {
+		t.Errorf("unexpected place %v", location.Place)
+	}
+}
+
+func TestCoordinateFormats(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	testData := []struct {
+		body     string
+		expected []float64
+		status   int
+		message  string
+	}{
+		{body: `{"username": "user31", "coordinates": "44.8154844, 20.2576593"}`, expected: []float64{20.2576593, 44.8154844}, status: http.StatusOK},
+		{body: `{"username": "user32", "location": {"type": "Point", "coordinates": [20.2576593, 44.8154844, 117]}}`, expected: []float64{20.2576593, 44.8154844}, status: http.StatusOK},
+		{body: `{"username": "user33", "coordinates": "44°48'55.7\"N 20°15'27.6\"E"}`, expected: []float64{20.2576667, 44.8154722}, status: http.StatusOK},
+		{body: `{"username": "user34", "coordinates": "S33 52.068 E151 12.55"}`, expected: []float64{151.2091667, -33.8678}, status: http.StatusOK},
+		{body: `{"username": "user35", "coordinates": "srywc"}`, expected: []float64{20.4565430, 44.8022461}, status: http.StatusOK},
+		{body: `{"username": "user36", "coordinates": "9C3W9QCJ+2VX"}`, expected: []float64{-1.2177656, 51.3701125}, status: http.StatusOK},
+		{body: `{"username": "user37", "location": {"type": "LineString", "coordinates": [[20.2, 44.8], [20.3, 44.9]]}}`, status: http.StatusBadRequest},
+		{body: `{"username": "user38", "location": {"type": "Point", "coordinates": [200, 44.8]}}`, status: http.StatusBadRequest, message: "invalid geojson location: longitude out of range"},
+		{body: `{"username": "user39", "coordinates": "44°70'N 20°15'E"}`, status: http.StatusBadRequest, message: "invalid degrees minutes seconds coordinates"},
+		{body: `{"username": "user40", "coordinates": "9C3W+2V"}`, status: http.StatusBadRequest, message: "invalid open location code coordinates '9C3W+2V': open location code '9C3W+2V' is a short code"},
+		{body: `{"username": "user41", "coordinates": "srywa"}`, status: http.StatusBadRequest, message: "invalid geohash coordinates"},
+		{body: `{"username": "user42", "coordinates": "Somewhere!"}`, status: http.StatusBadRequest, message: "unrecognized coordinates format"},
+		{body: `{"username": "user44", "coordinates": "44.815484412, 20.2576593"}`, status: http.StatusBadRequest, message: "unrecognized coordinates format"},
+		{body: `{"username": "user43", "coordinates": "44.8, 20.2", "location": {"type": "Point", "coordinates": [20.2, 44.8]}}`, status: http.StatusBadRequest},
+	}
+
+	for _, singleTestData := range testData {
+		response, err := http.Post("http://localhost:8080/user/location", "application/json", strings.NewReader(singleTestData.body))
+
+		if err != nil {
+			t.Fatalf("error updating location: %v", err)
+		}
+
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		if err != nil {
+			t.Fatalf("error reading response body: %v", err)
+		}
+
+		if response.StatusCode != singleTestData.status || !strings.Contains(string(body), singleTestData.message) {
+			t.Errorf("unexpected response %d '%s' for %s", response.StatusCode, strings.TrimSpace(string(body)), singleTestData.body)
+			continue
+		}
+
+		if singleTestData.expected == nil {
+			continue
+		}
+
+		username := struct {
+			Username string `json:"username"`
+		}{}
+
+		if err := json.Unmarshal([]byte(singleTestData.body), &username); err != nil {
+			t.Fatalf("error decoding request body: %v", err)
+		}
+
+		cursor := mongoClient.(db.MockDBClient).GetResponse(locationCollection, bson.M{"username": username.Username}, nil, nil, 0, 0)
+		locations := []model.LocationInfo{}
+
+		if err := cursor.All(context.Background(), &locations); err != nil || len(locations) != 1 {
+			t.Fatalf("error getting location of username '%s': %v", username.Username, err)
+		}
+
+		coordinates := locations[0].Location.Coordinates
+
+		if len(coordinates) != 2 || math.Abs(coordinates[0]-singleTestData.expected[0]) > 1e-6 || math.Abs(coordinates[1]-singleTestData.expected[1]) > 1e-6 {
+			t.Errorf("expected coordinates %v, got %v for %s", singleTestData.expected, coordinates, singleTestData.body)
+		}
+	}
+
+	mongoClient.(db.MockDBClient).SetResponse(locationCollection, bson.M{
+		"location": bson.M{
+			"$near": bson.M{
+				"$geometry":    bson.M{"type": "Point", "coordinates": []float64{20.2576593, 44.8154844}},
+				"$maxDistance": 10.0,
+			},
+		},
+	}, bson.M{"username": 1}, bson.M{"username": 1}, 1, 10, []any{bson.M{"username": "user31"}})
+
+	response, err := http.Post("http://localhost:8080/user/search", "application/json", strings.NewReader(`{"location": {"type": "Point", "coordinates": [20.2576593, 44.8154844]}, "distance": 10, "pageNumber": 1, "pageSize": 10}`))
+
+	if err != nil {
+		t.Fatalf("error searching users: %v", err)
+	}
+
+	defer response.Body.Close()
+	result := struct {
+		Usernames []string `json:"usernames"`
+	}{}
+
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatalf("error decoding search response: %v", err)
+	}
+
+	if len(result.Usernames) != 1 || result.Usernames[0] != "user31" {
+		t.Errorf("unexpected search result %v", result.Usernames)
+	}
+}
+
+func TestProblemResponse(t *testing.T) {
+	mongoClient = db.CreateMockDBClient()
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	testData := []struct {
+		method     string
+		path       string
+		body       string
+		status     int
+		code       string
+		violations []problem.Violation
+	}{
+		{method: http.MethodPost, path: "/user/location", body: `{"username": `, status: http.StatusBadRequest, code: problem.CodeInvalidBody},
+		{method: http.MethodPost, path: "/user/location", body: `{"username": "u"}`, status: http.StatusBadRequest, code: problem.CodeValidationFailed, violations: []problem.Violation{
+			{Field: "username", Code: "min", Message: "must be at least 4"},
+			{Field: "coordinates", Code: "required_without", Message: "is required when location is not set"},
+			{Field: "location", Code: "required_without", Message: "is required when coordinates is not set"},
+		}},
+		{method: http.MethodPost, path: "/geofence", body: `{"name": "office", "type": "circle", "polygon": ["1, 2"]}`, status: http.StatusBadRequest, code: problem.CodeValidationFailed, violations: []problem.Violation{
+			{Field: "coordinates", Code: "required_if", Message: "is required when type is circle"},
+			{Field: "radius", Code: "required_if", Message: "is required when type is circle"},
+			{Field: "polygon", Code: "min", Message: "must be at least 3"},
+		}},
+		{method: http.MethodGet, path: "/map/clusters?southWest=44.7,20.3&northEast=44.9,20.6&zoom=23", status: http.StatusBadRequest, code: problem.CodeValidationFailed, violations: []problem.Violation{
+			{Field: "zoom", Code: "lte", Message: "must be less than or equal to 22"},
+		}},
+		{method: http.MethodPost, path: "/user/search", body: `{"coordinates": "8FVC+22", "distance": 10, "pageNumber": 1, "pageSize": 10}`, status: http.StatusBadRequest, code: problem.CodeInvalidLocation},
+		{method: http.MethodGet, path: "/tiles/10/570/369.png", status: http.StatusBadRequest, code: problem.CodeInvalidRequest},
+		{method: http.MethodGet, path: "/geofence/000000000000000000000000", status: http.StatusNotFound, code: problem.CodeNotFound},
+	}
+
+	for i, singleTestData := range testData {
+		request, err := http.NewRequest(singleTestData.method, "http://localhost:8080"+singleTestData.path, strings.NewReader(singleTestData.body))
+
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+
+		requestID := fmt.Sprintf("problem-test-%d", i)
+		request.Header.Set(problem.RequestIDHeader, requestID)
+		response, err := http.DefaultClient.Do(request)
+
+		if err != nil {
+			t.Fatalf("error sending request: %v", err)
+		}
+
+		result := problem.Problem{}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+
+		if err != nil {
+			t.Fatalf("error decoding problem for %s %s: %v", singleTestData.method, singleTestData.path, err)
+		}
+
+		if response.StatusCode != singleTestData.status || response.Header.Get("Content-Type") != problem.ContentType || response.Header.Get(problem.RequestIDHeader) != requestID {
+			t.Errorf("unexpected response %d '%s' '%s' for %s %s", response.StatusCode, response.Header.Get("Content-Type"), response.Header.Get(problem.RequestIDHeader), singleTestData.method, singleTestData.path)
+		}
+
+		if result.Status != singleTestData.status || result.Code != singleTestData.code || result.Type != "urn:problem:location-tracking:"+singleTestData.code || result.Title == "" || result.RequestID != requestID {
+			t.Errorf("unexpected problem %+v for %s %s", result, singleTestData.method, singleTestData.path)
+		}
+
+		if singleTestData.violations != nil && !slices.Equal(result.Violations, singleTestData.violations) {
+			t.Errorf("expected violations %+v, got %+v for %s %s", singleTestData.violations, result.Violations, singleTestData.method, singleTestData.path)
+		}
+	}
+
+	response, err := http.Get("http://localhost:8080/geofence/000000000000000000000000")
+
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+
+	response.Body.Close()
+
+	if len(response.Header.Get(problem.RequestIDHeader)) != 32 {
+		t.Errorf("expected a generated request id, got '%s'", response.Header.Get(problem.RequestIDHeader))
+	}
+}
+
+func TestDatabaseTimeout(t *testing.T) {
+	mockClient := db.CreateMockDBClient()
+	mockClient.SetTimeouts(db.Timeouts{Default: 100 * time.Millisecond})
+	mockClient.SetLatency(time.Second)
+	mongoClient = mockClient
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+	defer mockClient.SetLatency(0)
+
+	testData := []struct {
+		path string
+		body string
+	}{
+		{path: "/user/location", body: `{"username": "user70", "coordinates": "` + deCoordinates + `"}`},
+		{path: "/user/search", body: `{"coordinates": "` + deCoordinates + `", "distance": 10, "pageNumber": 1, "pageSize": 10}`},
+	}
+
+	for _, singleTestData := range testData {
+		start := time.Now()
+		response, err := http.Post("http://localhost:8080"+singleTestData.path, "application/json", strings.NewReader(singleTestData.body))
+
+		if err != nil {
+			t.Fatalf("error sending request: %v", err)
+		}
+
+		result := problem.Problem{}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+
+		if err != nil {
+			t.Fatalf("error decoding problem for %s: %v", singleTestData.path, err)
+		}
+
+		if response.StatusCode != http.StatusGatewayTimeout || result.Code != problem.CodeTimeout {
+			t.Errorf("expected a timeout problem for %s, got %d %+v", singleTestData.path, response.StatusCode, result)
+		}
+
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected %s to time out after 100ms, took %v", singleTestData.path, elapsed)
+		}
+	}
+
+	client := pb.MustCreateClient("localhost:50052", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	_, err := client.UpdateUserLocation(context.Background(), &pb.UpdateLocationRequest{Username: "user70", Coordinates: deCoordinates})
+
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+
+	_, err = client.GetUserLocation(context.Background(), &pb.UserLocationRequest{Username: "user70"})
+
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request := httptest.NewRequest(http.MethodPost, "/user/location", strings.NewReader(testData[0].body)).WithContext(ctx)
+	recorder := httptest.NewRecorder()
+	updateUserLocationHandler(recorder, request)
+
+	if recorder.Code != problem.StatusClientClosedRequest || !strings.Contains(recorder.Body.String(), problem.CodeCanceled) {
+		t.Errorf("expected a canceled problem, got %d '%s'", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestSchemaDrift(t *testing.T) {
+	mockClient := db.CreateMockDBClient()
+
+	mockClient.SetCollection(webhookDeliveryCollection, db.CollectionState{
+		Exists: true,
+		Indexes: []db.IndexSpec{
+			{Name: "_id_", Keys: []db.IndexKey{{Field: "_id", Type: 1}}},
+			{Name: "webhookId_1", Keys: []db.IndexKey{{Field: "webhookId", Type: 1}}},
+			{Name: "createdAt_-1", Keys: []db.IndexKey{{Field: "createdAt", Type: -1}}},
+			{Name: "status_1__id_1", Keys: []db.IndexKey{{Field: "status", Type: 1}, {Field: "_id", Type: 1}}},
+		},
+	})
+
+	reportSchemaDrift(db.MustApplySchema(context.Background(), mockClient, schema))
+
+	if drift := db.MustApplySchema(context.Background(), mockClient, schema); len(drift) != 1 {
+		t.Errorf("expected only the unresolved drift when applying the schema again, got %v", drift)
+	}
+
+	mongoClient = mockClient
+	go main()
+	time.Sleep(2 * time.Second)
+	response, err := http.Get("http://localhost:8080/metrics")
+
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatalf("error reading metrics: %v", err)
+	}
+
+	expected := []string{
+		`schema_drift{collection="webhook-delivery",kind="missing_index",resolved="true"} 1`,
+		`schema_drift{collection="webhook-delivery",kind="unexpected_index",resolved="false"} 1`,
+	}
+
+	for _, metric := range expected {
+		if !bytes.Contains(body, []byte(metric)) {
+			t.Errorf("expected metric '%s'", metric)
+		}
+	}
+
+	if bytes.Contains(body, []byte(`collection="location"`)) {
+		t.Errorf("expected no drift of the collections created by the schema")
+	}
+}
+
+func TestMemoryDatabase(t *testing.T) {
+	testDatabaseBackend(t, db.CreateMemoryClient())
+}
+
+func TestMemoryStores(t *testing.T) {
+	currentLocations = store.CreateMemoryCurrentLocationStore()
+	defer func() { currentLocations = nil }()
+	testDatabaseBackend(t, db.CreateMemoryClient())
+}
+
+func TestEmbeddedDatabase(t *testing.T) {
+	client := db.MustCreateEmbeddedClient(filepath.Join(t.TempDir(), "location-management.db"))
+	defer client.Disconnect(context.Background())
+	testDatabaseBackend(t, client)
+}
+
+// testDatabaseBackend runs the service on the database client and checks that it behaves like on mongodb
+func testDatabaseBackend(t *testing.T, dbClient db.DBClient) {
+	mongoClient = dbClient
+	locationHistoryManagementClient = lhmp.CreateMockGRPCClient()
+	go main()
+	time.Sleep(2 * time.Second)
+
+	for username, coordinates := range map[string]string{"user80": deCoordinates, "user81": jaCoordinates, "user82": bgCoordinates} {
+		if err := updateLocation(username, coordinates); err != nil {
+			t.Fatalf("error updating location: %v", err)
+		}
+	}
+
+	testData := []struct {
+		distance   float64
+		pageNumber int
+		pageSize   int
+		expected   []string
+	}{
+		{distance: 1000, pageNumber: 1, pageSize: 10, expected: []string{"user80"}},
+		{distance: 30000, pageNumber: 1, pageSize: 10, expected: []string{"user80", "user81"}},
+		{distance: 200000, pageNumber: 2, pageSize: 2, expected: []string{"user82"}},
+	}
+
+	for _, singleTestData := range testData {
+		usernames, err := searchUsers(deCoordinates, singleTestData.distance, singleTestData.pageNumber, singleTestData.pageSize)
+
+		if err != nil {
+			t.Fatalf("error searching users: %v", err)
+		}
+
+		if !slices.Equal(usernames, singleTestData.expected) {
+			t.Errorf("expected %v within %f meters, got %v", singleTestData.expected, singleTestData.distance, usernames)
+		}
+	}
+
+	response, err := http.Get("http://localhost:8080/map/density?southWest=43.5,21&northEast=44.5,22&zoom=5&minCount=1")
+
+	if err != nil {
+		t.Fatalf("error getting location density: %v", err)
+	}
+
+	collection := featureCollection{}
+	err = json.NewDecoder(response.Body).Decode(&collection)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatalf("error decoding location density: %v", err)
+	}
+
+	if len(collection.Features) != 1 || collection.Features[0].Properties["count"] != float64(2) {
+		t.Errorf("unexpected location density %v", collection)
+	}
+
+	if err := updateLocation("user80", bgCoordinates); err != nil {
+		t.Fatalf("error updating location: %v", err)
+	}
+
+	usernames, err := searchUsers(bgCoordinates, 1000, 1, 10)
+
+	if err != nil {
+		t.Fatalf("error searching users: %v", err)
+	}
+
+	if !slices.Equal(usernames, []string{"user80", "user82"}) {
+		t.Errorf("expected the replaced location of user80 to be found, got %v", usernames)
+	}
+
+	client := pb.MustCreateClient("localhost:50052", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+	location, err := client.GetUserLocation(context.Background(), &pb.UserLocationRequest{Username: "user80"})
+
+	if err != nil {
+		t.Fatalf("error getting location: %v", err)
+	}
+
+	expected, err := extractCoordinates(bgCoordinates)
+
+	if err != nil {
+		t.Fatalf("error extracting coordinates: %v", err)
+	}
+
+	if !slices.Equal(location.Location.Coordinates, expected) {
+		t.Errorf("expected coordinates %v, got %v", expected, location.Location.Coordinates)
+	}
+
+	body := `{"name":"despotovac","type":"circle","coordinates":"` + deCoordinates + `","radius":1000}`
+	response, err = http.Post("http://localhost:8080/geofence", "application/json", strings.NewReader(body))
+
+	if err != nil {
+		t.Fatalf("error creating geofence: %v", err)
+	}
+
+	fence := store.Geofence{}
+	err = json.NewDecoder(response.Body).Decode(&fence)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatalf("error decoding geofence: %v", err)
+	}
+
+	if err := updateLocation("user83", deCoordinates); err != nil {
+		t.Fatalf("error updating location: %v", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	response, err = http.Get("http://localhost:8080/geofence/events?username=user83&pageNumber=1&pageSize=10")
+
+	if err != nil {
+		t.Fatalf("error listing geofence events: %v", err)
+	}
+
+	events := struct {
+		Events []store.GeofenceEvent `json:"events"`
+	}{}
+
+	err = json.NewDecoder(response.Body).Decode(&events)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatalf("error decoding geofence events: %v", err)
+	}
+
+	if len(events.Events) != 1 || events.Events[0].Type != "enter" || events.Events[0].FenceID != fence.ID {
+		t.Errorf("expected an enter event of geofence '%s', got %v", fence.ID, events.Events)
+	}
+}
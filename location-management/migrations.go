@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+)
+
+// migrations are the data migrations of the service, a new migration gets the next version and is never changed once released
+var migrations = []db.Migration{}
+
+// migrateOnStartup applies the pending migrations unless MIGRATE_ON_STARTUP is false, replicas starting at the same time wait for the one running them
+// it runs before the servers start, so no request is served while the data is migrated
+func migrateOnStartup() error {
+	if os.Getenv("MIGRATE_ON_STARTUP") == "false" {
+		log.Println("skipping migrations on startup")
+		return nil
+	}
+
+	migrator := db.MustCreateMigrator(mongoClient, migrationCollection, migrations)
+
+	if _, err := migrator.Up(context.Background(), 0, false); err != nil {
+		return fmt.Errorf("failed to apply migrations: %w", err)
+	}
+
+	return nil
+}
+
+// runMigrationCommand runs a migration command of the migrate entry point against the database configured like the service
+// it returns the error of the command instead of exiting, so the signal handler is stopped and the client disconnected first
+func runMigrationCommand(args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	client := createDBClient()
+	defer client.Disconnect(context.Background())
+	migrator := db.MustCreateMigrator(client, migrationCollection, migrations)
+
+	if err := db.RunMigrationCommand(ctx, migrator, args, os.Stdout); err != nil {
+		return fmt.Errorf("migration command failed: %w", err)
+	}
+
+	return nil
+}
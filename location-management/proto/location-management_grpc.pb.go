@@ -0,0 +1,236 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: location-management.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	LocationManagement_UpdateUserLocation_FullMethodName      = "/locationmanagement.LocationManagement/UpdateUserLocation"
+	LocationManagement_BatchUpdateUserLocation_FullMethodName = "/locationmanagement.LocationManagement/BatchUpdateUserLocation"
+	LocationManagement_GetUserLocation_FullMethodName         = "/locationmanagement.LocationManagement/GetUserLocation"
+	LocationManagement_SearchUserLocation_FullMethodName      = "/locationmanagement.LocationManagement/SearchUserLocation"
+)
+
+// LocationManagementClient is the client API for LocationManagement service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type LocationManagementClient interface {
+	UpdateUserLocation(ctx context.Context, in *UpdateLocationRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	BatchUpdateUserLocation(ctx context.Context, in *BatchUpdateLocationRequest, opts ...grpc.CallOption) (*BatchUpdateLocationResponse, error)
+	GetUserLocation(ctx context.Context, in *UserLocationRequest, opts ...grpc.CallOption) (*LocationInfo, error)
+	SearchUserLocation(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error)
+}
+
+type locationManagementClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLocationManagementClient(cc grpc.ClientConnInterface) LocationManagementClient {
+	return &locationManagementClient{cc}
+}
+
+func (c *locationManagementClient) UpdateUserLocation(ctx context.Context, in *UpdateLocationRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, LocationManagement_UpdateUserLocation_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationManagementClient) BatchUpdateUserLocation(ctx context.Context, in *BatchUpdateLocationRequest, opts ...grpc.CallOption) (*BatchUpdateLocationResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchUpdateLocationResponse)
+	err := c.cc.Invoke(ctx, LocationManagement_BatchUpdateUserLocation_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationManagementClient) GetUserLocation(ctx context.Context, in *UserLocationRequest, opts ...grpc.CallOption) (*LocationInfo, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LocationInfo)
+	err := c.cc.Invoke(ctx, LocationManagement_GetUserLocation_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationManagementClient) SearchUserLocation(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SearchResponse)
+	err := c.cc.Invoke(ctx, LocationManagement_SearchUserLocation_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// LocationManagementServer is the server API for LocationManagement service.
+// All implementations must embed UnimplementedLocationManagementServer
+// for forward compatibility.
+type LocationManagementServer interface {
+	UpdateUserLocation(context.Context, *UpdateLocationRequest) (*emptypb.Empty, error)
+	BatchUpdateUserLocation(context.Context, *BatchUpdateLocationRequest) (*BatchUpdateLocationResponse, error)
+	GetUserLocation(context.Context, *UserLocationRequest) (*LocationInfo, error)
+	SearchUserLocation(context.Context, *SearchRequest) (*SearchResponse, error)
+	mustEmbedUnimplementedLocationManagementServer()
+}
+
+// UnimplementedLocationManagementServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedLocationManagementServer struct{}
+
+func (UnimplementedLocationManagementServer) UpdateUserLocation(context.Context, *UpdateLocationRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateUserLocation not implemented")
+}
+func (UnimplementedLocationManagementServer) BatchUpdateUserLocation(context.Context, *BatchUpdateLocationRequest) (*BatchUpdateLocationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchUpdateUserLocation not implemented")
+}
+func (UnimplementedLocationManagementServer) GetUserLocation(context.Context, *UserLocationRequest) (*LocationInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserLocation not implemented")
+}
+func (UnimplementedLocationManagementServer) SearchUserLocation(context.Context, *SearchRequest) (*SearchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SearchUserLocation not implemented")
+}
+func (UnimplementedLocationManagementServer) mustEmbedUnimplementedLocationManagementServer() {}
+func (UnimplementedLocationManagementServer) testEmbeddedByValue()                            {}
+
+// UnsafeLocationManagementServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LocationManagementServer will
+// result in compilation errors.
+type UnsafeLocationManagementServer interface {
+	mustEmbedUnimplementedLocationManagementServer()
+}
+
+func RegisterLocationManagementServer(s grpc.ServiceRegistrar, srv LocationManagementServer) {
+	// If the following call pancis, it indicates UnimplementedLocationManagementServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&LocationManagement_ServiceDesc, srv)
+}
+
+func _LocationManagement_UpdateUserLocation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateLocationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationManagementServer).UpdateUserLocation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationManagement_UpdateUserLocation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationManagementServer).UpdateUserLocation(ctx, req.(*UpdateLocationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationManagement_BatchUpdateUserLocation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchUpdateLocationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationManagementServer).BatchUpdateUserLocation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationManagement_BatchUpdateUserLocation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationManagementServer).BatchUpdateUserLocation(ctx, req.(*BatchUpdateLocationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationManagement_GetUserLocation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserLocationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationManagementServer).GetUserLocation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationManagement_GetUserLocation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationManagementServer).GetUserLocation(ctx, req.(*UserLocationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationManagement_SearchUserLocation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationManagementServer).SearchUserLocation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationManagement_SearchUserLocation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationManagementServer).SearchUserLocation(ctx, req.(*SearchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// LocationManagement_ServiceDesc is the grpc.ServiceDesc for LocationManagement service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LocationManagement_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "locationmanagement.LocationManagement",
+	HandlerType: (*LocationManagementServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "UpdateUserLocation",
+			Handler:    _LocationManagement_UpdateUserLocation_Handler,
+		},
+		{
+			MethodName: "BatchUpdateUserLocation",
+			Handler:    _LocationManagement_BatchUpdateUserLocation_Handler,
+		},
+		{
+			MethodName: "GetUserLocation",
+			Handler:    _LocationManagement_GetUserLocation_Handler,
+		},
+		{
+			MethodName: "SearchUserLocation",
+			Handler:    _LocationManagement_SearchUserLocation_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "location-management.proto",
+}
@@ -0,0 +1,44 @@
+package proto
+
+import (
+	context "context"
+
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+type MockGRPCClient struct {
+}
+
+func (m *MockGRPCClient) Close() error {
+	return nil
+}
+
+func (m *MockGRPCClient) UpdateUserLocation(ctx context.Context, in *UpdateLocationRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+func (m *MockGRPCClient) BatchUpdateUserLocation(ctx context.Context, in *BatchUpdateLocationRequest, opts ...grpc.CallOption) (*BatchUpdateLocationResponse, error) {
+	results := []*BatchUpdateLocationResult{}
+
+	for i := range in.Locations {
+		results = append(results, &BatchUpdateLocationResult{Index: int32(i)})
+	}
+
+	return &BatchUpdateLocationResponse{Results: results}, nil
+}
+
+func (m *MockGRPCClient) GetUserLocation(ctx context.Context, in *UserLocationRequest, opts ...grpc.CallOption) (*LocationInfo, error) {
+	return nil, status.Errorf(codes.NotFound, "no location found for username '%s'", in.Username)
+}
+
+func (m *MockGRPCClient) SearchUserLocation(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error) {
+	return &SearchResponse{Usernames: []string{}}, nil
+}
+
+// CreateMockGRPCClient creates a new mock grpc client
+func CreateMockGRPCClient() *MockGRPCClient {
+	return &MockGRPCClient{}
+}
@@ -0,0 +1,89 @@
+package proto
+
+import (
+	context "context"
+	"log"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	grpc "google.golang.org/grpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+type GRPCClient interface {
+	Close() error
+	UpdateUserLocation(ctx context.Context, in *UpdateLocationRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	BatchUpdateUserLocation(ctx context.Context, in *BatchUpdateLocationRequest, opts ...grpc.CallOption) (*BatchUpdateLocationResponse, error)
+	GetUserLocation(ctx context.Context, in *UserLocationRequest, opts ...grpc.CallOption) (*LocationInfo, error)
+	SearchUserLocation(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error)
+}
+
+type LMGRPCClient struct {
+	connection *grpc.ClientConn
+	client     LocationManagementClient
+}
+
+// Close closes the grpc connection
+func (c *LMGRPCClient) Close() error {
+	return c.connection.Close()
+}
+
+// UpdateUserLocation updates the user location using the grpc client
+func (c *LMGRPCClient) UpdateUserLocation(ctx context.Context, in *UpdateLocationRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	return c.client.UpdateUserLocation(ctx, in, opts...)
+}
+
+// BatchUpdateUserLocation updates multiple user locations in a single call using the grpc client
+func (c *LMGRPCClient) BatchUpdateUserLocation(ctx context.Context, in *BatchUpdateLocationRequest, opts ...grpc.CallOption) (*BatchUpdateLocationResponse, error) {
+	return c.client.BatchUpdateUserLocation(ctx, in, opts...)
+}
+
+// GetUserLocation retrieves the current user location using the grpc client
+func (c *LMGRPCClient) GetUserLocation(ctx context.Context, in *UserLocationRequest, opts ...grpc.CallOption) (*LocationInfo, error) {
+	return c.client.GetUserLocation(ctx, in, opts...)
+}
+
+// SearchUserLocation searches for users within a distance from the given coordinates using the grpc client
+func (c *LMGRPCClient) SearchUserLocation(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error) {
+	return c.client.SearchUserLocation(ctx, in, opts...)
+}
+
+// CreateClient creates a new grpc client for the location management service
+func CreateClient(target string, opts ...grpc.DialOption) (*LMGRPCClient, error) {
+	connection, err := grpc.NewClient(target, opts...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LMGRPCClient{
+		connection: connection,
+		client:     NewLocationManagementClient(connection),
+	}, nil
+}
+
+// MustCreateClient creates a new grpc client for the location management service and panics if it fails
+func MustCreateClient(uri string, opts ...grpc.DialOption) *LMGRPCClient {
+	client, err := CreateClient(uri, opts...)
+
+	if err != nil {
+		log.Fatalf("failed to create location management client for uri '%s' and options '%v': %v\n", uri, opts, err)
+	}
+
+	return client
+}
+
+// LookupPlace resolves the [longitude, latitude] coordinates to the nearest place of the reverse geocoder, or returns nil if it has no places
+func LookupPlace(geocoder *geo.ReverseGeocoder, coordinates []float64) *Place {
+	place, distance, ok := geocoder.Lookup(coordinates)
+
+	if !ok {
+		return nil
+	}
+
+	return &Place{
+		Name:     place.Name,
+		Region:   place.Region,
+		Country:  place.Country,
+		Distance: distance,
+	}
+}
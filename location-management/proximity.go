@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/problem"
+	"github.com/mmilosevicgd/location-tracking/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type proximityRuleRequest struct {
+	Username      string  `json:"username" validate:"required,alphanum,min=4,max=16"`
+	OtherUsername string  `json:"otherUsername" validate:"required,alphanum,min=4,max=16,nefield=Username"`
+	Type          string  `json:"type" validate:"required,oneof=near far"`
+	Distance      float64 `json:"distance" validate:"required,gt=0"`
+}
+
+type proximityQueryRequest struct {
+	Username string `validate:"omitempty,alphanum,min=4,max=16"`
+	RuleID   string `validate:"omitempty,hexadecimal,len=24"`
+}
+
+// createProximityRuleHandler validates the request data and creates a new proximity rule
+func createProximityRuleHandler(w http.ResponseWriter, r *http.Request) {
+	data := proximityRuleRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		log.Printf("error decoding request body: %v\n", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, err.Error())
+		return
+	}
+
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	rule := buildProximityRule(primitive.NewObjectID().Hex(), data)
+
+	if err := proximityStore().Save(r.Context(), rule); err != nil {
+		log.Printf("error saving proximity rule for usernames '%s' and '%s': %v\n", rule.Username, rule.OtherUsername, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+// updateProximityRuleHandler validates the request data and replaces an existing proximity rule
+// the rule is rearmed, so it fires again on the next update matching it
+func updateProximityRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	data := proximityRuleRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		log.Printf("error decoding request body: %v\n", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, err.Error())
+		return
+	}
+
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	_, ok, err := proximityStore().Get(r.Context(), id)
+
+	if err != nil {
+		log.Printf("error finding proximity rule '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("proximity rule '%s' not found", id))
+		return
+	}
+
+	rule := buildProximityRule(id, data)
+
+	if err := proximityStore().Save(r.Context(), rule); err != nil {
+		log.Printf("error saving proximity rule '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// getProximityRuleHandler returns a single proximity rule
+func getProximityRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	rule, ok, err := proximityStore().Get(r.Context(), id)
+
+	if err != nil {
+		log.Printf("error finding proximity rule '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("proximity rule '%s' not found", id))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// listProximityRulesHandler returns a page of proximity rules, optionally only the ones of a single user
+func listProximityRulesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	data := proximityQueryRequest{
+		Username: query.Get("username"),
+	}
+
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	page, err := extractPage(query)
+
+	if err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	rules, err := proximityStore().List(r.Context(), data.Username, page.PageNumber, page.PageSize)
+
+	if err != nil {
+		log.Printf("error listing proximity rules for username '%s': %v\n", data.Username, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Rules []store.ProximityRule `json:"rules"`
+	}{
+		Rules: rules,
+	})
+}
+
+// deleteProximityRuleHandler deletes a proximity rule together with its state
+func deleteProximityRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	ok, err := proximityStore().Delete(r.Context(), id)
+
+	if err != nil {
+		log.Printf("error deleting proximity rule '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("proximity rule '%s' not found", id))
+		return
+	}
+
+	if err := proximityStore().Rearm(r.Context(), id); err != nil {
+		log.Printf("error deleting state of proximity rule '%s': %v\n", id, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listProximityAlertsHandler returns a page of proximity alerts of a user, a rule or both, latest first
+func listProximityAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	data := proximityQueryRequest{
+		Username: query.Get("username"),
+		RuleID:   query.Get("ruleId"),
+	}
+
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	if data.Username == "" && data.RuleID == "" {
+		log.Println("validation error for input data: username or rule id is required")
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "username or ruleId is required")
+		return
+	}
+
+	page, err := extractPage(query)
+
+	if err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	alerts, err := proximityStore().Alerts(r.Context(), data.Username, data.RuleID, page.PageNumber, page.PageSize)
+
+	if err != nil {
+		log.Printf("error listing proximity alerts for username '%s' and rule '%s': %v\n", data.Username, data.RuleID, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Alerts []store.ProximityAlert `json:"alerts"`
+	}{
+		Alerts: alerts,
+	})
+}
+
+// buildProximityRule converts the validated request data to a proximity rule with the given id
+func buildProximityRule(id string, data proximityRuleRequest) store.ProximityRule {
+	return store.ProximityRule{
+		ID:            id,
+		Username:      data.Username,
+		OtherUsername: data.OtherUsername,
+		Type:          data.Type,
+		Distance:      data.Distance,
+	}
+}
+
+// evaluateProximityRules compares the new location of the user with the current location of the other party of every rule of the user
+// a rule fires an alert when its condition starts to hold and is rearmed when it stops holding, so it fires once per transition
+func evaluateProximityRules(event locationEvent) error {
+	ctx := context.Background()
+	rules, err := proximityStore().Rules(ctx, event.Username, maxProximityRulesPerUser)
+
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		otherUsername := rule.OtherUsername
+
+		if otherUsername == event.Username {
+			otherUsername = rule.Username
+		}
+
+		other, ok, err := findCurrent(ctx, otherUsername)
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		state, _, err := proximityStore().State(ctx, rule.ID)
+
+		if err != nil {
+			return err
+		}
+
+		triggered := state.Triggered
+		distance := geo.Distance(event.Location.Coordinates, other.Location.Coordinates)
+		matches := distance <= rule.Distance
+
+		if rule.Type == "far" {
+			matches = distance > rule.Distance
+		}
+
+		if matches == triggered {
+			continue
+		}
+
+		state = store.ProximityState{ID: rule.ID, Triggered: matches}
+
+		if err := proximityStore().SaveState(ctx, state); err != nil {
+			return err
+		}
+
+		if !matches {
+			continue
+		}
+
+		alert := store.ProximityAlert{
+			ID:            fmt.Sprintf("%s:%s:%d", rule.ID, event.Username, event.Timestamp),
+			RuleID:        rule.ID,
+			Type:          rule.Type,
+			Username:      rule.Username,
+			OtherUsername: rule.OtherUsername,
+			Distance:      distance,
+			Location:      event.Location,
+			OtherLocation: other.Location,
+			Timestamp:     event.Timestamp,
+		}
+
+		if event.Username != rule.Username {
+			alert.Location, alert.OtherLocation = other.Location, event.Location
+		}
+
+		if err := proximityStore().SaveAlert(ctx, alert); err != nil {
+			return err
+		}
+
+		if !webhooks.Publish("proximity", alert) {
+			log.Printf("webhook queue is full, dropping proximity alert '%s'\n", alert.ID)
+		}
+	}
+
+	return nil
+}
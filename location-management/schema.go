@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/mmilosevicgd/location-tracking/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// locationValidator rejects current locations without a username, a geojson point or a timestamp
+var locationValidator = map[string]any{
+	"$jsonSchema": map[string]any{
+		"bsonType": "object",
+		"required": []string{"username", "location", "timestamp"},
+		"properties": map[string]any{
+			"username":  map[string]any{"bsonType": "string"},
+			"timestamp": map[string]any{"bsonType": "long"},
+			"location": map[string]any{
+				"bsonType": "object",
+				"required": []string{"type", "coordinates"},
+				"properties": map[string]any{
+					"type":        map[string]any{"enum": []string{"Point"}},
+					"coordinates": map[string]any{"bsonType": "array", "minItems": 2, "maxItems": 2},
+				},
+			},
+		},
+	},
+}
+
+// schema declares the collections of the service with their validators and indexes, it is applied at startup
+var schema = db.Schema{Collections: []db.CollectionSpec{
+	{
+		Name:      locationCollection,
+		Validator: locationValidator,
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}}},
+			{Keys: []db.IndexKey{{Field: "location", Type: "2dsphere"}}},
+		},
+	},
+	{
+		Name: geofenceCollection,
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "geometry", Type: "2dsphere"}}},
+		},
+	},
+	{
+		Name: geofenceStateCollection,
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}}},
+		},
+	},
+	{
+		Name: geofenceEventCollection,
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}}},
+			{Keys: []db.IndexKey{{Field: "fenceId", Type: 1}}},
+			{Keys: []db.IndexKey{{Field: "timestamp", Type: -1}}},
+		},
+	},
+	{
+		Name: proximityRuleCollection,
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}}},
+			{Keys: []db.IndexKey{{Field: "otherUsername", Type: 1}}},
+		},
+	},
+	{
+		Name: proximityStateCollection,
+	},
+	{
+		Name: proximityAlertCollection,
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "username", Type: 1}}},
+			{Keys: []db.IndexKey{{Field: "otherUsername", Type: 1}}},
+			{Keys: []db.IndexKey{{Field: "ruleId", Type: 1}}},
+			{Keys: []db.IndexKey{{Field: "timestamp", Type: -1}}},
+		},
+	},
+	{
+		Name: webhookCollection,
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "events", Type: 1}}},
+		},
+	},
+	{
+		Name: webhookDeliveryCollection,
+		Indexes: []db.IndexSpec{
+			{Keys: []db.IndexKey{{Field: "webhookId", Type: 1}, {Field: "createdAt", Type: -1}}},
+			{Keys: []db.IndexKey{{Field: "createdAt", Type: -1}}},
+			{Keys: []db.IndexKey{{Field: "status", Type: 1}, {Field: "_id", Type: 1}}},
+		},
+	},
+	{
+		Name: migrationCollection,
+	},
+}}
+
+// schemaDrift counts the differences between the schema and the database found when the schema was applied at startup
+var schemaDrift = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "schema_drift",
+	Help: "Differences between the schema and the database found at startup, by collection, kind and whether applying the schema resolved them.",
+}, []string{"collection", "kind", "resolved"})
+
+// reportSchemaDrift exposes the drift found when applying the schema as metrics
+func reportSchemaDrift(drift []db.Drift) {
+	schemaDrift.Reset()
+
+	for _, found := range drift {
+		schemaDrift.WithLabelValues(found.Collection, string(found.Kind), strconv.FormatBool(found.Resolved)).Inc()
+	}
+}
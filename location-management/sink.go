@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/model"
+	"github.com/nats-io/nats.go"
+)
+
+// sinkEvent is the schema of the location events published to the event sink
+// fields are only ever added to a schema version, any other change increases it
+type sinkEvent struct {
+	SchemaVersion int            `json:"schemaVersion"`
+	ID            string         `json:"id"`
+	Type          string         `json:"type"`
+	Username      string         `json:"username"`
+	Location      model.Location `json:"location"`
+	Timestamp     int64          `json:"timestamp"`
+}
+
+// eventSink publishes accepted location updates to an event stream for analytics
+type eventSink interface {
+	Publish(event sinkEvent) error
+	Close() error
+}
+
+// discardSink is the event sink used when none is configured, it drops every event
+type discardSink struct{}
+
+// fileSink appends every event as a json line to a file
+type fileSink struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// httpSink posts every event as json to an http endpoint
+type httpSink struct {
+	client *http.Client
+	url    string
+}
+
+// natsSink publishes every event as json to a nats subject
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// newSinkEvent converts a location event to the current schema version of the sink events
+// the id is derived from the username and timestamp, so consumers can drop duplicates
+func newSinkEvent(event locationEvent) sinkEvent {
+	return sinkEvent{
+		SchemaVersion: sinkEventSchemaVersion,
+		ID:            fmt.Sprintf("%s:%d", event.Username, event.Timestamp),
+		Type:          "location.updated",
+		Username:      event.Username,
+		Location:      event.Location,
+		Timestamp:     event.Timestamp,
+	}
+}
+
+// Publish drops the event
+func (s discardSink) Publish(event sinkEvent) error {
+	return nil
+}
+
+// Close does nothing
+func (s discardSink) Close() error {
+	return nil
+}
+
+// Publish appends the event to the file
+func (s *fileSink) Publish(event sinkEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.encoder.Encode(event)
+}
+
+// Close closes the file
+func (s *fileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.file.Close()
+}
+
+// Publish posts the event to the endpoint, any status code other than 2xx is a failure
+func (s *httpSink) Publish(event sinkEvent) error {
+	payload, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	response, err := s.client.Post(s.url, "application/json", bytes.NewReader(payload))
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// Close closes the idle connections to the endpoint
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Publish publishes the event to the subject
+func (s *natsSink) Publish(event sinkEvent) error {
+	payload, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	return s.conn.Publish(s.subject, payload)
+}
+
+// Close flushes the published events to the server and closes the connection
+func (s *natsSink) Close() error {
+	defer s.conn.Close()
+	return s.conn.FlushTimeout(10 * time.Second)
+}
+
+// createEventSink creates the event sink for the given uri
+// supported uris are file:///path/to/events.jsonl, http(s)://host/path and nats://host:port?subject=name, without a uri every event is dropped
+func createEventSink(uri string) (eventSink, error) {
+	if uri == "" {
+		return discardSink{}, nil
+	}
+
+	parsed, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid event sink uri '%s': %v", uri, err)
+	}
+
+	switch parsed.Scheme {
+	case "file":
+		file, err := os.OpenFile(parsed.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &fileSink{file: file, encoder: json.NewEncoder(file)}, nil
+
+	case "http", "https":
+		return &httpSink{client: &http.Client{Timeout: sinkTimeout}, url: uri}, nil
+
+	case "nats":
+		subject := parsed.Query().Get("subject")
+
+		if subject == "" {
+			subject = sinkDefaultSubject
+		}
+
+		parsed.RawQuery = ""
+		conn, err := nats.Connect(parsed.String(), nats.Timeout(sinkTimeout))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &natsSink{conn: conn, subject: subject}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown event sink scheme '%s'", parsed.Scheme)
+	}
+}
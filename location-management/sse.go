@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/problem"
+)
+
+// streamUserLocationHandler validates the requested circle or bounding box and streams the location updates of users inside it as server-sent events
+// clients reconnecting with a Last-Event-ID header receive the kept events they missed before the live ones
+func streamUserLocationHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	message := liveMessage{
+		Coordinates: query.Get("coordinates"),
+	}
+
+	if query.Has("distance") {
+		distance, err := strconv.ParseFloat(query.Get("distance"), 64)
+
+		if err != nil {
+			log.Printf("error parsing distance '%s': %v\n", query.Get("distance"), err)
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, fmt.Sprintf("invalid distance '%s', expected a number of meters", query.Get("distance")))
+			return
+		}
+
+		message.Distance = distance
+	}
+
+	if query.Has("southWest") || query.Has("northEast") {
+		message.Viewport = &liveViewport{
+			SouthWest: query.Get("southWest"),
+			NorthEast: query.Get("northEast"),
+		}
+	}
+
+	area, err := extractLiveArea(message)
+
+	if err != nil {
+		log.Printf("validation error for stream area: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	lastID := int64(0)
+	lastEventID := r.Header.Get("Last-Event-ID")
+
+	if lastEventID != "" {
+		lastID, err = strconv.ParseInt(lastEventID, 10, 64)
+
+		if err != nil {
+			log.Printf("error parsing last event id '%s': %v\n", lastEventID, err)
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, fmt.Sprintf("invalid Last-Event-ID header '%s', expected an event id", lastEventID))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		log.Println("response writer does not support flushing, cannot stream events")
+		problem.WriteInternal(w, r)
+		return
+	}
+
+	subscription := locationEvents.Subscribe(streamBufferSize, lastID)
+	defer subscription.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamHeartbeatPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return
+			}
+
+			if !area.Contains(event.Location.Coordinates) {
+				continue
+			}
+
+			if err := writeLocationEvent(w, event); err != nil {
+				log.Printf("error writing location event to stream: %v\n", err)
+				return
+			}
+
+			flusher.Flush()
+
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				log.Printf("error writing heartbeat to stream: %v\n", err)
+				return
+			}
+
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeLocationEvent writes a location event in the server-sent events format
+func writeLocationEvent(w http.ResponseWriter, event locationEvent) error {
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: location\ndata: %s\n\n", event.ID, data)
+	return err
+}
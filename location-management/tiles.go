@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"github.com/mmilosevicgd/location-tracking/problem"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// field numbers and values of the mapbox vector tile specification, version 2.1
+	mvtTileLayers       = 3
+	mvtLayerName        = 1
+	mvtLayerFeatures    = 2
+	mvtLayerKeys        = 3
+	mvtLayerValues      = 4
+	mvtLayerExtent      = 5
+	mvtLayerVersion     = 15
+	mvtFeatureID        = 1
+	mvtFeatureTags      = 2
+	mvtFeatureType      = 3
+	mvtFeatureGeometry  = 4
+	mvtValueString      = 1
+	mvtValueInt         = 4
+	mvtVersion          = 2
+	mvtPointType        = 1
+	mvtMoveToCommand    = 1
+	mvtContentType      = "application/vnd.mapbox-vector-tile"
+	mvtUsernameKeyIndex = 0
+	mvtTimeKeyIndex     = 1
+)
+
+// tileHandler returns the current locations of users inside a web mercator tile as point features of a mapbox vector tile
+// a tile with only part of its locations has the truncated header, vector tiles have no place for it in their layers
+func tileHandler(w http.ResponseWriter, r *http.Request) {
+	tile, err := extractTile(r.PathValue("z"), r.PathValue("x"), r.PathValue("tile"))
+
+	if err != nil {
+		log.Printf("validation error for tile: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	locations, truncated, err := findLocationsInBoundingBox(r.Context(), geo.TileBounds(tile.zoom, tile.x, tile.y))
+
+	if err != nil {
+		log.Printf("error finding locations of tile %d/%d/%d: %v\n", tile.zoom, tile.x, tile.y, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", mvtContentType)
+
+	if truncated {
+		w.Header().Set("X-Truncated", "true")
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(encodeLocationTile(tile, locations)); err != nil {
+		log.Printf("error writing tile %d/%d/%d: %v\n", tile.zoom, tile.x, tile.y, err)
+	}
+}
+
+// extractTile validates and extracts the zoom level and x and y coordinates of a tile, the y coordinate carries the .mvt extension
+func extractTile(z, x, y string) (mapTile, error) {
+	y, ok := strings.CutSuffix(y, ".mvt")
+
+	if !ok {
+		return mapTile{}, fmt.Errorf("tile '%s' does not have the .mvt extension", y)
+	}
+
+	zoom, err := strconv.Atoi(z)
+
+	if err != nil || zoom < 0 || zoom > maxTileZoom {
+		return mapTile{}, fmt.Errorf("invalid zoom level '%s'", z)
+	}
+
+	column, err := strconv.Atoi(x)
+
+	if err != nil || column < 0 || column >= 1<<zoom {
+		return mapTile{}, fmt.Errorf("invalid tile x coordinate '%s' at zoom level %d", x, zoom)
+	}
+
+	row, err := strconv.Atoi(y)
+
+	if err != nil || row < 0 || row >= 1<<zoom {
+		return mapTile{}, fmt.Errorf("invalid tile y coordinate '%s' at zoom level %d", y, zoom)
+	}
+
+	return mapTile{zoom: zoom, x: column, y: row}, nil
+}
+
+// encodeLocationTile encodes the locations inside the tile as a mapbox vector tile with a single layer of points carrying the username and timestamp
+// every location is only encoded in the tile containing it, so locations on the edges of tiles are not drawn twice
+func encodeLocationTile(tile mapTile, locations []model.LocationInfo) []byte {
+	layer := []byte{}
+	layer = protowire.AppendTag(layer, mvtLayerVersion, protowire.VarintType)
+	layer = protowire.AppendVarint(layer, mvtVersion)
+	layer = protowire.AppendTag(layer, mvtLayerName, protowire.BytesType)
+	layer = protowire.AppendString(layer, tileLayerName)
+	layer = protowire.AppendTag(layer, mvtLayerExtent, protowire.VarintType)
+	layer = protowire.AppendVarint(layer, tileExtent)
+
+	values := [][]byte{}
+
+	for _, location := range locations {
+		x, y := geo.TilePosition(location.Location.Coordinates, tile.zoom)
+
+		if int(x) != tile.x || int(y) != tile.y {
+			continue
+		}
+
+		usernameValue := protowire.AppendTag(nil, mvtValueString, protowire.BytesType)
+		usernameValue = protowire.AppendString(usernameValue, location.Username)
+		timestampValue := protowire.AppendTag(nil, mvtValueInt, protowire.VarintType)
+		timestampValue = protowire.AppendVarint(timestampValue, uint64(location.Timestamp))
+		values = append(values, usernameValue, timestampValue)
+
+		tags := protowire.AppendVarint(nil, mvtUsernameKeyIndex)
+		tags = protowire.AppendVarint(tags, uint64(len(values)-2))
+		tags = protowire.AppendVarint(tags, mvtTimeKeyIndex)
+		tags = protowire.AppendVarint(tags, uint64(len(values)-1))
+
+		geometry := protowire.AppendVarint(nil, mvtMoveToCommand|1<<3)
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(int64(math.Round((x-float64(tile.x))*tileExtent))))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(int64(math.Round((y-float64(tile.y))*tileExtent))))
+
+		feature := protowire.AppendTag(nil, mvtFeatureID, protowire.VarintType)
+		feature = protowire.AppendVarint(feature, uint64(len(values)/2))
+		feature = protowire.AppendTag(feature, mvtFeatureTags, protowire.BytesType)
+		feature = protowire.AppendBytes(feature, tags)
+		feature = protowire.AppendTag(feature, mvtFeatureType, protowire.VarintType)
+		feature = protowire.AppendVarint(feature, mvtPointType)
+		feature = protowire.AppendTag(feature, mvtFeatureGeometry, protowire.BytesType)
+		feature = protowire.AppendBytes(feature, geometry)
+
+		layer = protowire.AppendTag(layer, mvtLayerFeatures, protowire.BytesType)
+		layer = protowire.AppendBytes(layer, feature)
+	}
+
+	for _, key := range []string{"username", "timestamp"} {
+		layer = protowire.AppendTag(layer, mvtLayerKeys, protowire.BytesType)
+		layer = protowire.AppendString(layer, key)
+	}
+
+	for _, value := range values {
+		layer = protowire.AppendTag(layer, mvtLayerValues, protowire.BytesType)
+		layer = protowire.AppendBytes(layer, value)
+	}
+
+	encoded := protowire.AppendTag(nil, mvtTileLayers, protowire.BytesType)
+	return protowire.AppendBytes(encoded, layer)
+}
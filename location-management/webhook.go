@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mmilosevicgd/location-tracking/problem"
+	"github.com/mmilosevicgd/location-tracking/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type webhookRequest struct {
+	URL    string   `json:"url" validate:"required,http_url,max=2048"`
+	Events []string `json:"events" validate:"required,min=1,max=3,unique,dive,oneof=location geofence proximity"`
+	Secret string   `json:"secret" validate:"required,min=16,max=256"`
+}
+
+type webhookDeliveriesRequest struct {
+	Status string `validate:"omitempty,oneof=pending delivered dead"`
+}
+
+type webhookEvent struct {
+	Type      string
+	Data      any
+	Timestamp int64
+}
+
+type webhookPayload struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	Data      any    `json:"data"`
+}
+
+type webhookJob struct {
+	webhook  store.Webhook
+	delivery store.WebhookDelivery
+}
+
+// webhookDispatcher delivers events to the webhooks subscribed to them in the background
+// failed deliveries are retried with exponential backoff, deliveries which fail every attempt are kept as dead letters
+// every delivery is stored together with its attempts and its next attempt, so it can be inspected, redelivered and resumed after a restart
+// the mutex guards the closed flag and the timers of the retries waiting for their backoff
+type webhookDispatcher struct {
+	client      *http.Client
+	events      chan webhookEvent
+	jobs        chan webhookJob
+	workers     int
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	mutex       sync.RWMutex
+	closed      bool
+	timers      map[string]*time.Timer
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// createWebhookHandler validates the request data and creates a new webhook
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	data := webhookRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		log.Printf("error decoding request body: %v\n", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, err.Error())
+		return
+	}
+
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	hook := buildWebhook(primitive.NewObjectID().Hex(), data)
+
+	if err := webhookStore().Save(r.Context(), hook); err != nil {
+		log.Printf("error saving webhook for url '%s': %v\n", hook.URL, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// updateWebhookHandler validates the request data and replaces an existing webhook
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	data := webhookRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		log.Printf("error decoding request body: %v\n", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, err.Error())
+		return
+	}
+
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	_, ok, err := webhookStore().Get(r.Context(), id)
+
+	if err != nil {
+		log.Printf("error finding webhook '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("webhook '%s' not found", id))
+		return
+	}
+
+	hook := buildWebhook(id, data)
+
+	if err := webhookStore().Save(r.Context(), hook); err != nil {
+		log.Printf("error saving webhook '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, hook)
+}
+
+// getWebhookHandler returns a single webhook without its secret
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	hook, ok, err := webhookStore().Get(r.Context(), id)
+
+	if err != nil {
+		log.Printf("error finding webhook '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("webhook '%s' not found", id))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, hook)
+}
+
+// listWebhooksHandler returns a page of webhooks without their secrets
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := extractPage(r.URL.Query())
+
+	if err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	hooks, err := webhookStore().List(r.Context(), page.PageNumber, page.PageSize)
+
+	if err != nil {
+		log.Printf("error listing webhooks: %v\n", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Webhooks []store.Webhook `json:"webhooks"`
+	}{
+		Webhooks: hooks,
+	})
+}
+
+// deleteWebhookHandler deletes a webhook, its deliveries are kept
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	ok, err := webhookStore().Delete(r.Context(), id)
+
+	if err != nil {
+		log.Printf("error deleting webhook '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("webhook '%s' not found", id))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listWebhookDeliveriesHandler returns a page of deliveries of a webhook with their attempts, optionally only the ones with the given status, latest first
+func listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	query := r.URL.Query()
+	data := webhookDeliveriesRequest{
+		Status: query.Get("status"),
+	}
+
+	if err := validate.Struct(data); err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	page, err := extractPage(query)
+
+	if err != nil {
+		log.Printf("validation error for input data: %v\n", err)
+		problem.WriteValidation(w, r, err)
+		return
+	}
+
+	deliveries, err := webhookStore().Deliveries(r.Context(), id, data.Status, page.PageNumber, page.PageSize)
+
+	if err != nil {
+		log.Printf("error listing deliveries of webhook '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Deliveries []store.WebhookDelivery `json:"deliveries"`
+	}{
+		Deliveries: deliveries,
+	})
+}
+
+// redeliverWebhookDeliveryHandler queues a dead delivery for another round of attempts
+func redeliverWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	deliveryID := r.PathValue("deliveryId")
+	hook, ok, err := webhookStore().Get(r.Context(), id)
+
+	if err != nil {
+		log.Printf("error finding webhook '%s': %v\n", id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("webhook '%s' not found", id))
+		return
+	}
+
+	delivery, ok, err := webhookStore().Delivery(r.Context(), id, deliveryID)
+
+	if err != nil {
+		log.Printf("error finding delivery '%s' of webhook '%s': %v\n", deliveryID, id, err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("delivery '%s' of webhook '%s' not found", deliveryID, id))
+		return
+	}
+
+	if delivery.Status != "dead" {
+		log.Printf("delivery '%s' of webhook '%s' is %s, only dead deliveries can be redelivered\n", deliveryID, id, delivery.Status)
+		problem.Write(w, r, http.StatusConflict, problem.CodeConflict, fmt.Sprintf("delivery '%s' is %s, only dead deliveries can be redelivered", deliveryID, delivery.Status))
+		return
+	}
+
+	if !webhooks.Redeliver(hook, delivery) {
+		log.Printf("webhook queue is full, cannot redeliver delivery '%s' of webhook '%s'\n", deliveryID, id)
+		problem.Write(w, r, http.StatusServiceUnavailable, problem.CodeUnavailable, "webhook delivery queue is full, please retry later")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// buildWebhook converts the validated request data to a webhook with the given id
+func buildWebhook(id string, data webhookRequest) store.Webhook {
+	return store.Webhook{
+		ID:     id,
+		URL:    data.URL,
+		Events: data.Events,
+		Secret: data.Secret,
+	}
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 signature of the payload with the secret
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookDispatcher creates a new webhook dispatcher
+// the backoff before the n-th retry is the minimum backoff doubled n-1 times, up to the maximum backoff
+func newWebhookDispatcher(client *http.Client, workers, queueSize, maxAttempts int, minBackoff, maxBackoff time.Duration) *webhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &webhookDispatcher{
+		client:      client,
+		events:      make(chan webhookEvent, queueSize),
+		jobs:        make(chan webhookJob, queueSize),
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+		timers:      map[string]*time.Timer{},
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Start resumes the pending deliveries and starts the workers delivering the queued events
+// once the dispatcher is closed, the workers attempt the queued deliveries before they stop
+func (d *webhookDispatcher) Start() {
+	d.resume()
+
+	for range d.workers {
+		d.wg.Add(1)
+
+		go func() {
+			defer d.wg.Done()
+
+			for {
+				select {
+				case event, ok := <-d.events:
+					if !ok {
+						d.drain()
+						return
+					}
+
+					d.dispatch(event)
+
+				case job := <-d.jobs:
+					d.attempt(job)
+
+				case <-d.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Publish queues an event for delivery to the webhooks subscribed to its type and returns false if the queue is full or the dispatcher is closed
+func (d *webhookDispatcher) Publish(eventType string, data any) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.closed {
+		return false
+	}
+
+	select {
+	case d.events <- webhookEvent{Type: eventType, Data: data, Timestamp: time.Now().UnixMilli()}:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// Redeliver queues a dead delivery for another round of attempts and returns false if the queue is full or the dispatcher is closed
+// the attempts of the previous rounds are kept, only the status, the attempts of the round and the next attempt are reset
+func (d *webhookDispatcher) Redeliver(hook store.Webhook, delivery store.WebhookDelivery) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.closed {
+		return false
+	}
+
+	delivery.Status = "pending"
+	delivery.RoundAttempts = 0
+	delivery.NextAttemptAt = 0
+
+	select {
+	case d.jobs <- webhookJob{webhook: hook, delivery: delivery}:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// Close stops accepting events, waits for the queued events and deliveries to be dispatched and stops the workers
+// if they are not dispatched before the context is done, they are dropped
+// retries which are still waiting for their backoff are stopped, their deliveries stay pending and are resumed by the next start
+func (d *webhookDispatcher) Close(ctx context.Context) error {
+	d.mutex.Lock()
+
+	if d.closed {
+		d.mutex.Unlock()
+		return nil
+	}
+
+	d.closed = true
+
+	for id, timer := range d.timers {
+		timer.Stop()
+		delete(d.timers, id)
+	}
+
+	close(d.events)
+	d.mutex.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		d.cancel()
+		return nil
+
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// dispatch creates a delivery of the event for every webhook subscribed to its type and makes the first attempt of each
+func (d *webhookDispatcher) dispatch(event webhookEvent) {
+	hooks, err := webhookStore().Subscribed(context.Background(), event.Type, maxWebhooksPerEvent)
+
+	if err != nil {
+		log.Printf("error finding webhooks for event type '%s': %v\n", event.Type, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		id := primitive.NewObjectID().Hex()
+
+		payload, err := json.Marshal(webhookPayload{
+			ID:        id,
+			Type:      event.Type,
+			Timestamp: event.Timestamp,
+			Data:      event.Data,
+		})
+
+		if err != nil {
+			log.Printf("error encoding '%s' event for webhook '%s': %v\n", event.Type, hook.ID, err)
+			continue
+		}
+
+		d.attempt(webhookJob{
+			webhook: hook,
+			delivery: store.WebhookDelivery{
+				ID:        id,
+				WebhookID: hook.ID,
+				EventType: event.Type,
+				Payload:   string(payload),
+				Status:    "pending",
+				CreatedAt: event.Timestamp,
+			},
+		})
+	}
+}
+
+// attempt sends the delivery to its webhook once, stores the outcome and schedules a retry if the attempt failed and attempts of the round are left
+// the outcome is stored before the retry is scheduled, so a retry never races with the store of the attempt before it
+func (d *webhookDispatcher) attempt(job webhookJob) {
+	start := time.Now()
+	statusCode, err := d.send(job)
+	job.delivery.RoundAttempts++
+
+	job.delivery.Attempts = append(job.delivery.Attempts, store.WebhookAttempt{
+		Timestamp:  start.UnixMilli(),
+		StatusCode: statusCode,
+		Error:      errorMessage(err),
+		Duration:   time.Since(start).Milliseconds(),
+	})
+
+	job.delivery.UpdatedAt = time.Now().UnixMilli()
+	job.delivery.NextAttemptAt = 0
+	backoff := time.Duration(0)
+
+	switch {
+	case err == nil:
+		job.delivery.Status = "delivered"
+
+	case job.delivery.RoundAttempts >= d.maxAttempts:
+		log.Printf("delivery '%s' of webhook '%s' failed %d times, giving up: %v\n", job.delivery.ID, job.webhook.ID, job.delivery.RoundAttempts, err)
+		job.delivery.Status = "dead"
+
+	default:
+		backoff = d.backoff(job.delivery.RoundAttempts)
+		job.delivery.NextAttemptAt = time.Now().Add(backoff).UnixMilli()
+	}
+
+	if err := webhookStore().SaveDelivery(context.Background(), job.delivery); err != nil {
+		log.Printf("error saving delivery '%s' of webhook '%s': %v\n", job.delivery.ID, job.webhook.ID, err)
+	}
+
+	if backoff > 0 {
+		d.retry(job, backoff)
+	}
+}
+
+// send posts the signed payload of the delivery to the webhook url, any status code other than 2xx is a failure
+func (d *webhookDispatcher) send(job webhookJob) (int, error) {
+	payload := []byte(job.delivery.Payload)
+	request, err := http.NewRequestWithContext(d.ctx, http.MethodPost, job.webhook.URL, bytes.NewReader(payload))
+
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-Id", job.webhook.ID)
+	request.Header.Set("X-Webhook-Delivery", job.delivery.ID)
+	request.Header.Set("X-Webhook-Event", job.delivery.EventType)
+	request.Header.Set("X-Webhook-Attempt", strconv.Itoa(len(job.delivery.Attempts)+1))
+	request.Header.Set("X-Webhook-Signature", "sha256="+signWebhookPayload(job.webhook.Secret, payload))
+	response, err := d.client.Do(request)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
+
+// backoff returns the time to wait before retrying a delivery which failed the given number of attempts of its round
+func (d *webhookDispatcher) backoff(attempts int) time.Duration {
+	backoff := d.minBackoff << (attempts - 1)
+
+	if backoff > d.maxBackoff || backoff <= 0 {
+		return d.maxBackoff
+	}
+
+	return backoff
+}
+
+// retry queues the job again once its backoff has passed, unless the dispatcher is closed in the meantime
+// if the queue is full by then, the job waits for the minimum backoff again instead of blocking until there is room
+func (d *webhookDispatcher) retry(job webhookJob, backoff time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	d.timers[job.delivery.ID] = time.AfterFunc(backoff, func() {
+		if !d.requeue(job) {
+			log.Printf("webhook queue is full, retrying delivery '%s' of webhook '%s' later\n", job.delivery.ID, job.webhook.ID)
+			d.retry(job, d.minBackoff)
+		}
+	})
+}
+
+// requeue queues a job whose backoff has passed and returns false if the queue is full
+// a closed dispatcher does not queue the job, its delivery stays pending
+func (d *webhookDispatcher) requeue(job webhookJob) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.timers, job.delivery.ID)
+
+	if d.closed {
+		return true
+	}
+
+	select {
+	case d.jobs <- job:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// drain attempts the queued jobs until there are none left or the dispatcher is stopped
+// it runs once the dispatcher is closed, when no job is queued anymore
+func (d *webhookDispatcher) drain() {
+	for {
+		select {
+		case job := <-d.jobs:
+			d.attempt(job)
+
+		case <-d.ctx.Done():
+			return
+
+		default:
+			return
+		}
+	}
+}
+
+// resume schedules the pending deliveries stored before the dispatcher was started, each at its next attempt
+// the pending deliveries of deleted webhooks are given up as dead
+func (d *webhookDispatcher) resume() {
+	ctx := context.Background()
+	hooks := map[string]*store.Webhook{}
+	resumed := 0
+	after := ""
+
+	for {
+		deliveries, err := webhookStore().Pending(ctx, after, webhookResumePageSize)
+
+		if err != nil {
+			log.Printf("error finding pending webhook deliveries: %v\n", err)
+			return
+		}
+
+		for _, delivery := range deliveries {
+			after = delivery.ID
+			hook, cached := hooks[delivery.WebhookID]
+
+			if !cached {
+				found, ok, err := webhookStore().Get(ctx, delivery.WebhookID)
+
+				if err != nil {
+					log.Printf("error finding webhook '%s' of pending delivery '%s': %v\n", delivery.WebhookID, delivery.ID, err)
+					continue
+				}
+
+				if ok {
+					hook = &found
+				}
+
+				hooks[delivery.WebhookID] = hook
+			}
+
+			if hook == nil {
+				log.Printf("webhook '%s' of pending delivery '%s' no longer exists, giving up\n", delivery.WebhookID, delivery.ID)
+				delivery.Status = "dead"
+				delivery.NextAttemptAt = 0
+				delivery.UpdatedAt = time.Now().UnixMilli()
+
+				if err := webhookStore().SaveDelivery(ctx, delivery); err != nil {
+					log.Printf("error saving delivery '%s' of webhook '%s': %v\n", delivery.ID, delivery.WebhookID, err)
+				}
+
+				continue
+			}
+
+			d.retry(webhookJob{webhook: *hook, delivery: delivery}, max(0, time.Until(time.UnixMilli(delivery.NextAttemptAt))))
+			resumed++
+		}
+
+		if len(deliveries) < webhookResumePageSize {
+			break
+		}
+	}
+
+	if resumed > 0 {
+		log.Printf("resumed %d pending webhook deliveries\n", resumed)
+	}
+}
+
+// errorMessage returns the message of the error or an empty string if there is none
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mmilosevicgd/location-tracking/geo"
+	"github.com/mmilosevicgd/location-tracking/model"
+	"google.golang.org/grpc/status"
+)
+
+type liveMessage struct {
+	Type        string        `json:"type" validate:"required,oneof=location subscribe unsubscribe"`
+	ID          string        `json:"id" validate:"max=64"`
+	Username    string        `json:"username"`
+	Coordinates string        `json:"coordinates"`
+	Distance    float64       `json:"distance"`
+	Viewport    *liveViewport `json:"viewport"`
+}
+
+type liveViewport struct {
+	SouthWest string `json:"southWest" validate:"required,customcoordinates"`
+	NorthEast string `json:"northEast" validate:"required,customcoordinates"`
+}
+
+type liveCircle struct {
+	Coordinates string  `json:"coordinates" validate:"required,customcoordinates"`
+	Distance    float64 `json:"distance" validate:"required,gt=0"`
+}
+
+type liveFrame struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id,omitempty"`
+	Username  string          `json:"username,omitempty"`
+	Location  *model.Location `json:"location,omitempty"`
+	Timestamp int64           `json:"timestamp,omitempty"`
+	Message   string          `json:"message,omitempty"`
+}
+
+type liveArea interface {
+	Contains(coordinates []float64) bool
+}
+
+// liveConnection is a websocket connection which sends location updates and receives events about other users in its subscribed area
+// the read loop handles incoming frames and the write loop owns every write to the connection
+// the context is cancelled when the connection is closed, so the location updates it sent do not outlive it
+type liveConnection struct {
+	ctx     context.Context
+	conn    *websocket.Conn
+	replies chan liveFrame
+	closed  chan struct{}
+	mutex   sync.Mutex
+	area    liveArea
+	inside  map[string]bool
+	own     map[string]bool
+}
+
+var (
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     checkLiveOrigin,
+	}
+)
+
+// liveLocationHandler upgrades the request to a websocket connection which accepts location updates and pushes enter, move and leave events for users in the subscribed area
+func liveLocationHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		log.Printf("error upgrading connection to websocket: %v\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	connection := &liveConnection{
+		ctx:     ctx,
+		conn:    conn,
+		replies: make(chan liveFrame, liveBufferSize),
+		closed:  make(chan struct{}),
+		inside:  map[string]bool{},
+		own:     map[string]bool{},
+	}
+
+	subscription := locationEvents.Subscribe(liveBufferSize, 0)
+	done := make(chan struct{})
+
+	go connection.write(subscription, done)
+	connection.read()
+
+	close(done)
+	<-connection.closed
+	subscription.Unsubscribe()
+}
+
+// checkLiveOrigin allows websocket connections without an origin, from the host of the service and from the origins listed in LIVE_ALLOWED_ORIGINS
+// browsers always send the origin, so pages of other sites can not open connections with the cookies of their visitors
+func checkLiveOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if origin == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+
+	if err != nil {
+		return false
+	}
+
+	if strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+
+	return slices.Contains(strings.Split(os.Getenv("LIVE_ALLOWED_ORIGINS"), ","), origin)
+}
+
+// read reads frames from the connection and handles them until the connection fails or is closed
+// the read deadline is extended on every pong and frame, so a client which stops responding to pings is disconnected
+func (c *liveConnection) read() {
+	c.conn.SetReadLimit(liveReadLimit)
+	c.conn.SetReadDeadline(time.Now().Add(livePongWait))
+
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(livePongWait))
+	})
+
+	for {
+		_, payload, err := c.conn.ReadMessage()
+
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("error reading from websocket connection: %v\n", err)
+			}
+
+			return
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(livePongWait))
+		message := liveMessage{}
+		reply := liveFrame{}
+
+		if err := json.Unmarshal(payload, &message); err != nil {
+			reply = liveFrame{Type: "error", Message: fmt.Sprintf("invalid frame: %v", err)}
+
+		} else {
+			reply = c.handle(message)
+		}
+
+		select {
+		case c.replies <- reply:
+
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// handle validates a frame received from the connection and applies it, returning the reply for the client
+func (c *liveConnection) handle(message liveMessage) liveFrame {
+	if err := validate.Struct(message); err != nil {
+		return liveFrame{Type: "error", ID: message.ID, Message: err.Error()}
+	}
+
+	switch message.Type {
+	case "location":
+		c.mutex.Lock()
+		c.own[message.Username] = true
+		c.mutex.Unlock()
+
+		err := updateUserLocationFromRequest(c.ctx, userLocationRequest{
+			Username:    message.Username,
+			Coordinates: message.Coordinates,
+		})
+
+		if err != nil {
+			return liveFrame{Type: "error", ID: message.ID, Message: status.Convert(err).Message()}
+		}
+
+		return liveFrame{Type: "ack", ID: message.ID}
+
+	case "subscribe":
+		area, err := extractLiveArea(message)
+
+		if err != nil {
+			return liveFrame{Type: "error", ID: message.ID, Message: err.Error()}
+		}
+
+		c.mutex.Lock()
+		c.area = area
+		c.inside = map[string]bool{}
+		c.mutex.Unlock()
+
+		return liveFrame{Type: "subscribed", ID: message.ID}
+
+	default:
+		c.mutex.Lock()
+		c.area = nil
+		c.inside = map[string]bool{}
+		c.mutex.Unlock()
+
+		return liveFrame{Type: "unsubscribed", ID: message.ID}
+	}
+}
+
+// extractLiveArea validates and extracts the circle or viewport a subscribe frame asks for
+func extractLiveArea(message liveMessage) (liveArea, error) {
+	if message.Viewport != nil {
+		return extractBoundingBox(*message.Viewport)
+	}
+
+	circle := liveCircle{
+		Coordinates: message.Coordinates,
+		Distance:    message.Distance,
+	}
+
+	if err := validate.Struct(circle); err != nil {
+		return nil, err
+	}
+
+	center, err := extractCoordinates(circle.Coordinates)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return geo.Circle{Center: center, Radius: circle.Distance}, nil
+}
+
+// extractBoundingBox validates and extracts the bounding box between the south west and north east coordinates of a viewport
+func extractBoundingBox(viewport liveViewport) (geo.BoundingBox, error) {
+	if err := validate.Struct(viewport); err != nil {
+		return geo.BoundingBox{}, err
+	}
+
+	southWest, err := extractCoordinates(viewport.SouthWest)
+
+	if err != nil {
+		return geo.BoundingBox{}, err
+	}
+
+	northEast, err := extractCoordinates(viewport.NorthEast)
+
+	if err != nil {
+		return geo.BoundingBox{}, err
+	}
+
+	if southWest[1] > northEast[1] {
+		return geo.BoundingBox{}, fmt.Errorf("south west latitude %f is greater than north east latitude %f", southWest[1], northEast[1])
+	}
+
+	return geo.BoundingBox{SouthWest: southWest, NorthEast: northEast}, nil
+}
+
+// write writes replies, location events and pings to the connection until it fails, the client is too slow or the read loop is done
+func (c *liveConnection) write(subscription *locationSubscription, done <-chan struct{}) {
+	ticker := time.NewTicker(livePingPeriod)
+
+	defer func() {
+		ticker.Stop()
+		close(c.closed)
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case reply := <-c.replies:
+			if err := c.writeFrame(reply); err != nil {
+				log.Printf("error writing reply to websocket connection: %v\n", err)
+				return
+			}
+
+		case event, ok := <-subscription.Events():
+			if !ok {
+				log.Println("websocket connection is too slow to receive location events or the server is shutting down, closing it")
+				message := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "location events subscription ended")
+				c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(liveWriteWait))
+				return
+			}
+
+			frame, ok := c.evaluate(event)
+
+			if !ok {
+				continue
+			}
+
+			if err := c.writeFrame(frame); err != nil {
+				log.Printf("error writing location event to websocket connection: %v\n", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("error writing ping to websocket connection: %v\n", err)
+				return
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// writeFrame writes a single frame to the connection as json
+func (c *liveConnection) writeFrame(frame liveFrame) error {
+	c.conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+	return c.conn.WriteJSON(frame)
+}
+
+// evaluate compares the location event with the subscribed area and returns the enter, move or leave frame for it
+// events of users sending their locations over this connection are not reported back
+func (c *liveConnection) evaluate(event locationEvent) (liveFrame, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.area == nil || c.own[event.Username] {
+		return liveFrame{}, false
+	}
+
+	wasInside := c.inside[event.Username]
+	isInside := c.area.Contains(event.Location.Coordinates)
+	frameType := ""
+
+	switch {
+	case isInside && !wasInside:
+		frameType = "enter"
+		c.inside[event.Username] = true
+
+	case isInside && wasInside:
+		frameType = "move"
+
+	case !isInside && wasInside:
+		frameType = "leave"
+		delete(c.inside, event.Username)
+
+	default:
+		return liveFrame{}, false
+	}
+
+	return liveFrame{
+		Type:      frameType,
+		Username:  event.Username,
+		Location:  &event.Location,
+		Timestamp: event.Timestamp,
+	}, true
+}